@@ -0,0 +1,625 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ACL rule actions. A log rule records matching packets and evaluation
+// continues with the next rule, allow and deny end it.
+const (
+	ACLActionAllow = "allow"
+	ACLActionDeny  = "deny"
+	ACLActionLog   = "log"
+)
+
+// ACL rule directions, seen from the subscriber
+const (
+	ACLDirectionUpstream   = "upstream"
+	ACLDirectionDownstream = "downstream"
+	ACLDirectionBoth       = "both"
+)
+
+// ACL rule protocols
+const (
+	ACLProtocolAny  = "any"
+	ACLProtocolTCP  = "tcp"
+	ACLProtocolUDP  = "udp"
+	ACLProtocolICMP = "icmp"
+)
+
+const (
+	// MaxACLRules is the number of rules of one ACL
+	MaxACLRules = 256
+	// aclScopeNode is the history scope of the node default ACL
+	aclScopeNode = "default"
+)
+
+// ACLRule matches traffic of a subscriber. Empty match fields match anything.
+type ACLRule struct {
+	ID                string `json:"id" example:"9f86d081884c7d65"`
+	Description       string `json:"description,omitempty" example:"Block outbound SMTP"`
+	Action            string `json:"action" example:"deny"`
+	Direction         string `json:"direction" example:"upstream"`
+	Protocol          string `json:"protocol" example:"tcp"`
+	SourcePrefix      string `json:"source_prefix,omitempty" example:""`
+	SourcePort        string `json:"source_port,omitempty" example:""`
+	DestinationPrefix string `json:"destination_prefix,omitempty" example:"0.0.0.0/0"`
+	DestinationPort   string `json:"destination_port,omitempty" example:"25"`
+}
+
+// ACLMetadata represents the metadata of an ACL
+type ACLMetadata struct {
+	Node string `json:"node" example:"node001"`
+	// UserID is empty for the node default ACL
+	UserID          string `json:"user_id,omitempty" example:"2"`
+	ResourceVersion string `json:"resourceVersion" example:"1"`
+	UpdatedBy       string `json:"updatedBy" example:"admin"`
+	UpdatedAt       string `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// ACL is an ordered list of rules, evaluated top to bottom until the first
+// allow or deny rule matches
+type ACL struct {
+	Rules    []ACLRule   `json:"rules"`
+	Metadata ACLMetadata `json:"metadata"`
+}
+
+// ACLRequest represents the request to replace the rules of an ACL
+type ACLRequest struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+// ACLRevision is an immutable record of one version of an ACL
+type ACLRevision struct {
+	ResourceVersion string    `json:"resourceVersion" example:"2"`
+	Action          string    `json:"action" example:"update"`
+	UpdatedBy       string    `json:"updatedBy" example:"admin"`
+	UpdatedAt       string    `json:"updatedAt" example:"2025-01-01T00:00:00Z"`
+	Rules           []ACLRule `json:"rules"`
+}
+
+// EffectiveACLRule is a rule applied to a subscriber together with the ACL it comes from
+type EffectiveACLRule struct {
+	ACLRule
+	Origin string `json:"origin" example:"subscriber"`
+}
+
+// EffectiveACL lists the rules applied to a subscriber in evaluation order:
+// its own rules followed by the node default rules. Traffic matching no allow
+// or deny rule is allowed.
+type EffectiveACL struct {
+	NodeID string             `json:"node_id" example:"node001"`
+	UserID string             `json:"user_id" example:"2"`
+	Rules  []EffectiveACLRule `json:"rules"`
+}
+
+// aclKey is read by the node, which applies the subscriber's ACL before the node default
+func aclKey(nodeId, userId string) string {
+	return fmt.Sprintf("configs/%s/acl/%s", nodeId, userId)
+}
+
+func nodeACLKey(nodeId string) string {
+	return fmt.Sprintf("configs/%s/acl_default", nodeId)
+}
+
+func aclHistoryPrefix(nodeId, scope string) string {
+	return fmt.Sprintf("history/acl/%s/%s/", nodeId, scope)
+}
+
+// aclHistoryKey zero-pads the resource version so revisions sort by key
+func aclHistoryKey(nodeId, scope, resourceVersion string) string {
+	rv, _ := strconv.Atoi(resourceVersion)
+	return fmt.Sprintf("%s%010d", aclHistoryPrefix(nodeId, scope), rv)
+}
+
+// normalizeACLRules lowercases the keywords of rules, fills in the default
+// protocol and direction and assigns IDs to new rules
+func normalizeACLRules(rules []ACLRule) []ACLRule {
+	normalized := make([]ACLRule, 0, len(rules))
+	for _, rule := range rules {
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		rule.Direction = strings.ToLower(strings.TrimSpace(rule.Direction))
+		rule.Protocol = strings.ToLower(strings.TrimSpace(rule.Protocol))
+		if rule.Direction == "" {
+			rule.Direction = ACLDirectionBoth
+		}
+		if rule.Protocol == "" {
+			rule.Protocol = ACLProtocolAny
+		}
+		if rule.ID == "" {
+			rule.ID = newResourceID()
+		}
+		for _, prefix := range []*string{&rule.SourcePrefix, &rule.DestinationPrefix} {
+			if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(*prefix)); err == nil {
+				*prefix = ipNet.String()
+			}
+		}
+		normalized = append(normalized, rule)
+	}
+	return normalized
+}
+
+// validateACLRules checks normalized ACL rules
+func validateACLRules(rules []ACLRule) fieldErrors {
+	var errs fieldErrors
+	if len(rules) > MaxACLRules {
+		errs.add("rules", "An ACL must not have more than %d rules", MaxACLRules)
+		return errs
+	}
+
+	ids := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		if ids[rule.ID] {
+			errs.add(field+".id", "Rule ID %s is used more than once", rule.ID)
+		}
+		ids[rule.ID] = true
+		validatePrintableASCII(&errs, field+".description", "Description", rule.Description, 128)
+
+		switch rule.Action {
+		case ACLActionAllow, ACLActionDeny, ACLActionLog:
+		default:
+			errs.add(field+".action", "Action must be one of %s, %s or %s", ACLActionAllow, ACLActionDeny, ACLActionLog)
+		}
+		switch rule.Direction {
+		case ACLDirectionUpstream, ACLDirectionDownstream, ACLDirectionBoth:
+		default:
+			errs.add(field+".direction", "Direction must be one of %s, %s or %s",
+				ACLDirectionUpstream, ACLDirectionDownstream, ACLDirectionBoth)
+		}
+		switch rule.Protocol {
+		case ACLProtocolAny, ACLProtocolTCP, ACLProtocolUDP, ACLProtocolICMP:
+		default:
+			errs.add(field+".protocol", "Protocol must be one of %s, %s, %s or %s",
+				ACLProtocolAny, ACLProtocolTCP, ACLProtocolUDP, ACLProtocolICMP)
+		}
+
+		var families [2]string
+		for j, prefix := range []struct{ name, value string }{
+			{"source_prefix", rule.SourcePrefix},
+			{"destination_prefix", rule.DestinationPrefix},
+		} {
+			if prefix.value == "" {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(prefix.value)
+			if err != nil {
+				errs.add(field+"."+prefix.name, "Prefix must be an IPv4 or IPv6 prefix, e.g. 192.0.2.0/24")
+				continue
+			}
+			families[j] = "ipv6"
+			if ip.To4() != nil {
+				families[j] = "ipv4"
+			}
+		}
+		if families[0] != "" && families[1] != "" && families[0] != families[1] {
+			errs.add(field+".destination_prefix", "Source and destination prefixes must be of the same address family")
+		}
+
+		for _, port := range []struct{ name, value string }{
+			{"source_port", rule.SourcePort},
+			{"destination_port", rule.DestinationPort},
+		} {
+			if port.value == "" {
+				continue
+			}
+			if rule.Protocol != ACLProtocolTCP && rule.Protocol != ACLProtocolUDP {
+				errs.add(field+"."+port.name, "Ports can only be matched for %s or %s", ACLProtocolTCP, ACLProtocolUDP)
+			} else if _, _, err := utils.ParsePortRange(port.value); err != nil {
+				errs.add(field+"."+port.name, "Port must be a port or a port range between 1 and 65535, e.g. 8000-8010")
+			}
+		}
+	}
+	return errs
+}
+
+// loadACL reads an ACL together with its etcd mod revision. A nil ACL with a
+// zero revision means it does not exist.
+func (r *RestServer) loadACL(ctx context.Context, key string) (*ACL, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var acl ACL
+	if err := json.Unmarshal(resp.Kvs[0].Value, &acl); err != nil {
+		return nil, 0, err
+	}
+	return &acl, resp.Kvs[0].ModRevision, nil
+}
+
+// lastACLResourceVersion returns the resource version of the newest revision
+// of an ACL, so an ACL created again after being deleted continues its history
+func (r *RestServer) lastACLResourceVersion(ctx context.Context, nodeId, scope string) (string, error) {
+	resp, err := r.etcd.Client().Get(ctx, aclHistoryPrefix(nodeId, scope),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(1))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	var revision ACLRevision
+	if err := json.Unmarshal(resp.Kvs[0].Value, &revision); err != nil {
+		return "", err
+	}
+	return revision.ResourceVersion, nil
+}
+
+// writeACL replaces the rules of an ACL, or deletes it if rules is nil, and
+// records the change as a new revision in the same transaction. A non-empty
+// ifMatch must equal the stored resource version.
+func (r *RestServer) writeACL(ctx context.Context, nodeId, userId string, rules []ACLRule, username, ifMatch string) (*ACL, *apiError) {
+	key, scope, what := nodeACLKey(nodeId), aclScopeNode, "Node ACL"
+	if userId != "" {
+		key, scope, what = aclKey(nodeId, userId), userId, "ACL"
+	}
+
+	existing, modRevision, err := r.loadACL(ctx, key)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get current ACL")
+	}
+	if rules == nil && existing == nil {
+		return nil, newAPIError(http.StatusNotFound, what+" not found")
+	}
+	if ifMatch != "" && ifMatch != "*" && (existing == nil || ifMatch != existing.Metadata.ResourceVersion) {
+		body := gin.H{"error": what + " has been modified by another request"}
+		if existing != nil {
+			body["current"] = existing
+		}
+		return nil, &apiError{Status: http.StatusConflict, Body: body}
+	}
+
+	resourceVersion := "1"
+	if existing != nil {
+		resourceVersion = incrementResourceVersion(existing.Metadata.ResourceVersion)
+	} else {
+		last, err := r.lastACLResourceVersion(ctx, nodeId, scope)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get ACL history")
+		}
+		if last != "" {
+			resourceVersion = incrementResourceVersion(last)
+		}
+	}
+
+	acl := ACL{
+		Rules: rules,
+		Metadata: ACLMetadata{
+			Node:            nodeId,
+			UserID:          userId,
+			ResourceVersion: resourceVersion,
+			UpdatedBy:       username,
+			UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	revision := ACLRevision{
+		ResourceVersion: resourceVersion,
+		Action:          RevisionActionUpdate,
+		UpdatedBy:       username,
+		UpdatedAt:       acl.Metadata.UpdatedAt,
+		Rules:           rules,
+	}
+	switch {
+	case rules == nil:
+		revision.Action = RevisionActionDelete
+		revision.Rules = []ACLRule{}
+	case existing == nil:
+		revision.Action = RevisionActionCreate
+	}
+	revisionJSON, err := json.Marshal(revision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal ACL revision")
+	}
+	historyKey := aclHistoryKey(nodeId, scope, resourceVersion)
+
+	ops := []clientv3.Op{clientv3.OpPut(historyKey, string(revisionJSON))}
+	if rules == nil {
+		ops = append(ops, clientv3.OpDelete(key))
+	} else {
+		aclJSON, err := json.Marshal(acl)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal ACL")
+		}
+		ops = append(ops, clientv3.OpPut(key, string(aclJSON)))
+	}
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(key), "=", modRevision),
+			clientv3.Compare(clientv3.CreateRevision(historyKey), "=", 0),
+		).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to save ACL")
+	}
+	if !txnResp.Succeeded {
+		return nil, newAPIError(http.StatusConflict, what+" has been modified by another request")
+	}
+
+	logrus.Infof("%s of node %s %sd, user: %q, version: %s, rules: %d, by: %s",
+		what, nodeId, revision.Action, userId, resourceVersion, len(rules), username)
+	return &acl, nil
+}
+
+// saveACL validates and stores the rules of a subscriber ACL, or of the node
+// default ACL if userId is empty
+func (r *RestServer) saveACL(ctx context.Context, nodeId, userId string, rules []ACLRule, username, ifMatch string) (*ACL, *apiError) {
+	if userId != "" {
+		hsi, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+		}
+		if hsi == nil {
+			return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+		}
+	}
+	rules = normalizeACLRules(rules)
+	if apiErr := validateACLRules(rules).apiError("ACL"); apiErr != nil {
+		return nil, apiErr
+	}
+	return r.writeACL(ctx, nodeId, userId, rules, username, ifMatch)
+}
+
+// listACLRevisions returns the revisions of an ACL, oldest first
+func (r *RestServer) listACLRevisions(ctx context.Context, nodeId, scope string) ([]ACLRevision, error) {
+	resp, err := r.etcd.Client().Get(ctx, aclHistoryPrefix(nodeId, scope),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	revisions := []ACLRevision{}
+	for _, kv := range resp.Kvs {
+		var revision ACLRevision
+		if err := json.Unmarshal(kv.Value, &revision); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse ACL revision %s", kv.Key)
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// handleGetACL implements GetSubscriberACL and GetNodeACL
+func (r *RestServer) handleGetACL(c *gin.Context, key, what string) {
+	acl, _, err := r.loadACL(c.Request.Context(), key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get ACL"})
+		return
+	}
+	if acl == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": what + " not found"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(acl.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, acl)
+}
+
+// handlePutACL implements UpdateSubscriberACL and UpdateNodeACL
+func (r *RestServer) handlePutACL(c *gin.Context, userId string) {
+	var req ACLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Rules == nil {
+		req.Rules = []ACLRule{}
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	acl, apiErr := r.saveACL(c.Request.Context(), c.Param("nodeId"), userId, req.Rules, username,
+		parseIfMatch(c.GetHeader("If-Match")))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(acl.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, acl)
+}
+
+// handleDeleteACL implements DeleteSubscriberACL
+func (r *RestServer) handleDeleteACL(c *gin.Context, userId string) {
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+	if _, apiErr := r.writeACL(c.Request.Context(), c.Param("nodeId"), userId, nil, username,
+		parseIfMatch(c.GetHeader("If-Match"))); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ACL deleted successfully"})
+}
+
+// handleListACLRevisions implements ListSubscriberACLRevisions and ListNodeACLRevisions
+func (r *RestServer) handleListACLRevisions(c *gin.Context, scope string) {
+	revisions, err := r.listACLRevisions(c.Request.Context(), c.Param("nodeId"), scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get ACL revisions"})
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+// GetSubscriberACL returns the ACL of a subscriber
+// @Summary      Get subscriber ACL
+// @Description  Get the ordered ACL rules of a subscriber
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  ACL
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/acl/{userId} [get]
+func (r *RestServer) GetSubscriberACL(c *gin.Context) {
+	r.handleGetACL(c, aclKey(c.Param("nodeId"), c.Param("userId")), "ACL")
+}
+
+// UpdateSubscriberACL replaces the ACL of a subscriber
+// @Summary      Replace subscriber ACL
+// @Description  Replace the ordered ACL rules of a subscriber. Rules are evaluated top to bottom before the node default
+// @Description  rules, the first matching allow or deny rule decides and log rules record matches. Rules without an
+// @Description  ID get a new one, every change is kept as a revision.
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string      true   "Node ID"
+// @Param        userId    path      string      true   "User ID"
+// @Param        request   body      ACLRequest  true   "ACL rules"
+// @Param        If-Match  header    string      false  "Expected current resource version"
+// @Success      200       {object}  ACL
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/acl/{userId} [put]
+func (r *RestServer) UpdateSubscriberACL(c *gin.Context) {
+	r.handlePutACL(c, c.Param("userId"))
+}
+
+// DeleteSubscriberACL removes the ACL of a subscriber
+// @Summary      Delete subscriber ACL
+// @Description  Remove the ACL of a subscriber, which leaves only the node default rules applied
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string  true   "Node ID"
+// @Param        userId    path      string  true   "User ID"
+// @Param        If-Match  header    string  false  "Expected current resource version"
+// @Success      200       {object}  MessageResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/acl/{userId} [delete]
+func (r *RestServer) DeleteSubscriberACL(c *gin.Context) {
+	r.handleDeleteACL(c, c.Param("userId"))
+}
+
+// ListSubscriberACLRevisions returns the revisions of the ACL of a subscriber
+// @Summary      List subscriber ACL revisions
+// @Description  Get every version of the ACL of a subscriber, oldest first
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {array}   ACLRevision
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/acl/{userId}/revisions [get]
+func (r *RestServer) ListSubscriberACLRevisions(c *gin.Context) {
+	r.handleListACLRevisions(c, c.Param("userId"))
+}
+
+// GetEffectiveACL returns the rules applied to a subscriber
+// @Summary      Get effective subscriber ACL
+// @Description  Get the rules applied to a subscriber in evaluation order: its own rules followed by the node default rules
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  EffectiveACL
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/acl/{userId}/effective [get]
+func (r *RestServer) GetEffectiveACL(c *gin.Context) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	ctx := c.Request.Context()
+	effective := EffectiveACL{NodeID: nodeId, UserID: userId, Rules: []EffectiveACLRule{}}
+	for _, source := range []struct{ key, origin string }{
+		{aclKey(nodeId, userId), "subscriber"},
+		{nodeACLKey(nodeId), "node"},
+	} {
+		acl, _, err := r.loadACL(ctx, source.key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get ACL"})
+			return
+		}
+		if acl == nil {
+			continue
+		}
+		for _, rule := range acl.Rules {
+			effective.Rules = append(effective.Rules, EffectiveACLRule{ACLRule: rule, Origin: source.origin})
+		}
+	}
+	c.JSON(http.StatusOK, effective)
+}
+
+// GetNodeACL returns the default ACL of a node
+// @Summary      Get node default ACL
+// @Description  Get the ordered ACL rules applied to every subscriber of a node after its own rules
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  ACL
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/acl [get]
+func (r *RestServer) GetNodeACL(c *gin.Context) {
+	r.handleGetACL(c, nodeACLKey(c.Param("nodeId")), "Node ACL")
+}
+
+// UpdateNodeACL replaces the default ACL of a node
+// @Summary      Replace node default ACL
+// @Description  Replace the ordered ACL rules applied to every subscriber of a node after its own rules, e.g. to block
+// @Description  outbound SMTP for residential subscribers. An empty rule list clears it, every change is kept as a
+// @Description  revision.
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string      true   "Node ID"
+// @Param        request   body      ACLRequest  true   "ACL rules"
+// @Param        If-Match  header    string      false  "Expected current resource version"
+// @Success      200       {object}  ACL
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/acl [put]
+func (r *RestServer) UpdateNodeACL(c *gin.Context) {
+	r.handlePutACL(c, "")
+}
+
+// ListNodeACLRevisions returns the revisions of the default ACL of a node
+// @Summary      List node default ACL revisions
+// @Description  Get every version of the default ACL of a node, oldest first
+// @Tags         ACL
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   ACLRevision
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/acl/revisions [get]
+func (r *RestServer) ListNodeACLRevisions(c *gin.Context) {
+	r.handleListACLRevisions(c, aclScopeNode)
+}
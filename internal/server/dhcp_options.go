@@ -0,0 +1,385 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DHCP option value encodings
+const (
+	DHCPOptionTypeIP     = "ip"
+	DHCPOptionTypeString = "string"
+	DHCPOptionTypeUint8  = "uint8"
+	DHCPOptionTypeUint16 = "uint16"
+	DHCPOptionTypeUint32 = "uint32"
+	DHCPOptionTypeBool   = "bool"
+	DHCPOptionTypeHex    = "hex"
+)
+
+const (
+	MinDHCPLeaseTime     = 60
+	MaxDHCPLeaseTime     = 604800
+	MaxDHCPDNSServers    = 3
+	MaxDHCPNTPServers    = 3
+	MaxDHCPCustomOptions = 32
+	// maxDHCPOptionLength is the longest value a single DHCP option can carry
+	maxDHCPOptionLength = 255
+)
+
+// dhcpReservedOptionCodes are the option codes a custom option cannot set,
+// either because a dedicated field sets them or because the DHCP server
+// manages them itself
+var dhcpReservedOptionCodes = map[int]string{
+	1:  "it is derived from dhcp_subnet",
+	3:  "it is derived from dhcp_gateway",
+	6:  "use dhcp_dns",
+	15: "use dhcp_domain_name",
+	42: "use dhcp_ntp_servers",
+	50: "it is managed by the DHCP server",
+	51: "use dhcp_lease_time",
+	52: "it is managed by the DHCP server",
+	53: "it is managed by the DHCP server",
+	54: "it is managed by the DHCP server",
+	55: "it is managed by the DHCP server",
+	57: "it is managed by the DHCP server",
+	58: "it is derived from dhcp_lease_time",
+	59: "it is derived from dhcp_lease_time",
+	61: "it is managed by the DHCP server",
+	82: "it is managed by the DHCP server",
+}
+
+var domainNamePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// DHCPOption is a DHCP option without a dedicated field, identified by its code
+type DHCPOption struct {
+	Code int `json:"code" example:"66"`
+	// Type is the encoding of the value: ip, string, uint8, uint16, uint32, bool or hex
+	Type  string `json:"type" example:"string"`
+	Value string `json:"value" example:"tftp.example.com"`
+}
+
+// DHCPServerOptions are the options the DHCP server of a subscriber hands out
+// besides its address, netmask and gateway
+type DHCPServerOptions struct {
+	DNS        string       `json:"dhcp_dns,omitempty" example:"8.8.8.8,8.8.4.4"`
+	LeaseTime  string       `json:"dhcp_lease_time,omitempty" example:"86400"`
+	DomainName string       `json:"dhcp_domain_name,omitempty" example:"home.arpa"`
+	NTPServers string       `json:"dhcp_ntp_servers,omitempty" example:"192.168.3.1"`
+	Options    []DHCPOption `json:"dhcp_options,omitempty"`
+}
+
+// NodeDHCPDefaults are the DHCP options of the subscribers of a node that do
+// not set them themselves
+type NodeDHCPDefaults struct {
+	Node string `json:"node" example:"node001"`
+	DHCPServerOptions
+	ResourceVersion string `json:"resourceVersion,omitempty" example:"1"`
+	UpdatedBy       string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt       string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// nodeDHCPDefaultsKey is read by the node next to the HSI configs
+func nodeDHCPDefaultsKey(nodeId string) string {
+	return fmt.Sprintf("configs/%s/dhcp_defaults", nodeId)
+}
+
+// hsiDHCPOptions returns the DHCP options set by an HSI config
+func hsiDHCPOptions(config HSIConfig) DHCPServerOptions {
+	return DHCPServerOptions{
+		DNS:        config.DHCPDNS,
+		LeaseTime:  config.DHCPLeaseTime,
+		DomainName: config.DHCPDomainName,
+		NTPServers: config.DHCPNTPServers,
+		Options:    config.DHCPOptions,
+	}
+}
+
+// applyNodeDHCPDefaults fills the DHCP options an HSI config leaves empty from
+// the node defaults. Custom options are merged by code, the subscriber's win.
+// It returns the config and the names of the fields taken from the defaults.
+func applyNodeDHCPDefaults(config HSIConfig, defaults DHCPServerOptions) (HSIConfig, []string) {
+	inherited := []string{}
+	fields := []struct {
+		name    string
+		value   *string
+		inherit string
+	}{
+		{"dhcp_dns", &config.DHCPDNS, defaults.DNS},
+		{"dhcp_lease_time", &config.DHCPLeaseTime, defaults.LeaseTime},
+		{"dhcp_domain_name", &config.DHCPDomainName, defaults.DomainName},
+		{"dhcp_ntp_servers", &config.DHCPNTPServers, defaults.NTPServers},
+	}
+	for _, field := range fields {
+		if *field.value == "" && field.inherit != "" {
+			*field.value = field.inherit
+			inherited = append(inherited, field.name)
+		}
+	}
+
+	set := make(map[int]bool, len(config.DHCPOptions))
+	for _, option := range config.DHCPOptions {
+		set[option.Code] = true
+	}
+	merged := append([]DHCPOption(nil), config.DHCPOptions...)
+	for _, option := range defaults.Options {
+		if !set[option.Code] {
+			merged = append(merged, option)
+		}
+	}
+	if len(merged) > len(config.DHCPOptions) {
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].Code < merged[j].Code })
+		config.DHCPOptions = merged
+		inherited = append(inherited, "dhcp_options")
+	}
+	return config, inherited
+}
+
+// validateIPv4List checks a comma separated list of IPv4 addresses
+func validateIPv4List(errs *fieldErrors, field, what, list string, max int) {
+	if list == "" {
+		return
+	}
+	servers := strings.Split(list, ",")
+	if len(servers) > max {
+		errs.add(field, "At most %d %s are allowed", max, what)
+		return
+	}
+	for _, server := range servers {
+		if net.ParseIP(strings.TrimSpace(server)).To4() == nil {
+			errs.add(field, "%s must be comma separated IPv4 addresses", what)
+			return
+		}
+	}
+}
+
+var dhcpOptionTypes = map[string]bool{
+	DHCPOptionTypeIP:     true,
+	DHCPOptionTypeString: true,
+	DHCPOptionTypeUint8:  true,
+	DHCPOptionTypeUint16: true,
+	DHCPOptionTypeUint32: true,
+	DHCPOptionTypeBool:   true,
+	DHCPOptionTypeHex:    true,
+}
+
+// dhcpOptionLength returns the encoded length of a custom option value of a
+// known type
+func dhcpOptionLength(option DHCPOption) (int, error) {
+	switch option.Type {
+	case DHCPOptionTypeIP:
+		addresses := strings.Split(option.Value, ",")
+		for _, address := range addresses {
+			if net.ParseIP(strings.TrimSpace(address)).To4() == nil {
+				return 0, fmt.Errorf("must be comma separated IPv4 addresses")
+			}
+		}
+		return 4 * len(addresses), nil
+	case DHCPOptionTypeString:
+		if option.Value == "" {
+			return 0, fmt.Errorf("must not be empty")
+		}
+		return len(option.Value), nil
+	case DHCPOptionTypeUint8, DHCPOptionTypeUint16, DHCPOptionTypeUint32:
+		bits, _ := strconv.Atoi(strings.TrimPrefix(option.Type, "uint"))
+		if _, err := strconv.ParseUint(option.Value, 10, bits); err != nil {
+			return 0, fmt.Errorf("must be an unsigned %d-bit integer", bits)
+		}
+		return bits / 8, nil
+	case DHCPOptionTypeBool:
+		if option.Value != "true" && option.Value != "false" {
+			return 0, fmt.Errorf("must be true or false")
+		}
+		return 1, nil
+	case DHCPOptionTypeHex:
+		data, err := hex.DecodeString(strings.ReplaceAll(option.Value, ":", ""))
+		if err != nil || len(data) == 0 {
+			return 0, fmt.Errorf("must be hex encoded bytes, e.g. 0a:1b:2c")
+		}
+		return len(data), nil
+	}
+	return 0, fmt.Errorf("has an unknown type %s", option.Type)
+}
+
+// validateDHCPServerOptions checks DHCP options of a subscriber or of node
+// defaults. Field names are the JSON names shared by both.
+func validateDHCPServerOptions(errs *fieldErrors, options DHCPServerOptions) {
+	validateIPv4List(errs, "dhcp_dns", "DNS servers", options.DNS, MaxDHCPDNSServers)
+	validateIPv4List(errs, "dhcp_ntp_servers", "NTP servers", options.NTPServers, MaxDHCPNTPServers)
+
+	if options.LeaseTime != "" {
+		if lease, err := strconv.Atoi(options.LeaseTime); err != nil || lease < MinDHCPLeaseTime || lease > MaxDHCPLeaseTime {
+			errs.add("dhcp_lease_time", "DHCP lease time must be between %d and %d seconds", MinDHCPLeaseTime, MaxDHCPLeaseTime)
+		}
+	}
+	if options.DomainName != "" {
+		if len(options.DomainName) > 253 || !domainNamePattern.MatchString(options.DomainName) {
+			errs.add("dhcp_domain_name", "DHCP domain name must be a valid domain name, e.g. home.arpa")
+		}
+	}
+
+	if len(options.Options) > MaxDHCPCustomOptions {
+		errs.add("dhcp_options", "At most %d custom DHCP options are allowed", MaxDHCPCustomOptions)
+		return
+	}
+	seen := make(map[int]int)
+	for i, option := range options.Options {
+		field := fmt.Sprintf("dhcp_options[%d]", i)
+		if option.Code < 1 || option.Code > 254 {
+			errs.add(field+".code", "Option code must be between 1 and 254")
+		} else if reason, reserved := dhcpReservedOptionCodes[option.Code]; reserved {
+			errs.add(field+".code", "Option %d cannot be set as a custom option, %s", option.Code, reason)
+		} else if first, dup := seen[option.Code]; dup {
+			errs.add(field+".code", "Option %d is already set by dhcp_options[%d]", option.Code, first)
+		} else {
+			seen[option.Code] = i
+		}
+
+		if !dhcpOptionTypes[option.Type] {
+			errs.add(field+".type", "Option type must be one of ip, string, uint8, uint16, uint32, bool or hex")
+			continue
+		}
+		length, err := dhcpOptionLength(option)
+		if err != nil {
+			errs.add(field+".value", "Option value %v", err)
+		} else if length > maxDHCPOptionLength {
+			errs.add(field+".value", "Option value must not exceed %d bytes when encoded", maxDHCPOptionLength)
+		}
+	}
+}
+
+// getNodeDHCPDefaults reads the DHCP defaults of a node together with their
+// etcd mod revision. Nodes without defaults get empty ones.
+func (r *RestServer) getNodeDHCPDefaults(ctx context.Context, nodeId string) (NodeDHCPDefaults, int64, error) {
+	defaults := NodeDHCPDefaults{Node: nodeId}
+	resp, err := r.etcd.Client().Get(ctx, nodeDHCPDefaultsKey(nodeId))
+	if err != nil {
+		return defaults, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return defaults, 0, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &defaults); err != nil {
+		return defaults, 0, err
+	}
+	return defaults, resp.Kvs[0].ModRevision, nil
+}
+
+// GetNodeDHCPDefaults returns the DHCP option defaults of a node
+// @Summary      Get node DHCP defaults
+// @Description  Get the DHCP options handed out to the subscribers of a node that do not set them themselves
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeDHCPDefaults
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/dhcp-defaults [get]
+func (r *RestServer) GetNodeDHCPDefaults(c *gin.Context) {
+	defaults, _, err := r.getNodeDHCPDefaults(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node DHCP defaults"})
+		return
+	}
+	if defaults.ResourceVersion != "" {
+		c.Header("ETag", resourceVersionETag(defaults.ResourceVersion))
+	}
+	c.JSON(http.StatusOK, defaults)
+}
+
+// UpdateNodeDHCPDefaults replaces the DHCP option defaults of a node
+// @Summary      Update node DHCP defaults
+// @Description  Replace the DHCP option defaults of a node. Subscribers inherit every option they leave empty,
+// @Description  custom options are merged by code. Empty fields remove a default.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string             true   "Node ID"
+// @Param        request   body      DHCPServerOptions  true   "DHCP defaults"
+// @Param        If-Match  header    string             false  "Expected current resource version"
+// @Success      200       {object}  NodeDHCPDefaults
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/dhcp-defaults [put]
+func (r *RestServer) UpdateNodeDHCPDefaults(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	var req DHCPServerOptions
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	var errs fieldErrors
+	validateDHCPServerOptions(&errs, req)
+	if apiErr := errs.apiError("DHCP defaults"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	current, modRevision, err := r.getNodeDHCPDefaults(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node DHCP defaults"})
+		return
+	}
+	if ifMatch := parseIfMatch(c.GetHeader("If-Match")); ifMatch != "" && ifMatch != "*" && ifMatch != current.ResourceVersion {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node DHCP defaults have been modified by another request", "current": current})
+		return
+	}
+
+	resourceVersion := "1"
+	if current.ResourceVersion != "" {
+		resourceVersion = incrementResourceVersion(current.ResourceVersion)
+	}
+	defaults := NodeDHCPDefaults{
+		Node:              nodeId,
+		DHCPServerOptions: req,
+		ResourceVersion:   resourceVersion,
+		UpdatedBy:         username,
+		UpdatedAt:         time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal node DHCP defaults"})
+		return
+	}
+
+	key := nodeDHCPDefaultsKey(nodeId)
+	resp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to update DHCP defaults of node %s", nodeId)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node DHCP defaults"})
+		return
+	}
+	if !resp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node DHCP defaults have been modified by another request"})
+		return
+	}
+
+	logrus.Infof("DHCP defaults of node %s updated by %s", nodeId, username)
+	c.Header("ETag", resourceVersionETag(defaults.ResourceVersion))
+	c.JSON(http.StatusOK, defaults)
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxDHCPReservations bounds the number of static DHCP reservations of a subscriber
+const MaxDHCPReservations = 64
+
+// DHCPReservation pins a LAN address of a subscriber to a client MAC address
+type DHCPReservation struct {
+	MAC         string `json:"mac" example:"00:11:22:33:44:55"`
+	IP          string `json:"ip" example:"192.168.3.10"`
+	Description string `json:"description,omitempty" example:"NAS"`
+}
+
+// DHCPReservationRequest represents the request to replace a DHCP reservation
+type DHCPReservationRequest struct {
+	IP          string `json:"ip" example:"192.168.3.10"`
+	Description string `json:"description" example:"NAS"`
+}
+
+// normalizeMAC returns the lowercase, colon separated form of a unicast
+// Ethernet MAC address
+func normalizeMAC(s string) (string, bool) {
+	mac, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+// normalizeDHCPReservations returns a copy of reservations with their MAC and
+// IP addresses in canonical form. Invalid addresses are kept as they are.
+func normalizeDHCPReservations(reservations []DHCPReservation) []DHCPReservation {
+	if len(reservations) == 0 {
+		return nil
+	}
+	normalized := make([]DHCPReservation, len(reservations))
+	for i, reservation := range reservations {
+		if mac, ok := normalizeMAC(reservation.MAC); ok {
+			reservation.MAC = mac
+		}
+		if ip := net.ParseIP(strings.TrimSpace(reservation.IP)).To4(); ip != nil {
+			reservation.IP = ip.String()
+		}
+		normalized[i] = reservation
+	}
+	return normalized
+}
+
+// validateDHCPReservations checks that every reservation has a unicast MAC and
+// an address inside the subscriber's subnet, excluding the network, broadcast
+// and gateway addresses, and that neither is reserved twice. Addresses may be
+// inside or outside the DHCP address pool.
+func validateDHCPReservations(errs *fieldErrors, config HSIConfig) {
+	if len(config.DHCPReservations) > MaxDHCPReservations {
+		errs.add("dhcp_reservations", "At most %d DHCP reservations are allowed", MaxDHCPReservations)
+		return
+	}
+
+	// Subnet errors are reported by validateDHCPSettings
+	var subnet *net.IPNet
+	var broadcast net.IP
+	mask, maskErr := utils.ParseIPv4Netmask(config.DHCPSubnet)
+	gateway := net.ParseIP(strings.TrimSpace(config.DHCPGateway)).To4()
+	if maskErr == nil && gateway != nil {
+		subnet = &net.IPNet{IP: gateway.Mask(mask), Mask: mask}
+		broadcast = make(net.IP, len(subnet.IP))
+		for i := range subnet.IP {
+			broadcast[i] = subnet.IP[i] | ^mask[i]
+		}
+	}
+
+	seenMACs := make(map[string]int)
+	seenIPs := make(map[string]int)
+	for i, reservation := range config.DHCPReservations {
+		field := fmt.Sprintf("dhcp_reservations[%d]", i)
+
+		if mac, ok := normalizeMAC(reservation.MAC); !ok {
+			errs.add(field+".mac", "MAC must be a unicast Ethernet address, e.g. 00:11:22:33:44:55")
+		} else if first, dup := seenMACs[mac]; dup {
+			errs.add(field+".mac", "MAC %s is already reserved by dhcp_reservations[%d]", mac, first)
+		} else {
+			seenMACs[mac] = i
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(reservation.IP)).To4()
+		switch {
+		case ip == nil:
+			errs.add(field+".ip", "IP must be a valid IPv4 address")
+			continue
+		case subnet == nil:
+		case !subnet.Contains(ip):
+			errs.add(field+".ip", "IP must be inside the subscriber's subnet %s", subnet.String())
+		case ip.Equal(subnet.IP) || ip.Equal(broadcast):
+			errs.add(field+".ip", "IP must not be the network or broadcast address of %s", subnet.String())
+		case ip.Equal(gateway):
+			errs.add(field+".ip", "IP must not be the subscriber's gateway")
+		}
+		if first, dup := seenIPs[ip.String()]; dup {
+			errs.add(field+".ip", "IP %s is already reserved by dhcp_reservations[%d]", ip, first)
+		} else {
+			seenIPs[ip.String()] = i
+		}
+	}
+}
+
+// findDHCPReservation returns the index of the reservation of a MAC address, or -1
+func findDHCPReservation(reservations []DHCPReservation, mac string) int {
+	for i, reservation := range reservations {
+		if normalized, ok := normalizeMAC(reservation.MAC); ok && normalized == mac {
+			return i
+		}
+	}
+	return -1
+}
+
+// updateDHCPReservations applies a change to the reservations of a subscriber
+// and stores it as a new revision of the HSI config. A non-empty ifMatch must
+// equal the resource version of the HSI config.
+func (r *RestServer) updateDHCPReservations(ctx context.Context, nodeId, userId, username, ifMatch string,
+	update func([]DHCPReservation) ([]DHCPReservation, *apiError)) (*HSIConfigWithMetadata, *apiError) {
+	existing, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if existing == nil {
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	if !ifMatchSatisfied(ifMatch, existing) {
+		return nil, conflictError("HSI config has been modified by another request", maskedHSIConfig(existing))
+	}
+
+	// Keep inheriting the profile fields the subscriber does not override
+	config := existing.Config
+	if config.Profile != "" {
+		config = inheritProfileFields(config, existing.Metadata.Overrides)
+	}
+	config.Password = redactedValue
+	reservations, apiErr := update(append([]DHCPReservation(nil), existing.Config.DHCPReservations...))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	config.DHCPReservations = reservations
+
+	return r.writeHSIConfig(ctx, hsiWrite{
+		nodeId:   nodeId,
+		config:   config,
+		username: username,
+		ifMatch:  existing.Metadata.ResourceVersion,
+	})
+}
+
+// dhcpReservationParams returns the node, user and normalized MAC of a
+// reservation request, or writes a 400 response if the MAC is invalid
+func dhcpReservationParams(c *gin.Context) (string, string, string, bool) {
+	mac, ok := normalizeMAC(c.Param("mac"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MAC must be a unicast Ethernet address, e.g. 00:11:22:33:44:55"})
+		return "", "", "", false
+	}
+	return c.Param("nodeId"), c.Param("userId"), mac, true
+}
+
+// ListDHCPReservations returns the static DHCP reservations of a subscriber
+// @Summary      List DHCP reservations
+// @Description  Get the static DHCP reservations of a subscriber. The ETag is the resource version of the HSI config.
+// @Tags         DHCP Reservations
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {array}   DHCPReservation
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/reservations [get]
+func (r *RestServer) ListDHCPReservations(c *gin.Context) {
+	config, _, err := r.loadHSIConfig(c.Request.Context(), c.Param("nodeId"), c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config"})
+		return
+	}
+	if config == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
+		return
+	}
+	reservations := config.Config.DHCPReservations
+	if reservations == nil {
+		reservations = []DHCPReservation{}
+	}
+	c.Header("ETag", resourceVersionETag(config.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, reservations)
+}
+
+// GetDHCPReservation returns a static DHCP reservation
+// @Summary      Get DHCP reservation
+// @Description  Get the static DHCP reservation of a MAC address
+// @Tags         DHCP Reservations
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Param        mac     path      string  true  "Client MAC address"
+// @Success      200     {object}  DHCPReservation
+// @Failure      400     {object}  ErrorResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/reservations/{mac} [get]
+func (r *RestServer) GetDHCPReservation(c *gin.Context) {
+	nodeId, userId, mac, ok := dhcpReservationParams(c)
+	if !ok {
+		return
+	}
+	config, _, err := r.loadHSIConfig(c.Request.Context(), nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config"})
+		return
+	}
+	if config == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
+		return
+	}
+	i := findDHCPReservation(config.Config.DHCPReservations, mac)
+	if i < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "DHCP reservation not found"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(config.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, config.Config.DHCPReservations[i])
+}
+
+// CreateDHCPReservation adds a static DHCP reservation
+// @Summary      Create DHCP reservation
+// @Description  Reserve an address inside the subscriber's DHCP subnet for a MAC address. The address may be
+// @Description  inside or outside the DHCP address pool, but neither the MAC nor the address may be reserved twice.
+// @Tags         DHCP Reservations
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string           true   "Node ID"
+// @Param        userId    path      string           true   "User ID"
+// @Param        request   body      DHCPReservation  true   "DHCP reservation"
+// @Param        If-Match  header    string           false  "Expected resource version of the HSI config"
+// @Success      201       {object}  DHCPReservation
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/reservations [post]
+func (r *RestServer) CreateDHCPReservation(c *gin.Context) {
+	var req DHCPReservation
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	mac, ok := normalizeMAC(req.MAC)
+	if !ok {
+		abortWithAPIError(c, fieldErrors{{Field: "mac",
+			Message: "MAC must be a unicast Ethernet address, e.g. 00:11:22:33:44:55"}}.apiError("DHCP reservation"))
+		return
+	}
+	req.MAC = mac
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	saved, apiErr := r.updateDHCPReservations(c.Request.Context(), nodeId, userId, username,
+		parseIfMatch(c.GetHeader("If-Match")), func(reservations []DHCPReservation) ([]DHCPReservation, *apiError) {
+			if findDHCPReservation(reservations, mac) >= 0 {
+				return nil, newAPIError(http.StatusConflict, fmt.Sprintf("MAC %s is already reserved", mac))
+			}
+			return append(reservations, req), nil
+		})
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	logrus.Infof("DHCP reservation %s -> %s added for node %s, user %s by %s", mac, req.IP, nodeId, userId, username)
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusCreated, saved.Config.DHCPReservations[findDHCPReservation(saved.Config.DHCPReservations, mac)])
+}
+
+// UpdateDHCPReservation replaces a static DHCP reservation
+// @Summary      Update DHCP reservation
+// @Description  Change the reserved address or the description of a MAC address
+// @Tags         DHCP Reservations
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string                  true   "Node ID"
+// @Param        userId    path      string                  true   "User ID"
+// @Param        mac       path      string                  true   "Client MAC address"
+// @Param        request   body      DHCPReservationRequest  true   "DHCP reservation"
+// @Param        If-Match  header    string                  false  "Expected resource version of the HSI config"
+// @Success      200       {object}  DHCPReservation
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/reservations/{mac} [put]
+func (r *RestServer) UpdateDHCPReservation(c *gin.Context) {
+	nodeId, userId, mac, ok := dhcpReservationParams(c)
+	if !ok {
+		return
+	}
+	var req DHCPReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	saved, apiErr := r.updateDHCPReservations(c.Request.Context(), nodeId, userId, username,
+		parseIfMatch(c.GetHeader("If-Match")), func(reservations []DHCPReservation) ([]DHCPReservation, *apiError) {
+			i := findDHCPReservation(reservations, mac)
+			if i < 0 {
+				return nil, newAPIError(http.StatusNotFound, "DHCP reservation not found")
+			}
+			reservations[i] = DHCPReservation{MAC: mac, IP: req.IP, Description: req.Description}
+			return reservations, nil
+		})
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	logrus.Infof("DHCP reservation %s -> %s updated for node %s, user %s by %s", mac, req.IP, nodeId, userId, username)
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, saved.Config.DHCPReservations[findDHCPReservation(saved.Config.DHCPReservations, mac)])
+}
+
+// DeleteDHCPReservation removes a static DHCP reservation
+// @Summary      Delete DHCP reservation
+// @Description  Delete the static DHCP reservation of a MAC address
+// @Tags         DHCP Reservations
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string  true   "Node ID"
+// @Param        userId    path      string  true   "User ID"
+// @Param        mac       path      string  true   "Client MAC address"
+// @Param        If-Match  header    string  false  "Expected resource version of the HSI config"
+// @Success      200       {object}  MessageResponse
+// @Failure      400       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/reservations/{mac} [delete]
+func (r *RestServer) DeleteDHCPReservation(c *gin.Context) {
+	nodeId, userId, mac, ok := dhcpReservationParams(c)
+	if !ok {
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	saved, apiErr := r.updateDHCPReservations(c.Request.Context(), nodeId, userId, username,
+		parseIfMatch(c.GetHeader("If-Match")), func(reservations []DHCPReservation) ([]DHCPReservation, *apiError) {
+			i := findDHCPReservation(reservations, mac)
+			if i < 0 {
+				return nil, newAPIError(http.StatusNotFound, "DHCP reservation not found")
+			}
+			return append(reservations[:i], reservations[i+1:]...), nil
+		})
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	logrus.Infof("DHCP reservation %s deleted for node %s, user %s by %s", mac, nodeId, userId, username)
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, gin.H{"message": "DHCP reservation deleted successfully"})
+}
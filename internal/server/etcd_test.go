@@ -0,0 +1,56 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"fastrg-controller/internal/storage"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// newTestRestServer returns a RestServer connected to the etcd at
+// ETCD_TEST_ENDPOINTS, emptied before the test. The tests are skipped if the
+// variable is not set, it must point at a throwaway etcd.
+func newTestRestServer(t *testing.T) *RestServer {
+	t.Helper()
+	endpoints := os.Getenv("ETCD_TEST_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_TEST_ENDPOINTS is not set")
+	}
+
+	t.Setenv("ETCD_ENDPOINTS", endpoints)
+	etcd, err := storage.NewEtcdClient()
+	if err != nil {
+		t.Fatalf("Failed to connect to etcd: %v", err)
+	}
+	t.Cleanup(etcd.Close)
+	if _, err := etcd.Client().Delete(context.Background(), "\x00", clientv3.WithFromKey()); err != nil {
+		t.Fatalf("Failed to empty etcd: %v", err)
+	}
+	return NewRestServer(etcd)
+}
+
+// testHSIConfig returns a valid HSI config for a user ID and VLAN
+func testHSIConfig(userId, vlanId string) HSIConfig {
+	return HSIConfig{
+		UserID:       userId,
+		VlanID:       vlanId,
+		AccountName:  "user" + userId,
+		Password:     "secret" + userId,
+		DHCPAddrPool: "192.168.3.100-192.168.3.200",
+		DHCPSubnet:   "255.255.255.0",
+		DHCPGateway:  "192.168.3.1",
+	}
+}
+
+// putTestJSON stores a value in etcd or fails the test
+func putTestJSON(t *testing.T, r *RestServer, key, value string) {
+	t.Helper()
+	if _, err := r.etcd.Client().Put(context.Background(), key, value); err != nil {
+		t.Fatalf("Failed to put %s: %v", key, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -39,7 +40,7 @@ func NewGrpcServer(etcd *storage.EtcdClient) *GrpcServer {
 		etcd:           etcd,
 		ctx:            ctx,
 		cancelCtx:      cancel,
-		nodeMonitorMgr: NewNodeMonitorManager(),
+		nodeMonitorMgr: NewNodeMonitorManager(etcd),
 	}
 
 	// Start the stale node monitor in a background goroutine
@@ -93,8 +94,7 @@ func (s *GrpcServer) RegisterNode(ctx context.Context, req *controllerpb.NodeReg
 	}
 
 	// Store to etcd, using nodes/{node_uuid} as key
-	etcdKey := fmt.Sprintf("nodes/%s", req.NodeUuid)
-	_, err = s.etcd.Client().Put(ctx, etcdKey, string(nodeDataJSON))
+	err = s.storeNodeRegistration(ctx, req.NodeUuid, string(nodeDataJSON), int(req.GetMaxSubscribers()))
 	if err != nil {
 		logrus.WithError(err).Error("Failed to store node data to etcd")
 		return &controllerpb.NodeRegisterReply{
@@ -103,7 +103,7 @@ func (s *GrpcServer) RegisterNode(ctx context.Context, req *controllerpb.NodeReg
 		}, nil
 	}
 
-	logrus.Infof("Node registered successfully: UUID=%s, IP=%s, Version=%s", req.NodeUuid, req.Ip, req.Version)
+	logrus.Infof("Node registered successfully: UUID=%s, IP=%s, Version=%s, MaxSubscribers=%d", req.NodeUuid, req.Ip, req.Version, req.GetMaxSubscribers())
 
 	// Start monitoring the node
 	if err := s.nodeMonitorMgr.StartMonitoring(req.NodeUuid, req.Ip); err != nil {
@@ -117,6 +117,56 @@ func (s *GrpcServer) RegisterNode(ctx context.Context, req *controllerpb.NodeReg
 	}, nil
 }
 
+// storeNodeRegistration stores the data of a registering node together with
+// the subscriber capacity it reports, or removes the capacity if the node
+// reports none. Subscriber counts above the capacity are only logged, as the
+// hardware cannot be refused. The capacity is written only if the count did
+// not change since it was checked against it.
+func (s *GrpcServer) storeNodeRegistration(ctx context.Context, nodeId, nodeData string, maxSubscribers int) error {
+	countKey := fmt.Sprintf("user_counts/%s/", nodeId)
+	capacityKey := nodeSubscriberCapacityKey(nodeId)
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		countResp, err := s.etcd.Client().Get(ctx, countKey)
+		if err != nil {
+			return err
+		}
+		var countRevision int64
+		if len(countResp.Kvs) > 0 {
+			countRevision = countResp.Kvs[0].ModRevision
+			var countData SubscriberCountData
+			if json.Unmarshal(countResp.Kvs[0].Value, &countData) == nil {
+				if count, err := strconv.Atoi(countData.SubscriberCount); err == nil && maxSubscribers > 0 && count > maxSubscribers {
+					logrus.Warnf("Subscriber count %d of node %s is above the %d subscribers it supports", count, nodeId, maxSubscribers)
+				}
+			}
+		}
+
+		capacityOp := clientv3.OpDelete(capacityKey)
+		if maxSubscribers > 0 {
+			capacityJSON, err := json.Marshal(NodeSubscriberCapacity{
+				Node:           nodeId,
+				MaxSubscribers: maxSubscribers,
+				UpdatedAt:      time.Now().UTC().Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+			capacityOp = clientv3.OpPut(capacityKey, string(capacityJSON))
+		}
+		txnResp, err := s.etcd.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(countKey), "=", countRevision)).
+			Then(clientv3.OpPut(fmt.Sprintf("nodes/%s", nodeId), nodeData), capacityOp).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("subscriber count of node %s has been modified by other requests", nodeId)
+}
+
 func (s *GrpcServer) UnregisterNode(ctx context.Context, req *controllerpb.NodeRegisterRequest) (*emptypb.Empty, error) {
 	// Check required fields
 	if req.NodeUuid == "" {
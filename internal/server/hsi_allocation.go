@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NodeVlanRange is the range VLANs of new subscribers of a node are taken
+// from when they are created without one. A zero range disables it.
+type NodeVlanRange struct {
+	Node      string `json:"node" example:"node001"`
+	Start     int    `json:"start" example:"100"`
+	End       int    `json:"end" example:"1999"`
+	UpdatedBy string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// UpdateNodeVlanRange represents the request to change the VLAN range of a node
+type UpdateNodeVlanRange struct {
+	Start int `json:"start" example:"100"`
+	End   int `json:"end" example:"1999"`
+}
+
+// HSICreateResponse represents a created HSI config with the user ID and
+// VLAN it was given
+type HSICreateResponse struct {
+	Message         string `json:"message" example:"HSI config created successfully"`
+	ResourceVersion string `json:"resourceVersion" example:"1"`
+	UserID          string `json:"user_id" example:"2"`
+	VlanID          string `json:"vlan_id" example:"101"`
+	OuterVlanID     string `json:"outer_vlan_id,omitempty" example:"200"`
+}
+
+func nodeVlanRangeKey(nodeId string) string {
+	return fmt.Sprintf("vlan_range/%s", nodeId)
+}
+
+// getNodeVlanRange reads the VLAN range of a node, which is zero if none is set
+func (r *RestServer) getNodeVlanRange(ctx context.Context, nodeId string) (NodeVlanRange, error) {
+	vlanRange := NodeVlanRange{Node: nodeId}
+	resp, err := r.etcd.Client().Get(ctx, nodeVlanRangeKey(nodeId))
+	if err != nil {
+		return vlanRange, err
+	}
+	if len(resp.Kvs) == 0 {
+		return vlanRange, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &vlanRange); err != nil {
+		return vlanRange, err
+	}
+	return vlanRange, nil
+}
+
+// freeUserSlot returns the lowest numeric user ID of a node that has neither
+// an HSI config nor a subscriber record, up to the node's subscriber count
+func (r *RestServer) freeUserSlot(ctx context.Context, nodeId string) (string, *apiError) {
+	used := make(map[string]bool)
+	for _, prefix := range []string{fmt.Sprintf("configs/%s/hsi/", nodeId), subscriberPrefix(nodeId)} {
+		resp, err := r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return "", newAPIError(http.StatusInternalServerError, "Failed to get user IDs")
+		}
+		for _, kv := range resp.Kvs {
+			userId := strings.TrimPrefix(string(kv.Key), prefix)
+			if !strings.Contains(userId, "/") {
+				used[userId] = true
+			}
+		}
+	}
+
+	subscriberCount := r.GetSubscriberCount(ctx, nodeId)
+	for slot := 1; subscriberCount < 0 || slot <= subscriberCount; slot++ {
+		if userId := strconv.Itoa(slot); !used[userId] {
+			return userId, nil
+		}
+	}
+	return "", newAPIError(http.StatusConflict,
+		fmt.Sprintf("No free user ID on node %s, all %d subscriber slots are in use", nodeId, subscriberCount))
+}
+
+// freeVlan returns the lowest VLAN of the node's VLAN range that is neither
+// owned by a subscriber nor used as a multicast VLAN. In QinQ mode the inner
+// VLAN is chosen below the outer VLAN of the config.
+func (r *RestServer) freeVlan(ctx context.Context, nodeId string, config HSIConfig) (int, *apiError) {
+	vlanRange, err := r.getNodeVlanRange(ctx, nodeId)
+	if err != nil {
+		return 0, newAPIError(http.StatusInternalServerError, "Failed to get node VLAN range")
+	}
+	if vlanRange.Start == 0 {
+		return 0, fieldErrors{{Field: "vlan_id", Message: fmt.Sprintf("VLAN ID is required, node %s has no VLAN range", nodeId)}}.apiError("HSI config")
+	}
+	outer := 0
+	if config.OuterVlanID != "" {
+		if outer, err = strconv.Atoi(config.OuterVlanID); err != nil {
+			return 0, fieldErrors{{Field: "outer_vlan_id", Message: "Outer VLAN ID must be a number"}}.apiError("HSI config")
+		}
+	}
+
+	resp, err := r.etcd.Client().Get(ctx, vlanIndexPrefix(nodeId), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	used := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		used[strings.TrimPrefix(string(kv.Key), vlanIndexPrefix(nodeId))] = true
+	}
+	// Multicast VLANs only clash with the VLAN on the wire, the outer one for QinQ
+	multicast, err := r.multicastVlans(ctx, nodeId)
+	if err != nil {
+		return 0, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if outer != 0 && multicast[outer] != "" {
+		return 0, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Outer VLAN is used as multicast VLAN by the IPTV service of user: %s", multicast[outer]))
+	}
+
+	for vid := vlanRange.Start; vid <= vlanRange.End; vid++ {
+		if used[vlanTag{outer: outer, inner: vid}.String()] || (outer == 0 && multicast[vid] != "") {
+			continue
+		}
+		return vid, nil
+	}
+	return 0, newAPIError(http.StatusConflict,
+		fmt.Sprintf("No free VLAN in range %d-%d of node %s", vlanRange.Start, vlanRange.End, nodeId))
+}
+
+// GetNodeVlanRange returns the VLAN range of a node
+// @Summary      Get node VLAN range
+// @Description  Get the range VLANs of HSI configs created without vlan_id are taken from. A zero range means none is set.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeVlanRange
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/vlan-range [get]
+func (r *RestServer) GetNodeVlanRange(c *gin.Context) {
+	vlanRange, err := r.getNodeVlanRange(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node VLAN range"})
+		return
+	}
+	c.JSON(http.StatusOK, vlanRange)
+}
+
+// UpdateNodeVlanRange changes the VLAN range of a node
+// @Summary      Update node VLAN range
+// @Description  Set the range VLANs of HSI configs created without vlan_id are taken from, the lowest free VLAN
+// @Description  is chosen. A start and end of 0 disables automatic VLANs. Existing subscribers keep their VLANs.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string               true  "Node ID"
+// @Param        request  body      UpdateNodeVlanRange  true  "VLAN range"
+// @Success      200      {object}  NodeVlanRange
+// @Failure      400      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/vlan-range [put]
+func (r *RestServer) UpdateNodeVlanRange(c *gin.Context) {
+	var req UpdateNodeVlanRange
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	disabled := req.Start == 0 && req.End == 0
+	if !disabled && (req.Start < MinVlanID || req.End > MaxVlanID || req.Start > req.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("VLAN range must be between %d and %d with start not above end", MinVlanID, MaxVlanID)})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	nodeId := c.Param("nodeId")
+	vlanRange := NodeVlanRange{
+		Node:      nodeId,
+		Start:     req.Start,
+		End:       req.End,
+		UpdatedBy: username,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.Marshal(vlanRange)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal node VLAN range"})
+		return
+	}
+	if _, err := r.etcd.Client().Put(c.Request.Context(), nodeVlanRangeKey(nodeId), string(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save node VLAN range"})
+		return
+	}
+
+	logrus.Infof("VLAN range of node %s set to %d-%d by %s", nodeId, req.Start, req.End, username)
+	c.JSON(http.StatusOK, vlanRange)
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	RevisionActionCreate   = "create"
+	RevisionActionUpdate   = "update"
+	RevisionActionDelete   = "delete"
+	RevisionActionRollback = "rollback"
+
+	// redactedValue replaces secrets in API responses and revision diffs
+	redactedValue = "******"
+)
+
+// HSIFieldChange describes the change of a single HSI config field
+type HSIFieldChange struct {
+	Field string `json:"field" example:"vlan_id"`
+	Old   string `json:"old" example:"100"`
+	New   string `json:"new" example:"200"`
+}
+
+// HSIRevision is an immutable record of one change of an HSI config
+type HSIRevision struct {
+	ResourceVersion string           `json:"resourceVersion" example:"2"`
+	Action          string           `json:"action" example:"update"`
+	RollbackOf      string           `json:"rollbackOf,omitempty" example:"1"`
+	UpdatedBy       string           `json:"updatedBy" example:"admin"`
+	UpdatedAt       string           `json:"updatedAt" example:"2025-01-01T00:00:00Z"`
+	Config          *HSIConfig       `json:"config,omitempty"`
+	Overrides       []string         `json:"overrides,omitempty"`
+	Changes         []HSIFieldChange `json:"changes"`
+}
+
+// HSIRevisionListResponse represents the revisions of an HSI config
+type HSIRevisionListResponse struct {
+	NodeID    string        `json:"node_id" example:"node-1"`
+	UserID    string        `json:"user_id" example:"1"`
+	Revisions []HSIRevision `json:"revisions"`
+}
+
+// HSIRevisionDiffResponse represents the differences between two revisions
+type HSIRevisionDiffResponse struct {
+	From    string           `json:"from" example:"1"`
+	To      string           `json:"to" example:"3"`
+	Changes []HSIFieldChange `json:"changes"`
+}
+
+func hsiHistoryPrefix(nodeId, userId string) string {
+	return fmt.Sprintf("history/hsi/%s/%s/", nodeId, userId)
+}
+
+// hsiHistoryKey zero-pads the resource version so revisions sort by key
+func hsiHistoryKey(nodeId, userId, resourceVersion string) string {
+	rv, _ := strconv.Atoi(resourceVersion)
+	return fmt.Sprintf("%s%010d", hsiHistoryPrefix(nodeId, userId), rv)
+}
+
+// diffHSIConfigs lists the fields that differ between two configs, named after
+// their JSON fields. A nil config compares as empty. Passwords are redacted.
+func diffHSIConfigs(from, to *HSIConfig) []HSIFieldChange {
+	var empty HSIConfig
+	if from == nil {
+		from = &empty
+	}
+	if to == nil {
+		to = &empty
+	}
+
+	changes := []HSIFieldChange{}
+	fromValue, toValue := reflect.ValueOf(*from), reflect.ValueOf(*to)
+	for i := 0; i < fromValue.NumField(); i++ {
+		name := hsiFieldName(fromValue.Type().Field(i))
+		oldValue, newValue := formatHSIField(fromValue.Field(i)), formatHSIField(toValue.Field(i))
+		if oldValue == newValue {
+			continue
+		}
+		if name == "password" {
+			if oldValue != "" {
+				oldValue = redactedValue
+			}
+			if newValue != "" {
+				newValue = redactedValue
+			}
+		}
+		changes = append(changes, HSIFieldChange{Field: name, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+func formatHSIField(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	if v.IsZero() {
+		return ""
+	}
+	data, _ := json.Marshal(v.Interface())
+	return string(data)
+}
+
+// lastHSIResourceVersion returns the resource version of the newest revision of
+// a config, so a config created again after being deleted continues its history
+func (r *RestServer) lastHSIResourceVersion(ctx context.Context, nodeId, userId string) (string, error) {
+	resp, err := r.etcd.Client().Get(ctx, hsiHistoryPrefix(nodeId, userId),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(1))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	var revision HSIRevision
+	if err := json.Unmarshal(resp.Kvs[0].Value, &revision); err != nil {
+		return "", err
+	}
+	return revision.ResourceVersion, nil
+}
+
+// putRevisionOps returns the compare and put operations recording a revision.
+// The compare fails if the revision already exists, which keeps it immutable.
+func putRevisionOps(nodeId, userId string, revision HSIRevision) (clientv3.Cmp, clientv3.Op, error) {
+	key := hsiHistoryKey(nodeId, userId, revision.ResourceVersion)
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return clientv3.Cmp{}, clientv3.Op{}, err
+	}
+	return clientv3.Compare(clientv3.CreateRevision(key), "=", 0), clientv3.OpPut(key, string(data)), nil
+}
+
+func (r *RestServer) getHSIRevision(ctx context.Context, nodeId, userId, resourceVersion string) (*HSIRevision, *apiError) {
+	if _, err := strconv.Atoi(resourceVersion); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "Revision must be a number")
+	}
+	resp, err := r.etcd.Client().Get(ctx, hsiHistoryKey(nodeId, userId, resourceVersion))
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config revision")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("Revision %s not found", resourceVersion))
+	}
+	var revision HSIRevision
+	if err := json.Unmarshal(resp.Kvs[0].Value, &revision); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to parse HSI config revision")
+	}
+	if revision.Config != nil {
+		if err := r.openHSIConfig(revision.Config); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to decrypt HSI config revision")
+		}
+	}
+	return &revision, nil
+}
+
+// maskRevision hides the secrets of a revision before it is returned from the API
+func maskRevision(revision *HSIRevision) {
+	if revision.Config != nil {
+		revision.Config.Password = maskSecret(revision.Config.Password)
+	}
+}
+
+// ListHSIRevisions returns the revision history of an HSI config
+// @Summary      List HSI configuration revisions
+// @Description  List every recorded change of an HSI config, oldest first
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  HSIRevisionListResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/revisions [get]
+func (r *RestServer) ListHSIRevisions(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	userId := c.Param("userId")
+
+	resp, err := r.etcd.Client().Get(c.Request.Context(), hsiHistoryPrefix(nodeId, userId),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config revisions"})
+		return
+	}
+
+	revisions := make([]HSIRevision, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var revision HSIRevision
+		if err := json.Unmarshal(kv.Value, &revision); err != nil {
+			continue
+		}
+		maskRevision(&revision)
+		revisions = append(revisions, revision)
+	}
+	c.JSON(http.StatusOK, HSIRevisionListResponse{NodeID: nodeId, UserID: userId, Revisions: revisions})
+}
+
+// GetHSIRevision returns a single revision of an HSI config
+// @Summary      Get HSI configuration revision
+// @Description  Get a recorded revision of an HSI config. The PPPoE password is masked.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string  true  "Node ID"
+// @Param        userId    path      string  true  "User ID"
+// @Param        revision  path      string  true  "Resource version"
+// @Success      200       {object}  HSIRevision
+// @Failure      400       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/revisions/{revision} [get]
+func (r *RestServer) GetHSIRevision(c *gin.Context) {
+	revision, apiErr := r.getHSIRevision(c.Request.Context(), c.Param("nodeId"), c.Param("userId"), c.Param("revision"))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	maskRevision(revision)
+	c.JSON(http.StatusOK, revision)
+}
+
+// DiffHSIRevisions compares two revisions of an HSI config
+// @Summary      Diff HSI configuration revisions
+// @Description  Show the fields that differ between two revisions of an HSI config. Passwords are redacted.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true   "Node ID"
+// @Param        userId  path      string  true   "User ID"
+// @Param        from    query     string  true   "Resource version to compare from"
+// @Param        to      query     string  false  "Resource version to compare to, defaults to the latest revision"
+// @Success      200     {object}  HSIRevisionDiffResponse
+// @Failure      400     {object}  ErrorResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/revisions/diff [get]
+func (r *RestServer) DiffHSIRevisions(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	userId := c.Param("userId")
+	ctx := c.Request.Context()
+
+	fromVersion := c.Query("from")
+	if fromVersion == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from is required"})
+		return
+	}
+	toVersion := c.Query("to")
+	if toVersion == "" {
+		latest, err := r.lastHSIResourceVersion(ctx, nodeId, userId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config revisions"})
+			return
+		}
+		toVersion = latest
+	}
+
+	from, apiErr := r.getHSIRevision(ctx, nodeId, userId, fromVersion)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	to, apiErr := r.getHSIRevision(ctx, nodeId, userId, toVersion)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, HSIRevisionDiffResponse{
+		From:    from.ResourceVersion,
+		To:      to.ResourceVersion,
+		Changes: diffHSIConfigs(from.Config, to.Config),
+	})
+}
+
+// RollbackHSIConfig restores an HSI config to a previous revision
+// @Summary      Roll back HSI configuration
+// @Description  Restore the content of a previous revision as a new revision. The config is validated like an
+// @Description  update, and recreated if it has been deleted since.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string  true   "Node ID"
+// @Param        userId    path      string  true   "User ID"
+// @Param        revision  path      string  true   "Resource version to roll back to"
+// @Param        If-Match  header    string  false  "Expected current resource version"
+// @Success      200       {object}  HSIWriteResponse
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ConflictResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/revisions/{revision}/rollback [post]
+func (r *RestServer) RollbackHSIConfig(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	userId := c.Param("userId")
+	ctx := c.Request.Context()
+
+	revision, apiErr := r.getHSIRevision(ctx, nodeId, userId, c.Param("revision"))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	if revision.Config == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot roll back to a deleted revision"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	current, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get current HSI config"})
+		return
+	}
+
+	// Profile fields the revision inherited follow the current profile
+	config := *revision.Config
+	if config.Profile != "" {
+		config = inheritProfileFields(config, revision.Overrides)
+	}
+
+	saved, apiErr := r.writeHSIConfig(ctx, hsiWrite{
+		nodeId:     nodeId,
+		config:     config,
+		username:   username,
+		create:     current == nil,
+		ifMatch:    parseIfMatch(c.GetHeader("If-Match")),
+		rollbackOf: revision.ResourceVersion,
+	})
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, gin.H{
+		"message":         fmt.Sprintf("HSI config rolled back to revision %s", revision.ResourceVersion),
+		"resourceVersion": saved.Metadata.ResourceVersion,
+	})
+}
@@ -0,0 +1,589 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	ImportModeAtomic     = "atomic"
+	ImportModeBestEffort = "best_effort"
+
+	ImportRowValid      = "valid"
+	ImportRowCreated    = "created"
+	ImportRowUpdated    = "updated"
+	ImportRowFailed     = "failed"
+	ImportRowRolledBack = "rolled_back"
+	// ImportRowRollbackFailed marks a written row that could not be rolled
+	// back, for example because it was changed after the import wrote it
+	ImportRowRollbackFailed = "rollback_failed"
+
+	// maxImportSize bounds the size of an import request body
+	maxImportSize = 8 << 20
+	// hsiImportBatchSize is the number of rows an atomic import writes per
+	// transaction. A row with a service profile and an IPAM subnet takes up
+	// to 10 compares and 6 operations, so a batch stays below the etcd limit
+	// of 128 compares and 128 operations per transaction.
+	hsiImportBatchSize = 10
+)
+
+// hsiCSVColumns lists the CSV columns of an HSI import or export, one per
+// HSIConfig string field, named after the JSON fields
+var hsiCSVColumns, hsiCSVFields = hsiStringFields()
+
+func hsiStringFields() ([]string, map[string]int) {
+	var columns []string
+	fields := make(map[string]int)
+	configType := reflect.TypeOf(HSIConfig{})
+	for i := 0; i < configType.NumField(); i++ {
+		if configType.Field(i).Type.Kind() != reflect.String {
+			continue
+		}
+		name := hsiFieldName(configType.Field(i))
+		columns = append(columns, name)
+		fields[name] = i
+	}
+	return columns, fields
+}
+
+// hsiCSVRecord returns the CSV columns of a config
+func hsiCSVRecord(config HSIConfig) []string {
+	value := reflect.ValueOf(config)
+	record := make([]string, len(hsiCSVColumns))
+	for i, column := range hsiCSVColumns {
+		record[i] = value.Field(hsiCSVFields[column]).String()
+	}
+	return record
+}
+
+// keepNonCSVFields copies the fields CSV has no column for from the stored
+// config, so updating a subscriber from CSV does not clear them
+func keepNonCSVFields(config, stored HSIConfig) HSIConfig {
+	value, storedValue := reflect.ValueOf(&config).Elem(), reflect.ValueOf(stored)
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).Kind() != reflect.String {
+			value.Field(i).Set(storedValue.Field(i))
+		}
+	}
+	return config
+}
+
+// HSIImportRowResult reports the outcome of a single imported row
+type HSIImportRowResult struct {
+	Row         int          `json:"row" example:"1"`
+	UserID      string       `json:"user_id" example:"1"`
+	Status      string       `json:"status" example:"created"`
+	Error       string       `json:"error,omitempty"`
+	FieldErrors []FieldError `json:"field_errors,omitempty"`
+}
+
+// HSIImportResponse summarizes an HSI config import
+type HSIImportResponse struct {
+	DryRun    bool                 `json:"dry_run" example:"false"`
+	Mode      string               `json:"mode" example:"atomic"`
+	Applied   bool                 `json:"applied" example:"true"`
+	Total     int                  `json:"total" example:"2"`
+	Succeeded int                  `json:"succeeded" example:"2"`
+	Failed    int                  `json:"failed" example:"0"`
+	Rows      []HSIImportRowResult `json:"rows"`
+}
+
+func (row *HSIImportRowResult) fail(apiErr *apiError) {
+	row.Status = ImportRowFailed
+	if msg, ok := apiErr.Body["error"].(string); ok {
+		row.Error = msg
+	}
+	if fieldErrs, ok := apiErr.Body["field_errors"].([]FieldError); ok {
+		row.FieldErrors = fieldErrs
+	}
+}
+
+// importFormat picks the import or export format from the format query
+// parameter, falling back to the content type and finally JSON
+func importFormat(c *gin.Context) string {
+	if format := strings.ToLower(c.Query("format")); format != "" {
+		return format
+	}
+	if strings.Contains(c.ContentType(), "csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// parseHSICSV reads HSI configs from CSV with a header row naming the columns
+func parseHSICSV(data []byte) ([]HSIConfig, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if _, known := hsiCSVFields[name]; !known {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[name] = i
+	}
+
+	var configs []HSIConfig
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var config HSIConfig
+		value := reflect.ValueOf(&config).Elem()
+		for name, i := range columns {
+			if i < len(record) {
+				value.Field(hsiCSVFields[name]).SetString(strings.TrimSpace(record[i]))
+			}
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// checkHSIWrite runs the checks of saveHSIConfig without writing anything.
+// It returns whether the config already exists.
+func (r *RestServer) checkHSIWrite(ctx context.Context, nodeId string, config HSIConfig, overwrite bool) (bool, *apiError) {
+	config, _, _, apiErr := r.resolveHSIConfig(ctx, config)
+	if apiErr != nil {
+		return false, apiErr
+	}
+	ipam, err := r.loadIPAM(ctx)
+	if err != nil {
+		return false, newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocations")
+	}
+	if needsIPAMSubnet(config) {
+		if allocation, ok := ipam.allocate(nodeId, config.UserID); ok {
+			applyIPAMAllocation(&config, allocation)
+		}
+	}
+	if apiErr := validateHSIConfig(config).apiError("HSI config"); apiErr != nil {
+		return false, apiErr
+	}
+	if apiErr := r.checkUserIdInRange(ctx, nodeId, config.UserID); apiErr != nil {
+		return false, apiErr
+	}
+
+	existing, _, err := r.loadHSIConfig(ctx, nodeId, config.UserID)
+	if err != nil {
+		return false, newAPIError(http.StatusInternalServerError, "Failed to get current HSI config")
+	}
+	if existing != nil && !overwrite {
+		return true, newAPIError(http.StatusConflict, "HSI config already exists")
+	}
+	if existing == nil && config.Password == redactedValue {
+		return false, fieldErrors{{Field: "password", Message: "Password must not be the masked value"}}.apiError("HSI config")
+	}
+
+	if _, apiErr := r.checkVlanMode(ctx, nodeId, config); apiErr != nil {
+		return false, apiErr
+	}
+	if _, apiErr := r.checkQoSCapacity(ctx, nodeId, config); apiErr != nil {
+		return false, apiErr
+	}
+	if _, _, apiErr := ipam.assignOps(nodeId, config); apiErr != nil {
+		return false, apiErr
+	}
+	tag, _ := hsiVlanTag(config)
+	owner, _, err := r.getVlanOwner(ctx, nodeId, tag)
+	if err != nil {
+		return false, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if owner != "" && owner != config.UserID {
+		return false, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Input VLAN has been already used by other user: %s", owner))
+	}
+	return existing != nil, nil
+}
+
+// ImportHSIConfigs imports HSI configurations of a node from CSV or JSON
+// @Summary      Import HSI configurations
+// @Description  Create HSI configurations in bulk from CSV (header row with the JSON field names) or a JSON array.
+// @Description  Each row goes through the same validation and VLAN checks as a single create. In atomic mode
+// @Description  nothing is written unless every row is valid, and rows are written in transactions of 10 rows that
+// @Description  only commit if none of the configs, VLANs or subnets they depend on changed. If a batch fails, the
+// @Description  batches already written are rolled back, rows changed by others since are reported as
+// @Description  rollback_failed and left alone. In best_effort mode valid rows are written one by one and
+// @Description  invalid rows are reported.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Accept       text/csv
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId     path      string       true   "Node ID"
+// @Param        format     query     string       false  "Input format, json or csv (defaults to the content type)"
+// @Param        mode       query     string       false  "atomic (default) or best_effort"
+// @Param        dry_run    query     bool         false  "Only validate the rows"
+// @Param        overwrite  query     bool         false  "Update existing configs instead of rejecting them"
+// @Param        request    body      []HSIConfig  true   "HSI configurations"
+// @Success      200        {object}  HSIImportResponse
+// @Failure      400        {object}  ErrorResponse
+// @Failure      500        {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi:import [post]
+func (r *RestServer) ImportHSIConfigs(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	mode := c.DefaultQuery("mode", ImportModeAtomic)
+	if mode != ImportModeAtomic && mode != ImportModeBestEffort {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mode must be atomic or best_effort"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	overwrite := c.Query("overwrite") == "true"
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxImportSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if len(data) > maxImportSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Import is too large"})
+		return
+	}
+
+	var configs []HSIConfig
+	format := importFormat(c)
+	switch format {
+	case "csv":
+		if configs, err = parseHSICSV(data); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid CSV: %v", err)})
+			return
+		}
+	case "json":
+		if err := json.Unmarshal(data, &configs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: expected an array of HSI configs"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be json or csv"})
+		return
+	}
+	if len(configs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No HSI configs to import"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	result := HSIImportResponse{DryRun: dryRun, Mode: mode, Total: len(configs), Rows: make([]HSIImportRowResult, len(configs))}
+
+	// Validate every row first, including duplicates within the import itself
+	exists := make([]bool, len(configs))
+	seenUsers := make(map[string]int)
+	seenVlans := make(map[vlanTag]int)
+	for i, config := range configs {
+		row := &result.Rows[i]
+		row.Row, row.UserID, row.Status = i+1, config.UserID, ImportRowValid
+
+		if format == "csv" && overwrite {
+			existing, _, err := r.loadHSIConfig(ctx, nodeId, config.UserID)
+			if err != nil {
+				row.fail(newAPIError(http.StatusInternalServerError, "Failed to get current HSI config"))
+				continue
+			}
+			if existing != nil {
+				configs[i] = keepNonCSVFields(config, existing.Config)
+				config = configs[i]
+			}
+		}
+
+		existed, apiErr := r.checkHSIWrite(ctx, nodeId, config, overwrite)
+		if apiErr != nil {
+			row.fail(apiErr)
+			continue
+		}
+		exists[i] = existed
+
+		if first, ok := seenUsers[config.UserID]; ok {
+			row.fail(newAPIError(http.StatusConflict, fmt.Sprintf("User ID is duplicated in row %d", first)))
+			continue
+		}
+		tag, _ := hsiVlanTag(config)
+		if first, ok := seenVlans[tag]; ok {
+			row.fail(newAPIError(http.StatusConflict, fmt.Sprintf("VLAN is duplicated in row %d", first)))
+			continue
+		}
+		seenUsers[config.UserID] = row.Row
+		seenVlans[tag] = row.Row
+	}
+	for _, row := range result.Rows {
+		if row.Status == ImportRowFailed {
+			result.Failed++
+		}
+	}
+
+	if dryRun || (mode == ImportModeAtomic && result.Failed > 0) {
+		result.Succeeded = result.Total - result.Failed
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	if mode == ImportModeAtomic {
+		r.writeAtomicHSIImport(ctx, nodeId, username, configs, exists, &result)
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	for i, config := range configs {
+		row := &result.Rows[i]
+		if row.Status == ImportRowFailed {
+			continue
+		}
+		if _, apiErr := r.saveHSIConfig(ctx, nodeId, config, username, !exists[i], ""); apiErr != nil {
+			row.fail(apiErr)
+			result.Failed++
+			continue
+		}
+		row.Status = ImportRowCreated
+		if exists[i] {
+			row.Status = ImportRowUpdated
+		}
+		result.Succeeded++
+	}
+
+	result.Applied = result.Succeeded > 0
+	logrus.Infof("Imported %d of %d HSI configs for node %s by %s", result.Succeeded, result.Total, nodeId, username)
+	c.JSON(http.StatusOK, result)
+}
+
+// writeAtomicHSIImport writes the validated rows of an atomic import batch by
+// batch. If a batch fails, the batches already written are rolled back.
+func (r *RestServer) writeAtomicHSIImport(ctx context.Context, nodeId, username string, configs []HSIConfig, exists []bool, result *HSIImportResponse) {
+	var written []int
+	previous := make(map[int]*HSIConfigWithMetadata)
+	imported := make(map[int]string)
+	for start := 0; start < len(configs); start += hsiImportBatchSize {
+		batch := make([]int, 0, hsiImportBatchSize)
+		for i := start; i < len(configs) && i < start+hsiImportBatchSize; i++ {
+			batch = append(batch, i)
+		}
+		plans, failedRow, apiErr := r.writeHSIImportBatch(ctx, nodeId, username, configs, exists, batch)
+		if apiErr != nil {
+			if failedRow < 0 {
+				for _, i := range batch {
+					result.Rows[i].fail(apiErr)
+				}
+				result.Failed += len(batch)
+			} else {
+				result.Rows[failedRow].fail(apiErr)
+				result.Failed++
+			}
+			r.rollbackHSIImport(ctx, nodeId, username, configs, written, previous, imported, result.Rows)
+			result.Succeeded = 0
+			return
+		}
+		for _, i := range batch {
+			result.Rows[i].Status = ImportRowCreated
+			if plans[i].existing != nil {
+				result.Rows[i].Status = ImportRowUpdated
+				previous[i] = plans[i].existing
+			}
+			imported[i] = plans[i].result.Metadata.ResourceVersion
+		}
+		written = append(written, batch...)
+	}
+
+	result.Succeeded = len(written)
+	result.Applied = true
+	logrus.Infof("Imported %d HSI configs for node %s by %s", result.Succeeded, nodeId, username)
+}
+
+// writeHSIImportBatch writes rows of an import in one transaction. The rows
+// are planned against a shared IPAM state, so subnets allocated to earlier
+// rows are not handed out again. It returns the written plans of the rows, or
+// the error and the row that caused it, which is -1 if the whole batch failed.
+func (r *RestServer) writeHSIImportBatch(ctx context.Context, nodeId, username string, configs []HSIConfig, exists []bool, batch []int) (map[int]*hsiWritePlan, int, *apiError) {
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		ipam, err := r.loadIPAM(ctx)
+		if err != nil {
+			return nil, -1, newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocations")
+		}
+		var cmps []clientv3.Cmp
+		var ops []clientv3.Op
+		plans := make(map[int]*hsiWritePlan)
+		for _, i := range batch {
+			plan, apiErr := r.planHSIWrite(ctx, hsiWrite{
+				nodeId:   nodeId,
+				config:   configs[i],
+				username: username,
+				create:   !exists[i],
+			}, ipam)
+			if apiErr != nil {
+				return nil, i, apiErr
+			}
+			cmps = append(cmps, plan.cmps...)
+			ops = append(ops, plan.ops...)
+			plans[i] = plan
+		}
+
+		txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, -1, newAPIError(http.StatusInternalServerError, "Failed to save HSI configs")
+		}
+		if txnResp.Succeeded {
+			return plans, -1, nil
+		}
+		logrus.Infof("HSI configs of node %s changed while importing, retrying the batch", nodeId)
+	}
+	return nil, -1, newAPIError(http.StatusConflict, "HSI configs have been modified by other requests")
+}
+
+// rollbackHSIImport undoes the batches written by a failed atomic import in
+// reverse order. Created configs are deleted, updated configs get their
+// previous content back as a rollback revision. Both only happen if the
+// config still has the resource version the import wrote, so changes made by
+// others meanwhile are not overwritten.
+func (r *RestServer) rollbackHSIImport(ctx context.Context, nodeId, username string, configs []HSIConfig, written []int, previous map[int]*HSIConfigWithMetadata, imported map[int]string, rows []HSIImportRowResult) {
+	for j := len(written) - 1; j >= 0; j-- {
+		i := written[j]
+		userId := configs[i].UserID
+
+		var err *apiError
+		if prev, ok := previous[i]; ok {
+			_, err = r.writeHSIConfig(ctx, hsiWrite{
+				nodeId:     nodeId,
+				config:     prev.Config,
+				username:   username,
+				ifMatch:    imported[i],
+				rollbackOf: prev.Metadata.ResourceVersion,
+			})
+		} else {
+			err = r.deleteHSIConfig(ctx, nodeId, userId, imported[i], username)
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to roll back imported HSI config of node %s, user: %s", nodeId, userId)
+			rows[i].Status = ImportRowRollbackFailed
+			if msg, ok := err.Body["error"].(string); ok {
+				rows[i].Error = "Rollback failed: " + msg
+			}
+			continue
+		}
+		rows[i].Status = ImportRowRolledBack
+	}
+}
+
+// ExportHSIConfigs exports the HSI configurations of a node as CSV or JSON
+// @Summary      Export HSI configurations
+// @Description  Export all HSI configurations of a node in the format accepted by the import. PPPoE passwords are
+// @Description  masked by default, masked passwords keep the stored ones when imported with overwrite=true.
+// @Tags         HSI Configuration
+// @Produce      json
+// @Produce      text/csv
+// @Security     BearerAuth
+// @Param        nodeId            path      string  true   "Node ID"
+// @Param        format            query     string  false  "Output format, json (default) or csv"
+// @Param        redact_passwords  query     bool    false  "Leave the PPPoE passwords empty instead of masking them"
+// @Param        reveal            query     bool    false  "Export the PPPoE passwords in clear text, requires the reveal permission and is audited"
+// @Success      200               {array}   HSIConfig
+// @Failure      400               {object}  ErrorResponse
+// @Failure      500               {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi:export [get]
+func (r *RestServer) ExportHSIConfigs(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	format := strings.ToLower(c.DefaultQuery("format", "json"))
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be json or csv"})
+		return
+	}
+	redact := c.Query("redact_passwords") == "true"
+	reveal, apiErr := r.authorizeReveal(c, fmt.Sprintf("configs/%s/hsi/", nodeId), nil)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	resp, err := r.etcd.Client().Get(c.Request.Context(), fmt.Sprintf("configs/%s/hsi/", nodeId), clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI configs"})
+		return
+	}
+
+	configs := make([]HSIConfig, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var configWithMetadata HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &configWithMetadata); err != nil {
+			logrus.WithError(err).Warnf("Skipping unparsable HSI config %s in export", kv.Key)
+			continue
+		}
+		config := configWithMetadata.Config
+		switch {
+		case redact:
+			config.Password = ""
+		case reveal:
+			if err := r.openHSIConfig(&config); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt HSI configs"})
+				return
+			}
+		default:
+			config.Password = maskSecret(config.Password)
+		}
+		configs = append(configs, config)
+	}
+	sortHSIConfigs(configs)
+
+	if format == "json" {
+		c.JSON(http.StatusOK, configs)
+		return
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(hsiCSVColumns)
+	for _, config := range configs {
+		writer.Write(hsiCSVRecord(config))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write CSV"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=hsi-%s.csv", nodeId))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// sortHSIConfigs orders configs by user ID, numerically where possible
+func sortHSIConfigs(configs []HSIConfig) {
+	sort.SliceStable(configs, func(i, j int) bool {
+		return lessUserId(configs[i].UserID, configs[j].UserID)
+	})
+}
+
+// lessUserId orders user IDs numerically, falling back to string order
+func lessUserId(a, b string) bool {
+	x, errX := strconv.Atoi(a)
+	y, errY := strconv.Atoi(b)
+	if errX == nil && errY == nil {
+		return x < y
+	}
+	return a < b
+}
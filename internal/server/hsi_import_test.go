@@ -0,0 +1,239 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testImport returns n HSI configs with user IDs from 1 and VLANs from 100,
+// and the import response their rows are reported in
+func testImport(n int) ([]HSIConfig, []bool, *HSIImportResponse) {
+	configs := make([]HSIConfig, n)
+	result := &HSIImportResponse{Mode: ImportModeAtomic, Total: n, Rows: make([]HSIImportRowResult, n)}
+	for i := range configs {
+		configs[i] = testHSIConfig(strconv.Itoa(i+1), strconv.Itoa(100+i))
+		result.Rows[i] = HSIImportRowResult{Row: i + 1, UserID: configs[i].UserID, Status: ImportRowValid}
+	}
+	return configs, make([]bool, n), result
+}
+
+func TestWriteAtomicHSIImport(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+
+	existing, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, "")
+	if apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	// More rows than fit in one batch, the first one replaces a config
+	configs, exists, result := testImport(hsiImportBatchSize + 4)
+	configs[0].AccountName = "imported"
+	exists[0] = true
+	r.writeAtomicHSIImport(ctx, "node1", "admin", configs, exists, result)
+
+	if !result.Applied || result.Succeeded != len(configs) || result.Failed != 0 {
+		t.Fatalf("result = applied %v, succeeded %d, failed %d, want all %d applied",
+			result.Applied, result.Succeeded, result.Failed, len(configs))
+	}
+	for i, row := range result.Rows {
+		want := ImportRowCreated
+		if i == 0 {
+			want = ImportRowUpdated
+		}
+		if row.Status != want {
+			t.Errorf("row %d status = %s, want %s", row.Row, row.Status, want)
+		}
+	}
+
+	for _, config := range configs {
+		stored, _, err := r.loadHSIConfig(ctx, "node1", config.UserID)
+		if err != nil || stored == nil {
+			t.Fatalf("loadHSIConfig(%s) = %v, %v", config.UserID, stored, err)
+		}
+		if stored.Config.AccountName != config.AccountName {
+			t.Errorf("user %s account = %s, want %s", config.UserID, stored.Config.AccountName, config.AccountName)
+		}
+		vid, _ := strconv.Atoi(config.VlanID)
+		if owner, _, _ := r.getVlanOwner(ctx, "node1", vlanTag{inner: vid}); owner != config.UserID {
+			t.Errorf("VLAN %s owner = %q, want %s", config.VlanID, owner, config.UserID)
+		}
+	}
+	if stored, _, _ := r.loadHSIConfig(ctx, "node1", "1"); stored.Metadata.ResourceVersion != incrementResourceVersion(existing.Metadata.ResourceVersion) {
+		t.Errorf("user 1 resource version = %s, want the next after %s", stored.Metadata.ResourceVersion, existing.Metadata.ResourceVersion)
+	}
+}
+
+func TestWriteAtomicHSIImportRollsBackEarlierBatches(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+
+	original := testHSIConfig("1", "100")
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", original, "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	configs, exists, result := testImport(hsiImportBatchSize + 4)
+	configs[0].AccountName = "imported"
+	exists[0] = true
+	// The VLAN of a row in the second batch is taken after the rows were validated
+	failed := hsiImportBatchSize + 1
+	putTestJSON(t, r, vlanIndexKey("node1", vlanTag{inner: 100 + failed}), "99")
+	r.writeAtomicHSIImport(ctx, "node1", "admin", configs, exists, result)
+
+	if result.Applied || result.Succeeded != 0 || result.Failed != 1 {
+		t.Fatalf("result = applied %v, succeeded %d, failed %d, want nothing applied and one failure",
+			result.Applied, result.Succeeded, result.Failed)
+	}
+	if result.Rows[failed].Status != ImportRowFailed {
+		t.Errorf("row %d status = %s, want %s", failed+1, result.Rows[failed].Status, ImportRowFailed)
+	}
+	for i := 0; i < hsiImportBatchSize; i++ {
+		if result.Rows[i].Status != ImportRowRolledBack {
+			t.Errorf("row %d status = %s, want %s", i+1, result.Rows[i].Status, ImportRowRolledBack)
+		}
+	}
+
+	// The first batch is undone, the rest never written
+	stored, _, err := r.loadHSIConfig(ctx, "node1", "1")
+	if err != nil || stored == nil {
+		t.Fatalf("loadHSIConfig(1) = %v, %v", stored, err)
+	}
+	if stored.Config.AccountName != original.AccountName {
+		t.Errorf("user 1 account = %s, want %s restored", stored.Config.AccountName, original.AccountName)
+	}
+	for _, config := range configs[1:] {
+		if stored, _, _ := r.loadHSIConfig(ctx, "node1", config.UserID); stored != nil {
+			t.Errorf("user %s exists after the rollback", config.UserID)
+		}
+		vid, _ := strconv.Atoi(config.VlanID)
+		if owner, _, _ := r.getVlanOwner(ctx, "node1", vlanTag{inner: vid}); owner != "" && owner != "99" {
+			t.Errorf("VLAN %s owner = %q after the rollback", config.VlanID, owner)
+		}
+	}
+}
+
+func TestWriteAtomicHSIImportWithProfileIPAMAndSNAT(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	putTestJSON(t, r, serviceProfileKey("residential"), `{"name":"residential","config":{"dhcp_dns":"8.8.8.8"},"resource_version":"1"}`)
+	putTestJSON(t, r, ipamSupernetKey("site"), `{"name":"site","prefix":"10.16.0.0/16","subnet_length":24}`)
+	putTestJSON(t, r, snatPoolKey("node1", "cgnat"),
+		`{"name":"cgnat","prefix":"203.0.113.0/24","port_start":1024,"port_end":65535,"block_size":2048,"allocation":"dynamic"}`)
+
+	// Full batches of subscribers with a port block, moved to the profile
+	// and to subnets from IPAM
+	n := 2 * hsiImportBatchSize
+	configs, exists, result := testImport(n)
+	for i := range configs {
+		if _, apiErr := r.saveHSIConfig(ctx, "node1", configs[i], "admin", true, ""); apiErr != nil {
+			t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+		}
+		if _, _, apiErr := r.allocateSNATBlock(ctx, "node1", configs[i].UserID, "", "admin"); apiErr != nil {
+			t.Fatalf("allocateSNATBlock() error = %v", apiErr.Body)
+		}
+		configs[i].Profile = "residential"
+		configs[i].DHCPAddrPool, configs[i].DHCPSubnet, configs[i].DHCPGateway = "", "", ""
+		exists[i] = true
+	}
+	countKeys := func(prefix string) int64 {
+		t.Helper()
+		resp, err := r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Count
+	}
+
+	// The last row moves to a VLAN taken after the rows were validated
+	configs[n-1].VlanID = "300"
+	putTestJSON(t, r, vlanIndexKey("node1", vlanTag{inner: 300}), "99")
+	r.writeAtomicHSIImport(ctx, "node1", "admin", configs, exists, result)
+	if result.Applied || result.Rows[n-1].Status != ImportRowFailed {
+		t.Fatalf("result = applied %v, last row %s, want the last row failed", result.Applied, result.Rows[n-1].Status)
+	}
+	for i := 0; i < hsiImportBatchSize; i++ {
+		if result.Rows[i].Status != ImportRowRolledBack {
+			t.Errorf("row %d status = %s, want %s", i+1, result.Rows[i].Status, ImportRowRolledBack)
+		}
+		stored, _, _ := r.loadHSIConfig(ctx, "node1", configs[i].UserID)
+		if stored == nil || stored.Config.Profile != "" || stored.Config.DHCPGateway != "192.168.3.1" {
+			t.Errorf("user %s = %v, want the previous config restored", configs[i].UserID, stored)
+		}
+	}
+	if count := countKeys(ipamAllocationsPrefix); count != 0 {
+		t.Errorf("%d IPAM allocations after the rollback, want 0", count)
+	}
+
+	r.etcd.Client().Delete(ctx, vlanIndexKey("node1", vlanTag{inner: 300}))
+	_, _, result = testImport(n)
+	r.writeAtomicHSIImport(ctx, "node1", "admin", configs, exists, result)
+	if !result.Applied || result.Succeeded != n {
+		t.Fatalf("result = applied %v, succeeded %d, want all %d applied", result.Applied, result.Succeeded, n)
+	}
+	for _, config := range configs {
+		stored, _, _ := r.loadHSIConfig(ctx, "node1", config.UserID)
+		if stored == nil || stored.Config.DHCPDNS != "8.8.8.8" || !ipamTestManaged(stored.Config) {
+			t.Errorf("user %s = %v, want the profile and an IPAM subnet", config.UserID, stored)
+		}
+	}
+	if count := countKeys(ipamAllocationsPrefix); count != int64(n) {
+		t.Errorf("%d IPAM allocations, want %d", count, n)
+	}
+	// Port blocks are kept, neither the rollback nor the updates release them
+	if count := countKeys(snatAllocationPrefix("node1")); count != int64(n) {
+		t.Errorf("%d SNAT allocations, want %d", count, n)
+	}
+}
+
+// ipamTestManaged reports whether a config has a subnet of the test supernet
+func ipamTestManaged(config HSIConfig) bool {
+	prefix, ok := hsiLANPrefix(config)
+	return ok && prefix.Bits() == 24 && netip.MustParsePrefix("10.16.0.0/16").Contains(prefix.Addr())
+}
+
+func TestRollbackHSIImportKeepsChangedRows(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+	previous, _, _ := r.loadHSIConfig(ctx, "node1", "1")
+
+	configs, exists, result := testImport(2)
+	configs[0].AccountName = "imported"
+	exists[0] = true
+	r.writeAtomicHSIImport(ctx, "node1", "admin", configs, exists, result)
+	if !result.Applied {
+		t.Fatalf("import failed: %v", result.Rows)
+	}
+	imported := make(map[int]string)
+	for i, config := range configs {
+		stored, _, _ := r.loadHSIConfig(ctx, "node1", config.UserID)
+		imported[i] = stored.Metadata.ResourceVersion
+
+		// Both rows are changed by others after the import
+		config.AccountName = "changed"
+		if _, apiErr := r.saveHSIConfig(ctx, "node1", config, "admin", false, ""); apiErr != nil {
+			t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+		}
+	}
+
+	r.rollbackHSIImport(ctx, "node1", "admin", configs, []int{0, 1}, map[int]*HSIConfigWithMetadata{0: previous}, imported, result.Rows)
+
+	for i, config := range configs {
+		if result.Rows[i].Status != ImportRowRollbackFailed {
+			t.Errorf("row %d status = %s, want %s", i+1, result.Rows[i].Status, ImportRowRollbackFailed)
+		}
+		stored, _, _ := r.loadHSIConfig(ctx, "node1", config.UserID)
+		if stored == nil || stored.Config.AccountName != "changed" {
+			t.Errorf("user %s = %v, want the change kept", config.UserID, stored)
+		}
+	}
+}
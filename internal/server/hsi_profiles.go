@@ -0,0 +1,652 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const serviceProfilesPrefix = "profiles/"
+
+// Propagation statuses of a subscriber when a service profile changes
+const (
+	PropagationUnchanged = "unchanged"
+	PropagationPending   = "pending"
+	PropagationUpdated   = "updated"
+	PropagationInvalid   = "invalid"
+	PropagationFailed    = "failed"
+)
+
+// profileExcludedFields are the HSI config fields specific to a subscriber,
+// which a service profile cannot set
+var profileExcludedFields = map[string]bool{
+	"user_id":           true,
+	"vlan_id":           true,
+	"outer_vlan_id":     true,
+	"account_name":      true,
+	"password":          true,
+	"profile":           true,
+	"dhcp_reservations": true,
+	"wan_ip_address":    true,
+}
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// ServiceProfile is a named template of HSI config fields shared by subscribers.
+// String values may contain the placeholders {user_id} and {vlan_id}, which are
+// replaced with the subscriber's values.
+type ServiceProfile struct {
+	Name            string    `json:"name" example:"residential"`
+	Description     string    `json:"description,omitempty" example:"Residential /24, gateway .1"`
+	Config          HSIConfig `json:"config"`
+	ResourceVersion string    `json:"resource_version" example:"1"`
+	UpdatedBy       string    `json:"updated_by" example:"admin"`
+	UpdatedAt       string    `json:"updated_at" example:"2024-01-01T00:00:00Z"`
+}
+
+// ServiceProfileRequest represents the request to create or replace a service profile
+type ServiceProfileRequest struct {
+	Name        string    `json:"name" example:"residential"`
+	Description string    `json:"description" example:"Residential /24, gateway .1"`
+	Config      HSIConfig `json:"config"`
+}
+
+// ProfilePropagationResult reports how a profile change affects one subscriber
+type ProfilePropagationResult struct {
+	NodeID      string           `json:"node_id" example:"node001"`
+	UserID      string           `json:"user_id" example:"2"`
+	Status      string           `json:"status" example:"updated"`
+	Changes     []HSIFieldChange `json:"changes"`
+	Error       string           `json:"error,omitempty"`
+	FieldErrors []FieldError     `json:"field_errors,omitempty"`
+}
+
+// ServiceProfileUpdateResponse represents the outcome of a profile update
+type ServiceProfileUpdateResponse struct {
+	Profile     ServiceProfile             `json:"profile"`
+	DryRun      bool                       `json:"dry_run" example:"false"`
+	Applied     bool                       `json:"applied" example:"true"`
+	Subscribers []ProfilePropagationResult `json:"subscribers"`
+}
+
+// HSIEffectiveConfigResponse represents an HSI config resolved against its service profile
+type HSIEffectiveConfigResponse struct {
+	NodeID    string    `json:"node_id" example:"node001"`
+	UserID    string    `json:"user_id" example:"2"`
+	Profile   string    `json:"profile,omitempty" example:"residential"`
+	Config    HSIConfig `json:"config"`
+	Overrides []string  `json:"overrides"`
+	Inherited []string  `json:"inherited"`
+	// NodeDefaults lists the DHCP options taken from the node defaults
+	NodeDefaults []string `json:"node_defaults"`
+	// InSync is false when the stored config has not picked up the latest profile yet
+	InSync bool `json:"in_sync" example:"true"`
+}
+
+func serviceProfileKey(name string) string {
+	return serviceProfilesPrefix + name
+}
+
+// hsiFieldName returns the JSON name of an HSI config field
+func hsiFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		name = field.Name
+	}
+	return name
+}
+
+// resolveProfile merges a subscriber config with its service profile. A profile
+// field the subscriber leaves empty, or sets to the profile's value, is
+// inherited; any other value overrides the profile. It returns the effective
+// config and the names of the overridden fields.
+func resolveProfile(profile *ServiceProfile, config HSIConfig) (HSIConfig, []string) {
+	placeholders := strings.NewReplacer("{user_id}", config.UserID, "{vlan_id}", config.VlanID)
+
+	overrides := []string{}
+	effective := reflect.ValueOf(&config).Elem()
+	template := reflect.ValueOf(profile.Config)
+	for i := 0; i < template.NumField(); i++ {
+		name := hsiFieldName(template.Type().Field(i))
+		if profileExcludedFields[name] {
+			continue
+		}
+		inherited := template.Field(i)
+		if inherited.Kind() == reflect.String {
+			inherited = reflect.ValueOf(placeholders.Replace(inherited.String()))
+		}
+		value := effective.Field(i)
+		if value.IsZero() || reflect.DeepEqual(value.Interface(), inherited.Interface()) {
+			value.Set(inherited)
+		} else {
+			overrides = append(overrides, name)
+		}
+	}
+	return config, overrides
+}
+
+// inheritProfileFields clears the profile fields of an effective config that
+// are not overridden, so that resolving it again picks up the current profile
+func inheritProfileFields(config HSIConfig, overrides []string) HSIConfig {
+	overridden := make(map[string]bool, len(overrides))
+	for _, name := range overrides {
+		overridden[name] = true
+	}
+	value := reflect.ValueOf(&config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := hsiFieldName(value.Type().Field(i))
+		if profileExcludedFields[name] || overridden[name] {
+			continue
+		}
+		value.Field(i).Set(reflect.Zero(value.Field(i).Type()))
+	}
+	return config
+}
+
+func validateServiceProfile(profile ServiceProfile) fieldErrors {
+	var errs fieldErrors
+	if !profileNamePattern.MatchString(profile.Name) {
+		errs.add("name", "Name must be 1-63 letters, digits, '.', '_' or '-'")
+	}
+	value := reflect.ValueOf(profile.Config)
+	for i := 0; i < value.NumField(); i++ {
+		name := hsiFieldName(value.Type().Field(i))
+		if profileExcludedFields[name] && !value.Field(i).IsZero() {
+			errs.add("config."+name, "%s cannot be set by a service profile", name)
+		}
+	}
+	return errs
+}
+
+// getServiceProfile reads a service profile together with its etcd mod revision.
+// A nil profile means it does not exist.
+func (r *RestServer) getServiceProfile(ctx context.Context, name string) (*ServiceProfile, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, serviceProfileKey(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var profile ServiceProfile
+	if err := json.Unmarshal(resp.Kvs[0].Value, &profile); err != nil {
+		return nil, 0, err
+	}
+	return &profile, resp.Kvs[0].ModRevision, nil
+}
+
+// resolveHSIConfig returns the effective config of a subscriber config, the
+// fields overriding its profile and the mod revision of the profile, which is
+// zero for configs without a profile
+func (r *RestServer) resolveHSIConfig(ctx context.Context, config HSIConfig) (HSIConfig, []string, int64, *apiError) {
+	if config.Profile == "" {
+		return config, nil, 0, nil
+	}
+	profile, modRevision, err := r.getServiceProfile(ctx, config.Profile)
+	if err != nil {
+		return config, nil, 0, newAPIError(http.StatusInternalServerError, "Failed to get service profile")
+	}
+	if profile == nil {
+		return config, nil, 0, fieldErrors{{Field: "profile",
+			Message: fmt.Sprintf("Service profile %s does not exist", config.Profile)}}.apiError("HSI config")
+	}
+	effective, overrides := resolveProfile(profile, config)
+	return effective, overrides, modRevision, nil
+}
+
+// profileSubscriber is a stored HSI config referencing a service profile
+type profileSubscriber struct {
+	nodeId string
+	config HSIConfigWithMetadata
+}
+
+// listProfileSubscribers returns the HSI configs of all nodes using a profile,
+// ordered by node and user ID
+func (r *RestServer) listProfileSubscribers(ctx context.Context, name string) ([]profileSubscriber, error) {
+	resp, err := r.etcd.Client().Get(ctx, "configs/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var subscribers []profileSubscriber
+	for _, kv := range resp.Kvs {
+		// key format: configs/{nodeId}/hsi/{userId}
+		parts := strings.Split(string(kv.Key), "/")
+		if len(parts) != 4 || parts[2] != "hsi" {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			logrus.WithError(err).Warnf("Failed to parse HSI config %s", kv.Key)
+			continue
+		}
+		if config.Config.Profile == name {
+			subscribers = append(subscribers, profileSubscriber{nodeId: parts[1], config: config})
+		}
+	}
+	sort.SliceStable(subscribers, func(i, j int) bool {
+		if subscribers[i].nodeId != subscribers[j].nodeId {
+			return subscribers[i].nodeId < subscribers[j].nodeId
+		}
+		return lessUserId(subscribers[i].config.Config.UserID, subscribers[j].config.Config.UserID)
+	})
+	return subscribers, nil
+}
+
+// previewProfilePropagation resolves every subscriber of a profile against a
+// new version of it and validates the result
+func previewProfilePropagation(profile *ServiceProfile, subscribers []profileSubscriber) ([]ProfilePropagationResult, bool) {
+	results := make([]ProfilePropagationResult, 0, len(subscribers))
+	valid := true
+	for _, subscriber := range subscribers {
+		stored := subscriber.config.Config
+		effective, _ := resolveProfile(profile, inheritProfileFields(stored, subscriber.config.Metadata.Overrides))
+		result := ProfilePropagationResult{
+			NodeID:  subscriber.nodeId,
+			UserID:  stored.UserID,
+			Status:  PropagationPending,
+			Changes: diffHSIConfigs(&stored, &effective),
+		}
+		if apiErr := validateHSIConfig(effective).apiError("HSI config"); apiErr != nil {
+			result.Status = PropagationInvalid
+			result.Error, _ = apiErr.Body["error"].(string)
+			result.FieldErrors, _ = apiErr.Body["field_errors"].([]FieldError)
+			valid = false
+		} else if len(result.Changes) == 0 {
+			result.Status = PropagationUnchanged
+		}
+		results = append(results, result)
+	}
+	return results, valid
+}
+
+// propagateProfile rewrites the subscribers with pending changes so their
+// stored config follows the current profile. Overrides and passwords are kept,
+// and a subscriber modified since it was listed is reported as failed.
+func (r *RestServer) propagateProfile(ctx context.Context, subscribers []profileSubscriber, results []ProfilePropagationResult, username string) {
+	for i, subscriber := range subscribers {
+		if results[i].Status != PropagationPending {
+			continue
+		}
+		config := inheritProfileFields(subscriber.config.Config, subscriber.config.Metadata.Overrides)
+		config.Password = redactedValue
+		_, apiErr := r.writeHSIConfig(ctx, hsiWrite{
+			nodeId:   subscriber.nodeId,
+			config:   config,
+			username: username,
+			ifMatch:  subscriber.config.Metadata.ResourceVersion,
+		})
+		if apiErr != nil {
+			results[i].Status = PropagationFailed
+			results[i].Error, _ = apiErr.Body["error"].(string)
+			results[i].FieldErrors, _ = apiErr.Body["field_errors"].([]FieldError)
+			logrus.Warnf("Failed to propagate service profile to node %s, user %s: %v",
+				subscriber.nodeId, results[i].UserID, results[i].Error)
+			continue
+		}
+		results[i].Status = PropagationUpdated
+	}
+}
+
+// ListServiceProfiles returns all service profiles
+// @Summary      List service profiles
+// @Description  Get all HSI service profiles
+// @Tags         Service Profiles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   ServiceProfile
+// @Failure      500  {object}  ErrorResponse
+// @Router       /profiles [get]
+func (r *RestServer) ListServiceProfiles(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), serviceProfilesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get service profiles"})
+		return
+	}
+
+	profiles := []ServiceProfile{}
+	for _, kv := range resp.Kvs {
+		var profile ServiceProfile
+		if err := json.Unmarshal(kv.Value, &profile); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse service profile %s", kv.Key)
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+	c.JSON(http.StatusOK, profiles)
+}
+
+// GetServiceProfile returns a service profile
+// @Summary      Get service profile
+// @Description  Get an HSI service profile by name
+// @Tags         Service Profiles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        name  path      string  true  "Profile name"
+// @Success      200   {object}  ServiceProfile
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /profiles/{name} [get]
+func (r *RestServer) GetServiceProfile(c *gin.Context) {
+	profile, _, err := r.getServiceProfile(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get service profile"})
+		return
+	}
+	if profile == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service profile not found"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(profile.ResourceVersion))
+	c.JSON(http.StatusOK, profile)
+}
+
+// CreateServiceProfile creates a service profile
+// @Summary      Create service profile
+// @Description  Create a named template of HSI config fields. User ID, VLAN ID, account name and password
+// @Description  cannot be set by a profile. String values may use the {user_id} and {vlan_id} placeholders.
+// @Tags         Service Profiles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      ServiceProfileRequest  true  "Service profile"
+// @Success      201      {object}  ServiceProfile
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /profiles [post]
+func (r *RestServer) CreateServiceProfile(c *gin.Context) {
+	var req ServiceProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	profile := ServiceProfile{
+		Name:            req.Name,
+		Description:     req.Description,
+		Config:          req.Config,
+		ResourceVersion: "1",
+		UpdatedBy:       username,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if apiErr := validateServiceProfile(profile).apiError("service profile"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal service profile"})
+		return
+	}
+	key := serviceProfileKey(profile.Name)
+	txnResp, err := r.etcd.Client().Txn(c.Request.Context()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(profileJSON))).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save service profile"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Service profile already exists"})
+		return
+	}
+
+	logrus.Infof("Service profile %s created by %s", profile.Name, username)
+	c.Header("ETag", resourceVersionETag(profile.ResourceVersion))
+	c.JSON(http.StatusCreated, profile)
+}
+
+// UpdateServiceProfile replaces a service profile and propagates it to its subscribers
+// @Summary      Update service profile
+// @Description  Replace a service profile and rewrite the HSI config of every subscriber using it. Fields a
+// @Description  subscriber overrides are kept. With dry_run=true the per-subscriber changes are only previewed.
+// @Description  Nothing is written if the new profile would make any subscriber's config invalid.
+// @Tags         Service Profiles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        name       path      string                 true   "Profile name"
+// @Param        request    body      ServiceProfileRequest  true   "Service profile"
+// @Param        dry_run    query     bool                   false  "Preview the changes without writing"
+// @Param        propagate  query     bool                   false  "Rewrite subscribers using the profile, defaults to true"
+// @Param        If-Match   header    string                 false  "Expected current resource version"
+// @Success      200        {object}  ServiceProfileUpdateResponse
+// @Failure      400        {object}  ServiceProfileUpdateResponse
+// @Failure      404        {object}  ErrorResponse
+// @Failure      409        {object}  ErrorResponse
+// @Failure      500        {object}  ErrorResponse
+// @Router       /profiles/{name} [put]
+func (r *RestServer) UpdateServiceProfile(c *gin.Context) {
+	name := c.Param("name")
+	ctx := c.Request.Context()
+
+	var req ServiceProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Name != "" && req.Name != name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Profile name cannot be changed"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	propagate := c.DefaultQuery("propagate", "true") != "false"
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	existing, modRevision, err := r.getServiceProfile(ctx, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get service profile"})
+		return
+	}
+	if existing == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service profile not found"})
+		return
+	}
+	if ifMatch := parseIfMatch(c.GetHeader("If-Match")); ifMatch != "" && ifMatch != "*" && ifMatch != existing.ResourceVersion {
+		c.JSON(http.StatusConflict, gin.H{"error": "Service profile has been modified by another request", "current": existing})
+		return
+	}
+
+	profile := ServiceProfile{
+		Name:            name,
+		Description:     req.Description,
+		Config:          req.Config,
+		ResourceVersion: incrementResourceVersion(existing.ResourceVersion),
+		UpdatedBy:       username,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if apiErr := validateServiceProfile(profile).apiError("service profile"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	subscribers, err := r.listProfileSubscribers(ctx, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list subscribers of service profile"})
+		return
+	}
+	results, valid := previewProfilePropagation(&profile, subscribers)
+	response := ServiceProfileUpdateResponse{Profile: profile, DryRun: dryRun, Subscribers: results}
+	if dryRun {
+		response.Profile = *existing
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if !valid {
+		response.Profile = *existing
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal service profile"})
+		return
+	}
+	key := serviceProfileKey(name)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, string(profileJSON))).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save service profile"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Service profile has been modified by another request"})
+		return
+	}
+	response.Applied = true
+	logrus.Infof("Service profile %s updated by %s, version: %s", name, username, profile.ResourceVersion)
+
+	if propagate {
+		r.propagateProfile(ctx, subscribers, results, username)
+	}
+
+	c.Header("ETag", resourceVersionETag(profile.ResourceVersion))
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteServiceProfile removes a service profile that is no longer used
+// @Summary      Delete service profile
+// @Description  Delete a service profile. Profiles still referenced by an HSI config cannot be deleted.
+// @Tags         Service Profiles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        name  path      string  true  "Profile name"
+// @Success      200   {object}  MessageResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /profiles/{name} [delete]
+func (r *RestServer) DeleteServiceProfile(c *gin.Context) {
+	name := c.Param("name")
+	ctx := c.Request.Context()
+
+	subscribers, err := r.listProfileSubscribers(ctx, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list subscribers of service profile"})
+		return
+	}
+	if len(subscribers) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Service profile is used by %d subscribers", len(subscribers))})
+		return
+	}
+
+	resp, err := r.etcd.Client().Delete(ctx, serviceProfileKey(name))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete service profile"})
+		return
+	}
+	if resp.Deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service profile not found"})
+		return
+	}
+
+	logrus.Infof("Service profile %s deleted", name)
+	c.JSON(http.StatusOK, gin.H{"message": "Service profile deleted successfully"})
+}
+
+// GetEffectiveHSIConfig returns an HSI config resolved against its service profile
+// @Summary      Get effective HSI configuration
+// @Description  Resolve an HSI config against the current version of its service profile and list which
+// @Description  fields are overridden by the subscriber and which are inherited. DHCP options left empty
+// @Description  are filled from the node defaults. The password is masked.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  HSIEffectiveConfigResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/effective [get]
+func (r *RestServer) GetEffectiveHSIConfig(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	userId := c.Param("userId")
+	ctx := c.Request.Context()
+
+	stored, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config"})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
+		return
+	}
+
+	response := HSIEffectiveConfigResponse{
+		NodeID:    nodeId,
+		UserID:    userId,
+		Profile:   stored.Config.Profile,
+		Config:    stored.Config,
+		Overrides: []string{},
+		Inherited: []string{},
+		InSync:    true,
+	}
+	if stored.Config.Profile != "" {
+		profile, _, err := r.getServiceProfile(ctx, stored.Config.Profile)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get service profile"})
+			return
+		}
+		if profile != nil {
+			effective, overrides := resolveProfile(profile, inheritProfileFields(stored.Config, stored.Metadata.Overrides))
+			response.Config = effective
+			response.Overrides = overrides
+			response.InSync = len(diffHSIConfigs(&stored.Config, &effective)) == 0
+
+			overridden := make(map[string]bool, len(overrides))
+			for _, name := range overrides {
+				overridden[name] = true
+			}
+			template := reflect.ValueOf(profile.Config)
+			for i := 0; i < template.NumField(); i++ {
+				name := hsiFieldName(template.Type().Field(i))
+				if !profileExcludedFields[name] && !overridden[name] && !template.Field(i).IsZero() {
+					response.Inherited = append(response.Inherited, name)
+				}
+			}
+		} else {
+			response.InSync = false
+		}
+	}
+
+	defaults, _, err := r.getNodeDHCPDefaults(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node DHCP defaults"})
+		return
+	}
+	response.Config, response.NodeDefaults = applyNodeDHCPDefaults(response.Config, defaults.DHCPServerOptions)
+	response.Config.Password = maskSecret(response.Config.Password)
+	c.JSON(http.StatusOK, response)
+}
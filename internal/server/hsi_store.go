@@ -0,0 +1,500 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// hsiWriteRetries bounds how often a write is retried when the config or the
+// VLAN index changed between reading and committing
+const hsiWriteRetries = 3
+
+// HSIWriteResponse represents a successful HSI config write
+type HSIWriteResponse struct {
+	Message         string `json:"message" example:"HSI config updated successfully"`
+	ResourceVersion string `json:"resourceVersion" example:"2"`
+}
+
+// ConflictResponse represents a 409 response carrying the current stored object
+type ConflictResponse struct {
+	Error   string                `json:"error" example:"HSI config has been modified by another request"`
+	Current HSIConfigWithMetadata `json:"current"`
+}
+
+func hsiConfigKey(nodeId, userId string) string {
+	return fmt.Sprintf("configs/%s/hsi/%s", nodeId, userId)
+}
+
+// resourceVersionETag formats a resource version as a strong ETag
+func resourceVersionETag(resourceVersion string) string {
+	return fmt.Sprintf("%q", resourceVersion)
+}
+
+// parseIfMatch extracts the resource version from an If-Match header value.
+// An empty result means the header was absent and no precondition applies.
+func parseIfMatch(header string) string {
+	header = strings.TrimSpace(header)
+	header = strings.TrimPrefix(header, "W/")
+	return strings.Trim(header, `"`)
+}
+
+// ifMatchSatisfied reports whether the stored object satisfies an If-Match precondition
+func ifMatchSatisfied(ifMatch string, current *HSIConfigWithMetadata) bool {
+	if ifMatch == "" {
+		return true
+	}
+	if current == nil {
+		return false
+	}
+	return ifMatch == "*" || ifMatch == current.Metadata.ResourceVersion
+}
+
+// maskedHSIConfig returns a copy of a config that is safe to return from the API
+func maskedHSIConfig(config *HSIConfigWithMetadata) *HSIConfigWithMetadata {
+	if config == nil {
+		return nil
+	}
+	masked := *config
+	masked.Config.Password = maskSecret(masked.Config.Password)
+	return &masked
+}
+
+func conflictError(message string, current *HSIConfigWithMetadata) *apiError {
+	body := gin.H{"error": message}
+	if current != nil {
+		body["current"] = current
+	}
+	return &apiError{Status: http.StatusConflict, Body: body}
+}
+
+// loadHSIConfig reads an HSI config together with its etcd mod revision, with
+// its secrets decrypted. A nil config with a zero revision means the config
+// does not exist.
+func (r *RestServer) loadHSIConfig(ctx context.Context, nodeId, userId string) (*HSIConfigWithMetadata, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, hsiConfigKey(nodeId, userId))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	var configWithMetadata HSIConfigWithMetadata
+	if err := json.Unmarshal(resp.Kvs[0].Value, &configWithMetadata); err != nil {
+		return nil, 0, err
+	}
+	if err := r.openHSIConfig(&configWithMetadata.Config); err != nil {
+		return nil, 0, err
+	}
+	return &configWithMetadata, resp.Kvs[0].ModRevision, nil
+}
+
+// saveHSIConfig validates and stores an HSI config. Creating a config resets
+// its enable status to disabled, updating keeps the current status. A non-empty
+// ifMatch must equal the stored resource version. The VLAN is reserved in the
+// VLAN index in the same transaction, which only commits if neither the config
+// nor the index entry changed since they were read, so concurrent writers can
+// neither overwrite each other nor claim the same VLAN. A config created
+// without user ID or VLAN gets the lowest free ones of the node.
+func (r *RestServer) saveHSIConfig(ctx context.Context, nodeId string, config HSIConfig, username string, create bool, ifMatch string) (*HSIConfigWithMetadata, *apiError) {
+	return r.writeHSIConfig(ctx, hsiWrite{
+		nodeId:     nodeId,
+		config:     config,
+		username:   username,
+		create:     create,
+		ifMatch:    ifMatch,
+		autoUserID: create && config.UserID == "",
+		autoVlan:   create && config.VlanID == "",
+	})
+}
+
+// hsiWrite describes a write of an HSI config
+type hsiWrite struct {
+	nodeId   string
+	config   HSIConfig
+	username string
+	create   bool
+	ifMatch  string
+	// rollbackOf is the resource version whose content is being restored
+	rollbackOf string
+	// autoUserID and autoVlan pick the lowest free user ID and VLAN on every attempt
+	autoUserID bool
+	autoVlan   bool
+	// ipamTakeover is the subscriber whose LAN subnet the config takes over
+	ipamTakeover *subscriberRef
+}
+
+// hsiWritePlan is the transaction writing an HSI config and recording its
+// revision, together with the config as stored and the one it replaces
+type hsiWritePlan struct {
+	cmps     []clientv3.Cmp
+	ops      []clientv3.Op
+	result   *HSIConfigWithMetadata
+	existing *HSIConfigWithMetadata
+}
+
+// writeHSIConfig implements saveHSIConfig and records the change as a new
+// revision in the same transaction
+func (r *RestServer) writeHSIConfig(ctx context.Context, w hsiWrite) (*HSIConfigWithMetadata, *apiError) {
+	nodeId, username, create := w.nodeId, w.username, w.create
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		plan, apiErr := r.planHSIWrite(ctx, w, nil)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		if plan == nil {
+			continue
+		}
+		config := plan.result.Config
+
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(plan.cmps...).
+			Then(plan.ops...).
+			Commit()
+		if err != nil {
+			if create {
+				return nil, newAPIError(http.StatusInternalServerError, "Failed to save HSI config")
+			}
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to update HSI config")
+		}
+		if !txnResp.Succeeded {
+			logrus.Infof("HSI config, VLAN index, VLAN mode, NIC capacity, IPAM, IPTV services or service profile of node %s changed while writing user %s, retrying", nodeId, config.UserID)
+			continue
+		}
+
+		if create {
+			logrus.Infof("HSI config created for node %s, user: %s, version: %s, by: %s",
+				nodeId, config.UserID, plan.result.Metadata.ResourceVersion, username)
+		} else {
+			logrus.Infof("HSI config updated for node %s, user: %s, version: %s, by: %s",
+				nodeId, config.UserID, plan.result.Metadata.ResourceVersion, username)
+		}
+		return plan.result, nil
+	}
+
+	if w.autoUserID {
+		return nil, newAPIError(http.StatusConflict, "User IDs of the node have been modified by other requests")
+	}
+	current, _, _ := r.loadHSIConfig(ctx, nodeId, w.config.UserID)
+	return nil, conflictError("HSI config has been modified by another request", maskedHSIConfig(current))
+}
+
+// planHSIWrite runs the checks of an HSI config write and prepares its
+// transaction, which only commits if nothing it depends on changed. IPAM is
+// read unless a state is passed, which is then updated with the subnet of the
+// config so several writes can share one transaction. A nil plan without an
+// error means the picked user ID or VLAN was taken meanwhile, the write has to
+// be planned again.
+func (r *RestServer) planHSIWrite(ctx context.Context, w hsiWrite, ipam *ipamState) (*hsiWritePlan, *apiError) {
+	nodeId, username, create, ifMatch := w.nodeId, w.username, w.create, w.ifMatch
+	request := w.config
+	if w.autoUserID {
+		slot, apiErr := r.freeUserSlot(ctx, nodeId)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		request.UserID = slot
+	}
+	userId := request.UserID
+	if apiErr := r.checkUserIdInRange(ctx, nodeId, userId); apiErr != nil {
+		return nil, apiErr
+	}
+	etcdKey := hsiConfigKey(nodeId, userId)
+
+	// The VLAN is picked before the profile is resolved, so {vlan_id}
+	// expands to it
+	if w.autoVlan {
+		vid, apiErr := r.freeVlan(ctx, nodeId, request)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		request.VlanID = strconv.Itoa(vid)
+	}
+	// Resolve the service profile on every attempt, the transaction
+	// only commits if the profile did not change in between
+	config, overrides, profileRevision, apiErr := r.resolveHSIConfig(ctx, request)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	shared := ipam != nil
+	if !shared {
+		var err error
+		if ipam, err = r.loadIPAM(ctx); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocations")
+		}
+	}
+	if w.ipamTakeover != nil {
+		ipam.release(w.ipamTakeover.nodeId, w.ipamTakeover.userId)
+	}
+	// A config without LAN settings gets a subnet from the node's supernets
+	if needsIPAMSubnet(config) {
+		if allocation, ok := ipam.allocate(nodeId, userId); ok {
+			applyIPAMAllocation(&config, allocation)
+		}
+	}
+	if apiErr := validateHSIConfig(config).apiError("HSI config"); apiErr != nil {
+		return nil, apiErr
+	}
+	config.DHCPReservations = normalizeDHCPReservations(config.DHCPReservations)
+	config.OuterTPID = strings.ToLower(config.OuterTPID)
+
+	existing, modRevision, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get current HSI config")
+	}
+	if create && existing != nil && w.autoUserID {
+		// The slot was taken since it was picked
+		return nil, nil
+	}
+	if create && existing != nil {
+		return nil, conflictError("HSI config already exists", maskedHSIConfig(existing))
+	}
+	if !create && existing == nil {
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	if !ifMatchSatisfied(ifMatch, existing) {
+		return nil, conflictError("HSI config has been modified by another request", maskedHSIConfig(existing))
+	}
+
+	// A masked password, as returned by the API, keeps the stored one
+	if config.Password == redactedValue {
+		if existing == nil {
+			return nil, fieldErrors{{Field: "password", Message: "Password must not be the masked value"}}.apiError("HSI config")
+		}
+		config.Password = existing.Config.Password
+	}
+
+	// Port-forward rules must keep pointing into the subscriber's subnet
+	if existing != nil && (existing.Config.DHCPSubnet != config.DHCPSubnet || existing.Config.DHCPGateway != config.DHCPGateway) {
+		if apiErr := r.checkNATRulesInSubnet(ctx, nodeId, userId, config); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+
+	vlanModeRevision, apiErr := r.checkVlanMode(ctx, nodeId, config)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	capacityRevision, apiErr := r.checkQoSCapacity(ctx, nodeId, config)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	ipamCmps, ipamOps, apiErr := ipam.assignOps(nodeId, config)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// Check if VLAN is already in use by another user
+	tag, _ := hsiVlanTag(config)
+	owner, indexRevision, err := r.getVlanOwner(ctx, nodeId, tag)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if owner != "" && owner != config.UserID && w.autoVlan {
+		// The VLAN was taken since it was picked
+		return nil, nil
+	}
+	if owner != "" && owner != config.UserID {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Input VLAN has been already used by other user: %s", owner))
+	}
+	// Multicast VLANs are single-tagged, they can only clash with the
+	// outer tag of a QinQ subscriber or the VLAN of a single-tagged one
+	var multicastCmps []clientv3.Cmp
+	if existing == nil || existing.Config.VlanID != config.VlanID || existing.Config.OuterVlanID != config.OuterVlanID {
+		wireVid := tag.inner
+		if tag.outer != 0 {
+			wireVid = tag.outer
+		}
+		iptvUser, iptvCmp, err := r.multicastVlanUser(ctx, nodeId, wireVid)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+		}
+		if iptvUser != "" {
+			return nil, newAPIError(http.StatusConflict,
+				fmt.Sprintf("Input VLAN is used as multicast VLAN by the IPTV service of user: %s", iptvUser))
+		}
+		multicastCmps = append(multicastCmps, iptvCmp)
+	}
+
+	resourceVersion := "1"
+	enableStatus := "disabled"
+	if existing != nil {
+		resourceVersion = incrementResourceVersion(existing.Metadata.ResourceVersion)
+		enableStatus = existing.Metadata.EnableStatus
+	} else {
+		last, err := r.lastHSIResourceVersion(ctx, nodeId, config.UserID)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config history")
+		}
+		if last != "" {
+			resourceVersion = incrementResourceVersion(last)
+		}
+	}
+
+	stored, err := r.sealHSIConfig(config)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to encrypt HSI config secrets")
+	}
+
+	// Create config with metadata
+	configWithMetadata := HSIConfigWithMetadata{
+		Config: config,
+	}
+	configWithMetadata.Metadata.Node = nodeId
+	configWithMetadata.Metadata.ResourceVersion = resourceVersion
+	configWithMetadata.Metadata.UpdatedBy = username
+	configWithMetadata.Metadata.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	configWithMetadata.Metadata.EnableStatus = enableStatus
+	configWithMetadata.Metadata.Overrides = overrides
+
+	// The password is stored encrypted, nodes receive it in clear text
+	// only in the dial commands
+	storedWithMetadata := configWithMetadata
+	storedWithMetadata.Config = stored
+	configJSON, err := json.Marshal(storedWithMetadata)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal config")
+	}
+
+	revision := HSIRevision{
+		ResourceVersion: resourceVersion,
+		Action:          RevisionActionUpdate,
+		RollbackOf:      w.rollbackOf,
+		UpdatedBy:       username,
+		UpdatedAt:       configWithMetadata.Metadata.UpdatedAt,
+		Config:          &stored,
+		Overrides:       overrides,
+	}
+	var previous *HSIConfig
+	if existing != nil {
+		previous = &existing.Config
+	}
+	revision.Changes = diffHSIConfigs(previous, &config)
+	switch {
+	case w.rollbackOf != "":
+		revision.Action = RevisionActionRollback
+	case create:
+		revision.Action = RevisionActionCreate
+	}
+	revisionCmp, revisionOp, err := putRevisionOps(nodeId, config.UserID, revision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal config revision")
+	}
+
+	// Reserve the VLAN in the same transaction and release the previous one
+	ops := []clientv3.Op{
+		clientv3.OpPut(etcdKey, string(configJSON)),
+		clientv3.OpPut(vlanIndexKey(nodeId, tag), config.UserID),
+		revisionOp,
+	}
+	ops = append(ops, ipamOps...)
+	if existing != nil {
+		if oldTag, err := hsiVlanTag(existing.Config); err == nil && oldTag != tag {
+			ops = append(ops, releaseVlanOp(nodeId, oldTag, config.UserID))
+		}
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision),
+		clientv3.Compare(clientv3.ModRevision(vlanIndexKey(nodeId, tag)), "=", indexRevision),
+		clientv3.Compare(clientv3.ModRevision(nodeVlanModeKey(nodeId)), "=", vlanModeRevision),
+		clientv3.Compare(clientv3.ModRevision(nicCapacityKey(nodeId)), "=", capacityRevision),
+		revisionCmp,
+	}
+	cmps = append(cmps, ipamCmps...)
+	cmps = append(cmps, multicastCmps...)
+	if config.Profile != "" {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(serviceProfileKey(config.Profile)), "=", profileRevision))
+	}
+
+	if shared {
+		ipam.apply(nodeId, config)
+	}
+	return &hsiWritePlan{cmps: cmps, ops: ops, result: &configWithMetadata, existing: existing}, nil
+}
+
+// deleteHSIConfig removes an HSI config together with its NAT rules, IPTV
+// service, SNAT port block and IPAM subnet if it still satisfies the If-Match
+// precondition and records the deletion as a revision
+func (r *RestServer) deleteHSIConfig(ctx context.Context, nodeId, userId, ifMatch, username string) *apiError {
+	existing, modRevision, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to check HSI config")
+	}
+	if existing == nil {
+		return newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	if !ifMatchSatisfied(ifMatch, existing) {
+		return conflictError("HSI config has been modified by another request", maskedHSIConfig(existing))
+	}
+
+	cmps, ops, err := hsiDeleteOps(nodeId, userId, existing, modRevision, username)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to marshal config revision")
+	}
+	snatCmps, snatOps, err := r.snatReleaseOps(ctx, nodeId, userId)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get SNAT allocation")
+	}
+	cmps, ops = append(cmps, snatCmps...), append(ops, snatOps...)
+	ipamCmps, ipamOps, err := r.ipamReleaseOps(ctx, nodeId, existing.Config)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocation")
+	}
+	cmps, ops = append(cmps, ipamCmps...), append(ops, ipamOps...)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(cmps...).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to delete HSI config")
+	}
+	if !txnResp.Succeeded {
+		current, _, _ := r.loadHSIConfig(ctx, nodeId, userId)
+		return conflictError("HSI config has been modified by another request", maskedHSIConfig(current))
+	}
+
+	logrus.Infof("HSI config deleted for node %s, user: %s", nodeId, userId)
+	return nil
+}
+
+// hsiDeleteOps returns the transaction deleting a loaded HSI config, its NAT
+// rules, IPTV service and ACL, which only commits if the config is unchanged
+func hsiDeleteOps(nodeId, userId string, existing *HSIConfigWithMetadata, modRevision int64, username string) ([]clientv3.Cmp, []clientv3.Op, error) {
+	revisionCmp, revisionOp, err := putRevisionOps(nodeId, userId, HSIRevision{
+		ResourceVersion: incrementResourceVersion(existing.Metadata.ResourceVersion),
+		Action:          RevisionActionDelete,
+		UpdatedBy:       username,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+		Changes:         diffHSIConfigs(&existing.Config, nil),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	etcdKey := hsiConfigKey(nodeId, userId)
+	// Port-forward rules, the IPTV service and the ACL depend on the subscriber's HSI config and go with it
+	ops := []clientv3.Op{
+		clientv3.OpDelete(etcdKey),
+		revisionOp,
+		clientv3.OpDelete(natRulePrefix(nodeId, userId), clientv3.WithPrefix()),
+		clientv3.OpDelete(iptvConfigKey(nodeId, userId)),
+		clientv3.OpDelete(aclKey(nodeId, userId)),
+	}
+	if tag, err := hsiVlanTag(existing.Config); err == nil {
+		ops = append(ops, releaseVlanOp(nodeId, tag, userId))
+	}
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision), revisionCmp}
+	return cmps, ops, nil
+}
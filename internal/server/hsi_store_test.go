@@ -0,0 +1,119 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteHSIConfigRetriesConcurrentUpdates(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() create error = %v", apiErr.Body)
+	}
+
+	// Every writer loses at most once to each of the others, so all of
+	// them commit within hsiWriteRetries attempts
+	const writers = hsiWriteRetries
+	var wg sync.WaitGroup
+	errs := make([]*apiError, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			config := testHSIConfig("1", "100")
+			config.AccountName = "writer" + strconv.Itoa(i)
+			_, errs[i] = r.saveHSIConfig(ctx, "node1", config, "admin", false, "")
+		}(i)
+	}
+	wg.Wait()
+	for i, apiErr := range errs {
+		if apiErr != nil {
+			t.Errorf("writer %d error = %v", i, apiErr.Body)
+		}
+	}
+
+	stored, _, err := r.loadHSIConfig(ctx, "node1", "1")
+	if err != nil || stored == nil {
+		t.Fatalf("loadHSIConfig() = %v, %v", stored, err)
+	}
+	if want := "4"; stored.Metadata.ResourceVersion != want {
+		t.Errorf("resource version = %s, want %s", stored.Metadata.ResourceVersion, want)
+	}
+}
+
+func TestWriteHSIConfigAutoAssignConcurrent(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	putTestJSON(t, r, nodeVlanRangeKey("node1"), `{"node":"node1","start":100,"end":199}`)
+
+	const writers = hsiWriteRetries
+	var wg sync.WaitGroup
+	results := make([]*HSIConfigWithMetadata, writers)
+	errs := make([]*apiError, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = r.saveHSIConfig(ctx, "node1", testHSIConfig("", ""), "admin", true, "")
+		}(i)
+	}
+	wg.Wait()
+
+	users, vlans := make(map[string]bool), make(map[string]bool)
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("writer %d error = %v", i, errs[i].Body)
+		}
+		users[results[i].Config.UserID] = true
+		vlans[results[i].Config.VlanID] = true
+	}
+	if len(users) != writers || len(vlans) != writers {
+		t.Errorf("got user IDs %v and VLANs %v, want %d distinct each", users, vlans, writers)
+	}
+	for vlan := range vlans {
+		vid, _ := strconv.Atoi(vlan)
+		owner, _, err := r.getVlanOwner(ctx, "node1", vlanTag{inner: vid})
+		if err != nil || owner == "" {
+			t.Errorf("VLAN %s has no owner in the index (%v)", vlan, err)
+		}
+	}
+}
+
+func TestWriteHSIConfigIfMatch(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+
+	created, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, "")
+	if apiErr != nil {
+		t.Fatalf("saveHSIConfig() create error = %v", apiErr.Body)
+	}
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr == nil || apiErr.Status != http.StatusConflict {
+		t.Errorf("second create error = %v, want %d", apiErr, http.StatusConflict)
+	}
+
+	updated, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "101"), "admin", false, created.Metadata.ResourceVersion)
+	if apiErr != nil {
+		t.Fatalf("saveHSIConfig() update error = %v", apiErr.Body)
+	}
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "102"), "admin", false, created.Metadata.ResourceVersion); apiErr == nil || apiErr.Status != http.StatusConflict {
+		t.Errorf("stale If-Match error = %v, want %d", apiErr, http.StatusConflict)
+	}
+
+	// The VLAN moved, the old one is released
+	if owner, _, _ := r.getVlanOwner(ctx, "node1", vlanTag{inner: 100}); owner != "" {
+		t.Errorf("VLAN 100 owner = %q, want released", owner)
+	}
+	if owner, _, _ := r.getVlanOwner(ctx, "node1", vlanTag{inner: 101}); owner != "1" {
+		t.Errorf("VLAN 101 owner = %q, want 1", owner)
+	}
+	if updated.Metadata.ResourceVersion != "2" {
+		t.Errorf("resource version = %s, want 2", updated.Metadata.ResourceVersion)
+	}
+}
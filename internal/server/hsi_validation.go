@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MinVlanID = 1
+	MaxVlanID = 4094
+)
+
+// IPv6 WAN modes. The WAN address is negotiated with IPv6CP on the PPPoE
+// session in both enabled modes; dhcpv6_pd also requests a delegated prefix
+// for the LAN.
+const (
+	IPv6WANDisabled = "disabled"
+	IPv6WANSLAAC    = "slaac"
+	IPv6WANDHCPv6PD = "dhcpv6_pd"
+)
+
+// IPv6 LAN address assignment modes
+const (
+	IPv6LANSLAAC          = "slaac"
+	IPv6LANDHCPv6Stateful = "dhcpv6_stateful"
+)
+
+const (
+	MinIPv6PDLength         = 32
+	MaxIPv6PDLength         = 64
+	MaxIPv6DNSServers       = 3
+	DefaultIPv6LANPrefixLen = 64
+)
+
+// FieldError describes a validation failure of a single request field
+type FieldError struct {
+	Field   string `json:"field" example:"vlan_id"`
+	Message string `json:"message" example:"VLAN ID must be between 1 and 4094"`
+}
+
+// ValidationErrorResponse represents a validation error response with per-field details
+type ValidationErrorResponse struct {
+	Error       string       `json:"error" example:"Invalid HSI config: VLAN ID must be between 1 and 4094"`
+	FieldErrors []FieldError `json:"field_errors"`
+}
+
+type fieldErrors []FieldError
+
+func (e *fieldErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// has reports whether a field already failed validation, so dependent checks can be skipped
+func (e fieldErrors) has(field string) bool {
+	for _, fe := range e {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// apiError converts the field errors to a 400 response, or nil if there are none.
+// The first failure is repeated in the error message for clients that only show it.
+func (e fieldErrors) apiError(what string) *apiError {
+	if len(e) == 0 {
+		return nil
+	}
+	return &apiError{
+		Status: http.StatusBadRequest,
+		Body: gin.H{
+			"error":        fmt.Sprintf("Invalid %s: %s", what, e[0].Message),
+			"field_errors": []FieldError(e),
+		},
+	}
+}
+
+// validateVlanID checks that a VLAN ID is a number between 1 and 4094
+func validateVlanID(errs *fieldErrors, field, vlanId string) {
+	vid, err := strconv.Atoi(vlanId)
+	if err != nil {
+		errs.add(field, "VLAN ID must be a number")
+		return
+	}
+	if vid < MinVlanID || vid > MaxVlanID {
+		errs.add(field, "VLAN ID must be between %d and %d", MinVlanID, MaxVlanID)
+	}
+}
+
+// validateHSIConfig checks required fields and the semantic consistency of the
+// VLAN and DHCP settings of an HSI config
+func validateHSIConfig(config HSIConfig) fieldErrors {
+	var errs fieldErrors
+
+	if config.UserID == "" {
+		errs.add("user_id", "User ID is required")
+	} else if strings.Contains(config.UserID, "/") {
+		errs.add("user_id", "User ID must not contain '/'")
+	}
+	if config.VlanID == "" {
+		errs.add("vlan_id", "VLAN ID is required")
+	} else {
+		validateVlanID(&errs, "vlan_id", config.VlanID)
+	}
+	validateOuterVlan(&errs, config)
+	if config.DHCPAddrPool == "" {
+		errs.add("dhcp_addr_pool", "DHCP Address Pool is required")
+	}
+	if config.DHCPSubnet == "" {
+		errs.add("dhcp_subnet", "DHCP Subnet is required")
+	}
+	if config.DHCPGateway == "" {
+		errs.add("dhcp_gateway", "DHCP Gateway is required")
+	}
+
+	validateWANSettings(&errs, config)
+	validatePPPoEOptions(&errs, config)
+	validateQoSSettings(&errs, config)
+	validateDHCPSettings(&errs, config)
+	validateDHCPReservations(&errs, config)
+	validateDHCPServerOptions(&errs, hsiDHCPOptions(config))
+	validateIPv6Settings(&errs, config)
+
+	return errs
+}
+
+// validateDHCPSettings checks that the gateway and the address pool lie inside
+// the subnet implied by the gateway and DHCPSubnet, and that the gateway is
+// not handed out by the pool
+func validateDHCPSettings(errs *fieldErrors, config HSIConfig) {
+	var (
+		mask    net.IPMask
+		gateway netip.Addr
+	)
+
+	if config.DHCPSubnet != "" {
+		var err error
+		if mask, err = utils.ParseIPv4Netmask(config.DHCPSubnet); err != nil {
+			errs.add("dhcp_subnet", "DHCP Subnet must be a valid netmask, e.g. 255.255.255.0")
+		} else if ones, _ := mask.Size(); ones < 8 || ones > 30 {
+			errs.add("dhcp_subnet", "DHCP Subnet prefix length must be between /8 and /30")
+			mask = nil
+		}
+	}
+
+	if config.DHCPGateway != "" {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(config.DHCPGateway)); err != nil || !addr.Unmap().Is4() {
+			errs.add("dhcp_gateway", "DHCP Gateway must be a valid IPv4 address")
+		} else {
+			gateway = addr.Unmap()
+		}
+	}
+
+	var poolStart, poolEnd netip.Addr
+	if config.DHCPAddrPool != "" {
+		start, end, err := utils.ParseAddrRange(config.DHCPAddrPool)
+		if err != nil {
+			errs.add("dhcp_addr_pool", "DHCP Address Pool must be in the form <start IP>-<end IP>")
+		} else if !start.Is4() || !end.Is4() {
+			errs.add("dhcp_addr_pool", "DHCP Address Pool must contain IPv4 addresses")
+		} else if start.Compare(end) > 0 {
+			errs.add("dhcp_addr_pool", "DHCP Address Pool start must not be greater than its end")
+		} else {
+			poolStart, poolEnd = start, end
+		}
+	}
+
+	// The remaining checks need a valid netmask and gateway to derive the subnet
+	if mask == nil || !gateway.IsValid() {
+		return
+	}
+	ones, _ := mask.Size()
+	subnet := netip.PrefixFrom(gateway, ones).Masked()
+	network, broadcast := subnet.Addr(), utils.PrefixLastAddr(subnet)
+
+	if gateway == network || gateway == broadcast {
+		errs.add("dhcp_gateway", "DHCP Gateway must not be the network or broadcast address of %s", subnet.String())
+	}
+
+	if !poolStart.IsValid() {
+		return
+	}
+	if poolStart.Compare(network) <= 0 || poolEnd.Compare(broadcast) >= 0 {
+		errs.add("dhcp_addr_pool", "DHCP Address Pool must be inside subnet %s, excluding network and broadcast addresses", subnet.String())
+	} else if utils.AddrInRange(gateway, poolStart, poolEnd) && !errs.has("dhcp_gateway") {
+		errs.add("dhcp_gateway", "DHCP Gateway must not be inside the DHCP Address Pool")
+	}
+}
+
+// validateIPv6Settings checks the optional IPv6 settings. LAN settings need a
+// prefix delegated on the WAN, and the LAN prefix must fit into it.
+func validateIPv6Settings(errs *fieldErrors, config HSIConfig) {
+	lanFields := []struct{ name, value string }{
+		{"ipv6_pd_length", config.IPv6PDLength},
+		{"ipv6_lan_prefix_len", config.IPv6LANPrefixLen},
+		{"ipv6_lan_mode", config.IPv6LANMode},
+		{"ipv6_dhcp_addr_pool", config.IPv6DHCPAddrPool},
+		{"ipv6_dns", config.IPv6DNS},
+	}
+
+	switch config.IPv6WANMode {
+	case IPv6WANDHCPv6PD:
+	case "", IPv6WANDisabled, IPv6WANSLAAC:
+		for _, field := range lanFields {
+			if field.value != "" {
+				errs.add(field.name, "%s requires ipv6_wan_mode %s", field.name, IPv6WANDHCPv6PD)
+			}
+		}
+		return
+	default:
+		errs.add("ipv6_wan_mode", "IPv6 WAN mode must be one of %s, %s or %s", IPv6WANDisabled, IPv6WANSLAAC, IPv6WANDHCPv6PD)
+		return
+	}
+
+	pdLength := MinIPv6PDLength
+	if config.IPv6PDLength != "" {
+		n, err := strconv.Atoi(config.IPv6PDLength)
+		if err != nil || n < MinIPv6PDLength || n > MaxIPv6PDLength {
+			errs.add("ipv6_pd_length", "IPv6 PD length must be a number between %d and %d", MinIPv6PDLength, MaxIPv6PDLength)
+		} else {
+			pdLength = n
+		}
+	}
+
+	lanPrefixLen := DefaultIPv6LANPrefixLen
+	if config.IPv6LANPrefixLen != "" {
+		n, err := strconv.Atoi(config.IPv6LANPrefixLen)
+		if err != nil || n < MinIPv6PDLength || n > MaxIPv6PDLength {
+			errs.add("ipv6_lan_prefix_len", "IPv6 LAN prefix length must be a number between %d and %d", MinIPv6PDLength, MaxIPv6PDLength)
+		} else {
+			lanPrefixLen = n
+		}
+	}
+	if !errs.has("ipv6_pd_length") && !errs.has("ipv6_lan_prefix_len") && lanPrefixLen < pdLength {
+		errs.add("ipv6_lan_prefix_len", "IPv6 LAN prefix /%d does not fit into the delegated prefix /%d", lanPrefixLen, pdLength)
+	}
+
+	switch config.IPv6LANMode {
+	case "":
+		errs.add("ipv6_lan_mode", "IPv6 LAN mode is required with ipv6_wan_mode %s", IPv6WANDHCPv6PD)
+	case IPv6LANSLAAC:
+		if lanPrefixLen != 64 && !errs.has("ipv6_lan_prefix_len") {
+			errs.add("ipv6_lan_prefix_len", "SLAAC requires a /64 LAN prefix")
+		}
+		if config.IPv6DHCPAddrPool != "" {
+			errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool is only used with ipv6_lan_mode %s", IPv6LANDHCPv6Stateful)
+		}
+	case IPv6LANDHCPv6Stateful:
+		if config.IPv6DHCPAddrPool == "" {
+			errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool is required with ipv6_lan_mode %s", IPv6LANDHCPv6Stateful)
+		} else if !errs.has("ipv6_lan_prefix_len") {
+			validateIPv6Pool(errs, config.IPv6DHCPAddrPool, lanPrefixLen)
+		}
+	default:
+		errs.add("ipv6_lan_mode", "IPv6 LAN mode must be %s or %s", IPv6LANSLAAC, IPv6LANDHCPv6Stateful)
+	}
+
+	if config.IPv6DNS != "" {
+		servers := strings.Split(config.IPv6DNS, ",")
+		if len(servers) > MaxIPv6DNSServers {
+			errs.add("ipv6_dns", "At most %d IPv6 DNS servers are allowed", MaxIPv6DNSServers)
+		}
+		for _, server := range servers {
+			ip := net.ParseIP(strings.TrimSpace(server))
+			if ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() && !ip.IsLinkLocalUnicast() {
+				errs.add("ipv6_dns", "IPv6 DNS server %q must be a unicast IPv6 address", strings.TrimSpace(server))
+				break
+			}
+		}
+	}
+}
+
+// validateIPv6Pool checks a stateful DHCPv6 pool given as a range of interface
+// identifiers, e.g. ::1000-::1fff, which the node combines with the LAN prefix
+func validateIPv6Pool(errs *fieldErrors, pool string, lanPrefixLen int) {
+	start, end, err := utils.ParseAddrRange(pool)
+	if err != nil || start.Is4() || end.Is4() {
+		errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool must be in the form <start IPv6>-<end IPv6>, e.g. ::1000-::1fff")
+		return
+	}
+	if _, err := utils.AddrRangeSize(start, end); err != nil {
+		errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool start must not be greater than its end")
+		return
+	}
+	zero := netip.IPv6Unspecified()
+	if netip.PrefixFrom(start, lanPrefixLen).Masked().Addr() != zero || netip.PrefixFrom(end, lanPrefixLen).Masked().Addr() != zero {
+		errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool must only set the lower %d bits of a /%d LAN prefix", 128-lanPrefixLen, lanPrefixLen)
+	} else if start == zero {
+		errs.add("ipv6_dhcp_addr_pool", "IPv6 DHCP Address Pool must not contain the subnet-router anycast address")
+	}
+}
@@ -0,0 +1,771 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Subscriber LAN subnets are bounded like DHCPSubnet
+const (
+	MinIPAMPrefixLength     = 8
+	MaxIPAMPrefixLength     = 30
+	DefaultIPAMSubnetLength = 24
+)
+
+const (
+	ipamPrefix            = "ipam/"
+	ipamSupernetsPrefix   = "ipam/supernets/"
+	ipamAllocationsPrefix = "ipam/allocations/"
+)
+
+var ipamSupernetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// IPAMSupernet is an IPv4 range subscriber LAN subnets are allocated from,
+// either for one node or, without a node ID, for all nodes of the site
+type IPAMSupernet struct {
+	Name   string `json:"name" example:"site-a"`
+	Prefix string `json:"prefix" example:"10.16.0.0/16"`
+	// SubnetLength is the prefix length of the subnets allocated to subscribers
+	SubnetLength int    `json:"subnet_length" example:"24"`
+	NodeID       string `json:"node_id,omitempty" example:"node001"`
+	UpdatedBy    string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt    string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// IPAMSupernetResponse reports a supernet with its capacity and usage
+type IPAMSupernetResponse struct {
+	IPAMSupernet
+	TotalSubnets     int `json:"total_subnets" example:"256"`
+	AllocatedSubnets int `json:"allocated_subnets" example:"12"`
+}
+
+// IPAMAllocation is a subscriber LAN subnet inside a supernet
+type IPAMAllocation struct {
+	Prefix      string `json:"prefix" example:"10.16.3.0/24"`
+	Supernet    string `json:"supernet" example:"site-a"`
+	NodeID      string `json:"node_id" example:"node001"`
+	UserID      string `json:"user_id" example:"2"`
+	Gateway     string `json:"gateway" example:"10.16.3.1"`
+	AddrPool    string `json:"addr_pool" example:"10.16.3.2-10.16.3.254"`
+	AllocatedAt string `json:"allocatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// IPAMOverlap reports two HSI configs whose LAN subnets overlap
+type IPAMOverlap struct {
+	NodeID      string `json:"node_id" example:"node001"`
+	UserID      string `json:"user_id" example:"2"`
+	Subnet      string `json:"subnet" example:"10.16.3.0/24"`
+	OtherNodeID string `json:"other_node_id" example:"node002"`
+	OtherUserID string `json:"other_user_id" example:"7"`
+	OtherSubnet string `json:"other_subnet" example:"10.16.3.128/25"`
+	// Managed is true if one of the subnets lies inside a supernet
+	Managed bool `json:"managed" example:"true"`
+}
+
+func ipamSupernetKey(name string) string {
+	return ipamSupernetsPrefix + name
+}
+
+// ipamAllocationKey is unique as allocated subnets never overlap
+func ipamAllocationKey(prefix netip.Prefix) string {
+	return ipamAllocationsPrefix + prefix.Masked().Addr().String()
+}
+
+// hsiLANPrefix returns the LAN subnet of an HSI config, derived from the
+// gateway and DHCPSubnet
+func hsiLANPrefix(config HSIConfig) (netip.Prefix, bool) {
+	mask, err := utils.ParseIPv4Netmask(config.DHCPSubnet)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	gateway, err := netip.ParseAddr(strings.TrimSpace(config.DHCPGateway))
+	if err != nil || !gateway.Unmap().Is4() {
+		return netip.Prefix{}, false
+	}
+	ones, _ := mask.Size()
+	return netip.PrefixFrom(gateway.Unmap(), ones).Masked(), true
+}
+
+// needsIPAMSubnet reports whether a config leaves its LAN subnet to IPAM
+func needsIPAMSubnet(config HSIConfig) bool {
+	return config.DHCPAddrPool == "" && config.DHCPSubnet == "" && config.DHCPGateway == ""
+}
+
+// applyIPAMAllocation fills in the LAN settings of a config from an allocation
+func applyIPAMAllocation(config *HSIConfig, allocation *IPAMAllocation) {
+	prefix := netip.MustParsePrefix(allocation.Prefix)
+	config.DHCPSubnet = net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+	config.DHCPGateway = allocation.Gateway
+	config.DHCPAddrPool = allocation.AddrPool
+}
+
+// ipamState is a consistent view of all supernets and allocations
+type ipamState struct {
+	supernets   []IPAMSupernet
+	allocations []IPAMAllocation
+	revision    int64
+}
+
+// loadIPAM reads all supernets, ordered with node supernets before site-wide
+// ones and then by name, and all allocations ordered by address
+func (r *RestServer) loadIPAM(ctx context.Context) (*ipamState, error) {
+	resp, err := r.etcd.Client().Get(ctx, ipamPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	state := &ipamState{supernets: []IPAMSupernet{}, allocations: []IPAMAllocation{}, revision: resp.Header.Revision}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		switch {
+		case strings.HasPrefix(key, ipamSupernetsPrefix):
+			var supernet IPAMSupernet
+			if err := json.Unmarshal(kv.Value, &supernet); err != nil {
+				logrus.WithError(err).Errorf("Failed to parse IPAM supernet %s", key)
+				continue
+			}
+			state.supernets = append(state.supernets, supernet)
+		case strings.HasPrefix(key, ipamAllocationsPrefix):
+			var allocation IPAMAllocation
+			if err := json.Unmarshal(kv.Value, &allocation); err != nil {
+				logrus.WithError(err).Errorf("Failed to parse IPAM allocation %s", key)
+				continue
+			}
+			state.allocations = append(state.allocations, allocation)
+		}
+	}
+	sort.SliceStable(state.supernets, func(i, j int) bool {
+		if (state.supernets[i].NodeID == "") != (state.supernets[j].NodeID == "") {
+			return state.supernets[i].NodeID != ""
+		}
+		return state.supernets[i].Name < state.supernets[j].Name
+	})
+	sort.SliceStable(state.allocations, func(i, j int) bool {
+		return netip.MustParsePrefix(state.allocations[i].Prefix).Addr().Less(netip.MustParsePrefix(state.allocations[j].Prefix).Addr())
+	})
+	return state, nil
+}
+
+// supernetFor returns the supernet of a node containing a subnet, or nil if
+// the subnet is not managed by IPAM
+func (s *ipamState) supernetFor(nodeId string, prefix netip.Prefix) *IPAMSupernet {
+	for i, supernet := range s.supernets {
+		if supernet.NodeID != "" && supernet.NodeID != nodeId {
+			continue
+		}
+		if p := netip.MustParsePrefix(supernet.Prefix); p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) {
+			return &s.supernets[i]
+		}
+	}
+	return nil
+}
+
+// allocationOf returns the allocation of a subscriber, or nil if it has none
+func (s *ipamState) allocationOf(nodeId, userId string) *IPAMAllocation {
+	for i, allocation := range s.allocations {
+		if allocation.NodeID == nodeId && allocation.UserID == userId {
+			return &s.allocations[i]
+		}
+	}
+	return nil
+}
+
+// release drops the allocation of a subscriber, as deleting its HSI config would
+func (s *ipamState) release(nodeId, userId string) {
+	for i, allocation := range s.allocations {
+		if allocation.NodeID == nodeId && allocation.UserID == userId {
+			s.allocations = append(s.allocations[:i], s.allocations[i+1:]...)
+			return
+		}
+	}
+}
+
+// apply updates the state with the LAN subnet of an HSI config as written
+// with the operations of assignOps
+func (s *ipamState) apply(nodeId string, config HSIConfig) {
+	s.release(nodeId, config.UserID)
+	prefix, ok := hsiLANPrefix(config)
+	if !ok || s.supernetFor(nodeId, prefix) == nil {
+		return
+	}
+	s.allocations = append(s.allocations, IPAMAllocation{
+		Prefix: prefix.String(),
+		NodeID: nodeId,
+		UserID: config.UserID,
+	})
+}
+
+// conflicting returns an allocation of another subscriber overlapping a subnet
+func (s *ipamState) conflicting(nodeId, userId string, prefix netip.Prefix) *IPAMAllocation {
+	for i, allocation := range s.allocations {
+		if allocation.NodeID == nodeId && allocation.UserID == userId {
+			continue
+		}
+		if netip.MustParsePrefix(allocation.Prefix).Overlaps(prefix) {
+			return &s.allocations[i]
+		}
+	}
+	return nil
+}
+
+// usedIn returns the allocated subnets inside a supernet
+func (s *ipamState) usedIn(supernet IPAMSupernet) []netip.Prefix {
+	super := netip.MustParsePrefix(supernet.Prefix)
+	var used []netip.Prefix
+	for _, allocation := range s.allocations {
+		if prefix := netip.MustParsePrefix(allocation.Prefix); super.Overlaps(prefix) {
+			used = append(used, prefix)
+		}
+	}
+	return used
+}
+
+// allocate returns the allocation of a subscriber, which keeps its subnet, or
+// the first free subnet of the supernets of its node
+func (s *ipamState) allocate(nodeId, userId string) (*IPAMAllocation, bool) {
+	if own := s.allocationOf(nodeId, userId); own != nil {
+		return own, true
+	}
+	for _, supernet := range s.supernets {
+		if supernet.NodeID != "" && supernet.NodeID != nodeId {
+			continue
+		}
+		prefix, ok := utils.NextFreePrefix(netip.MustParsePrefix(supernet.Prefix), supernet.SubnetLength, s.usedIn(supernet))
+		if !ok {
+			continue
+		}
+		gateway := prefix.Addr().Next()
+		return &IPAMAllocation{
+			Prefix:   prefix.String(),
+			Supernet: supernet.Name,
+			NodeID:   nodeId,
+			UserID:   userId,
+			Gateway:  gateway.String(),
+			AddrPool: fmt.Sprintf("%s-%s", gateway.Next(), utils.PrefixLastAddr(prefix).Prev()),
+		}, true
+	}
+	return nil, false
+}
+
+// assignOps returns the transaction recording the LAN subnet of an HSI config
+// in IPAM, or releasing the subscriber's allocation if its subnet is no
+// longer managed. The transaction only commits if the allocation keys it
+// writes and the supernet the subnet comes from did not change since IPAM
+// was read, so writes of other subnets do not conflict. Subnets allocated
+// from a supernet have its subnet length and so the same key when they
+// overlap.
+func (s *ipamState) assignOps(nodeId string, config HSIConfig) ([]clientv3.Cmp, []clientv3.Op, *apiError) {
+	own := s.allocationOf(nodeId, config.UserID)
+	prefix, ok := hsiLANPrefix(config)
+	var supernet *IPAMSupernet
+	if ok {
+		supernet = s.supernetFor(nodeId, prefix)
+	}
+	if supernet == nil && own == nil {
+		return nil, nil, nil
+	}
+
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	unchanged := func(key string) clientv3.Cmp {
+		return clientv3.Compare(clientv3.ModRevision(key), "<", s.revision+1)
+	}
+	if own != nil && (supernet == nil || own.Prefix != prefix.String()) {
+		key := ipamAllocationKey(netip.MustParsePrefix(own.Prefix))
+		cmps = append(cmps, unchanged(key))
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+	if supernet != nil {
+		if other := s.conflicting(nodeId, config.UserID, prefix); other != nil {
+			return nil, nil, newAPIError(http.StatusConflict,
+				fmt.Sprintf("DHCP subnet %s overlaps subnet %s of node %s, user: %s", prefix, other.Prefix, other.NodeID, other.UserID))
+		}
+		allocation := IPAMAllocation{
+			Prefix:      prefix.String(),
+			Supernet:    supernet.Name,
+			NodeID:      nodeId,
+			UserID:      config.UserID,
+			Gateway:     strings.TrimSpace(config.DHCPGateway),
+			AddrPool:    strings.TrimSpace(config.DHCPAddrPool),
+			AllocatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		if own != nil && own.Prefix == allocation.Prefix {
+			allocation.AllocatedAt = own.AllocatedAt
+		}
+		allocationJSON, err := json.Marshal(allocation)
+		if err != nil {
+			return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to marshal IPAM allocation")
+		}
+		cmps = append(cmps, unchanged(ipamAllocationKey(prefix)), unchanged(ipamSupernetKey(supernet.Name)))
+		ops = append(ops, clientv3.OpPut(ipamAllocationKey(prefix), string(allocationJSON)))
+	}
+	return cmps, ops, nil
+}
+
+// ipamReleaseOps returns the transaction reclaiming the LAN subnet of a
+// deleted HSI config, which is empty if the subnet is not allocated to it
+func (r *RestServer) ipamReleaseOps(ctx context.Context, nodeId string, config HSIConfig) ([]clientv3.Cmp, []clientv3.Op, error) {
+	prefix, ok := hsiLANPrefix(config)
+	if !ok {
+		return nil, nil, nil
+	}
+	key := ipamAllocationKey(prefix)
+	resp, err := r.etcd.Client().Get(ctx, key)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, nil, err
+	}
+	var allocation IPAMAllocation
+	if err := json.Unmarshal(resp.Kvs[0].Value, &allocation); err != nil {
+		return nil, nil, err
+	}
+	if allocation.NodeID != nodeId || allocation.UserID != config.UserID {
+		return nil, nil, nil
+	}
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)}
+	return cmps, []clientv3.Op{clientv3.OpDelete(key)}, nil
+}
+
+// reassignIPAMSubnet records the LAN subnet of a stored HSI config in IPAM
+// again, after another subscriber that had taken it over released it
+func (r *RestServer) reassignIPAMSubnet(ctx context.Context, nodeId string, config HSIConfig) *apiError {
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		ipam, err := r.loadIPAM(ctx)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocations")
+		}
+		cmps, ops, apiErr := ipam.assignOps(nodeId, config)
+		if apiErr != nil {
+			return apiErr
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "Failed to save IPAM allocation")
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+	return newAPIError(http.StatusConflict, "IPAM allocations have been modified by other requests")
+}
+
+// subscriberSubnet is the LAN subnet of a stored HSI config
+type subscriberSubnet struct {
+	nodeId string
+	userId string
+	prefix netip.Prefix
+	config HSIConfig
+}
+
+// listSubscriberSubnets returns the LAN subnets of the HSI configs of all
+// nodes ordered by address, together with the revision they were read at
+func (r *RestServer) listSubscriberSubnets(ctx context.Context) ([]subscriberSubnet, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, "configs/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	var subnets []subscriberSubnet
+	for _, kv := range resp.Kvs {
+		// key format: configs/{nodeId}/hsi/{userId}
+		parts := strings.Split(string(kv.Key), "/")
+		if len(parts) != 4 || parts[2] != "hsi" {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			logrus.WithError(err).Warnf("Failed to parse HSI config %s", kv.Key)
+			continue
+		}
+		if prefix, ok := hsiLANPrefix(config.Config); ok {
+			subnets = append(subnets, subscriberSubnet{nodeId: parts[1], userId: parts[3], prefix: prefix, config: config.Config})
+		}
+	}
+	sort.SliceStable(subnets, func(i, j int) bool {
+		if subnets[i].prefix.Addr() != subnets[j].prefix.Addr() {
+			return subnets[i].prefix.Addr().Less(subnets[j].prefix.Addr())
+		}
+		return subnets[i].prefix.Bits() < subnets[j].prefix.Bits()
+	})
+	return subnets, resp.Header.Revision, nil
+}
+
+// findOverlaps returns the pairs of subnets that overlap. As subnets are
+// ordered by address, every subnet is only compared with the following ones
+// starting inside it.
+func findOverlaps(subnets []subscriberSubnet, state *ipamState, all bool) []IPAMOverlap {
+	overlaps := []IPAMOverlap{}
+	for i, a := range subnets {
+		last := utils.PrefixLastAddr(a.prefix)
+		for _, b := range subnets[i+1:] {
+			if b.prefix.Addr().Compare(last) > 0 {
+				break
+			}
+			managed := state.supernetFor(a.nodeId, a.prefix) != nil || state.supernetFor(b.nodeId, b.prefix) != nil
+			if !managed && !all {
+				continue
+			}
+			overlaps = append(overlaps, IPAMOverlap{
+				NodeID:      a.nodeId,
+				UserID:      a.userId,
+				Subnet:      a.prefix.String(),
+				OtherNodeID: b.nodeId,
+				OtherUserID: b.userId,
+				OtherSubnet: b.prefix.String(),
+				Managed:     managed,
+			})
+		}
+	}
+	return overlaps
+}
+
+// normalizeIPAMSupernet fills in the defaults of a supernet
+func normalizeIPAMSupernet(supernet IPAMSupernet) IPAMSupernet {
+	supernet.NodeID = strings.TrimSpace(supernet.NodeID)
+	if supernet.SubnetLength == 0 {
+		supernet.SubnetLength = DefaultIPAMSubnetLength
+	}
+	if prefix, err := netip.ParsePrefix(strings.TrimSpace(supernet.Prefix)); err == nil {
+		supernet.Prefix = prefix.Masked().String()
+	}
+	return supernet
+}
+
+// validateIPAMSupernet checks a normalized supernet
+func validateIPAMSupernet(supernet IPAMSupernet) fieldErrors {
+	var errs fieldErrors
+	if !ipamSupernetNamePattern.MatchString(supernet.Name) {
+		errs.add("name", "Name must be 1-63 letters, digits, '.', '_' or '-'")
+	}
+	prefix, err := netip.ParsePrefix(supernet.Prefix)
+	if err != nil || !prefix.Addr().Is4() {
+		errs.add("prefix", "Prefix must be an IPv4 prefix, e.g. 10.16.0.0/16")
+	} else if prefix.Bits() < MinIPAMPrefixLength || prefix.Bits() > MaxIPAMPrefixLength {
+		errs.add("prefix", "Prefix length must be between /%d and /%d", MinIPAMPrefixLength, MaxIPAMPrefixLength)
+	}
+	if supernet.SubnetLength < MinIPAMPrefixLength || supernet.SubnetLength > MaxIPAMPrefixLength {
+		errs.add("subnet_length", "Subnet length must be between %d and %d", MinIPAMPrefixLength, MaxIPAMPrefixLength)
+	} else if !errs.has("prefix") && supernet.SubnetLength < prefix.Bits() {
+		errs.add("subnet_length", "Subnet length must not be shorter than the prefix length /%d", prefix.Bits())
+	}
+	return errs
+}
+
+// supernetResponse reports the capacity and usage of a supernet
+func (s *ipamState) supernetResponse(supernet IPAMSupernet) IPAMSupernetResponse {
+	allocated := 0
+	for _, allocation := range s.allocations {
+		if allocation.Supernet == supernet.Name {
+			allocated++
+		}
+	}
+	return IPAMSupernetResponse{
+		IPAMSupernet:     supernet,
+		TotalSubnets:     1 << (supernet.SubnetLength - netip.MustParsePrefix(supernet.Prefix).Bits()),
+		AllocatedSubnets: allocated,
+	}
+}
+
+// ListIPAMSupernets returns all supernets
+// @Summary      List IPAM supernets
+// @Description  Get the supernets subscriber LAN subnets are allocated from with their capacity and usage
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   IPAMSupernetResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /ipam/supernets [get]
+func (r *RestServer) ListIPAMSupernets(c *gin.Context) {
+	state, err := r.loadIPAM(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM supernets"})
+		return
+	}
+	response := make([]IPAMSupernetResponse, 0, len(state.supernets))
+	for _, supernet := range state.supernets {
+		response = append(response, state.supernetResponse(supernet))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetIPAMSupernet returns a supernet
+// @Summary      Get IPAM supernet
+// @Description  Get a supernet with its capacity and usage
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        name  path      string  true  "Supernet name"
+// @Success      200   {object}  IPAMSupernetResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /ipam/supernets/{name} [get]
+func (r *RestServer) GetIPAMSupernet(c *gin.Context) {
+	state, err := r.loadIPAM(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM supernets"})
+		return
+	}
+	for _, supernet := range state.supernets {
+		if supernet.Name == c.Param("name") {
+			c.JSON(http.StatusOK, state.supernetResponse(supernet))
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "IPAM supernet not found"})
+}
+
+// CreateIPAMSupernet adds a supernet
+// @Summary      Create IPAM supernet
+// @Description  Add an IPv4 range subscriber LAN subnets of subnet_length are allocated from, for one node or,
+// @Description  without node_id, for all nodes. Supernets must not overlap. HSI configs whose LAN subnet already lies
+// @Description  inside the supernet are adopted, overlapping ones are left to the overlap report.
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      IPAMSupernet  true  "IPAM supernet"
+// @Success      201      {object}  IPAMSupernetResponse
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /ipam/supernets [post]
+func (r *RestServer) CreateIPAMSupernet(c *gin.Context) {
+	var supernet IPAMSupernet
+	if err := c.ShouldBindJSON(&supernet); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	supernet = normalizeIPAMSupernet(supernet)
+	if apiErr := validateIPAMSupernet(supernet).apiError("IPAM supernet"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+	supernet.UpdatedBy = username
+	supernet.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	supernetJSON, err := json.Marshal(supernet)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal IPAM supernet"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	prefix := netip.MustParsePrefix(supernet.Prefix)
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		state, err := r.loadIPAM(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM supernets"})
+			return
+		}
+		for _, other := range state.supernets {
+			if other.Name == supernet.Name {
+				c.JSON(http.StatusConflict, gin.H{"error": "IPAM supernet already exists"})
+				return
+			}
+			if netip.MustParsePrefix(other.Prefix).Overlaps(prefix) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Prefix %s overlaps supernet %s (%s)", supernet.Prefix, other.Name, other.Prefix)})
+				return
+			}
+		}
+		subnets, configsRevision, err := r.listSubscriberSubnets(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI configs"})
+			return
+		}
+
+		// Adopt the subnets already in use inside the supernet, the first
+		// one by address wins if they overlap
+		ops := []clientv3.Op{clientv3.OpPut(ipamSupernetKey(supernet.Name), string(supernetJSON))}
+		var adopted []netip.Prefix
+		for _, subnet := range subnets {
+			if supernet.NodeID != "" && subnet.nodeId != supernet.NodeID {
+				continue
+			}
+			if prefix.Bits() > subnet.prefix.Bits() || !prefix.Contains(subnet.prefix.Addr()) {
+				continue
+			}
+			if len(adopted) > 0 && adopted[len(adopted)-1].Overlaps(subnet.prefix) {
+				logrus.Warnf("Subnet %s of node %s, user %s overlaps an adopted subnet, not adopted into supernet %s",
+					subnet.prefix, subnet.nodeId, subnet.userId, supernet.Name)
+				continue
+			}
+			allocationJSON, err := json.Marshal(IPAMAllocation{
+				Prefix:      subnet.prefix.String(),
+				Supernet:    supernet.Name,
+				NodeID:      subnet.nodeId,
+				UserID:      subnet.userId,
+				Gateway:     strings.TrimSpace(subnet.config.DHCPGateway),
+				AddrPool:    strings.TrimSpace(subnet.config.DHCPAddrPool),
+				AllocatedAt: supernet.UpdatedAt,
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal IPAM allocation"})
+				return
+			}
+			ops = append(ops, clientv3.OpPut(ipamAllocationKey(subnet.prefix), string(allocationJSON)))
+			adopted = append(adopted, subnet.prefix)
+		}
+
+		// Allocations are compared as a whole, as the adopted subnets must
+		// not have been allocated meanwhile
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.ModRevision(ipamSupernetsPrefix), "<", state.revision+1).WithPrefix(),
+				clientv3.Compare(clientv3.ModRevision(ipamAllocationsPrefix), "<", state.revision+1).WithPrefix(),
+				clientv3.Compare(clientv3.ModRevision("configs/"), "<", configsRevision+1).WithPrefix(),
+			).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save IPAM supernet"})
+			return
+		}
+		if !txnResp.Succeeded {
+			logrus.Infof("IPAM or HSI configs changed while creating supernet %s, retrying", supernet.Name)
+			continue
+		}
+
+		logrus.Infof("IPAM supernet %s (%s, /%d) created by %s, %d subnets adopted",
+			supernet.Name, supernet.Prefix, supernet.SubnetLength, username, len(adopted))
+		c.JSON(http.StatusCreated, IPAMSupernetResponse{
+			IPAMSupernet:     supernet,
+			TotalSubnets:     1 << (supernet.SubnetLength - prefix.Bits()),
+			AllocatedSubnets: len(adopted),
+		})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "IPAM or HSI configs have been modified by another request"})
+}
+
+// DeleteIPAMSupernet removes a supernet
+// @Summary      Delete IPAM supernet
+// @Description  Remove a supernet, which is only possible while none of its subnets is allocated
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        name  path      string  true  "Supernet name"
+// @Success      200   {object}  MessageResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /ipam/supernets/{name} [delete]
+func (r *RestServer) DeleteIPAMSupernet(c *gin.Context) {
+	name := c.Param("name")
+	ctx := c.Request.Context()
+	state, err := r.loadIPAM(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM supernets"})
+		return
+	}
+	found := false
+	for _, supernet := range state.supernets {
+		if supernet.Name == name {
+			found = true
+			if allocated := state.supernetResponse(supernet).AllocatedSubnets; allocated > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("IPAM supernet %s has %d allocated subnets", name, allocated)})
+				return
+			}
+		}
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IPAM supernet not found"})
+		return
+	}
+
+	// No subnet may have been allocated from the supernet since it was read
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(ipamSupernetKey(name)), "<", state.revision+1),
+			clientv3.Compare(clientv3.ModRevision(ipamAllocationsPrefix), "<", state.revision+1).WithPrefix(),
+		).
+		Then(clientv3.OpDelete(ipamSupernetKey(name))).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete IPAM supernet"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "IPAM has been modified by another request"})
+		return
+	}
+
+	logrus.Infof("IPAM supernet %s deleted", name)
+	c.JSON(http.StatusOK, gin.H{"message": "IPAM supernet deleted successfully"})
+}
+
+// ListIPAMAllocations returns the allocated subscriber LAN subnets
+// @Summary      List IPAM allocations
+// @Description  Get the subscriber LAN subnets allocated from supernets, ordered by address
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        node_id   query     string  false  "Only list allocations of this node"
+// @Param        supernet  query     string  false  "Only list allocations of this supernet"
+// @Success      200       {array}   IPAMAllocation
+// @Failure      500       {object}  ErrorResponse
+// @Router       /ipam/allocations [get]
+func (r *RestServer) ListIPAMAllocations(c *gin.Context) {
+	state, err := r.loadIPAM(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM allocations"})
+		return
+	}
+	nodeId, supernet := c.Query("node_id"), c.Query("supernet")
+	allocations := []IPAMAllocation{}
+	for _, allocation := range state.allocations {
+		if (nodeId == "" || allocation.NodeID == nodeId) && (supernet == "" || allocation.Supernet == supernet) {
+			allocations = append(allocations, allocation)
+		}
+	}
+	c.JSON(http.StatusOK, allocations)
+}
+
+// ListIPAMOverlaps reports HSI configs with overlapping LAN subnets
+// @Summary      List overlapping subnets
+// @Description  Find HSI configs of all nodes whose LAN subnets overlap. By default only overlaps involving a
+// @Description  subnet inside a supernet are reported, as unmanaged subscriber LANs may reuse private ranges.
+// @Tags         IPAM
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        all  query     bool  false  "Also report overlaps between unmanaged subnets"
+// @Success      200  {array}   IPAMOverlap
+// @Failure      500  {object}  ErrorResponse
+// @Router       /ipam/overlaps [get]
+func (r *RestServer) ListIPAMOverlaps(c *gin.Context) {
+	ctx := c.Request.Context()
+	state, err := r.loadIPAM(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPAM supernets"})
+		return
+	}
+	subnets, _, err := r.listSubscriberSubnets(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI configs"})
+		return
+	}
+	c.JSON(http.StatusOK, findOverlaps(subnets, state, c.Query("all") == "true"))
+}
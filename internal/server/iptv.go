@@ -0,0 +1,446 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// IGMP handling modes of the IPTV service
+const (
+	IPTVModeProxy       = "proxy"
+	IPTVModePassthrough = "passthrough"
+)
+
+const (
+	MinIPTVMaxGroups = 1
+	MaxIPTVMaxGroups = 1024
+)
+
+// multicastRange is the IPv4 multicast address space, multicastControlRange
+// the link-local control block that is never forwarded
+var (
+	_, multicastRange, _        = net.ParseCIDR("224.0.0.0/4")
+	_, multicastControlRange, _ = net.ParseCIDR("224.0.0.0/24")
+)
+
+// IPTVConfig represents the IPTV service of a subscriber
+type IPTVConfig struct {
+	UserID          string   `json:"user_id" example:"2"`
+	Enabled         bool     `json:"enabled" example:"true"`
+	Mode            string   `json:"mode" example:"proxy"`
+	IGMPVersion     string   `json:"igmp_version" example:"3"`
+	MulticastVlanID string   `json:"multicast_vlan_id" example:"4000"`
+	AllowedGroups   []string `json:"allowed_groups" example:"239.1.1.0/24"`
+	MaxGroups       int      `json:"max_groups" example:"8"`
+}
+
+// IPTVMetadata represents the metadata of an IPTV service config
+type IPTVMetadata struct {
+	Node            string `json:"node" example:"node001"`
+	ResourceVersion string `json:"resourceVersion" example:"1"`
+	UpdatedBy       string `json:"updatedBy" example:"admin"`
+	UpdatedAt       string `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// IPTVConfigWithMetadata is the etcd representation of an IPTV service config
+type IPTVConfigWithMetadata struct {
+	Config   IPTVConfig   `json:"config"`
+	Metadata IPTVMetadata `json:"metadata"`
+}
+
+func iptvConfigPrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/iptv/", nodeId)
+}
+
+func iptvConfigKey(nodeId, userId string) string {
+	return iptvConfigPrefix(nodeId) + userId
+}
+
+// validateIPTVConfig checks an IPTV service config. The HSI VLAN of the
+// subscriber is needed to make sure multicast uses a separate VLAN.
+func validateIPTVConfig(config IPTVConfig, hsiVlanId string) fieldErrors {
+	var errs fieldErrors
+
+	if config.UserID == "" {
+		errs.add("user_id", "User ID is required")
+	}
+	switch config.Mode {
+	case IPTVModeProxy, IPTVModePassthrough:
+	default:
+		errs.add("mode", "Mode must be %s or %s", IPTVModeProxy, IPTVModePassthrough)
+	}
+	switch config.IGMPVersion {
+	case "2", "3":
+	default:
+		errs.add("igmp_version", "IGMP version must be 2 or 3")
+	}
+
+	if config.MulticastVlanID == "" {
+		errs.add("multicast_vlan_id", "Multicast VLAN ID is required")
+	} else {
+		validateVlanID(&errs, "multicast_vlan_id", config.MulticastVlanID)
+		if !errs.has("multicast_vlan_id") && config.MulticastVlanID == hsiVlanId {
+			errs.add("multicast_vlan_id", "Multicast VLAN must differ from the subscriber's HSI VLAN")
+		}
+	}
+
+	if len(config.AllowedGroups) == 0 {
+		errs.add("allowed_groups", "At least one allowed group range is required")
+	}
+	for _, group := range config.AllowedGroups {
+		_, groupNet, err := net.ParseCIDR(strings.TrimSpace(group))
+		if err != nil || groupNet.IP.To4() == nil {
+			errs.add("allowed_groups", "Allowed group %q must be an IPv4 CIDR such as 239.1.1.0/24", group)
+			continue
+		}
+		ones, _ := groupNet.Mask.Size()
+		if !multicastRange.Contains(groupNet.IP) || ones < 4 {
+			errs.add("allowed_groups", "Allowed group %s must be inside the multicast range 224.0.0.0/4", groupNet.String())
+		} else if multicastControlRange.Contains(groupNet.IP) {
+			errs.add("allowed_groups", "Allowed group %s must not include the local network control block 224.0.0.0/24", groupNet.String())
+		}
+	}
+
+	if config.MaxGroups < MinIPTVMaxGroups || config.MaxGroups > MaxIPTVMaxGroups {
+		errs.add("max_groups", "Max groups must be between %d and %d", MinIPTVMaxGroups, MaxIPTVMaxGroups)
+	}
+	return errs
+}
+
+// multicastVlans maps the multicast VLANs of the IPTV services of a node to
+// the subscriber using them
+func (r *RestServer) multicastVlans(ctx context.Context, nodeId string) (map[int]string, error) {
+	resp, err := r.etcd.Client().Get(ctx, iptvConfigPrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	vlans := make(map[int]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var config IPTVConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			continue
+		}
+		if mvid, err := strconv.Atoi(config.Config.MulticastVlanID); err == nil {
+			if _, ok := vlans[mvid]; !ok {
+				vlans[mvid] = config.Config.UserID
+			}
+		}
+	}
+	return vlans, nil
+}
+
+// multicastVlanUser returns a subscriber whose IPTV service uses a VLAN as
+// multicast VLAN, or "" if there is none, together with a compare that only
+// holds if the IPTV services of the node did not change since
+func (r *RestServer) multicastVlanUser(ctx context.Context, nodeId string, vid int) (string, clientv3.Cmp, error) {
+	resp, err := r.etcd.Client().Get(ctx, iptvConfigPrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return "", clientv3.Cmp{}, err
+	}
+	cmp := clientv3.Compare(clientv3.ModRevision(iptvConfigPrefix(nodeId)), "<", resp.Header.Revision+1).WithPrefix()
+	for _, kv := range resp.Kvs {
+		var config IPTVConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			continue
+		}
+		if mvid, err := strconv.Atoi(config.Config.MulticastVlanID); err == nil && mvid == vid {
+			return config.Config.UserID, cmp, nil
+		}
+	}
+	return "", cmp, nil
+}
+
+// loadIPTVConfig reads an IPTV service config together with its etcd mod
+// revision. A nil config means it does not exist.
+func (r *RestServer) loadIPTVConfig(ctx context.Context, nodeId, userId string) (*IPTVConfigWithMetadata, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, iptvConfigKey(nodeId, userId))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var config IPTVConfigWithMetadata
+	if err := json.Unmarshal(resp.Kvs[0].Value, &config); err != nil {
+		return nil, 0, err
+	}
+	return &config, resp.Kvs[0].ModRevision, nil
+}
+
+// saveIPTVConfig validates and stores the IPTV service of a subscriber, which
+// needs an HSI config. The write only commits if neither the IPTV config, the
+// HSI config nor the multicast VLAN's index entries changed since they were read.
+func (r *RestServer) saveIPTVConfig(ctx context.Context, nodeId string, config IPTVConfig, username string, create bool, ifMatch string) (*IPTVConfigWithMetadata, *apiError) {
+	if config.IGMPVersion == "" {
+		config.IGMPVersion = "3"
+	}
+	config.Mode = strings.ToLower(config.Mode)
+
+	hsi, hsiRevision, err := r.loadHSIConfig(ctx, nodeId, config.UserID)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if hsi == nil {
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	// On QinQ nodes the multicast VLAN shares the wire with the outer tag
+	hsiVlanId := hsi.Config.VlanID
+	if hsi.Config.OuterVlanID != "" {
+		hsiVlanId = hsi.Config.OuterVlanID
+	}
+	if apiErr := validateIPTVConfig(config, hsiVlanId).apiError("IPTV config"); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// The multicast VLAN is shared by subscribers, but must not be an HSI VLAN
+	// or the outer VLAN of a QinQ subscriber
+	vid, _ := strconv.Atoi(config.MulticastVlanID)
+	owner, indexRevision, err := r.getVlanOwner(ctx, nodeId, vlanTag{inner: vid})
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if owner != "" {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Multicast VLAN is used as HSI VLAN by user: %s", owner))
+	}
+	outerPrefix := fmt.Sprintf("%s%d.", vlanIndexPrefix(nodeId), vid)
+	outerResp, err := r.etcd.Client().Get(ctx, outerPrefix, clientv3.WithPrefix(), clientv3.WithLimit(1))
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if len(outerResp.Kvs) > 0 {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Multicast VLAN is used as outer VLAN by user: %s", outerResp.Kvs[0].Value))
+	}
+
+	existing, modRevision, err := r.loadIPTVConfig(ctx, nodeId, config.UserID)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get current IPTV config")
+	}
+	if create && existing != nil {
+		return nil, &apiError{Status: http.StatusConflict, Body: gin.H{"error": "IPTV config already exists", "current": existing}}
+	}
+	if !create && existing == nil {
+		return nil, newAPIError(http.StatusNotFound, "IPTV config not found")
+	}
+	resourceVersion := "1"
+	if existing != nil {
+		if ifMatch != "" && ifMatch != "*" && ifMatch != existing.Metadata.ResourceVersion {
+			return nil, &apiError{Status: http.StatusConflict, Body: gin.H{
+				"error": "IPTV config has been modified by another request", "current": existing}}
+		}
+		resourceVersion = incrementResourceVersion(existing.Metadata.ResourceVersion)
+	}
+
+	saved := IPTVConfigWithMetadata{Config: config}
+	saved.Metadata.Node = nodeId
+	saved.Metadata.ResourceVersion = resourceVersion
+	saved.Metadata.UpdatedBy = username
+	saved.Metadata.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	savedJSON, err := json.Marshal(saved)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal IPTV config")
+	}
+
+	etcdKey := iptvConfigKey(nodeId, config.UserID)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision),
+			clientv3.Compare(clientv3.ModRevision(hsiConfigKey(nodeId, config.UserID)), "=", hsiRevision),
+			clientv3.Compare(clientv3.ModRevision(vlanIndexKey(nodeId, vlanTag{inner: vid})), "=", indexRevision),
+			clientv3.Compare(clientv3.ModRevision(outerPrefix), "<", outerResp.Header.Revision+1).WithPrefix(),
+		).
+		Then(clientv3.OpPut(etcdKey, string(savedJSON))).
+		Commit()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to save IPTV config")
+	}
+	if !txnResp.Succeeded {
+		return nil, newAPIError(http.StatusConflict, "IPTV config, HSI config or VLAN index has been modified by another request")
+	}
+
+	logrus.Infof("IPTV config saved for node %s, user: %s, version: %s, by: %s",
+		nodeId, config.UserID, resourceVersion, username)
+	return &saved, nil
+}
+
+// ListIPTVConfigs returns the IPTV service configs of a node
+// @Summary      List IPTV configurations
+// @Description  Get the IPTV service configs of all subscribers of a node
+// @Tags         IPTV
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   IPTVConfigWithMetadata
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/iptv [get]
+func (r *RestServer) ListIPTVConfigs(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), iptvConfigPrefix(c.Param("nodeId")), clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPTV configs"})
+		return
+	}
+
+	configs := []IPTVConfigWithMetadata{}
+	for _, kv := range resp.Kvs {
+		var config IPTVConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse IPTV config %s", kv.Key)
+			continue
+		}
+		configs = append(configs, config)
+	}
+	c.JSON(http.StatusOK, configs)
+}
+
+// GetIPTVConfig returns the IPTV service config of a subscriber
+// @Summary      Get IPTV configuration
+// @Description  Get the IPTV service config of a subscriber
+// @Tags         IPTV
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  IPTVConfigWithMetadata
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/iptv/{userId} [get]
+func (r *RestServer) GetIPTVConfig(c *gin.Context) {
+	config, _, err := r.loadIPTVConfig(c.Request.Context(), c.Param("nodeId"), c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPTV config"})
+		return
+	}
+	if config == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IPTV config not found"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(config.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, config)
+}
+
+// CreateIPTVConfig adds the IPTV service to a subscriber
+// @Summary      Create IPTV configuration
+// @Description  Provision IGMP proxy or passthrough for a subscriber that has an HSI config. The multicast
+// @Description  VLAN may be shared by subscribers but must not be an HSI VLAN of the node.
+// @Tags         IPTV
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string      true  "Node ID"
+// @Param        request  body      IPTVConfig  true  "IPTV configuration"
+// @Success      201      {object}  IPTVConfigWithMetadata
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /config/{nodeId}/iptv [post]
+func (r *RestServer) CreateIPTVConfig(c *gin.Context) {
+	var config IPTVConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	saved, apiErr := r.saveIPTVConfig(c.Request.Context(), c.Param("nodeId"), config, username, true, "")
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusCreated, saved)
+}
+
+// UpdateIPTVConfig replaces the IPTV service config of a subscriber
+// @Summary      Update IPTV configuration
+// @Description  Replace the IPTV service config of a subscriber
+// @Tags         IPTV
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string      true   "Node ID"
+// @Param        userId    path      string      true   "User ID"
+// @Param        request   body      IPTVConfig  true   "IPTV configuration"
+// @Param        If-Match  header    string      false  "Expected current resource version"
+// @Success      200       {object}  IPTVConfigWithMetadata
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/iptv/{userId} [put]
+func (r *RestServer) UpdateIPTVConfig(c *gin.Context) {
+	userId := c.Param("userId")
+	var config IPTVConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if config.UserID != "" && config.UserID != userId {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID mismatch"})
+		return
+	}
+	config.UserID = userId
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	saved, apiErr := r.saveIPTVConfig(c.Request.Context(), c.Param("nodeId"), config, username, false,
+		parseIfMatch(c.GetHeader("If-Match")))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, saved)
+}
+
+// DeleteIPTVConfig removes the IPTV service of a subscriber
+// @Summary      Delete IPTV configuration
+// @Description  Remove the IPTV service of a subscriber. The HSI config is kept.
+// @Tags         IPTV
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  MessageResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/iptv/{userId} [delete]
+func (r *RestServer) DeleteIPTVConfig(c *gin.Context) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	resp, err := r.etcd.Client().Delete(c.Request.Context(), iptvConfigKey(nodeId, userId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete IPTV config"})
+		return
+	}
+	if resp.Deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IPTV config not found"})
+		return
+	}
+
+	logrus.Infof("IPTV config deleted for node %s, user: %s", nodeId, userId)
+	c.JSON(http.StatusOK, gin.H{"message": "IPTV config deleted successfully"})
+}
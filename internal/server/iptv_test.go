@@ -0,0 +1,61 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func testIPTVConfig(userId, multicastVlanId string) IPTVConfig {
+	return IPTVConfig{
+		UserID:          userId,
+		Mode:            IPTVModeProxy,
+		MulticastVlanID: multicastVlanId,
+		AllowedGroups:   []string{"239.1.1.0/24"},
+		MaxGroups:       8,
+	}
+}
+
+func TestHSIWriteFailsIfMulticastVlanTakenMeanwhile(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	plan, apiErr := r.planHSIWrite(ctx, hsiWrite{nodeId: "node1", config: testHSIConfig("2", "300"), username: "admin", create: true}, nil)
+	if apiErr != nil || plan == nil {
+		t.Fatalf("planHSIWrite() = %v, %v", plan, apiErr)
+	}
+	// VLAN 300 becomes a multicast VLAN before the HSI config is written
+	if _, apiErr := r.saveIPTVConfig(ctx, "node1", testIPTVConfig("1", "300"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveIPTVConfig() error = %v", apiErr.Body)
+	}
+	txnResp, err := r.etcd.Client().Txn(ctx).If(plan.cmps...).Then(plan.ops...).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txnResp.Succeeded {
+		t.Error("HSI config was written with a multicast VLAN")
+	}
+}
+
+func TestIPTVConfigRejectsOuterVlan(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+	// A QinQ subscriber uses VLAN 300 as outer tag
+	putTestJSON(t, r, vlanIndexKey("node1", vlanTag{outer: 300, inner: 5}), "7")
+
+	_, apiErr := r.saveIPTVConfig(ctx, "node1", testIPTVConfig("1", "300"), "admin", true, "")
+	if apiErr == nil || apiErr.Status != http.StatusConflict {
+		t.Fatalf("saveIPTVConfig() error = %v, want a conflict", apiErr)
+	}
+	if _, apiErr := r.saveIPTVConfig(ctx, "node1", testIPTVConfig("1", "301"), "admin", true, ""); apiErr != nil {
+		t.Errorf("saveIPTVConfig() with a free VLAN error = %v", apiErr.Body)
+	}
+}
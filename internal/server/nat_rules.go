@@ -0,0 +1,562 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NAT rule protocols
+const (
+	NATProtocolTCP  = "tcp"
+	NATProtocolUDP  = "udp"
+	NATProtocolBoth = "both"
+)
+
+const (
+	// DefaultNATRulesPerNode is the port-forward rule limit of a node without configured limits
+	DefaultNATRulesPerNode = 4096
+	// DefaultNATRulesPerSubscriber is the port-forward rule limit of a subscriber without configured limits
+	DefaultNATRulesPerSubscriber = 32
+)
+
+// NATRule forwards an external port or port range of a subscriber's WAN
+// address to a host on the subscriber's LAN
+type NATRule struct {
+	ID              string `json:"id" example:"9f86d081884c7d65"`
+	Description     string `json:"description,omitempty" example:"Web server"`
+	Protocol        string `json:"protocol" example:"tcp"`
+	ExternalPort    string `json:"external_port" example:"8080"`
+	InternalIP      string `json:"internal_ip" example:"192.168.3.100"`
+	InternalPort    string `json:"internal_port" example:"80"`
+	ResourceVersion string `json:"resource_version" example:"1"`
+	UpdatedBy       string `json:"updated_by" example:"admin"`
+	UpdatedAt       string `json:"updated_at" example:"2024-01-01T00:00:00Z"`
+}
+
+// NATRuleRequest represents the request to create or replace a port-forward rule
+type NATRuleRequest struct {
+	Description  string `json:"description" example:"Web server"`
+	Protocol     string `json:"protocol" example:"tcp"`
+	ExternalPort string `json:"external_port" example:"8080"`
+	InternalIP   string `json:"internal_ip" example:"192.168.3.100"`
+	// InternalPort defaults to the external port, a range must be as long as the external one
+	InternalPort string `json:"internal_port" example:"80"`
+}
+
+// NodeNATLimits bounds the number of port-forward rules of a node
+type NodeNATLimits struct {
+	Node                  string `json:"node" example:"node001"`
+	MaxRules              int    `json:"max_rules" example:"4096"`
+	MaxRulesPerSubscriber int    `json:"max_rules_per_subscriber" example:"32"`
+	UpdatedBy             string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt             string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// UpdateNodeNATLimits represents the request to change the NAT limits of a node
+type UpdateNodeNATLimits struct {
+	MaxRules              int `json:"max_rules" example:"4096"`
+	MaxRulesPerSubscriber int `json:"max_rules_per_subscriber" example:"32"`
+}
+
+func natNodePrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/nat/", nodeId)
+}
+
+func natRulePrefix(nodeId, userId string) string {
+	return fmt.Sprintf("%s%s/", natNodePrefix(nodeId), userId)
+}
+
+func natRuleKey(nodeId, userId, ruleId string) string {
+	return natRulePrefix(nodeId, userId) + ruleId
+}
+
+func natLimitsKey(nodeId string) string {
+	return fmt.Sprintf("nat_limits/%s", nodeId)
+}
+
+// natProtocolsOverlap reports whether two rule protocols share a protocol
+func natProtocolsOverlap(a, b string) bool {
+	return a == b || a == NATProtocolBoth || b == NATProtocolBoth
+}
+
+// validateNATRule checks a rule on its own and against the LAN of the subscriber
+func validateNATRule(rule NATRule, hsi HSIConfig) fieldErrors {
+	var errs fieldErrors
+
+	switch rule.Protocol {
+	case NATProtocolTCP, NATProtocolUDP, NATProtocolBoth:
+	default:
+		errs.add("protocol", "Protocol must be one of %s, %s or %s", NATProtocolTCP, NATProtocolUDP, NATProtocolBoth)
+	}
+
+	extFirst, extLast, err := utils.ParsePortRange(rule.ExternalPort)
+	if err != nil {
+		errs.add("external_port", "External port must be a port or a port range between 1 and 65535, e.g. 8000-8010")
+	}
+	intFirst, intLast, err := utils.ParsePortRange(rule.InternalPort)
+	if err != nil {
+		errs.add("internal_port", "Internal port must be a port or a port range between 1 and 65535, e.g. 8000-8010")
+	} else if !errs.has("external_port") && intLast-intFirst != 0 && intLast-intFirst != extLast-extFirst {
+		errs.add("internal_port", "Internal port range must be a single port or as long as the external port range")
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(rule.InternalIP)).To4()
+	if ip == nil {
+		errs.add("internal_ip", "Internal IP must be a valid IPv4 address")
+		return errs
+	}
+	mask, maskErr := utils.ParseIPv4Netmask(hsi.DHCPSubnet)
+	gateway := net.ParseIP(strings.TrimSpace(hsi.DHCPGateway)).To4()
+	if maskErr != nil || gateway == nil {
+		errs.add("internal_ip", "Subscriber has no valid DHCP subnet to forward to")
+		return errs
+	}
+	subnet := &net.IPNet{IP: gateway.Mask(mask), Mask: mask}
+	broadcast := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		broadcast[i] = subnet.IP[i] | ^mask[i]
+	}
+	switch {
+	case !subnet.Contains(ip):
+		errs.add("internal_ip", "Internal IP must be inside the subscriber's subnet %s", subnet.String())
+	case ip.Equal(subnet.IP) || ip.Equal(broadcast):
+		errs.add("internal_ip", "Internal IP must not be the network or broadcast address of %s", subnet.String())
+	case ip.Equal(gateway):
+		errs.add("internal_ip", "Internal IP must not be the subscriber's gateway")
+	}
+	return errs
+}
+
+// checkNATRulesInSubnet rejects a subnet change of a subscriber that would
+// leave port-forward rules pointing outside its LAN
+func (r *RestServer) checkNATRulesInSubnet(ctx context.Context, nodeId, userId string, hsi HSIConfig) *apiError {
+	rules, err := r.listNATRules(ctx, nodeId, userId)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get NAT rules")
+	}
+	for _, rule := range rules {
+		if errs := validateNATRule(rule, hsi); errs.has("internal_ip") {
+			return newAPIError(http.StatusConflict,
+				fmt.Sprintf("NAT rule %s forwards to %s, which is outside the new DHCP subnet", rule.ID, rule.InternalIP))
+		}
+	}
+	return nil
+}
+
+// getNATLimits returns the NAT limits of a node, or the defaults if none are configured
+func (r *RestServer) getNATLimits(ctx context.Context, nodeId string) (NodeNATLimits, error) {
+	limits := NodeNATLimits{
+		Node:                  nodeId,
+		MaxRules:              DefaultNATRulesPerNode,
+		MaxRulesPerSubscriber: DefaultNATRulesPerSubscriber,
+	}
+	resp, err := r.etcd.Client().Get(ctx, natLimitsKey(nodeId))
+	if err != nil {
+		return limits, err
+	}
+	if len(resp.Kvs) > 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, &limits); err != nil {
+			return limits, err
+		}
+	}
+	return limits, nil
+}
+
+// listNATRules returns the rules of a subscriber ordered by external port
+func (r *RestServer) listNATRules(ctx context.Context, nodeId, userId string) ([]NATRule, error) {
+	resp, err := r.etcd.Client().Get(ctx, natRulePrefix(nodeId, userId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	rules := []NATRule{}
+	for _, kv := range resp.Kvs {
+		var rule NATRule
+		if err := json.Unmarshal(kv.Value, &rule); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse NAT rule %s", kv.Key)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, _, _ := utils.ParsePortRange(rules[i].ExternalPort)
+		b, _, _ := utils.ParsePortRange(rules[j].ExternalPort)
+		return a < b
+	})
+	return rules, nil
+}
+
+// saveNATRule validates and creates or updates a port-forward rule. The rules of the node are read and written in one
+// transaction that only commits if no rule of the node changed in between, so
+// limits and external port conflicts hold under concurrent writes.
+func (r *RestServer) saveNATRule(ctx context.Context, nodeId, userId string, rule NATRule, create bool, ifMatch string) (*NATRule, *apiError) {
+	hsi, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if hsi == nil {
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	if rule.InternalPort == "" {
+		rule.InternalPort = rule.ExternalPort
+	}
+	rule.Protocol = strings.ToLower(rule.Protocol)
+	if apiErr := validateNATRule(rule, hsi.Config).apiError("NAT rule"); apiErr != nil {
+		return nil, apiErr
+	}
+
+	limits, err := r.getNATLimits(ctx, nodeId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get NAT limits")
+	}
+
+	extFirst, extLast, _ := utils.ParsePortRange(rule.ExternalPort)
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		resp, err := r.etcd.Client().Get(ctx, natNodePrefix(nodeId), clientv3.WithPrefix())
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get NAT rules")
+		}
+
+		var existing *NATRule
+		nodeRules, userRules := 0, 0
+		for _, kv := range resp.Kvs {
+			var other NATRule
+			if err := json.Unmarshal(kv.Value, &other); err != nil {
+				continue
+			}
+			nodeRules++
+			if !strings.HasPrefix(string(kv.Key), natRulePrefix(nodeId, userId)) {
+				continue
+			}
+			userRules++
+			if other.ID == rule.ID {
+				existing = &other
+				continue
+			}
+			// Each subscriber has its own WAN address, so external ports only
+			// conflict between rules of the same subscriber
+			first, last, err := utils.ParsePortRange(other.ExternalPort)
+			if err == nil && first <= extLast && extFirst <= last && natProtocolsOverlap(rule.Protocol, other.Protocol) {
+				return nil, newAPIError(http.StatusConflict,
+					fmt.Sprintf("External port %s/%s conflicts with NAT rule %s (%s/%s)",
+						rule.ExternalPort, rule.Protocol, other.ID, other.ExternalPort, other.Protocol))
+			}
+		}
+
+		resourceVersion := "1"
+		if create {
+			if existing != nil {
+				return nil, newAPIError(http.StatusConflict, "NAT rule already exists")
+			}
+			if nodeRules >= limits.MaxRules {
+				return nil, newAPIError(http.StatusConflict,
+					fmt.Sprintf("Node %s has reached its limit of %d NAT rules", nodeId, limits.MaxRules))
+			}
+			if userRules >= limits.MaxRulesPerSubscriber {
+				return nil, newAPIError(http.StatusConflict,
+					fmt.Sprintf("User %s has reached its limit of %d NAT rules", userId, limits.MaxRulesPerSubscriber))
+			}
+		} else {
+			if existing == nil {
+				return nil, newAPIError(http.StatusNotFound, "NAT rule not found")
+			}
+			if ifMatch != "" && ifMatch != "*" && ifMatch != existing.ResourceVersion {
+				return nil, &apiError{Status: http.StatusConflict, Body: gin.H{
+					"error": "NAT rule has been modified by another request", "current": existing}}
+			}
+			resourceVersion = incrementResourceVersion(existing.ResourceVersion)
+		}
+		rule.ResourceVersion = resourceVersion
+
+		ruleJSON, err := json.Marshal(rule)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal NAT rule")
+		}
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(natNodePrefix(nodeId)), "<", resp.Header.Revision+1).WithPrefix()).
+			Then(clientv3.OpPut(natRuleKey(nodeId, userId, rule.ID), string(ruleJSON))).
+			Commit()
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to save NAT rule")
+		}
+		if !txnResp.Succeeded {
+			logrus.Infof("NAT rules of node %s changed while writing rule %s, retrying", nodeId, rule.ID)
+			continue
+		}
+
+		logrus.Infof("NAT rule %s saved for node %s, user: %s, %s %s -> %s:%s, by: %s",
+			rule.ID, nodeId, userId, rule.Protocol, rule.ExternalPort, rule.InternalIP, rule.InternalPort, rule.UpdatedBy)
+		return &rule, nil
+	}
+	return nil, newAPIError(http.StatusConflict, "NAT rules have been modified by another request")
+}
+
+// ListNATRules returns the port-forward rules of a subscriber
+// @Summary      List NAT rules
+// @Description  Get the port-forward rules of a subscriber, ordered by external port
+// @Tags         NAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {array}   NATRule
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/nat/{userId} [get]
+func (r *RestServer) ListNATRules(c *gin.Context) {
+	rules, err := r.listNATRules(c.Request.Context(), c.Param("nodeId"), c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get NAT rules"})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// GetNATRule returns a port-forward rule
+// @Summary      Get NAT rule
+// @Description  Get a port-forward rule of a subscriber
+// @Tags         NAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Param        ruleId  path      string  true  "Rule ID"
+// @Success      200     {object}  NATRule
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/nat/{userId}/{ruleId} [get]
+func (r *RestServer) GetNATRule(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), natRuleKey(c.Param("nodeId"), c.Param("userId"), c.Param("ruleId")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get NAT rule"})
+		return
+	}
+	if len(resp.Kvs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "NAT rule not found"})
+		return
+	}
+	var rule NATRule
+	if err := json.Unmarshal(resp.Kvs[0].Value, &rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse NAT rule"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(rule.ResourceVersion))
+	c.JSON(http.StatusOK, rule)
+}
+
+// CreateNATRule creates a port-forward rule
+// @Summary      Create NAT rule
+// @Description  Forward an external port or port range of a subscriber to a host inside its DHCP subnet. The
+// @Description  external ports must not overlap another rule of the subscriber for the same protocol.
+// @Tags         NAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string          true  "Node ID"
+// @Param        userId   path      string          true  "User ID"
+// @Param        request  body      NATRuleRequest  true  "NAT rule"
+// @Success      201      {object}  NATRule
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /config/{nodeId}/nat/{userId} [post]
+func (r *RestServer) CreateNATRule(c *gin.Context) {
+	var req NATRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	rule := NATRule{
+		ID:           newResourceID(),
+		Description:  req.Description,
+		Protocol:     req.Protocol,
+		ExternalPort: req.ExternalPort,
+		InternalIP:   req.InternalIP,
+		InternalPort: req.InternalPort,
+		UpdatedBy:    username,
+		UpdatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	saved, apiErr := r.saveNATRule(c.Request.Context(), c.Param("nodeId"), c.Param("userId"), rule, true, "")
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(saved.ResourceVersion))
+	c.JSON(http.StatusCreated, saved)
+}
+
+// UpdateNATRule replaces a port-forward rule
+// @Summary      Update NAT rule
+// @Description  Replace a port-forward rule of a subscriber
+// @Tags         NAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string          true   "Node ID"
+// @Param        userId    path      string          true   "User ID"
+// @Param        ruleId    path      string          true   "Rule ID"
+// @Param        request   body      NATRuleRequest  true   "NAT rule"
+// @Param        If-Match  header    string          false  "Expected current resource version"
+// @Success      200       {object}  NATRule
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /config/{nodeId}/nat/{userId}/{ruleId} [put]
+func (r *RestServer) UpdateNATRule(c *gin.Context) {
+	var req NATRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	rule := NATRule{
+		ID:           c.Param("ruleId"),
+		Description:  req.Description,
+		Protocol:     req.Protocol,
+		ExternalPort: req.ExternalPort,
+		InternalIP:   req.InternalIP,
+		InternalPort: req.InternalPort,
+		UpdatedBy:    username,
+		UpdatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	saved, apiErr := r.saveNATRule(c.Request.Context(), c.Param("nodeId"), c.Param("userId"), rule, false,
+		parseIfMatch(c.GetHeader("If-Match")))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(saved.ResourceVersion))
+	c.JSON(http.StatusOK, saved)
+}
+
+// DeleteNATRule removes a port-forward rule
+// @Summary      Delete NAT rule
+// @Description  Delete a port-forward rule of a subscriber
+// @Tags         NAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Param        ruleId  path      string  true  "Rule ID"
+// @Success      200     {object}  MessageResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/nat/{userId}/{ruleId} [delete]
+func (r *RestServer) DeleteNATRule(c *gin.Context) {
+	nodeId, userId, ruleId := c.Param("nodeId"), c.Param("userId"), c.Param("ruleId")
+	resp, err := r.etcd.Client().Delete(c.Request.Context(), natRuleKey(nodeId, userId, ruleId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete NAT rule"})
+		return
+	}
+	if resp.Deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "NAT rule not found"})
+		return
+	}
+
+	logrus.Infof("NAT rule %s deleted for node %s, user: %s", ruleId, nodeId, userId)
+	c.JSON(http.StatusOK, gin.H{"message": "NAT rule deleted successfully"})
+}
+
+// GetNodeNATLimits returns the NAT limits of a node
+// @Summary      Get Node NAT Limits
+// @Description  Get the maximum number of port-forward rules of a node and of each of its subscribers
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeNATLimits
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/nat-limits [get]
+func (r *RestServer) GetNodeNATLimits(c *gin.Context) {
+	limits, err := r.getNATLimits(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get NAT limits"})
+		return
+	}
+	c.JSON(http.StatusOK, limits)
+}
+
+// UpdateNodeNATLimits changes the NAT limits of a node
+// @Summary      Update Node NAT Limits
+// @Description  Set the maximum number of port-forward rules of a node and of each of its subscribers.
+// @Description  Existing rules above a lowered limit are kept, but no new rules can be added.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string               true  "Node ID"
+// @Param        request  body      UpdateNodeNATLimits  true  "NAT limits"
+// @Success      200      {object}  NodeNATLimits
+// @Failure      400      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/nat-limits [put]
+func (r *RestServer) UpdateNodeNATLimits(c *gin.Context) {
+	var req UpdateNodeNATLimits
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.MaxRules < 0 || req.MaxRulesPerSubscriber < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "NAT limits must be non-negative"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	nodeId := c.Param("nodeId")
+	limits := NodeNATLimits{
+		Node:                  nodeId,
+		MaxRules:              req.MaxRules,
+		MaxRulesPerSubscriber: req.MaxRulesPerSubscriber,
+		UpdatedBy:             username,
+		UpdatedAt:             time.Now().UTC().Format(time.RFC3339),
+	}
+	limitsJSON, err := json.Marshal(limits)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal NAT limits"})
+		return
+	}
+	if _, err := r.etcd.Client().Put(c.Request.Context(), natLimitsKey(nodeId), string(limitsJSON)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save NAT limits"})
+		return
+	}
+
+	logrus.Infof("NAT limits of node %s set to %d rules, %d per subscriber by %s",
+		nodeId, limits.MaxRules, limits.MaxRulesPerSubscriber, username)
+	c.JSON(http.StatusOK, limits)
+}
@@ -2,17 +2,26 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"fastrg-controller/internal/storage"
 	"fastrg-controller/internal/utils"
 	fastrgnodepb "fastrg-controller/proto/fastrgnodepb"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -26,9 +35,35 @@ type NodeMonitor struct {
 	cancel       context.CancelFunc
 	grpcConn     *grpc.ClientConn
 	fastrgClient fastrgnodepb.FastrgServiceClient
+	etcd         *storage.EtcdClient
 	metrics      *NodeMetrics
+	// lastThroughput is the per-user byte count at the last throughput publish
+	lastThroughput *throughputSample
+	// lastConnected is the list of connected users last published to etcd
+	lastConnected      string
+	connectedPublished bool
+	// reservations caches the DHCP reservations of the node's HSI configs.
+	// A watch on the configs marks it stale when they change and clears
+	// reservationsWatched when it ends, the next poll then reads them again.
+	reservations        map[string][]netip.Addr
+	reservationsStale   atomic.Bool
+	reservationsWatched atomic.Bool
 }
 
+// throughputSample holds the per-user byte counters of the subscriber-facing NIC
+type throughputSample struct {
+	at    time.Time
+	users map[string]userBytes
+}
+
+type userBytes struct {
+	rx, tx uint64
+}
+
+// subscriberNICIndex is the NIC facing the subscribers, traffic received on
+// it is upstream and traffic transmitted on it downstream
+const subscriberNICIndex = 0
+
 // NodeMetrics holds Prometheus metrics for a node
 type NodeMetrics struct {
 	rxPackets                       *prometheus.GaugeVec
@@ -60,6 +95,8 @@ type NodeMetrics struct {
 	totalPPPoEErrorSessions         *prometheus.GaugeVec
 	perUserDhcpCurLeaseCount        *prometheus.GaugeVec
 	perUserDhcpMaxLeaseCount        *prometheus.GaugeVec
+	perUserDhcpPoolUtilization      *prometheus.GaugeVec
+	perUserDhcpReservedCount        *prometheus.GaugeVec
 	totalRunningDhcpServer          *prometheus.GaugeVec
 	totalStoppedDhcpServer          *prometheus.GaugeVec
 	totalNotConfiguredDhcpServer    *prometheus.GaugeVec
@@ -74,10 +111,11 @@ type NodeMonitorManager struct {
 	mu       sync.RWMutex
 	monitors map[string]*NodeMonitor
 	metrics  *NodeMetrics
+	etcd     *storage.EtcdClient
 }
 
 // NewNodeMonitorManager creates a new NodeMonitorManager
-func NewNodeMonitorManager() *NodeMonitorManager {
+func NewNodeMonitorManager(etcd *storage.EtcdClient) *NodeMonitorManager {
 	metrics := &NodeMetrics{
 		rxPackets: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
@@ -282,6 +320,20 @@ func NewNodeMonitorManager() *NodeMonitorManager {
 			},
 			[]string{"node_uuid", "user_id"},
 		),
+		perUserDhcpPoolUtilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fastrg_node_per_user_dhcp_pool_utilization",
+				Help: "Ratio of leased or reserved to available addresses of the DHCP pool per user, for IPv4 and IPv6 pools",
+			},
+			[]string{"node_uuid", "user_id", "ip_family"},
+		),
+		perUserDhcpReservedCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fastrg_node_per_user_dhcp_reserved_count",
+				Help: "Number of static DHCP reservations per user",
+			},
+			[]string{"node_uuid", "user_id"},
+		),
 		totalRunningDhcpServer: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "fastrg_node_total_running_dhcp_server",
@@ -363,6 +415,8 @@ func NewNodeMonitorManager() *NodeMonitorManager {
 	prometheus.MustRegister(metrics.totalPPPoEErrorSessions)
 	prometheus.MustRegister(metrics.perUserDhcpCurLeaseCount)
 	prometheus.MustRegister(metrics.perUserDhcpMaxLeaseCount)
+	prometheus.MustRegister(metrics.perUserDhcpPoolUtilization)
+	prometheus.MustRegister(metrics.perUserDhcpReservedCount)
 	prometheus.MustRegister(metrics.totalRunningDhcpServer)
 	prometheus.MustRegister(metrics.totalStoppedDhcpServer)
 	prometheus.MustRegister(metrics.totalNotConfiguredDhcpServer)
@@ -374,6 +428,7 @@ func NewNodeMonitorManager() *NodeMonitorManager {
 	return &NodeMonitorManager{
 		monitors: make(map[string]*NodeMonitor),
 		metrics:  metrics,
+		etcd:     etcd,
 	}
 }
 
@@ -410,6 +465,7 @@ func (nmm *NodeMonitorManager) StartMonitoring(nodeUUID, nodeIP string) error {
 		cancel:       cancel,
 		grpcConn:     conn,
 		fastrgClient: fastrgClient,
+		etcd:         nmm.etcd,
 		metrics:      nmm.metrics,
 	}
 
@@ -516,6 +572,7 @@ func (nm *NodeMonitor) getNicCounter(ctx context.Context) error {
 		return err
 	}
 
+	users := make(map[string]userBytes)
 	for i, stat := range sysInfo.Stats {
 		nicIndex := fmt.Sprintf("%d", i)
 		nm.metrics.rxPackets.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(stat.RxPackets))
@@ -525,9 +582,13 @@ func (nm *NodeMonitor) getNicCounter(ctx context.Context) error {
 		nm.metrics.rxErrors.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(stat.RxErrors))
 		nm.metrics.txErrors.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(stat.TxErrors))
 		nm.metrics.rxDropped.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(stat.RxDropped))
+		subscriberFacing := i == subscriberNICIndex
 		for i := 0; i < len(stat.PerUserStats)-1; i++ {
 			userStat := stat.PerUserStats[i]
 			userID := fmt.Sprintf("%d", userStat.UserId)
+			if subscriberFacing {
+				users[userID] = userBytes{rx: uint64(userStat.RxBytes), tx: uint64(userStat.TxBytes)}
+			}
 			nm.metrics.perUserRxPackets.WithLabelValues(nm.nodeUUID, nicIndex, userID).Set(float64(userStat.RxPackets))
 			nm.metrics.perUserRxBytes.WithLabelValues(nm.nodeUUID, nicIndex, userID).Set(float64(userStat.RxBytes))
 			nm.metrics.perUserTxPackets.WithLabelValues(nm.nodeUUID, nicIndex, userID).Set(float64(userStat.TxPackets))
@@ -543,10 +604,79 @@ func (nm *NodeMonitor) getNicCounter(ctx context.Context) error {
 		nm.metrics.unknownUserDropPackets.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(unknownStat.DroppedPackets))
 		nm.metrics.unknownUserDropBytes.WithLabelValues(nm.nodeUUID, nicIndex).Set(float64(unknownStat.DroppedBytes))
 	}
+	nm.publishThroughput(ctx, users)
 
 	return nil
 }
 
+// publishThroughput stores the average per-user throughput since the last
+// publish in etcd once every ThroughputPublishInterval, where the REST API
+// compares it with the configured rates
+func (nm *NodeMonitor) publishThroughput(ctx context.Context, users map[string]userBytes) {
+	now := time.Now()
+	last := nm.lastThroughput
+	if last != nil && now.Sub(last.at) < ThroughputPublishInterval {
+		return
+	}
+	nm.lastThroughput = &throughputSample{at: now, users: users}
+	if last == nil || nm.etcd == nil {
+		return
+	}
+
+	seconds := now.Sub(last.at).Seconds()
+	mbps := func(bytes uint64) float64 {
+		return math.Round(float64(bytes)*8/seconds/1e4) / 100
+	}
+	throughput := NodeThroughput{
+		Node:            nm.nodeUUID,
+		SampledAt:       now.UTC().Format(time.RFC3339),
+		IntervalSeconds: math.Round(seconds*10) / 10,
+		Users:           make(map[string]ObservedThroughput, len(users)),
+	}
+	for userID, current := range users {
+		previous, ok := last.users[userID]
+		// Counters start over when the node restarts
+		if !ok || current.rx < previous.rx || current.tx < previous.tx {
+			continue
+		}
+		throughput.Users[userID] = ObservedThroughput{
+			UpstreamMbps:   mbps(current.rx - previous.rx),
+			DownstreamMbps: mbps(current.tx - previous.tx),
+		}
+	}
+
+	data, err := json.Marshal(throughput)
+	if err != nil {
+		return
+	}
+	if _, err := nm.etcd.Client().Put(ctx, nodeThroughputKey(nm.nodeUUID), string(data)); err != nil {
+		logrus.WithError(err).Debugf("Failed to publish throughput of node %s", nm.nodeUUID)
+	}
+}
+
+// publishConnectedUsers stores the users with a session in data phase in etcd
+// when they change, so a replacement node can dial them again
+func (nm *NodeMonitor) publishConnectedUsers(ctx context.Context, connected []string) {
+	sort.Slice(connected, func(i, j int) bool { return lessUserId(connected[i], connected[j]) })
+	joined := strings.Join(connected, ",")
+	if (nm.connectedPublished && joined == nm.lastConnected) || nm.etcd == nil {
+		return
+	}
+	data, err := json.Marshal(NodeSessions{
+		Node:      nm.nodeUUID,
+		Connected: append([]string{}, connected...),
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	if _, err := nm.etcd.Client().Put(ctx, nodeSessionsKey(nm.nodeUUID), string(data)); err != nil {
+		logrus.WithError(err).Debugf("Failed to publish connected users of node %s", nm.nodeUUID)
+		return
+	}
+	nm.lastConnected, nm.connectedPublished = joined, true
+}
+
 func (nm *NodeMonitor) getPPPoESessionStats(ctx context.Context) error {
 	var (
 		totalPPPoEDataSessions          uint64
@@ -557,6 +687,7 @@ func (nm *NodeMonitor) getPPPoESessionStats(ctx context.Context) error {
 		totalPPPoETerminatedSessions    uint64
 		totalPPPoENotConfiguredSessions uint64
 		totalPPPoEErrorSessions         uint64
+		connected                       []string
 	)
 
 	hsiInfo, err := nm.fastrgClient.GetFastrgHsiInfo(ctx, &emptypb.Empty{})
@@ -567,6 +698,7 @@ func (nm *NodeMonitor) getPPPoESessionStats(ctx context.Context) error {
 		switch hsi.Status {
 		case "Data phase":
 			totalPPPoEDataSessions++
+			connected = append(connected, fmt.Sprint(hsi.UserId))
 		case "IPCP phase":
 			totalPPPoEIPCPSessions++
 		case "Auth phase":
@@ -587,6 +719,7 @@ func (nm *NodeMonitor) getPPPoESessionStats(ctx context.Context) error {
 		nm.metrics.perPPPoESessionTxPackets.WithLabelValues(nm.nodeUUID, fmt.Sprint(hsi.UserId)).Set(float64(hsi.PppoesTxPackets))
 		nm.metrics.perPPPoESessionTxBytes.WithLabelValues(nm.nodeUUID, fmt.Sprint(hsi.UserId)).Set(float64(hsi.PppoesTxBytes))
 	}
+	nm.publishConnectedUsers(ctx, connected)
 
 	nm.metrics.totalPPPoEDataSessions.WithLabelValues(nm.nodeUUID).Set(float64(totalPPPoEDataSessions))
 	nm.metrics.totalPPPoEIPCPSessions.WithLabelValues(nm.nodeUUID).Set(float64(totalPPPoEIPCPSessions))
@@ -612,51 +745,47 @@ func (nm *NodeMonitor) getDhcpLeaseStats(ctx context.Context) error {
 		return err
 	}
 
+	// Reservations are not reported by the node, the controller's config is
+	// used instead. Utilization is still reported without them.
+	reservations, err := nm.getDhcpReservations(ctx)
+	if err != nil {
+		logrus.WithError(err).Debugf("Failed to get DHCP reservations of node %s", nm.nodeUUID)
+	}
+
 	for _, dhcpInfo := range dhcpInfo.DhcpInfos {
-		if dhcpInfo.Status == "DHCP server is on" {
-			curLeaseCount := len(dhcpInfo.InuseIps)
-			nm.metrics.perUserDhcpCurLeaseCount.WithLabelValues(nm.nodeUUID, fmt.Sprint(dhcpInfo.UserId)).Set(float64(curLeaseCount))
-			ipStart, ipEnd, err := utils.ParseIPRange(dhcpInfo.IpRange)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to parse IP range %s from node %s", dhcpInfo.IpRange, nm.nodeUUID)
-				continue
-			}
-			ipStartUint, err := utils.IPv4toInt(ipStart)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to convert start IP %s to int from node %s", ipStart.String(), nm.nodeUUID)
-				continue
-			}
-			ipEndUint, err := utils.IPv4toInt(ipEnd)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to convert end IP %s to int from node %s", ipEnd.String(), nm.nodeUUID)
-				continue
-			}
-			maxLeaseCount := ipEndUint - ipStartUint + 1
-			nm.metrics.perUserDhcpMaxLeaseCount.WithLabelValues(nm.nodeUUID, fmt.Sprint(dhcpInfo.UserId)).Set(float64(maxLeaseCount))
+		running := dhcpInfo.Status == "DHCP server is on"
+		if !running && (dhcpInfo.Status != "DHCP server is off" || dhcpInfo.IpRange == "Not configured") {
+			totalNotConfiguredDhcpServer++
+			continue
+		}
+
+		userID := fmt.Sprint(dhcpInfo.UserId)
+		curLeaseCount := len(dhcpInfo.InuseIps)
+		nm.metrics.perUserDhcpCurLeaseCount.WithLabelValues(nm.nodeUUID, userID).Set(float64(curLeaseCount))
+		nm.metrics.perUserDhcpReservedCount.WithLabelValues(nm.nodeUUID, userID).Set(float64(len(reservations[userID])))
+		ipStart, ipEnd, err := utils.ParseAddrRange(dhcpInfo.IpRange)
+		if err != nil {
+			logrus.WithError(err).Debugf("Failed to parse IP range %s from node %s", dhcpInfo.IpRange, nm.nodeUUID)
+			continue
+		}
+		// Pool sizes are counted for both families, an IPv6 pool may exceed uint64
+		poolSize, err := utils.AddrRangeSize(ipStart, ipEnd)
+		if err != nil {
+			logrus.WithError(err).Debugf("Failed to get size of IP range %s from node %s", dhcpInfo.IpRange, nm.nodeUUID)
+			continue
+		}
+		maxLeaseCount, _ := new(big.Float).SetInt(poolSize).Float64()
+		family := "ipv6"
+		if ipStart.Is4() {
+			family = "ipv4"
+		}
+		nm.metrics.perUserDhcpMaxLeaseCount.WithLabelValues(nm.nodeUUID, userID).Set(maxLeaseCount)
+		usedCount := curLeaseCount + unleasedReservationsInPool(reservations[userID], dhcpInfo.InuseIps, ipStart, ipEnd)
+		nm.metrics.perUserDhcpPoolUtilization.WithLabelValues(nm.nodeUUID, userID, family).Set(float64(usedCount) / maxLeaseCount)
+		if running {
 			totalRunningDhcpServer++
-		} else if dhcpInfo.Status == "DHCP server is off" && dhcpInfo.IpRange != "Not configured" {
-			curLeaseCount := len(dhcpInfo.InuseIps)
-			nm.metrics.perUserDhcpCurLeaseCount.WithLabelValues(nm.nodeUUID, fmt.Sprint(dhcpInfo.UserId)).Set(float64(curLeaseCount))
-			ipStart, ipEnd, err := utils.ParseIPRange(dhcpInfo.IpRange)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to parse IP range %s from node %s", dhcpInfo.IpRange, nm.nodeUUID)
-				continue
-			}
-			ipStartUint, err := utils.IPv4toInt(ipStart)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to convert start IP %s to int from node %s", ipStart.String(), nm.nodeUUID)
-				continue
-			}
-			ipEndUint, err := utils.IPv4toInt(ipEnd)
-			if err != nil {
-				logrus.WithError(err).Debugf("Failed to convert end IP %s to int from node %s", ipEnd.String(), nm.nodeUUID)
-				continue
-			}
-			maxLeaseCount := ipEndUint - ipStartUint + 1
-			nm.metrics.perUserDhcpMaxLeaseCount.WithLabelValues(nm.nodeUUID, fmt.Sprint(dhcpInfo.UserId)).Set(float64(maxLeaseCount))
-			totalStoppedDhcpServer++
 		} else {
-			totalNotConfiguredDhcpServer++
+			totalStoppedDhcpServer++
 		}
 	}
 
@@ -666,3 +795,75 @@ func (nm *NodeMonitor) getDhcpLeaseStats(ctx context.Context) error {
 
 	return nil
 }
+
+// watchDhcpReservations marks the cached DHCP reservations stale whenever an
+// HSI config of the node changes after revision, until the monitor stops or
+// the watch fails
+func (nm *NodeMonitor) watchDhcpReservations(prefix string, revision int64) {
+	defer nm.reservationsWatched.Store(false)
+	for watchResp := range nm.etcd.Client().Watch(nm.ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision)) {
+		nm.reservationsStale.Store(true)
+		if err := watchResp.Err(); err != nil {
+			logrus.WithError(err).Debugf("Watch on HSI configs of node %s failed", nm.nodeUUID)
+			return
+		}
+	}
+}
+
+// getDhcpReservations returns the reserved addresses of the subscribers of the
+// node, keyed by user ID
+func (nm *NodeMonitor) getDhcpReservations(ctx context.Context) (map[string][]netip.Addr, error) {
+	if nm.etcd == nil {
+		return nil, nil
+	}
+	if nm.reservations != nil && nm.reservationsWatched.Load() && !nm.reservationsStale.Load() {
+		return nm.reservations, nil
+	}
+	// A change while reading marks the cache stale again
+	nm.reservationsStale.Store(false)
+	prefix := fmt.Sprintf("configs/%s/hsi/", nm.nodeUUID)
+	resp, err := nm.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make(map[string][]netip.Addr)
+	for _, kv := range resp.Kvs {
+		userID := strings.TrimPrefix(string(kv.Key), prefix)
+		if strings.Contains(userID, "/") {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			continue
+		}
+		for _, reservation := range config.Config.DHCPReservations {
+			if ip, err := netip.ParseAddr(reservation.IP); err == nil {
+				reservations[userID] = append(reservations[userID], ip.Unmap())
+			}
+		}
+	}
+	nm.reservations = reservations
+	if !nm.reservationsWatched.Swap(true) {
+		go nm.watchDhcpReservations(prefix, resp.Header.Revision+1)
+	}
+	return reservations, nil
+}
+
+// unleasedReservationsInPool counts the reserved addresses inside a pool that
+// are not leased at the moment, as the DHCP server holds them back anyway
+func unleasedReservationsInPool(reserved []netip.Addr, inuseIps []string, start, end netip.Addr) int {
+	leased := make(map[string]bool, len(inuseIps))
+	for _, inuse := range inuseIps {
+		if ip, err := netip.ParseAddr(inuse); err == nil {
+			leased[ip.Unmap().String()] = true
+		}
+	}
+	count := 0
+	for _, ip := range reserved {
+		if !leased[ip.String()] && utils.AddrInRange(ip, start, end) {
+			count++
+		}
+	}
+	return count
+}
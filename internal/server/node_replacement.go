@@ -0,0 +1,554 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"fastrg-controller/internal/utils"
+)
+
+const (
+	// NodeReplacementDialDelay defines how long a replacement node has to be
+	// registered before its subscribers are dialed (in seconds)
+	NodeReplacementDialDelay = 30
+
+	// nodeReplacementBatchSize keeps each transaction of a replacement below
+	// the etcd limit of 128 operations per transaction. A batch compares at
+	// most one key per operation besides the node data, so it stays below
+	// the limit of 128 compares as well.
+	nodeReplacementBatchSize = 100
+
+	nodeReplacementPrefix = "node_replacements/"
+)
+
+// Node replacement modes
+const (
+	ReplaceModeMove  = "move"
+	ReplaceModeClone = "clone"
+)
+
+// Node replacement statuses
+const (
+	ReplacementStatusCopying      = "copying"
+	ReplacementStatusAwaitingNode = "awaiting_node"
+	ReplacementStatusDialing      = "dialing"
+	ReplacementStatusCompleted    = "completed"
+	ReplacementStatusFailed       = "failed"
+)
+
+// NodeSessions lists the users of a node with a connected session, as last
+// reported by the node
+type NodeSessions struct {
+	Node      string   `json:"node" example:"node001"`
+	Connected []string `json:"connected" example:"1,2,5"`
+	UpdatedAt string   `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// ReplaceNodeRequest represents the request to replace a failed node
+type ReplaceNodeRequest struct {
+	NewNodeID string `json:"new_node_id" example:"node002"`
+	// Mode is move (default), which removes the data of the old node, or clone, which keeps it
+	Mode string `json:"mode" example:"move"`
+}
+
+// NodeReplacement records the replacement of a failed node by a new one
+type NodeReplacement struct {
+	OldNodeID string `json:"old_node_id" example:"node001"`
+	NewNodeID string `json:"new_node_id" example:"node002"`
+	Mode      string `json:"mode" example:"move"`
+	Status    string `json:"status,omitempty" example:"awaiting_node"`
+	Error     string `json:"error,omitempty"`
+	DryRun    bool   `json:"dry_run" example:"false"`
+	// Keys counts the etcd keys written for the new node by kind
+	Keys map[string]int `json:"keys"`
+	// Dial lists the users that were connected on the old node
+	Dial        []string               `json:"dial"`
+	DialResults []ScheduleTargetResult `json:"dial_results,omitempty"`
+	CreatedBy   string                 `json:"created_by,omitempty" example:"admin"`
+	CreatedAt   string                 `json:"created_at,omitempty" example:"2024-01-01T00:00:00Z"`
+	UpdatedAt   string                 `json:"updated_at,omitempty" example:"2024-01-01T00:00:00Z"`
+	CompletedAt string                 `json:"completed_at,omitempty" example:"2024-01-01T00:05:00Z"`
+}
+
+// nodeKeySource is an etcd key or prefix holding data of a node
+type nodeKeySource struct {
+	kind   string
+	key    string
+	prefix bool
+}
+
+// nodeKeySources lists the data of a node that moves to its replacement.
+// What the node reports about itself (capacity, throughput, sessions and
+// failed events) and its maintenance state describe the failed hardware and
+// stay behind.
+func nodeKeySources(nodeId string) []nodeKeySource {
+	return []nodeKeySource{
+		{"configs", fmt.Sprintf("configs/%s/", nodeId), true},
+		{"hsi_history", fmt.Sprintf("history/hsi/%s/", nodeId), true},
+		{"acl_history", fmt.Sprintf("history/acl/%s/", nodeId), true},
+		{"vlan_index", vlanIndexPrefix(nodeId), true},
+		{"subscriber_archives", subscriberArchivePrefix(nodeId), true},
+		{"subscriber_count", fmt.Sprintf("user_counts/%s/", nodeId), false},
+		{"nat_limits", natLimitsKey(nodeId), false},
+		{"nic_capacity", nicCapacityKey(nodeId), false},
+		{"vlan_range", nodeVlanRangeKey(nodeId), false},
+	}
+}
+
+// nodeFields are the JSON fields naming the node a value belongs to
+var nodeFields = []string{"node", "node_id"}
+
+func nodeSessionsKey(nodeId string) string {
+	return fmt.Sprintf("sessions/%s", nodeId)
+}
+
+func nodeReplacementKey(newNodeId string) string {
+	return nodeReplacementPrefix + newNodeId
+}
+
+// errNodeDataChanged reports that data read for a replacement changed before
+// all of its batches were committed
+var errNodeDataChanged = errors.New("node data changed during the replacement")
+
+// nodeReplacementPlan holds the writes of a replacement, planned from one
+// revision of etcd. Puts are applied before deletes, so a replacement that
+// fails half way loses nothing and can be run again.
+type nodeReplacementPlan struct {
+	replacement NodeReplacement
+	puts        []clientv3.Op
+	deletes     []clientv3.Op
+	// guards compare the data of the old node with the planned revision, every
+	// batch checks them
+	guards []clientv3.Cmp
+	// putGuards compare keys rewritten in place with the revision they were
+	// read at, by the index of their put
+	putGuards map[int]clientv3.Cmp
+	// recordRevision is the mod revision of the replacement record of the new node
+	recordRevision int64
+}
+
+// planNodeReplacement collects the writes re-keying the data of a node to a
+// new node ID and the references other data holds to it: IPAM subnets, SNAT
+// port blocks and pools, and scheduled jobs
+func (r *RestServer) planNodeReplacement(ctx context.Context, oldNode string, req ReplaceNodeRequest) (*nodeReplacementPlan, *apiError) {
+	newNode := req.NewNodeID
+	if newNode == "" || strings.Contains(newNode, "/") {
+		return nil, newAPIError(http.StatusBadRequest, "A valid new node ID is required")
+	}
+	if newNode == oldNode {
+		return nil, newAPIError(http.StatusBadRequest, "New node ID must differ from the old node ID")
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = ReplaceModeMove
+	}
+	if mode != ReplaceModeMove && mode != ReplaceModeClone {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("Mode must be either %s or %s", ReplaceModeMove, ReplaceModeClone))
+	}
+
+	// Both nodes would serve the same subscribers
+	nodeKey := fmt.Sprintf("nodes/%s", oldNode)
+	nodeResp, err := r.etcd.Client().Get(ctx, nodeKey)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check node existence")
+	}
+	if len(nodeResp.Kvs) > 0 {
+		return nil, newAPIError(http.StatusConflict, fmt.Sprintf("Node %s is still registered, unregister it first", oldNode))
+	}
+	// Everything else is read at the same revision, so the copies are consistent
+	revision := nodeResp.Header.Revision
+	atRevision := clientv3.WithRev(revision)
+	unchanged := func(key string) clientv3.Cmp {
+		return clientv3.Compare(clientv3.ModRevision(key), "<", revision+1)
+	}
+
+	plan := &nodeReplacementPlan{
+		replacement: NodeReplacement{
+			OldNodeID: oldNode,
+			NewNodeID: newNode,
+			Mode:      mode,
+			Keys:      make(map[string]int),
+			Dial:      []string{},
+		},
+		guards:    []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(nodeKey), "=", 0)},
+		putGuards: make(map[int]clientv3.Cmp),
+	}
+	recordResp, err := r.etcd.Client().Get(ctx, nodeReplacementKey(newNode), atRevision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get node replacement")
+	}
+	// A failed replacement can be run again, its copies are overwritten
+	resuming := false
+	if len(recordResp.Kvs) > 0 {
+		var previous NodeReplacement
+		if err := json.Unmarshal(recordResp.Kvs[0].Value, &previous); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to parse node replacement")
+		}
+		if previous.OldNodeID != oldNode || previous.Status != ReplacementStatusFailed {
+			return nil, newAPIError(http.StatusConflict,
+				fmt.Sprintf("Node %s already replaces node %s", newNode, previous.OldNodeID))
+		}
+		resuming = true
+		plan.recordRevision = recordResp.Kvs[0].ModRevision
+	}
+	if !resuming {
+		resp, err := r.etcd.Client().Get(ctx, fmt.Sprintf("configs/%s/", newNode), clientv3.WithPrefix(), clientv3.WithCountOnly(), atRevision)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get node configs")
+		}
+		if resp.Count > 0 {
+			return nil, newAPIError(http.StatusConflict, fmt.Sprintf("Node %s already has configs", newNode))
+		}
+	}
+
+	hsiPrefix := fmt.Sprintf("configs/%s/hsi/", oldNode)
+	configured := make(map[string]bool)
+	suspended := make(map[string]bool)
+	for i, source := range nodeKeySources(oldNode) {
+		target := nodeKeySources(newNode)[i]
+		var opts []clientv3.OpOption
+		guard := unchanged(source.key)
+		if source.prefix {
+			opts = append(opts, clientv3.WithPrefix())
+			guard = guard.WithPrefix()
+		}
+		resp, err := r.etcd.Client().Get(ctx, source.key, append(opts, atRevision)...)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get node data")
+		}
+		plan.guards = append(plan.guards, guard)
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			value, _, _ := utils.ReplaceJSONField(kv.Value, nodeFields, oldNode, newNode)
+			plan.puts = append(plan.puts, clientv3.OpPut(target.key+strings.TrimPrefix(key, source.key), string(value)))
+			plan.replacement.Keys[source.kind]++
+
+			if userId, ok := strings.CutPrefix(key, hsiPrefix); ok && !strings.Contains(userId, "/") {
+				configured[userId] = true
+			}
+			if userId, ok := strings.CutPrefix(key, subscriberPrefix(oldNode)); ok {
+				var subscriber Subscriber
+				if json.Unmarshal(kv.Value, &subscriber) == nil && subscriber.State == SubscriberSuspended {
+					suspended[userId] = true
+				}
+			}
+		}
+		if mode == ReplaceModeMove && len(resp.Kvs) > 0 {
+			plan.deletes = append(plan.deletes, clientv3.OpDelete(source.key, opts...))
+		}
+	}
+	if plan.replacement.Keys["configs"] == 0 && plan.replacement.Keys["subscriber_count"] == 0 {
+		return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("Node %s has no configs to replace", oldNode))
+	}
+	if mode == ReplaceModeClone {
+		// A port block belongs to one node, deleting a subscriber of the kept
+		// copy must not release the block of the new node
+		plan.deletes = append(plan.deletes, clientv3.OpDelete(snatAllocationPrefix(oldNode), clientv3.WithPrefix()))
+	}
+
+	// References held by data of all nodes are rewritten in place, if they
+	// did not change since they were read. In clone mode the IPAM subnets
+	// move to the new node as well, the kept configs of the old node still
+	// carry them but can only be changed to other subnets or deleted.
+	rewrite := func(key, value string, modRevision int64) {
+		plan.putGuards[len(plan.puts)] = clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)
+		plan.puts = append(plan.puts, clientv3.OpPut(key, value))
+	}
+	for _, shared := range []struct{ kind, prefix string }{{"ipam", ipamPrefix}, {"schedules", scheduleJobsPrefix}} {
+		resp, err := r.etcd.Client().Get(ctx, shared.prefix, clientv3.WithPrefix(), atRevision)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get node references")
+		}
+		for _, kv := range resp.Kvs {
+			if value, replaced, _ := utils.ReplaceJSONField(kv.Value, nodeFields, oldNode, newNode); replaced {
+				rewrite(string(kv.Key), string(value), kv.ModRevision)
+				plan.replacement.Keys[shared.kind]++
+			}
+		}
+	}
+	blocksResp, err := r.etcd.Client().Get(ctx, "index/snat/", clientv3.WithPrefix(), atRevision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get SNAT port blocks")
+	}
+	for _, kv := range blocksResp.Kvs {
+		// Port blocks point to "<node>/<user>"
+		if userId, ok := strings.CutPrefix(string(kv.Value), oldNode+"/"); ok {
+			rewrite(string(kv.Key), newNode+"/"+userId, kv.ModRevision)
+			plan.replacement.Keys["snat_blocks"]++
+		}
+	}
+	registry, registryRevision, err := r.getSNATPoolRegistry(ctx, atRevision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get SNAT pools")
+	}
+	moved := 0
+	for name, prefix := range registry {
+		if pool, ok := strings.CutPrefix(name, oldNode+"/"); ok {
+			registry[newNode+"/"+pool] = prefix
+			if mode == ReplaceModeMove {
+				delete(registry, name)
+			}
+			moved++
+		}
+	}
+	if moved > 0 {
+		registryJSON, err := json.Marshal(registry)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to marshal SNAT pools")
+		}
+		rewrite(snatPoolRegistryKey, string(registryJSON), registryRevision)
+		plan.replacement.Keys["snat_pools"] = moved
+	}
+
+	// Subscribers connected when the old node was last seen are dialed on the new one
+	sessionsResp, err := r.etcd.Client().Get(ctx, nodeSessionsKey(oldNode), atRevision)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get node sessions")
+	}
+	if len(sessionsResp.Kvs) > 0 {
+		var sessions NodeSessions
+		if err := json.Unmarshal(sessionsResp.Kvs[0].Value, &sessions); err == nil {
+			for _, userId := range sessions.Connected {
+				if configured[userId] && !suspended[userId] {
+					plan.replacement.Dial = append(plan.replacement.Dial, userId)
+				}
+			}
+		}
+	}
+	return plan, nil
+}
+
+// commitInBatches applies operations in transactions of at most
+// nodeReplacementBatchSize operations. Each transaction only commits if the
+// guards and the guards of its operations hold, otherwise errNodeDataChanged
+// is returned.
+func (r *RestServer) commitInBatches(ctx context.Context, guards []clientv3.Cmp, ops []clientv3.Op, opGuards map[int]clientv3.Cmp) error {
+	for start := 0; start < len(ops); start += nodeReplacementBatchSize {
+		end := min(start+nodeReplacementBatchSize, len(ops))
+		cmps := append([]clientv3.Cmp{}, guards...)
+		for i := start; i < end; i++ {
+			if guard, ok := opGuards[i]; ok {
+				cmps = append(cmps, guard)
+			}
+		}
+		txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops[start:end]...).Commit()
+		if err != nil {
+			return err
+		}
+		if !txnResp.Succeeded {
+			return errNodeDataChanged
+		}
+	}
+	return nil
+}
+
+// putNodeReplacement stores a replacement record if it was not modified since modRevision
+func (r *RestServer) putNodeReplacement(ctx context.Context, replacement *NodeReplacement, modRevision int64) (int64, bool, error) {
+	replacement.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	replacementJSON, err := json.Marshal(replacement)
+	if err != nil {
+		return 0, false, err
+	}
+	key := nodeReplacementKey(replacement.NewNodeID)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, string(replacementJSON))).
+		Commit()
+	if err != nil {
+		return 0, false, err
+	}
+	return txnResp.Header.Revision, txnResp.Succeeded, nil
+}
+
+// dialReplacementNodes dials the previously connected subscribers of the
+// replacement nodes that registered at least NodeReplacementDialDelay ago
+func (s *Scheduler) dialReplacementNodes(ctx context.Context) {
+	resp, err := s.etcd.Client().Get(ctx, nodeReplacementPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list node replacements")
+		return
+	}
+
+	for _, kv := range resp.Kvs {
+		var replacement NodeReplacement
+		if err := json.Unmarshal(kv.Value, &replacement); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse node replacement %s", kv.Key)
+			continue
+		}
+		if replacement.Status != ReplacementStatusAwaitingNode {
+			continue
+		}
+		nodeResp, err := s.etcd.Client().Get(ctx, fmt.Sprintf("nodes/%s", replacement.NewNodeID))
+		if err != nil || len(nodeResp.Kvs) == 0 {
+			continue
+		}
+		var nodeData map[string]interface{}
+		if err := json.Unmarshal(nodeResp.Kvs[0].Value, &nodeData); err != nil {
+			continue
+		}
+		// The node loads its configs after registering
+		registeredAt, _ := nodeData["registered_at"].(float64)
+		if time.Now().Unix()-int64(registeredAt) < NodeReplacementDialDelay {
+			continue
+		}
+
+		// Claim the replacement first, so a leader change never dials twice
+		replacement.Status = ReplacementStatusDialing
+		modRevision, claimed, err := s.rest.putNodeReplacement(ctx, &replacement, kv.ModRevision)
+		if err != nil || !claimed {
+			continue
+		}
+		logrus.Infof("Replacement node %s registered, dialing %d subscribers of node %s",
+			replacement.NewNodeID, len(replacement.Dial), replacement.OldNodeID)
+		replacement.DialResults = []ScheduleTargetResult{}
+		for _, userId := range replacement.Dial {
+			result := ScheduleTargetResult{Target: fmt.Sprintf("%s/%s", replacement.NewNodeID, userId)}
+			if apiErr := s.rest.sendWANCommand(ctx, replacement.NewNodeID, userId, WANActionConnect); apiErr != nil {
+				result.Error = apiErr.Error()
+			}
+			replacement.DialResults = append(replacement.DialResults, result)
+		}
+		replacement.Status = ReplacementStatusCompleted
+		replacement.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+		if _, _, err := s.rest.putNodeReplacement(ctx, &replacement, modRevision); err != nil {
+			logrus.WithError(err).Errorf("Failed to save node replacement of %s", replacement.NewNodeID)
+		}
+	}
+}
+
+// ReplaceNode recreates the subscribers of a failed node on a new node
+// @Summary      Replace node
+// @Description  Re-key the configs, subscriber count, node settings, VLAN index, archives and HSI/ACL history of a
+// @Description  failed node to a new node ID, together with its IPAM subnets, SNAT port blocks and scheduled jobs.
+// @Description  In move mode the old keys are removed, in clone mode they are kept except for the SNAT port blocks
+// @Description  and IPAM subnets, which belong to the new node. The kept configs can only give their subnets up.
+// @Description  The old node must be unregistered. The data is read at one revision and every batch only commits
+// @Description  if it did not change since, otherwise the replacement fails with 409 and can be run again.
+// @Description  Subscribers connected when the old node was last seen are dialed once the new node has registered.
+// @Description  dry_run only reports the changes.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string              true   "Old node ID"
+// @Param        dry_run  query     bool                false  "Only report the changes"
+// @Param        request  body      ReplaceNodeRequest  true   "Replacement node"
+// @Success      200      {object}  NodeReplacement
+// @Failure      400      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/replace [post]
+func (r *RestServer) ReplaceNode(c *gin.Context) {
+	var req ReplaceNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	oldNode := c.Param("nodeId")
+	plan, apiErr := r.planNodeReplacement(ctx, oldNode, req)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	replacement := plan.replacement
+	if dryRun {
+		replacement.DryRun = true
+		c.JSON(http.StatusOK, replacement)
+		return
+	}
+
+	replacement.Status = ReplacementStatusCopying
+	replacement.CreatedBy = username
+	replacement.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	modRevision, stored, err := r.putNodeReplacement(ctx, &replacement, plan.recordRevision)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save node replacement"})
+		return
+	}
+	if !stored {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Node %s is already being replaced", oldNode)})
+		return
+	}
+
+	status := http.StatusInternalServerError
+	err = r.commitInBatches(ctx, plan.guards, plan.puts, plan.putGuards)
+	if err != nil {
+		replacement.Error = "Failed to copy node data"
+	} else if err = r.commitInBatches(ctx, plan.guards, plan.deletes, nil); err != nil {
+		replacement.Error = "Failed to remove the data of the old node"
+	}
+	if errors.Is(err, errNodeDataChanged) {
+		replacement.Error = "Node data was modified by another request"
+		status = http.StatusConflict
+	}
+	if replacement.Error != "" {
+		replacement.Status = ReplacementStatusFailed
+		if _, _, err := r.putNodeReplacement(ctx, &replacement, modRevision); err != nil {
+			logrus.WithError(err).Errorf("Failed to save node replacement of %s", replacement.NewNodeID)
+		}
+		c.JSON(status, gin.H{"error": replacement.Error + ", run the replacement again"})
+		return
+	}
+
+	replacement.Status = ReplacementStatusAwaitingNode
+	if len(replacement.Dial) == 0 {
+		replacement.Status = ReplacementStatusCompleted
+		replacement.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, _, err := r.putNodeReplacement(ctx, &replacement, modRevision); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save node replacement"})
+		return
+	}
+
+	logrus.Infof("Node %s replaced by %s (%s) by %s, %d subscribers to dial", oldNode, replacement.NewNodeID, replacement.Mode, username, len(replacement.Dial))
+	c.JSON(http.StatusOK, replacement)
+}
+
+// GetNodeReplacement returns the replacement a node was created for
+// @Summary      Get node replacement
+// @Description  Get the replacement of a failed node by this node, with the subscribers dialed once it registered
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "New node ID"
+// @Success      200     {object}  NodeReplacement
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/replacement [get]
+func (r *RestServer) GetNodeReplacement(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), nodeReplacementKey(c.Param("nodeId")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node replacement"})
+		return
+	}
+	if len(resp.Kvs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node replacement not found"})
+		return
+	}
+	var replacement NodeReplacement
+	if err := json.Unmarshal(resp.Kvs[0].Value, &replacement); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse node replacement"})
+		return
+	}
+	c.JSON(http.StatusOK, replacement)
+}
@@ -0,0 +1,158 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// replaceTestNode runs the replacement of node1 with a request body
+func replaceTestNode(t *testing.T, r *RestServer, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := r.generateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/nodes/node1/replace", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Header.Set("Authorization", token)
+	c.Params = gin.Params{{Key: "nodeId", Value: "node1"}}
+	r.ReplaceNode(c)
+	return w
+}
+
+func TestReplaceNodeCommitsInBatches(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+
+	// Far more keys than etcd accepts in one transaction
+	const users = 150
+	for i := 1; i <= users; i++ {
+		userId := strconv.Itoa(i)
+		config := HSIConfigWithMetadata{Config: testHSIConfig(userId, strconv.Itoa(100+i))}
+		config.Metadata.Node = "node1"
+		configJSON, _ := json.Marshal(config)
+		putTestJSON(t, r, hsiConfigKey("node1", userId), string(configJSON))
+		putTestJSON(t, r, vlanIndexKey("node1", vlanTag{inner: 100 + i}), userId)
+	}
+	putTestJSON(t, r, nodeSessionsKey("node1"), `{"node":"node1","connected":["1","2"]}`)
+
+	w := replaceTestNode(t, r, `{"new_node_id":"node2"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ReplaceNode() status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var replacement NodeReplacement
+	if err := json.Unmarshal(w.Body.Bytes(), &replacement); err != nil {
+		t.Fatal(err)
+	}
+	if replacement.Status != ReplacementStatusAwaitingNode {
+		t.Errorf("status = %s, want %s", replacement.Status, ReplacementStatusAwaitingNode)
+	}
+	if replacement.Keys["configs"] != users || replacement.Keys["vlan_index"] != users {
+		t.Errorf("keys = %v, want %d configs and VLAN index entries", replacement.Keys, users)
+	}
+	if fmt.Sprint(replacement.Dial) != "[1 2]" {
+		t.Errorf("dial = %v, want [1 2]", replacement.Dial)
+	}
+
+	for node, want := range map[string]int64{"node1": 0, "node2": users} {
+		resp, err := r.etcd.Client().Get(ctx, fmt.Sprintf("configs/%s/hsi/", node), clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Count != want {
+			t.Errorf("%s has %d HSI configs, want %d", node, resp.Count, want)
+		}
+	}
+	stored, _, err := r.loadHSIConfig(ctx, "node2", strconv.Itoa(users))
+	if err != nil || stored == nil {
+		t.Fatalf("loadHSIConfig() = %v, %v", stored, err)
+	}
+	if stored.Metadata.Node != "node2" {
+		t.Errorf("metadata node = %s, want node2", stored.Metadata.Node)
+	}
+	if owner, _, _ := r.getVlanOwner(ctx, "node2", vlanTag{inner: 100 + users}); owner != strconv.Itoa(users) {
+		t.Errorf("VLAN owner on node2 = %q, want %d", owner, users)
+	}
+}
+
+func TestReplaceNodeBatchesFailIfNodeDataChanged(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+	plan, apiErr := r.planNodeReplacement(ctx, "node1", ReplaceNodeRequest{NewNodeID: "node2"})
+	if apiErr != nil {
+		t.Fatalf("planNodeReplacement() error = %v", apiErr.Body)
+	}
+
+	// The old node gets a subscriber after the replacement was planned
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("2", "101"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+	if err := r.commitInBatches(ctx, plan.guards, plan.puts, plan.putGuards); err != errNodeDataChanged {
+		t.Fatalf("commitInBatches() error = %v, want %v", err, errNodeDataChanged)
+	}
+	if stored, _, _ := r.loadHSIConfig(ctx, "node2", "1"); stored != nil {
+		t.Error("node2 got a copy of user 1")
+	}
+}
+
+func TestReplaceNodeCloneMovesIPAMSubnets(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	putTestJSON(t, r, ipamSupernetKey("site"), `{"name":"site","prefix":"10.16.0.0/16","subnet_length":24}`)
+	config := testHSIConfig("1", "100")
+	config.DHCPAddrPool, config.DHCPSubnet, config.DHCPGateway = "", "", ""
+	stored, apiErr := r.saveHSIConfig(ctx, "node1", config, "admin", true, "")
+	if apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	if w := replaceTestNode(t, r, `{"new_node_id":"node2","mode":"clone"}`); w.Code != http.StatusOK {
+		t.Fatalf("ReplaceNode() status = %d, body = %s", w.Code, w.Body.String())
+	}
+	prefix, _ := hsiLANPrefix(stored.Config)
+	allocation := func() *IPAMAllocation {
+		t.Helper()
+		state, err := r.loadIPAM(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, allocation := range state.allocations {
+			if allocation.Prefix == prefix.String() {
+				return &allocation
+			}
+		}
+		return nil
+	}
+	if a := allocation(); a == nil || a.NodeID != "node2" {
+		t.Fatalf("allocation of %s = %v, want node2", prefix, a)
+	}
+
+	// The kept copy can not take the subnet back, deleting it leaves the
+	// allocation of the new node alone
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", stored.Config, "admin", false, ""); apiErr == nil || apiErr.Status != http.StatusConflict {
+		t.Errorf("saveHSIConfig() of the kept copy error = %v, want a conflict", apiErr)
+	}
+	if apiErr := r.deleteHSIConfig(ctx, "node1", "1", "", "admin"); apiErr != nil {
+		t.Fatalf("deleteHSIConfig() error = %v", apiErr.Body)
+	}
+	if a := allocation(); a == nil || a.NodeID != "node2" {
+		t.Errorf("allocation of %s after deleting the kept copy = %v, want node2", prefix, a)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"strconv"
+)
+
+// PPPoE authentication protocols. auto accepts whichever of PAP and CHAP the
+// BNG requests.
+const (
+	PPPoEAuthAuto = "auto"
+	PPPoEAuthPAP  = "pap"
+	PPPoEAuthCHAP = "chap"
+)
+
+const (
+	MinPPPoEMRU                 = 576
+	MaxPPPoEMRU                 = 1492
+	DefaultPPPoEMRU             = 1492
+	MaxPPPoELCPEchoInterval     = 300
+	DefaultPPPoELCPEchoInterval = 10
+	MinPPPoELCPEchoFailure      = 1
+	MaxPPPoELCPEchoFailure      = 30
+	DefaultPPPoELCPEchoFailure  = 3
+	MaxPPPoETagLength           = 64
+)
+
+// PPPoEOptions are the PPPoE client settings of a subscriber with the
+// defaults applied, as sent to the node
+type PPPoEOptions struct {
+	ServiceName     string `json:"service_name"`
+	ACName          string `json:"ac_name"`
+	MRU             int    `json:"mru"`
+	AuthProtocol    string `json:"auth_protocol"`
+	LCPEchoInterval int    `json:"lcp_echo_interval"`
+	LCPEchoFailure  int    `json:"lcp_echo_failure"`
+}
+
+// resolvePPPoEOptions returns the PPPoE options of a valid config, using the
+// defaults for the options it leaves empty
+func resolvePPPoEOptions(config HSIConfig) PPPoEOptions {
+	options := PPPoEOptions{
+		ServiceName:     config.PPPoEServiceName,
+		ACName:          config.PPPoEACName,
+		MRU:             DefaultPPPoEMRU,
+		AuthProtocol:    PPPoEAuthAuto,
+		LCPEchoInterval: DefaultPPPoELCPEchoInterval,
+		LCPEchoFailure:  DefaultPPPoELCPEchoFailure,
+	}
+	if mru, err := strconv.Atoi(config.PPPoEMRU); err == nil {
+		options.MRU = mru
+	}
+	if config.PPPoEAuthProtocol != "" {
+		options.AuthProtocol = config.PPPoEAuthProtocol
+	}
+	if interval, err := strconv.Atoi(config.PPPoELCPEchoInterval); err == nil {
+		options.LCPEchoInterval = interval
+	}
+	if failure, err := strconv.Atoi(config.PPPoELCPEchoFailure); err == nil {
+		options.LCPEchoFailure = failure
+	}
+	return options
+}
+
+// validatePrintableASCII checks a free-form value sent on the wire, such as a
+// PPPoE tag or a DHCP option
+func validatePrintableASCII(errs *fieldErrors, field, name, value string, maxLength int) {
+	if len(value) > maxLength {
+		errs.add(field, "%s must not be longer than %d characters", name, maxLength)
+		return
+	}
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			errs.add(field, "%s must only contain printable ASCII characters", name)
+			return
+		}
+	}
+}
+
+// validatePPPoEOptions checks the optional PPPoE client settings
+func validatePPPoEOptions(errs *fieldErrors, config HSIConfig) {
+	validatePrintableASCII(errs, "pppoe_service_name", "Service-Name", config.PPPoEServiceName, MaxPPPoETagLength)
+	validatePrintableASCII(errs, "pppoe_ac_name", "AC-Name", config.PPPoEACName, MaxPPPoETagLength)
+
+	if config.PPPoEMRU != "" {
+		if mru, err := strconv.Atoi(config.PPPoEMRU); err != nil || mru < MinPPPoEMRU || mru > MaxPPPoEMRU {
+			errs.add("pppoe_mru", "MRU must be between %d and %d", MinPPPoEMRU, MaxPPPoEMRU)
+		}
+	}
+
+	switch config.PPPoEAuthProtocol {
+	case "", PPPoEAuthAuto, PPPoEAuthPAP, PPPoEAuthCHAP:
+	default:
+		errs.add("pppoe_auth_protocol", "Authentication protocol must be one of %s, %s or %s",
+			PPPoEAuthAuto, PPPoEAuthPAP, PPPoEAuthCHAP)
+	}
+
+	if config.PPPoELCPEchoInterval != "" {
+		if interval, err := strconv.Atoi(config.PPPoELCPEchoInterval); err != nil || interval < 0 || interval > MaxPPPoELCPEchoInterval {
+			errs.add("pppoe_lcp_echo_interval", "LCP echo interval must be between 0 (disabled) and %d seconds", MaxPPPoELCPEchoInterval)
+		}
+	}
+	if config.PPPoELCPEchoFailure != "" {
+		if failure, err := strconv.Atoi(config.PPPoELCPEchoFailure); err != nil || failure < MinPPPoELCPEchoFailure || failure > MaxPPPoELCPEchoFailure {
+			errs.add("pppoe_lcp_echo_failure", "LCP echo failure count must be between %d and %d", MinPPPoELCPEchoFailure, MaxPPPoELCPEchoFailure)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// VLAN modes of a node. Single-tagged nodes identify subscribers by one VLAN,
+// QinQ nodes by an outer S-VLAN and inner C-VLAN pair.
+const (
+	VlanModeSingle = "single"
+	VlanModeQinQ   = "qinq"
+)
+
+// TPIDs accepted for the outer tag. 0x88a8 is the 802.1ad S-tag, the others
+// are used by older equipment.
+const (
+	TPID8100         = "0x8100"
+	TPID88A8         = "0x88a8"
+	TPID9100         = "0x9100"
+	TPID9200         = "0x9200"
+	DefaultOuterTPID = TPID88A8
+)
+
+var outerTPIDs = map[string]bool{TPID8100: true, TPID88A8: true, TPID9100: true, TPID9200: true}
+
+// NodeVlanMode represents the VLAN mode of a node
+type NodeVlanMode struct {
+	Node      string `json:"node" example:"node001"`
+	Mode      string `json:"mode" example:"qinq"`
+	UpdatedBy string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// UpdateNodeVlanMode represents the request to change the VLAN mode of a node
+type UpdateNodeVlanMode struct {
+	Mode string `json:"mode" example:"qinq"`
+}
+
+// nodeVlanModeKey is read by the node to know how subscriber traffic is tagged
+func nodeVlanModeKey(nodeId string) string {
+	return fmt.Sprintf("configs/%s/vlan_mode", nodeId)
+}
+
+// outerTPID returns the TPID of the outer tag of a QinQ config
+func outerTPID(config HSIConfig) string {
+	if config.OuterTPID == "" {
+		return DefaultOuterTPID
+	}
+	return strings.ToLower(config.OuterTPID)
+}
+
+// validateOuterVlan checks the format of the outer tag fields, whether they
+// are allowed at all depends on the node and is checked by checkVlanMode
+func validateOuterVlan(errs *fieldErrors, config HSIConfig) {
+	if config.OuterVlanID != "" {
+		validateVlanID(errs, "outer_vlan_id", config.OuterVlanID)
+	}
+	if config.OuterTPID == "" {
+		return
+	}
+	if config.OuterVlanID == "" {
+		errs.add("outer_tpid", "Outer TPID requires an outer VLAN ID")
+	} else if !outerTPIDs[strings.ToLower(config.OuterTPID)] {
+		errs.add("outer_tpid", "Outer TPID must be one of %s, %s, %s or %s", TPID88A8, TPID8100, TPID9100, TPID9200)
+	}
+}
+
+// getNodeVlanMode reads the VLAN mode of a node together with its etcd mod
+// revision. Nodes without one are single-tagged.
+func (r *RestServer) getNodeVlanMode(ctx context.Context, nodeId string) (NodeVlanMode, int64, error) {
+	mode := NodeVlanMode{Node: nodeId, Mode: VlanModeSingle}
+	resp, err := r.etcd.Client().Get(ctx, nodeVlanModeKey(nodeId))
+	if err != nil {
+		return mode, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return mode, 0, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &mode); err != nil {
+		return mode, 0, err
+	}
+	return mode, resp.Kvs[0].ModRevision, nil
+}
+
+// checkVlanMode checks that a config is tagged the way its node expects and
+// returns the mod revision of the node's VLAN mode, so writers can make sure
+// it did not change before they commit
+func (r *RestServer) checkVlanMode(ctx context.Context, nodeId string, config HSIConfig) (int64, *apiError) {
+	mode, modRevision, err := r.getNodeVlanMode(ctx, nodeId)
+	if err != nil {
+		return 0, newAPIError(http.StatusInternalServerError, "Failed to get node VLAN mode")
+	}
+	var errs fieldErrors
+	switch {
+	case mode.Mode == VlanModeQinQ && config.OuterVlanID == "":
+		errs.add("outer_vlan_id", "Outer VLAN ID is required, node %s uses QinQ", nodeId)
+	case mode.Mode != VlanModeQinQ && config.OuterVlanID != "":
+		errs.add("outer_vlan_id", "Outer VLAN ID is not allowed, node %s is single-tagged", nodeId)
+	}
+	return modRevision, errs.apiError("HSI config")
+}
+
+// addVlanTags sets the VLAN tags of a subscriber in a node command
+func addVlanTags(commandData map[string]interface{}, config HSIConfig) {
+	commandData["vlan"] = config.VlanID
+	if config.OuterVlanID != "" {
+		commandData["outer_vlan"] = config.OuterVlanID
+		commandData["outer_tpid"] = outerTPID(config)
+	}
+}
+
+// GetNodeVlanMode returns the VLAN mode of a node
+// @Summary      Get node VLAN mode
+// @Description  Get whether the subscribers of a node are single-tagged or identified by an S-VLAN/C-VLAN pair
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeVlanMode
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/vlan-mode [get]
+func (r *RestServer) GetNodeVlanMode(c *gin.Context) {
+	mode, _, err := r.getNodeVlanMode(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node VLAN mode"})
+		return
+	}
+	c.JSON(http.StatusOK, mode)
+}
+
+// UpdateNodeVlanMode changes the VLAN mode of a node
+// @Summary      Update node VLAN mode
+// @Description  Switch a node between single-tagged (single) and double-tagged (qinq) subscribers.
+// @Description  The mode can only be changed while the node has no HSI configs.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string              true  "Node ID"
+// @Param        request  body      UpdateNodeVlanMode  true  "VLAN mode"
+// @Success      200      {object}  NodeVlanMode
+// @Failure      400      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/vlan-mode [put]
+func (r *RestServer) UpdateNodeVlanMode(c *gin.Context) {
+	var req UpdateNodeVlanMode
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Mode != VlanModeSingle && req.Mode != VlanModeQinQ {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("VLAN mode must be either %s or %s", VlanModeSingle, VlanModeQinQ)})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	nodeId := c.Param("nodeId")
+	current, modRevision, err := r.getNodeVlanMode(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node VLAN mode"})
+		return
+	}
+	if current.Mode == req.Mode {
+		c.JSON(http.StatusOK, current)
+		return
+	}
+
+	mode := NodeVlanMode{
+		Node:      nodeId,
+		Mode:      req.Mode,
+		UpdatedBy: username,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.Marshal(mode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal node VLAN mode"})
+		return
+	}
+
+	// Existing subscribers are tagged for the current mode, so the mode only
+	// changes while no HSI config exists
+	key := nodeVlanModeKey(nodeId)
+	hsiPrefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	countResp, err := r.etcd.Client().Get(ctx, hsiPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count HSI configs"})
+		return
+	}
+	if countResp.Count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf(
+			"VLAN mode can only be changed while the node has no HSI configs, node %s has %d", nodeId, countResp.Count)})
+		return
+	}
+	resp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(key), "=", modRevision),
+			clientv3.Compare(clientv3.CreateRevision(hsiPrefix), "=", 0).WithPrefix(),
+		).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to update VLAN mode of node %s", nodeId)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node VLAN mode"})
+		return
+	}
+	if !resp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node VLAN mode or HSI configs have been modified by another request"})
+		return
+	}
+
+	logrus.Infof("VLAN mode of node %s changed from %s to %s by %s", nodeId, current.Mode, mode.Mode, username)
+	c.JSON(http.StatusOK, mode)
+}
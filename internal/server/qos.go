@@ -0,0 +1,455 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// QoS priority classes of subscriber traffic, scheduled by the node in
+// ascending order of precedence
+const (
+	QoSClassBestEffort = "best_effort"
+	QoSClassAssured    = "assured"
+	QoSClassExpedited  = "expedited"
+)
+
+const (
+	// MaxQoSRateMbps is the highest shaping rate of a subscriber, in Mbit/s
+	MaxQoSRateMbps = 100000
+	// MaxQoSBurstKB is the largest burst size of a subscriber, in KB
+	MaxQoSBurstKB = 131072
+	// DefaultNICCapacityMbps is the NIC capacity of a node without configured capacity
+	DefaultNICCapacityMbps = 10000
+	// ThroughputPublishInterval is how often node monitors publish the observed throughput of subscribers
+	ThroughputPublishInterval = 10 * time.Second
+)
+
+// QoSSettings are the shaping settings of a subscriber with the defaults applied
+type QoSSettings struct {
+	Shaped            bool   `json:"shaped" example:"true"`
+	UpstreamMbps      int    `json:"upstream_mbps,omitempty" example:"300"`
+	DownstreamMbps    int    `json:"downstream_mbps,omitempty" example:"300"`
+	UpstreamBurstKB   int    `json:"upstream_burst_kb,omitempty" example:"375"`
+	DownstreamBurstKB int    `json:"downstream_burst_kb,omitempty" example:"375"`
+	PriorityClass     string `json:"priority_class" example:"best_effort"`
+}
+
+// ObservedThroughput is the average throughput of a subscriber over the last
+// publish interval of its node monitor
+type ObservedThroughput struct {
+	UpstreamMbps   float64 `json:"upstream_mbps" example:"287.4"`
+	DownstreamMbps float64 `json:"downstream_mbps" example:"295.1"`
+}
+
+// NodeThroughput is the observed throughput of the subscribers of a node, as
+// published by its node monitor
+type NodeThroughput struct {
+	Node            string                        `json:"node"`
+	SampledAt       string                        `json:"sampled_at"`
+	IntervalSeconds float64                       `json:"interval_seconds"`
+	Users           map[string]ObservedThroughput `json:"users"`
+}
+
+// SubscriberQoSStatus compares the configured rates of a subscriber with its observed throughput
+type SubscriberQoSStatus struct {
+	NodeID     string              `json:"node_id" example:"node001"`
+	UserID     string              `json:"user_id" example:"2"`
+	Profile    string              `json:"profile,omitempty" example:"300M"`
+	Configured QoSSettings         `json:"configured"`
+	Observed   *ObservedThroughput `json:"observed"`
+	SampledAt  string              `json:"sampled_at,omitempty" example:"2024-01-01T00:00:00Z"`
+	// Utilization is the observed throughput in percent of the configured rate
+	UpstreamUtilization   float64 `json:"upstream_utilization,omitempty" example:"95.8"`
+	DownstreamUtilization float64 `json:"downstream_utilization,omitempty" example:"98.4"`
+}
+
+// NodeNICCapacity is the capacity of the subscriber-facing and uplink
+// directions of a node, which no subscriber rate may exceed
+type NodeNICCapacity struct {
+	Node           string `json:"node" example:"node001"`
+	UpstreamMbps   int    `json:"upstream_mbps" example:"10000"`
+	DownstreamMbps int    `json:"downstream_mbps" example:"10000"`
+	UpdatedBy      string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt      string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// NodeNICCapacityResponse reports the NIC capacity of a node and how far it is
+// oversubscribed by the configured subscriber rates
+type NodeNICCapacityResponse struct {
+	NodeNICCapacity
+	ShapedSubscribers        int   `json:"shaped_subscribers" example:"120"`
+	ConfiguredUpstreamMbps   int64 `json:"configured_upstream_mbps" example:"36000"`
+	ConfiguredDownstreamMbps int64 `json:"configured_downstream_mbps" example:"36000"`
+	// Oversubscription is the sum of the configured rates divided by the capacity
+	UpstreamOversubscription   float64 `json:"upstream_oversubscription" example:"3.6"`
+	DownstreamOversubscription float64 `json:"downstream_oversubscription" example:"3.6"`
+}
+
+// UpdateNodeNICCapacity represents the request to change the NIC capacity of a node
+type UpdateNodeNICCapacity struct {
+	UpstreamMbps   int `json:"upstream_mbps" example:"10000"`
+	DownstreamMbps int `json:"downstream_mbps" example:"10000"`
+}
+
+func nicCapacityKey(nodeId string) string {
+	return fmt.Sprintf("nic_capacity/%s", nodeId)
+}
+
+// nodeThroughputKey is written by the node monitor of the node
+func nodeThroughputKey(nodeId string) string {
+	return fmt.Sprintf("throughput/%s", nodeId)
+}
+
+// validateQoSSettings checks the optional shaping settings of a config. Rates
+// are in Mbit/s and bursts in KB, a burst needs the rate of its direction.
+func validateQoSSettings(errs *fieldErrors, config HSIConfig) {
+	validateQoSDirection(errs, "upstream", "Upstream", config.QoSUpstreamRate, config.QoSUpstreamBurst)
+	validateQoSDirection(errs, "downstream", "Downstream", config.QoSDownstreamRate, config.QoSDownstreamBurst)
+
+	switch config.QoSPriorityClass {
+	case "", QoSClassBestEffort, QoSClassAssured, QoSClassExpedited:
+	default:
+		errs.add("qos_priority_class", "Priority class must be one of %s, %s or %s",
+			QoSClassBestEffort, QoSClassAssured, QoSClassExpedited)
+	}
+}
+
+func validateQoSDirection(errs *fieldErrors, direction, name, rate, burst string) {
+	if rate != "" {
+		if mbps, err := strconv.Atoi(rate); err != nil || mbps < 1 || mbps > MaxQoSRateMbps {
+			errs.add("qos_"+direction+"_rate", "%s rate must be between 1 and %d Mbit/s", name, MaxQoSRateMbps)
+		}
+	}
+	if burst == "" {
+		return
+	}
+	if rate == "" {
+		errs.add("qos_"+direction+"_burst", "%s burst requires a %s rate", name, direction)
+	} else if kb, err := strconv.Atoi(burst); err != nil || kb < 1 || kb > MaxQoSBurstKB {
+		errs.add("qos_"+direction+"_burst", "%s burst must be between 1 and %d KB", name, MaxQoSBurstKB)
+	}
+}
+
+// defaultQoSBurstKB returns the burst of a rate without configured burst,
+// which is 10ms of traffic but at least one full-sized frame
+func defaultQoSBurstKB(mbps int) int {
+	return max((mbps*5+3)/4, 2)
+}
+
+// resolveQoS returns the shaping settings of a valid config, using the
+// defaults for the settings it leaves empty
+func resolveQoS(config HSIConfig) QoSSettings {
+	settings := QoSSettings{PriorityClass: QoSClassBestEffort}
+	if config.QoSPriorityClass != "" {
+		settings.PriorityClass = config.QoSPriorityClass
+	}
+	if mbps, err := strconv.Atoi(config.QoSUpstreamRate); err == nil {
+		settings.Shaped = true
+		settings.UpstreamMbps = mbps
+		settings.UpstreamBurstKB = defaultQoSBurstKB(mbps)
+		if kb, err := strconv.Atoi(config.QoSUpstreamBurst); err == nil {
+			settings.UpstreamBurstKB = kb
+		}
+	}
+	if mbps, err := strconv.Atoi(config.QoSDownstreamRate); err == nil {
+		settings.Shaped = true
+		settings.DownstreamMbps = mbps
+		settings.DownstreamBurstKB = defaultQoSBurstKB(mbps)
+		if kb, err := strconv.Atoi(config.QoSDownstreamBurst); err == nil {
+			settings.DownstreamBurstKB = kb
+		}
+	}
+	return settings
+}
+
+// getNICCapacity reads the NIC capacity of a node together with its etcd mod
+// revision. Nodes without one use the default capacity.
+func (r *RestServer) getNICCapacity(ctx context.Context, nodeId string) (NodeNICCapacity, int64, error) {
+	capacity := NodeNICCapacity{
+		Node:           nodeId,
+		UpstreamMbps:   DefaultNICCapacityMbps,
+		DownstreamMbps: DefaultNICCapacityMbps,
+	}
+	resp, err := r.etcd.Client().Get(ctx, nicCapacityKey(nodeId))
+	if err != nil {
+		return capacity, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return capacity, 0, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &capacity); err != nil {
+		return capacity, 0, err
+	}
+	return capacity, resp.Kvs[0].ModRevision, nil
+}
+
+// checkQoSCapacity checks that the rates of a config fit the NIC capacity of
+// its node and returns the mod revision of the capacity, so writers can make
+// sure it did not change before they commit
+func (r *RestServer) checkQoSCapacity(ctx context.Context, nodeId string, config HSIConfig) (int64, *apiError) {
+	capacity, modRevision, err := r.getNICCapacity(ctx, nodeId)
+	if err != nil {
+		return 0, newAPIError(http.StatusInternalServerError, "Failed to get node NIC capacity")
+	}
+	settings := resolveQoS(config)
+	var errs fieldErrors
+	if settings.UpstreamMbps > capacity.UpstreamMbps {
+		errs.add("qos_upstream_rate", "Upstream rate must not exceed the upstream NIC capacity of node %s (%d Mbit/s)",
+			nodeId, capacity.UpstreamMbps)
+	}
+	if settings.DownstreamMbps > capacity.DownstreamMbps {
+		errs.add("qos_downstream_rate", "Downstream rate must not exceed the downstream NIC capacity of node %s (%d Mbit/s)",
+			nodeId, capacity.DownstreamMbps)
+	}
+	return modRevision, errs.apiError("HSI config")
+}
+
+// getNodeThroughput reads the throughput last published for a node. A nil
+// result means no node monitor has published it recently.
+func (r *RestServer) getNodeThroughput(ctx context.Context, nodeId string) (*NodeThroughput, error) {
+	resp, err := r.etcd.Client().Get(ctx, nodeThroughputKey(nodeId))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var throughput NodeThroughput
+	if err := json.Unmarshal(resp.Kvs[0].Value, &throughput); err != nil {
+		return nil, err
+	}
+	sampledAt, err := time.Parse(time.RFC3339, throughput.SampledAt)
+	if err != nil || time.Since(sampledAt) > 3*ThroughputPublishInterval {
+		return nil, nil
+	}
+	return &throughput, nil
+}
+
+// utilization returns an observed rate in percent of a configured one
+func utilization(observedMbps float64, configuredMbps int) float64 {
+	if configuredMbps == 0 {
+		return 0
+	}
+	return math.Round(observedMbps/float64(configuredMbps)*1000) / 10
+}
+
+// GetSubscriberQoS returns the configured rates of a subscriber next to its observed throughput
+// @Summary      Get subscriber QoS
+// @Description  Get the shaping rates, bursts and priority class of a subscriber together with the throughput observed
+// @Description  by the node over the last interval, to check whether the subscriber gets its tier
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  SubscriberQoSStatus
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/hsi/{userId}/qos [get]
+func (r *RestServer) GetSubscriberQoS(c *gin.Context) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	ctx := c.Request.Context()
+	config, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI config"})
+		return
+	}
+	if config == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
+		return
+	}
+
+	status := SubscriberQoSStatus{
+		NodeID:     nodeId,
+		UserID:     userId,
+		Profile:    config.Config.Profile,
+		Configured: resolveQoS(config.Config),
+	}
+	throughput, err := r.getNodeThroughput(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get observed throughput"})
+		return
+	}
+	if throughput != nil {
+		status.SampledAt = throughput.SampledAt
+		if observed, ok := throughput.Users[userId]; ok {
+			status.Observed = &observed
+			status.UpstreamUtilization = utilization(observed.UpstreamMbps, status.Configured.UpstreamMbps)
+			status.DownstreamUtilization = utilization(observed.DownstreamMbps, status.Configured.DownstreamMbps)
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// GetNodeNICCapacity returns the NIC capacity of a node
+// @Summary      Get node NIC capacity
+// @Description  Get the upstream and downstream NIC capacity of a node and its oversubscription by the configured
+// @Description  subscriber rates
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeNICCapacityResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/nic-capacity [get]
+func (r *RestServer) GetNodeNICCapacity(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	ctx := c.Request.Context()
+	capacity, _, err := r.getNICCapacity(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node NIC capacity"})
+		return
+	}
+
+	prefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	resp, err := r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI configs"})
+		return
+	}
+	response := NodeNICCapacityResponse{NodeNICCapacity: capacity}
+	for _, kv := range resp.Kvs {
+		if strings.Contains(strings.TrimPrefix(string(kv.Key), prefix), "/") {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			continue
+		}
+		settings := resolveQoS(config.Config)
+		if !settings.Shaped {
+			continue
+		}
+		response.ShapedSubscribers++
+		response.ConfiguredUpstreamMbps += int64(settings.UpstreamMbps)
+		response.ConfiguredDownstreamMbps += int64(settings.DownstreamMbps)
+	}
+	if capacity.UpstreamMbps > 0 {
+		response.UpstreamOversubscription = math.Round(float64(response.ConfiguredUpstreamMbps)/float64(capacity.UpstreamMbps)*100) / 100
+	}
+	if capacity.DownstreamMbps > 0 {
+		response.DownstreamOversubscription = math.Round(float64(response.ConfiguredDownstreamMbps)/float64(capacity.DownstreamMbps)*100) / 100
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateNodeNICCapacity changes the NIC capacity of a node
+// @Summary      Update node NIC capacity
+// @Description  Set the upstream and downstream NIC capacity of a node in Mbit/s. The capacity cannot be lowered below
+// @Description  the rate of any of its subscribers.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string                 true  "Node ID"
+// @Param        request  body      UpdateNodeNICCapacity  true  "NIC capacity"
+// @Success      200      {object}  NodeNICCapacity
+// @Failure      400      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/nic-capacity [put]
+func (r *RestServer) UpdateNodeNICCapacity(c *gin.Context) {
+	var req UpdateNodeNICCapacity
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.UpstreamMbps < 1 || req.UpstreamMbps > MaxQoSRateMbps || req.DownstreamMbps < 1 || req.DownstreamMbps > MaxQoSRateMbps {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("NIC capacity must be between 1 and %d Mbit/s", MaxQoSRateMbps)})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	nodeId := c.Param("nodeId")
+	_, modRevision, err := r.getNICCapacity(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node NIC capacity"})
+		return
+	}
+
+	// No subscriber may be left with a rate above the new capacity
+	prefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	resp, err := r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HSI configs"})
+		return
+	}
+	var exceeding []string
+	for _, kv := range resp.Kvs {
+		userId := strings.TrimPrefix(string(kv.Key), prefix)
+		if strings.Contains(userId, "/") {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			continue
+		}
+		settings := resolveQoS(config.Config)
+		if settings.UpstreamMbps > req.UpstreamMbps || settings.DownstreamMbps > req.DownstreamMbps {
+			exceeding = append(exceeding, userId)
+		}
+	}
+	if len(exceeding) > 0 {
+		sort.Slice(exceeding, func(i, j int) bool { return lessUserId(exceeding[i], exceeding[j]) })
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    fmt.Sprintf("%d subscribers of node %s have a rate above the requested capacity", len(exceeding), nodeId),
+			"user_ids": exceeding,
+		})
+		return
+	}
+
+	capacity := NodeNICCapacity{
+		Node:           nodeId,
+		UpstreamMbps:   req.UpstreamMbps,
+		DownstreamMbps: req.DownstreamMbps,
+		UpdatedBy:      username,
+		UpdatedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.Marshal(capacity)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal node NIC capacity"})
+		return
+	}
+
+	// HSI writes compare the capacity revision, so only configs written before
+	// the scan above can exist and none of them may have changed since
+	key := nicCapacityKey(nodeId)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(key), "=", modRevision),
+			clientv3.Compare(clientv3.ModRevision(prefix), "<", resp.Header.Revision+1).WithPrefix(),
+		).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save node NIC capacity"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node NIC capacity or HSI configs have been modified by another request"})
+		return
+	}
+
+	logrus.Infof("NIC capacity of node %s set to %d Mbit/s upstream, %d Mbit/s downstream by %s",
+		nodeId, capacity.UpstreamMbps, capacity.DownstreamMbps, username)
+	c.JSON(http.StatusOK, capacity)
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"fastrg-controller/internal/storage"
+	"fastrg-controller/internal/utils"
 
 	"github.com/sirupsen/logrus"
 
@@ -61,6 +62,45 @@ type HSIConfig struct {
 	DHCPAddrPool string `json:"dhcp_addr_pool" example:"192.168.3.100-192.168.3.200"`
 	DHCPSubnet   string `json:"dhcp_subnet" example:"255.255.255.0"`
 	DHCPGateway  string `json:"dhcp_gateway" example:"192.168.3.1"`
+	// DHCP options are optional, empty ones are inherited from the node defaults
+	DHCPDNS        string       `json:"dhcp_dns,omitempty" example:"8.8.8.8,8.8.4.4"`
+	DHCPLeaseTime  string       `json:"dhcp_lease_time,omitempty" example:"86400"`
+	DHCPDomainName string       `json:"dhcp_domain_name,omitempty" example:"home.arpa"`
+	DHCPNTPServers string       `json:"dhcp_ntp_servers,omitempty" example:"192.168.3.1"`
+	DHCPOptions    []DHCPOption `json:"dhcp_options,omitempty"`
+	Profile        string       `json:"profile,omitempty" example:"residential"`
+	// PPPoE options are optional, empty ones use the defaults
+	PPPoEServiceName     string `json:"pppoe_service_name,omitempty" example:"internet"`
+	PPPoEACName          string `json:"pppoe_ac_name,omitempty" example:"BNG-1"`
+	PPPoEMRU             string `json:"pppoe_mru,omitempty" example:"1492"`
+	PPPoEAuthProtocol    string `json:"pppoe_auth_protocol,omitempty" example:"chap"`
+	PPPoELCPEchoInterval string `json:"pppoe_lcp_echo_interval,omitempty" example:"10"`
+	PPPoELCPEchoFailure  string `json:"pppoe_lcp_echo_failure,omitempty" example:"3"`
+	// WANMode selects how the WAN is brought up, PPPoE unless set
+	WANMode            string `json:"wan_mode,omitempty" example:"pppoe"`
+	WANDHCPHostname    string `json:"wan_dhcp_hostname,omitempty" example:"fastrg-2"`
+	WANDHCPVendorClass string `json:"wan_dhcp_vendor_class,omitempty" example:"fastrg"`
+	WANIPAddress       string `json:"wan_ip_address,omitempty" example:"203.0.113.10/30"`
+	WANGateway         string `json:"wan_gateway,omitempty" example:"203.0.113.9"`
+	WANDNS             string `json:"wan_dns,omitempty" example:"203.0.113.53"`
+	// In QinQ mode VlanID is the inner C-VLAN, tagged with the outer S-VLAN
+	OuterVlanID string `json:"outer_vlan_id,omitempty" example:"200"`
+	OuterTPID   string `json:"outer_tpid,omitempty" example:"0x88a8"`
+	// QoS is optional, rates are in Mbit/s and bursts in KB
+	QoSUpstreamRate    string `json:"qos_upstream_rate,omitempty" example:"300"`
+	QoSDownstreamRate  string `json:"qos_downstream_rate,omitempty" example:"300"`
+	QoSUpstreamBurst   string `json:"qos_upstream_burst,omitempty" example:"375"`
+	QoSDownstreamBurst string `json:"qos_downstream_burst,omitempty" example:"375"`
+	QoSPriorityClass   string `json:"qos_priority_class,omitempty" example:"best_effort"`
+	// IPv6 is optional and disabled unless IPv6WANMode is set
+	IPv6WANMode      string `json:"ipv6_wan_mode,omitempty" example:"dhcpv6_pd"`
+	IPv6PDLength     string `json:"ipv6_pd_length,omitempty" example:"56"`
+	IPv6LANPrefixLen string `json:"ipv6_lan_prefix_len,omitempty" example:"64"`
+	IPv6LANMode      string `json:"ipv6_lan_mode,omitempty" example:"slaac"`
+	IPv6DHCPAddrPool string `json:"ipv6_dhcp_addr_pool,omitempty" example:"::1000-::1fff"`
+	IPv6DNS          string `json:"ipv6_dns,omitempty" example:"2001:4860:4860::8888,2001:4860:4860::8844"`
+	// DHCPReservations pins LAN addresses to client MAC addresses
+	DHCPReservations []DHCPReservation `json:"dhcp_reservations,omitempty"`
 }
 
 // HSIMetadata represents the metadata for HSI configuration
@@ -70,6 +110,8 @@ type HSIMetadata struct {
 	UpdatedBy       string `json:"updatedBy" example:"admin"`
 	UpdatedAt       string `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
 	EnableStatus    string `json:"enableStatus" example:"disabled"`
+	// Overrides lists the fields set by the subscriber instead of its service profile
+	Overrides []string `json:"overrides,omitempty"`
 }
 
 // HSI config with metadata structure for etcd storage
@@ -106,6 +148,7 @@ type SubscriberCountData struct {
 type RestServer struct {
 	etcd      *storage.EtcdClient
 	jwtSecret []byte
+	keys      utils.KeyProvider
 }
 
 func NewRestServer(etcd *storage.EtcdClient) *RestServer {
@@ -173,85 +216,20 @@ func (r *RestServer) getUserFromToken(tokenString string) (string, error) {
 	return username, nil
 }
 
-// Get next resource version for HSI config
-func (r *RestServer) getNextResourceVersion(ctx context.Context, etcdKey string) (string, error) {
-	resp, err := r.etcd.Client().Get(ctx, etcdKey)
-	if err != nil {
-		return "", err
-	}
-
-	if len(resp.Kvs) == 0 {
-		// First time creation, start with version 1
-		return "1", nil
-	}
-
-	// Parse existing config to get current version
-	var existingConfig HSIConfigWithMetadata
-	if err := json.Unmarshal(resp.Kvs[0].Value, &existingConfig); err != nil {
-		// If can't parse metadata, assume it's old format, start with version 2
-		return "2", nil
-	}
-
-	// Parse current version and increment
-	currentVersion := existingConfig.Metadata.ResourceVersion
-	if currentVersion == "" {
-		return "2", nil
+// incrementResourceVersion returns the resource version following current
+func incrementResourceVersion(current string) string {
+	if current == "" {
+		return "2"
 	}
 
 	// Simple increment - parse as number and add 1
 	var nextVersion int
-	if _, err := fmt.Sscanf(currentVersion, "%d", &nextVersion); err != nil {
-		return "2", nil
+	if _, err := fmt.Sscanf(current, "%d", &nextVersion); err != nil {
+		return "2"
 	}
 	nextVersion++
 
-	return fmt.Sprintf("%d", nextVersion), nil
-}
-
-// Check if VLAN is already in use by another user on the same node
-func (r *RestServer) isVlanInUse(ctx context.Context, nodeId, vlanId, currentUserId string) (bool, string, error) {
-	etcdHSIConfigKey := fmt.Sprintf("configs/%s/hsi/", nodeId)
-	resp, err := r.etcd.Client().Get(ctx, etcdHSIConfigKey, clientv3.WithPrefix())
-	if err != nil {
-		return false, "", err
-	}
-
-	for _, kv := range resp.Kvs {
-		var configWithMetadata HSIConfigWithMetadata
-		var config HSIConfig
-
-		if err := json.Unmarshal(kv.Value, &configWithMetadata); err == nil {
-			config = configWithMetadata.Config
-		} else {
-			continue
-		}
-
-		// Check if this VLAN is used by a different user
-		if config.VlanID == vlanId && config.UserID != currentUserId {
-			return true, config.UserID, nil
-		}
-	}
-
-	return false, "", nil
-}
-
-func (r *RestServer) isHSIConfigEnabled(ctx context.Context, nodeId, userId string) (string, error) {
-	etcdKey := fmt.Sprintf("configs/%s/hsi/%s", nodeId, userId)
-	resp, err := r.etcd.Client().Get(ctx, etcdKey)
-	if err != nil {
-		return "unknown", err
-	}
-
-	if len(resp.Kvs) == 0 {
-		return "unknown", nil
-	}
-
-	var configWithMetadata HSIConfigWithMetadata
-	if err := json.Unmarshal(resp.Kvs[0].Value, &configWithMetadata); err != nil {
-		return "unknown", err
-	}
-
-	return configWithMetadata.Metadata.EnableStatus, nil
+	return fmt.Sprintf("%d", nextVersion)
 }
 
 // AuthMiddleware with blacklist check for production
@@ -335,6 +313,40 @@ type MessageResponse struct {
 	Message string `json:"message" example:"operation successful"`
 }
 
+// apiError carries the HTTP status and response body of a failed operation,
+// so the same logic can back both REST handlers and background jobs
+type apiError struct {
+	Status int
+	Body   gin.H
+}
+
+func newAPIError(status int, message string) *apiError {
+	return &apiError{Status: status, Body: gin.H{"error": message}}
+}
+
+func (e *apiError) Error() string {
+	message, _ := e.Body["error"].(string)
+	return message
+}
+
+// abortWithAPIError writes the error response of a failed operation
+func abortWithAPIError(c *gin.Context, err *apiError) {
+	c.JSON(err.Status, err.Body)
+}
+
+// customMethods dispatches "<resource>:<method>" path segments to their
+// handlers. Gin only supports escaped colons in routes when served with Run,
+// so these are registered as a path parameter named "action" instead.
+func customMethods(handlers map[string]gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if handler, ok := handlers[c.Param("action")]; ok {
+			handler(c)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	}
+}
+
 // Login authenticates a user and returns a JWT token
 // @Summary      User login
 // @Description  Authenticate user with username and password, returns JWT token
@@ -756,15 +768,18 @@ func (r *RestServer) GetHSIUserIds(c *gin.Context) {
 
 // GetHSIConfig returns the HSI configuration for a specific user on a node
 // @Summary      Get HSI configuration
-// @Description  Get the HSI configuration (PPPoE and DHCP settings) for a specific user on a node
+// @Description  Get the HSI configuration (PPPoE and DHCP settings) for a specific user on a node. The PPPoE password is masked by default.
 // @Tags         HSI Configuration
 // @Accept       json
 // @Produce      json
 // @Security     BearerAuth
 // @Param        nodeId  path      string  true  "Node ID"
-// @Param        userId  path      string  true  "User ID"
+// @Param        userId  path      string  true   "User ID"
+// @Param        reveal  query     bool    false  "Return the PPPoE password in clear text, requires the reveal permission and is audited"
 // @Success      200     {object}  HSIConfigWithMetadata
+// @Header       200     {string}  ETag  "Resource version of the config"
 // @Failure      400     {object}  ErrorResponse
+// @Failure      403     {object}  ErrorResponse
 // @Failure      404     {object}  ErrorResponse
 // @Failure      500     {object}  ErrorResponse
 // @Router       /config/{nodeId}/hsi/{userId} [get]
@@ -803,7 +818,21 @@ func (r *RestServer) GetHSIConfig(c *gin.Context) {
 
 	var configWithMetadata HSIConfigWithMetadata
 	if err := json.Unmarshal(resp.Kvs[0].Value, &configWithMetadata); err == nil {
+		// Secrets are masked unless the caller may and asks to reveal them
+		reveal, apiErr := r.authorizeReveal(c, etcdKey, []string{userId})
+		if apiErr != nil {
+			abortWithAPIError(c, apiErr)
+			return
+		}
+		if !reveal {
+			configWithMetadata.Config.Password = maskSecret(configWithMetadata.Config.Password)
+		} else if err := r.openHSIConfig(&configWithMetadata.Config); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt HSI config"})
+			return
+		}
+
 		// New format, only return the config part to the frontend
+		c.Header("ETag", resourceVersionETag(configWithMetadata.Metadata.ResourceVersion))
 		c.JSON(http.StatusOK, configWithMetadata)
 		return
 	}
@@ -813,16 +842,20 @@ func (r *RestServer) GetHSIConfig(c *gin.Context) {
 
 // CreateHSIConfig creates a new HSI configuration for a node
 // @Summary      Create HSI configuration
-// @Description  Create a new HSI configuration (PPPoE and DHCP settings) for a node
+// @Description  Create a new HSI configuration (PPPoE and DHCP settings) for a node.
+// @Description  Without dhcp_addr_pool, dhcp_subnet and dhcp_gateway the LAN subnet is allocated from the IPAM
+// @Description  supernets of the node. Without user_id the lowest free user slot within the subscriber count is
+// @Description  taken, without vlan_id the lowest free VLAN of the node's VLAN range. The response returns both.
 // @Tags         HSI Configuration
 // @Accept       json
 // @Produce      json
 // @Security     BearerAuth
 // @Param        nodeId   path      string     true  "Node ID"
 // @Param        request  body      HSIConfig  true  "HSI configuration"
-// @Success      200      {object}  MessageResponse
-// @Failure      400      {object}  ErrorResponse
-// @Failure      409      {object}  ErrorResponse  "VLAN already in use"
+// @Success      200      {object}  HSICreateResponse
+// @Header       200      {string}  ETag  "Resource version of the created config"
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      409      {object}  ConflictResponse  "Config already exists or VLAN already in use"
 // @Failure      500      {object}  ErrorResponse
 // @Router       /config/{nodeId}/hsi [post]
 func (r *RestServer) CreateHSIConfig(c *gin.Context) {
@@ -838,63 +871,6 @@ func (r *RestServer) CreateHSIConfig(c *gin.Context) {
 		return
 	}
 
-	// Validate required fields
-	if config.UserID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
-		return
-	}
-	if config.VlanID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "VLAN ID is required"})
-		return
-	}
-	if config.AccountName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Account Name is required"})
-		return
-	}
-	if config.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
-		return
-	}
-	if config.DHCPAddrPool == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Address Pool is required"})
-		return
-	}
-	if config.DHCPSubnet == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Subnet is required"})
-		return
-	}
-	if config.DHCPGateway == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Gateway is required"})
-		return
-	}
-
-	ctx := c.Request.Context()
-
-	subscriberCount := r.GetSubscriberCount(ctx, nodeId)
-	if subscriberCount < 0 {
-		logrus.Infof("No valid subscriber count found for node %s, proceeding without filtering", nodeId)
-	} else {
-		if uidNum, err := strconv.Atoi(config.UserID); err == nil {
-			if uidNum > subscriberCount {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "User ID exceeds subscriber count"})
-				return
-			}
-		}
-	}
-
-	// Check if VLAN is already in use by another user
-	inUse, existingUserId, err := r.isVlanInUse(ctx, nodeId, config.VlanID, config.UserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check VLAN availability"})
-		return
-	}
-	if inUse {
-		c.JSON(http.StatusConflict, gin.H{
-			"error": fmt.Sprintf("Input VLAN has been already used by other user: %s", existingUserId),
-		})
-		return
-	}
-
 	// Get current username
 	authHeader := c.GetHeader("Authorization")
 	username, err := r.getUserFromToken(authHeader)
@@ -903,56 +879,38 @@ func (r *RestServer) CreateHSIConfig(c *gin.Context) {
 		return
 	}
 
-	// Get next resource version
-	key := fmt.Sprintf("configs/%s/hsi/%s", nodeId, config.UserID)
-	resourceVersion, err := r.getNextResourceVersion(ctx, key)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get resource version"})
-		return
-	}
-
-	// Create config with metadata
-	configWithMetadata := HSIConfigWithMetadata{
-		Config: config,
-	}
-	configWithMetadata.Metadata.Node = nodeId
-	configWithMetadata.Metadata.ResourceVersion = resourceVersion
-	configWithMetadata.Metadata.UpdatedBy = username
-	configWithMetadata.Metadata.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	configWithMetadata.Metadata.EnableStatus = "disabled"
-
-	etcdKey := fmt.Sprintf("configs/%s/hsi/%s", nodeId, config.UserID)
-
-	configJSON, err := json.Marshal(configWithMetadata)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal config"})
-		return
-	}
-
-	_, err = r.etcd.Client().Put(ctx, etcdKey, string(configJSON))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save HSI config"})
+	saved, apiErr := r.saveHSIConfig(c.Request.Context(), nodeId, config, username, true, "")
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
 		return
 	}
 
-	logrus.Infof("HSI config created for node %s, user: %s, version: %s, by: %s",
-		nodeId, config.UserID, resourceVersion, username)
-	c.JSON(http.StatusOK, gin.H{"message": "HSI config created successfully"})
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, HSICreateResponse{
+		Message:         "HSI config created successfully",
+		ResourceVersion: saved.Metadata.ResourceVersion,
+		UserID:          saved.Config.UserID,
+		VlanID:          saved.Config.VlanID,
+		OuterVlanID:     saved.Config.OuterVlanID,
+	})
 }
 
 // UpdateHSIConfig updates an existing HSI configuration
 // @Summary      Update HSI configuration
-// @Description  Update an existing HSI configuration for a specific user on a node
+// @Description  Update an existing HSI configuration for a specific user on a node. A masked password (******) keeps the stored one.
 // @Tags         HSI Configuration
 // @Accept       json
 // @Produce      json
 // @Security     BearerAuth
 // @Param        nodeId   path      string     true  "Node ID"
-// @Param        userId   path      string     true  "User ID"
-// @Param        request  body      HSIConfig  true  "HSI configuration"
-// @Success      200      {object}  MessageResponse
-// @Failure      400      {object}  ErrorResponse
-// @Failure      409      {object}  ErrorResponse  "VLAN already in use"
+// @Param        userId   path      string     true   "User ID"
+// @Param        If-Match header    string     false  "Expected resource version, as returned in the ETag header"
+// @Param        request  body      HSIConfig  true   "HSI configuration"
+// @Success      200      {object}  HSIWriteResponse
+// @Header       200      {string}  ETag  "Resource version of the updated config"
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ConflictResponse  "Config modified concurrently or VLAN already in use"
 // @Failure      500      {object}  ErrorResponse
 // @Router       /config/{nodeId}/hsi/{userId} [put]
 func (r *RestServer) UpdateHSIConfig(c *gin.Context) {
@@ -969,69 +927,12 @@ func (r *RestServer) UpdateHSIConfig(c *gin.Context) {
 		return
 	}
 
-	// Validate required fields
-	if config.UserID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
-		return
-	}
-	if config.VlanID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "VLAN ID is required"})
-		return
-	}
-	if config.AccountName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Account Name is required"})
-		return
-	}
-	if config.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
-		return
-	}
-	if config.DHCPAddrPool == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Address Pool is required"})
-		return
-	}
-	if config.DHCPSubnet == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Subnet is required"})
-		return
-	}
-	if config.DHCPGateway == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "DHCP Gateway is required"})
-		return
-	}
-
 	// Ensure userId in URL params matches UserID in request body
 	if config.UserID != userId {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID mismatch"})
 		return
 	}
 
-	ctx := c.Request.Context()
-
-	subscriberCount := r.GetSubscriberCount(ctx, nodeId)
-	if subscriberCount < 0 {
-		logrus.Infof("No valid subscriber count found for node %s, proceeding without filtering", nodeId)
-	} else {
-		if uidNum, err := strconv.Atoi(config.UserID); err == nil {
-			if uidNum > subscriberCount {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "User ID exceeds subscriber count"})
-				return
-			}
-		}
-	}
-
-	// Check if VLAN is already in use by another user
-	inUse, existingUserId, err := r.isVlanInUse(ctx, nodeId, config.VlanID, userId)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check VLAN availability"})
-		return
-	}
-	if inUse {
-		c.JSON(http.StatusConflict, gin.H{
-			"error": fmt.Sprintf("Input VLAN has been already used by other user: %s", existingUserId),
-		})
-		return
-	}
-
 	// Get current username
 	authHeader := c.GetHeader("Authorization")
 	username, err := r.getUserFromToken(authHeader)
@@ -1040,45 +941,33 @@ func (r *RestServer) UpdateHSIConfig(c *gin.Context) {
 		return
 	}
 
-	// Get next resource version
-	etcdKey := fmt.Sprintf("configs/%s/hsi/%s", nodeId, userId)
-	resourceVersion, err := r.getNextResourceVersion(ctx, etcdKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get resource version"})
-		return
-	}
-
-	enableStatus, err := r.isHSIConfigEnabled(ctx, nodeId, userId)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get current config status"})
+	ifMatch := parseIfMatch(c.GetHeader("If-Match"))
+	saved, apiErr := r.saveHSIConfig(c.Request.Context(), nodeId, config, username, false, ifMatch)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
 		return
 	}
 
-	// Create config with metadata
-	configWithMetadata := HSIConfigWithMetadata{
-		Config: config,
-	}
-	configWithMetadata.Metadata.Node = nodeId
-	configWithMetadata.Metadata.ResourceVersion = resourceVersion
-	configWithMetadata.Metadata.UpdatedBy = username
-	configWithMetadata.Metadata.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	configWithMetadata.Metadata.EnableStatus = enableStatus
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "HSI config updated successfully",
+		"resourceVersion": saved.Metadata.ResourceVersion,
+	})
+}
 
-	configJSON, err := json.Marshal(configWithMetadata)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal config"})
-		return
+// checkUserIdInRange rejects numeric user IDs above the node's subscriber count
+func (r *RestServer) checkUserIdInRange(ctx context.Context, nodeId, userId string) *apiError {
+	subscriberCount := r.GetSubscriberCount(ctx, nodeId)
+	if subscriberCount < 0 {
+		logrus.Infof("No valid subscriber count found for node %s, proceeding without filtering", nodeId)
+		return nil
 	}
-
-	_, err = r.etcd.Client().Put(ctx, etcdKey, string(configJSON))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update HSI config"})
-		return
+	if uidNum, err := strconv.Atoi(userId); err == nil {
+		if uidNum > subscriberCount {
+			return newAPIError(http.StatusBadRequest, "User ID exceeds subscriber count")
+		}
 	}
-
-	logrus.Infof("HSI config updated for node %s, user: %s, version: %s, by: %s",
-		nodeId, userId, resourceVersion, username)
-	c.JSON(http.StatusOK, gin.H{"message": "HSI config updated successfully"})
+	return nil
 }
 
 // DeleteHSIConfig deletes an HSI configuration
@@ -1088,12 +977,14 @@ func (r *RestServer) UpdateHSIConfig(c *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Security     BearerAuth
-// @Param        nodeId  path      string  true  "Node ID"
-// @Param        userId  path      string  true  "User ID"
-// @Success      200     {object}  MessageResponse
-// @Failure      400     {object}  ErrorResponse
-// @Failure      404     {object}  ErrorResponse
-// @Failure      500     {object}  ErrorResponse
+// @Param        nodeId    path      string  true   "Node ID"
+// @Param        userId    path      string  true   "User ID"
+// @Param        If-Match  header    string  false  "Expected resource version, as returned in the ETag header"
+// @Success      200       {object}  MessageResponse
+// @Failure      400       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ConflictResponse  "Config modified concurrently"
+// @Failure      500       {object}  ErrorResponse
 // @Router       /config/{nodeId}/hsi/{userId} [delete]
 func (r *RestServer) DeleteHSIConfig(c *gin.Context) {
 	nodeId := c.Param("nodeId")
@@ -1117,27 +1008,17 @@ func (r *RestServer) DeleteHSIConfig(c *gin.Context) {
 		}
 	}
 
-	etcdKey := fmt.Sprintf("configs/%s/hsi/%s", nodeId, userId)
-	// Check if config exists
-	resp, err := r.etcd.Client().Get(ctx, etcdKey)
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check HSI config"})
-		return
-	}
-
-	if len(resp.Kvs) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
 		return
 	}
 
-	// Delete config
-	_, err = r.etcd.Client().Delete(ctx, etcdKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete HSI config"})
+	if apiErr := r.deleteHSIConfig(ctx, nodeId, userId, parseIfMatch(c.GetHeader("If-Match")), username); apiErr != nil {
+		abortWithAPIError(c, apiErr)
 		return
 	}
 
-	logrus.Infof("HSI config deleted for node %s, user: %s", nodeId, userId)
 	c.JSON(http.StatusOK, gin.H{"message": "HSI config deleted successfully"})
 }
 
@@ -1166,73 +1047,11 @@ func (r *RestServer) DialPPPoE(c *gin.Context) {
 		return
 	}
 
-	ctx := c.Request.Context()
-
-	subscriberCount := r.GetSubscriberCount(ctx, req.NodeID)
-	if subscriberCount < 0 {
-		logrus.Infof("No valid subscriber count found for node %s, proceeding without filtering", req.NodeID)
-	} else {
-		if uidNum, err := strconv.Atoi(req.UserID); err == nil {
-			if uidNum > subscriberCount {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "User ID exceeds subscriber count"})
-				return
-			}
-		}
-	}
-
-	// Check if HSI config exists
-	configKey := fmt.Sprintf("configs/%s/hsi/%s", req.NodeID, req.UserID)
-	resp, err := r.etcd.Client().Get(ctx, configKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check PPPoE config"})
-		return
-	}
-
-	if len(resp.Kvs) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "PPPoE config not found"})
-		return
-	}
-
-	// Parse HSI config to get PPPoE related parameters
-	var hsiConfig HSIConfig
-
-	// Try to parse new format (with metadata)
-	var configWithMetadata HSIConfigWithMetadata
-	if err := json.Unmarshal(resp.Kvs[0].Value, &configWithMetadata); err == nil {
-		// New format
-		hsiConfig = configWithMetadata.Config
-	} else {
-		// Try to parse old format
-		if err := json.Unmarshal(resp.Kvs[0].Value, &hsiConfig); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse HSI config"})
-			return
-		}
-	}
-
-	// Create dial command and store it in etcd for the node to execute
-	commandKey := fmt.Sprintf("commands/%s/pppoe_dial_%s", req.NodeID, req.UserID)
-	commandData := map[string]interface{}{
-		"action":    "dial",
-		"user_id":   req.UserID,
-		"vlan":      hsiConfig.VlanID,
-		"account":   hsiConfig.AccountName,
-		"password":  hsiConfig.Password,
-		"timestamp": time.Now().Unix(),
-	}
-
-	commandJSON, err := json.Marshal(commandData)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create command"})
-		return
-	}
-
-	_, err = r.etcd.Client().Put(ctx, commandKey, string(commandJSON))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send dial command"})
+	if apiErr := r.sendPPPoECommand(c.Request.Context(), req.NodeID, req.UserID, "dial"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
 		return
 	}
 
-	logrus.Infof("PPPoE dial command sent to node %s for user %s", req.NodeID, req.UserID)
 	c.JSON(http.StatusOK, gin.H{"message": "PPPoE dial command sent successfully"})
 }
 
@@ -1261,34 +1080,53 @@ func (r *RestServer) HangupPPPoE(c *gin.Context) {
 		return
 	}
 
-	ctx := c.Request.Context()
+	if apiErr := r.sendPPPoECommand(c.Request.Context(), req.NodeID, req.UserID, "hangup"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
 
-	subscriberCount := r.GetSubscriberCount(ctx, req.NodeID)
-	if subscriberCount < 0 {
-		logrus.Infof("No valid subscriber count found for node %s, proceeding without filtering", req.NodeID)
-	} else {
-		if uidNum, err := strconv.Atoi(req.UserID); err == nil {
-			if uidNum > subscriberCount {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "User ID exceeds subscriber count"})
-				return
-			}
+	c.JSON(http.StatusOK, gin.H{"message": "PPPoE hangup command sent successfully"})
+}
+
+// sendPPPoECommand stores a PPPoE dial or hangup command in etcd for the node to execute
+func (r *RestServer) sendPPPoECommand(ctx context.Context, nodeId, userId, action string) *apiError {
+	hsiConfig, apiErr := r.commandHSIConfig(ctx, nodeId, userId)
+	if apiErr != nil {
+		return apiErr
+	}
+	if mode := wanMode(*hsiConfig); mode != WANModePPPoE {
+		return newAPIError(http.StatusBadRequest,
+			fmt.Sprintf("Subscriber uses WAN mode %s, use /wan/connect or /wan/disconnect instead", mode))
+	}
+	if action == "dial" {
+		if apiErr := r.checkNodeInService(ctx, nodeId); apiErr != nil {
+			return apiErr
+		}
+		if apiErr := r.checkSubscriberActive(ctx, nodeId, userId); apiErr != nil {
+			return apiErr
 		}
 	}
+	return r.putPPPoECommand(ctx, nodeId, userId, action, hsiConfig)
+}
+
+// commandHSIConfig reads the HSI config a node command is built from
+func (r *RestServer) commandHSIConfig(ctx context.Context, nodeId, userId string) (*HSIConfig, *apiError) {
+	if apiErr := r.checkUserIdInRange(ctx, nodeId, userId); apiErr != nil {
+		return nil, apiErr
+	}
 
 	// Check if HSI config exists
-	configKey := fmt.Sprintf("configs/%s/hsi/%s", req.NodeID, req.UserID)
+	configKey := fmt.Sprintf("configs/%s/hsi/%s", nodeId, userId)
 	resp, err := r.etcd.Client().Get(ctx, configKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check HSI config"})
-		return
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check HSI config")
 	}
 
 	if len(resp.Kvs) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "HSI config not found"})
-		return
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
 	}
 
-	// Parse HSI config to get PPPoE related parameters
+	// Parse HSI config to get the command parameters
 	var hsiConfig HSIConfig
 
 	// Try to parse new format (with metadata)
@@ -1299,51 +1137,62 @@ func (r *RestServer) HangupPPPoE(c *gin.Context) {
 	} else {
 		// Try to parse old format
 		if err := json.Unmarshal(resp.Kvs[0].Value, &hsiConfig); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse HSI config"})
-			return
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to parse HSI config")
 		}
 	}
+	if err := r.openHSIConfig(&hsiConfig); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to decrypt HSI config")
+	}
+	return &hsiConfig, nil
+}
 
-	// Create hangup command and store it in etcd for the node to execute
-	commandKey := fmt.Sprintf("commands/%s/pppoe_hangup_%s", req.NodeID, req.UserID)
+// putPPPoECommand stores a PPPoE dial or hangup command for a subscriber
+func (r *RestServer) putPPPoECommand(ctx context.Context, nodeId, userId, action string, hsiConfig *HSIConfig) *apiError {
+	// Create command and store it in etcd for the node to execute
+	commandKey := fmt.Sprintf("commands/%s/pppoe_%s_%s", nodeId, action, userId)
 	commandData := map[string]interface{}{
-		"action":    "hangup",
-		"user_id":   req.UserID,
-		"vlan":      hsiConfig.VlanID,
+		"action":    action,
+		"user_id":   userId,
 		"account":   hsiConfig.AccountName,
 		"password":  hsiConfig.Password,
+		"pppoe":     resolvePPPoEOptions(*hsiConfig),
 		"timestamp": time.Now().Unix(),
 	}
+	addVlanTags(commandData, *hsiConfig)
 
 	commandJSON, err := json.Marshal(commandData)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create command"})
-		return
+		return newAPIError(http.StatusInternalServerError, "Failed to create command")
 	}
 
 	_, err = r.etcd.Client().Put(ctx, commandKey, string(commandJSON))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send hangup command"})
-		return
+		return newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to send %s command", action))
 	}
 
-	logrus.Infof("PPPoE hangup command sent to node %s for user %s", req.NodeID, req.UserID)
-	c.JSON(http.StatusOK, gin.H{"message": "PPPoE hangup command sent successfully"})
+	logrus.Infof("PPPoE %s command sent to node %s for user %s", action, nodeId, userId)
+	return nil
 }
 
 // UpdateNodeSubscriberCount updates the subscriber count for a node
 // @Summary      Update Node Subscriber Count
-// @Description  Update the subscriber count for a specific node
+// @Description  Update the subscriber count for a specific node. The count must not exceed the subscriber capacity
+// @Description  reported by the node. Lowering it below existing user IDs is refused and the affected subscribers are
+// @Description  listed, unless force is set, which archives (default) or deletes them first. dry_run only lists them.
 // @Tags         Nodes
 // @Accept       json
 // @Produce      json
 // @Security     BearerAuth
-// @Param        nodeId  path      string  true  "Node ID"
-// @Param        request body      UpdateSubscriberCount  true  "Subscriber count request"
-// @Success      200     {object}  MessageResponse
-// @Failure      400     {object}  ErrorResponse
-// @Failure      500     {object}  ErrorResponse
-// @Router       /nodes/:nodeId/subscriber-count [put]
+// @Param        nodeId   path      string                 true   "Node ID"
+// @Param        dry_run  query     bool                   false  "Only list the affected subscribers"
+// @Param        force    query     bool                   false  "Remove the affected subscribers"
+// @Param        action   query     string                 false  "archive (default) or delete, with force"
+// @Param        request  body      UpdateSubscriberCount  true   "Subscriber count request"
+// @Success      200      {object}  SubscriberCountChangeResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse  "Subscribers above the new count, listed in affected"
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/subscriber-count [put]
 func (r *RestServer) UpdateNodeSubscriberCount(c *gin.Context) {
 	nodeId := c.Param("nodeId")
 	if nodeId == "" {
@@ -1361,6 +1210,13 @@ func (r *RestServer) UpdateNodeSubscriberCount(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscriber count must be non-negative"})
 		return
 	}
+	dryRun := c.Query("dry_run") == "true"
+	force := c.Query("force") == "true"
+	action := c.DefaultQuery("action", SubscriberCountActionArchive)
+	if action != SubscriberCountActionArchive && action != SubscriberCountActionDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be archive or delete"})
+		return
+	}
 
 	ctx := c.Request.Context()
 
@@ -1372,13 +1228,96 @@ func (r *RestServer) UpdateNodeSubscriberCount(c *gin.Context) {
 		return
 	}
 
-	// Get next resource version
+	response := SubscriberCountChangeResponse{
+		NodeID:          nodeId,
+		SubscriberCount: req.SubscriberCount,
+		DryRun:          dryRun,
+	}
+	capacity, capacityRevision, err := r.getNodeSubscriberCapacity(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node subscriber capacity"})
+		return
+	}
+	if capacity != nil {
+		response.Capacity = capacity.MaxSubscribers
+		if req.SubscriberCount > capacity.MaxSubscribers {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Subscriber count must not exceed the %d subscribers node %s supports",
+				capacity.MaxSubscribers, nodeId)})
+			return
+		}
+	}
+
+	affected, _, err := r.subscribersAbove(ctx, nodeId, req.SubscriberCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscribers"})
+		return
+	}
+	response.Affected = affected
+	if dryRun {
+		response.Message = fmt.Sprintf("%d subscribers are above the new subscriber count", len(affected))
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if len(affected) > 0 && !force {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            fmt.Sprintf("%d subscribers are above the new subscriber count: %s", len(affected), affectedUserIds(affected)),
+			"node_id":          nodeId,
+			"subscriber_count": req.SubscriberCount,
+			"affected":         affected,
+		})
+		return
+	}
+
+	// Remove the affected subscribers first, the count is only written once
+	// none is left above it
+	if len(affected) > 0 {
+		response.Action = action
+		reason := fmt.Sprintf("Subscriber count lowered to %d", req.SubscriberCount)
+		failed := 0
+		for i, subscriber := range affected {
+			var apiErr *apiError
+			if action == SubscriberCountActionArchive {
+				affected[i].ArchiveID, apiErr = r.archiveSubscriber(ctx, nodeId, subscriber.UserID, username, reason)
+			} else {
+				apiErr = r.deleteSubscriber(ctx, nodeId, subscriber.UserID, username)
+			}
+			if apiErr != nil {
+				affected[i].Error = apiErr.Error()
+				failed++
+			}
+		}
+		if failed > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":            fmt.Sprintf("Failed to %s %d of %d subscribers, subscriber count not changed", action, failed, len(affected)),
+				"node_id":          nodeId,
+				"subscriber_count": req.SubscriberCount,
+				"action":           action,
+				"affected":         affected,
+			})
+			return
+		}
+	}
+
+	// The next resource version is derived from the count it replaces, which
+	// the update compares against
 	key := fmt.Sprintf("user_counts/%s/", nodeId)
-	resourceVersion, err := r.getNextResourceVersion(ctx, key)
+	countResp, err := r.etcd.Client().Get(ctx, key)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get resource version"})
 		return
 	}
+	resourceVersion := "1"
+	var countRevision int64
+	if len(countResp.Kvs) > 0 {
+		countRevision = countResp.Kvs[0].ModRevision
+		var existing SubscriberCountData
+		if err := json.Unmarshal(countResp.Kvs[0].Value, &existing); err != nil {
+			// A count in the old format starts over with version 2
+			resourceVersion = "2"
+		} else {
+			resourceVersion = incrementResourceVersion(existing.Metadata.ResourceVersion)
+		}
+	}
 
 	countData := SubscriberCountData{}
 	countData.SubscriberCount = fmt.Sprintf("%d", req.SubscriberCount)
@@ -1393,19 +1332,38 @@ func (r *RestServer) UpdateNodeSubscriberCount(c *gin.Context) {
 		return
 	}
 
-	_, err = r.etcd.Client().Put(ctx, key, string(countJSON))
+	// Subscribers created above the new count in the meantime abort the update
+	remaining, revision, err := r.subscribersAbove(ctx, nodeId, req.SubscriberCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscribers"})
+		return
+	}
+	if len(remaining) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Subscribers have been created above the new subscriber count: %s", affectedUserIds(remaining))})
+		return
+	}
+	// The node may report another capacity when it registers meanwhile
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(fmt.Sprintf("configs/%s/", nodeId)), "<", revision+1).WithPrefix(),
+			clientv3.Compare(clientv3.ModRevision(nodeSubscriberCapacityKey(nodeId)), "=", capacityRevision),
+			clientv3.Compare(clientv3.ModRevision(key), "=", countRevision),
+		).
+		Then(clientv3.OpPut(key, string(countJSON))).
+		Commit()
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to update subscriber count for node %s", nodeId)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscriber count"})
 		return
 	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Configs, subscriber count or subscriber capacity of the node have been modified by another request"})
+		return
+	}
 
 	logrus.Infof("Updated subscriber count for node %s to %d", nodeId, req.SubscriberCount)
-	c.JSON(http.StatusOK, gin.H{
-		"message":          "Subscriber count updated successfully",
-		"node_id":          nodeId,
-		"subscriber_count": req.SubscriberCount,
-	})
+	response.Message = "Subscriber count updated successfully"
+	c.JSON(http.StatusOK, response)
 }
 
 // GetNodeSubscriberCount gets the subscriber count for a node
@@ -1460,10 +1418,14 @@ func (r *RestServer) GetNodeSubscriberCount(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"node_id":          nodeId,
 		"subscriber_count": count,
-	})
+	}
+	if capacity, _, err := r.getNodeSubscriberCapacity(ctx, nodeId); err == nil && capacity != nil {
+		response["subscriber_capacity"] = capacity.MaxSubscribers
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // FailedEventsResponse represents the response for failed events
@@ -1585,6 +1547,26 @@ func (r *RestServer) StartRestServer(addr string) error {
 		api.DELETE("/nodes/:uuid", r.AuthMiddlewareWithBlacklist(), r.UnregisterNode)
 		api.GET("/nodes/:nodeId/subscriber-count", r.AuthMiddlewareWithBlacklist(), r.GetNodeSubscriberCount)
 		api.PUT("/nodes/:nodeId/subscriber-count", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeSubscriberCount)
+		api.GET("/nodes/:nodeId/subscriber-capacity", r.AuthMiddlewareWithBlacklist(), r.GetNodeSubscriberCapacity)
+		api.GET("/nodes/:nodeId/subscriber-archives", r.AuthMiddlewareWithBlacklist(), r.ListSubscriberArchives)
+		api.GET("/nodes/:nodeId/subscriber-archives/:archiveId", r.AuthMiddlewareWithBlacklist(), r.GetSubscriberArchive)
+		api.POST("/nodes/:nodeId/replace", r.AuthMiddlewareWithBlacklist(), r.ReplaceNode)
+		api.GET("/nodes/:nodeId/replacement", r.AuthMiddlewareWithBlacklist(), r.GetNodeReplacement)
+		api.GET("/nodes/:nodeId/maintenance", r.AuthMiddlewareWithBlacklist(), r.GetNodeMaintenance)
+		api.PUT("/nodes/:nodeId/maintenance", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeMaintenance)
+		api.GET("/nodes/:nodeId/nat-limits", r.AuthMiddlewareWithBlacklist(), r.GetNodeNATLimits)
+		api.PUT("/nodes/:nodeId/nat-limits", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeNATLimits)
+		api.GET("/nodes/:nodeId/dhcp-defaults", r.AuthMiddlewareWithBlacklist(), r.GetNodeDHCPDefaults)
+		api.PUT("/nodes/:nodeId/dhcp-defaults", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeDHCPDefaults)
+		api.GET("/nodes/:nodeId/vlan-mode", r.AuthMiddlewareWithBlacklist(), r.GetNodeVlanMode)
+		api.PUT("/nodes/:nodeId/vlan-mode", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeVlanMode)
+		api.GET("/nodes/:nodeId/vlan-range", r.AuthMiddlewareWithBlacklist(), r.GetNodeVlanRange)
+		api.PUT("/nodes/:nodeId/vlan-range", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeVlanRange)
+		api.GET("/nodes/:nodeId/nic-capacity", r.AuthMiddlewareWithBlacklist(), r.GetNodeNICCapacity)
+		api.PUT("/nodes/:nodeId/nic-capacity", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeNICCapacity)
+		api.GET("/nodes/:nodeId/acl", r.AuthMiddlewareWithBlacklist(), r.GetNodeACL)
+		api.PUT("/nodes/:nodeId/acl", r.AuthMiddlewareWithBlacklist(), r.UpdateNodeACL)
+		api.GET("/nodes/:nodeId/acl/revisions", r.AuthMiddlewareWithBlacklist(), r.ListNodeACLRevisions)
 		api.POST("/users", r.AuthMiddlewareWithBlacklist(), r.AddUser)
 		api.DELETE("/users/:username", r.AuthMiddlewareWithBlacklist(), r.DeleteUser)
 		api.GET("/users", r.AuthMiddlewareWithBlacklist(), r.ListUsers)
@@ -1595,12 +1577,95 @@ func (r *RestServer) StartRestServer(addr string) error {
 		api.POST("/config/:nodeId/hsi", r.AuthMiddlewareWithBlacklist(), r.CreateHSIConfig)
 		api.PUT("/config/:nodeId/hsi/:userId", r.AuthMiddlewareWithBlacklist(), r.UpdateHSIConfig)
 		api.DELETE("/config/:nodeId/hsi/:userId", r.AuthMiddlewareWithBlacklist(), r.DeleteHSIConfig)
+		api.GET("/config/:nodeId/hsi/:userId/revisions", r.AuthMiddlewareWithBlacklist(), r.ListHSIRevisions)
+		api.GET("/config/:nodeId/hsi/:userId/revisions/diff", r.AuthMiddlewareWithBlacklist(), r.DiffHSIRevisions)
+		api.GET("/config/:nodeId/hsi/:userId/revisions/:revision", r.AuthMiddlewareWithBlacklist(), r.GetHSIRevision)
+		api.POST("/config/:nodeId/hsi/:userId/revisions/:revision/rollback", r.AuthMiddlewareWithBlacklist(), r.RollbackHSIConfig)
+		api.GET("/config/:nodeId/hsi/:userId/effective", r.AuthMiddlewareWithBlacklist(), r.GetEffectiveHSIConfig)
+		api.GET("/config/:nodeId/hsi/:userId/qos", r.AuthMiddlewareWithBlacklist(), r.GetSubscriberQoS)
+		api.GET("/config/:nodeId/hsi/:userId/reservations", r.AuthMiddlewareWithBlacklist(), r.ListDHCPReservations)
+		api.POST("/config/:nodeId/hsi/:userId/reservations", r.AuthMiddlewareWithBlacklist(), r.CreateDHCPReservation)
+		api.GET("/config/:nodeId/hsi/:userId/reservations/:mac", r.AuthMiddlewareWithBlacklist(), r.GetDHCPReservation)
+		api.PUT("/config/:nodeId/hsi/:userId/reservations/:mac", r.AuthMiddlewareWithBlacklist(), r.UpdateDHCPReservation)
+		api.DELETE("/config/:nodeId/hsi/:userId/reservations/:mac", r.AuthMiddlewareWithBlacklist(), r.DeleteDHCPReservation)
+		api.GET("/config/:nodeId/vlans/:vlanId", r.AuthMiddlewareWithBlacklist(), r.GetVlanOwner)
+		api.GET("/config/:nodeId/:action", r.AuthMiddlewareWithBlacklist(), customMethods(map[string]gin.HandlerFunc{
+			"hsi:export": r.ExportHSIConfigs,
+		}))
+		api.POST("/config/:nodeId/:action", r.AuthMiddlewareWithBlacklist(), customMethods(map[string]gin.HandlerFunc{
+			"hsi:import": r.ImportHSIConfigs,
+		}))
+		api.POST("/config/:nodeId/vlans/rebuild", r.AuthMiddlewareWithBlacklist(), r.RebuildVlanIndex)
+		api.GET("/config/:nodeId/nat/:userId", r.AuthMiddlewareWithBlacklist(), r.ListNATRules)
+		api.POST("/config/:nodeId/nat/:userId", r.AuthMiddlewareWithBlacklist(), r.CreateNATRule)
+		api.GET("/config/:nodeId/nat/:userId/:ruleId", r.AuthMiddlewareWithBlacklist(), r.GetNATRule)
+		api.PUT("/config/:nodeId/nat/:userId/:ruleId", r.AuthMiddlewareWithBlacklist(), r.UpdateNATRule)
+		api.DELETE("/config/:nodeId/nat/:userId/:ruleId", r.AuthMiddlewareWithBlacklist(), r.DeleteNATRule)
+		api.GET("/config/:nodeId/acl/:userId", r.AuthMiddlewareWithBlacklist(), r.GetSubscriberACL)
+		api.PUT("/config/:nodeId/acl/:userId", r.AuthMiddlewareWithBlacklist(), r.UpdateSubscriberACL)
+		api.DELETE("/config/:nodeId/acl/:userId", r.AuthMiddlewareWithBlacklist(), r.DeleteSubscriberACL)
+		api.GET("/config/:nodeId/acl/:userId/revisions", r.AuthMiddlewareWithBlacklist(), r.ListSubscriberACLRevisions)
+		api.GET("/config/:nodeId/acl/:userId/effective", r.AuthMiddlewareWithBlacklist(), r.GetEffectiveACL)
+		api.GET("/config/:nodeId/snat/pools", r.AuthMiddlewareWithBlacklist(), r.ListSNATPools)
+		api.POST("/config/:nodeId/snat/pools", r.AuthMiddlewareWithBlacklist(), r.CreateSNATPool)
+		api.GET("/config/:nodeId/snat/pools/:name", r.AuthMiddlewareWithBlacklist(), r.GetSNATPool)
+		api.DELETE("/config/:nodeId/snat/pools/:name", r.AuthMiddlewareWithBlacklist(), r.DeleteSNATPool)
+		api.GET("/config/:nodeId/snat/allocations", r.AuthMiddlewareWithBlacklist(), r.ListSNATAllocations)
+		api.GET("/config/:nodeId/snat/allocations/:userId", r.AuthMiddlewareWithBlacklist(), r.GetSNATAllocation)
+		api.POST("/config/:nodeId/snat/allocations/:userId", r.AuthMiddlewareWithBlacklist(), r.AllocateSNATBlock)
+		api.DELETE("/config/:nodeId/snat/allocations/:userId", r.AuthMiddlewareWithBlacklist(), r.ReleaseSNATBlock)
+		api.GET("/snat/lookup", r.AuthMiddlewareWithBlacklist(), r.LookupSNAT)
+		api.GET("/ipam/supernets", r.AuthMiddlewareWithBlacklist(), r.ListIPAMSupernets)
+		api.POST("/ipam/supernets", r.AuthMiddlewareWithBlacklist(), r.CreateIPAMSupernet)
+		api.GET("/ipam/supernets/:name", r.AuthMiddlewareWithBlacklist(), r.GetIPAMSupernet)
+		api.DELETE("/ipam/supernets/:name", r.AuthMiddlewareWithBlacklist(), r.DeleteIPAMSupernet)
+		api.GET("/ipam/allocations", r.AuthMiddlewareWithBlacklist(), r.ListIPAMAllocations)
+		api.GET("/ipam/overlaps", r.AuthMiddlewareWithBlacklist(), r.ListIPAMOverlaps)
+		api.GET("/config/:nodeId/iptv", r.AuthMiddlewareWithBlacklist(), r.ListIPTVConfigs)
+		api.POST("/config/:nodeId/iptv", r.AuthMiddlewareWithBlacklist(), r.CreateIPTVConfig)
+		api.GET("/config/:nodeId/iptv/:userId", r.AuthMiddlewareWithBlacklist(), r.GetIPTVConfig)
+		api.PUT("/config/:nodeId/iptv/:userId", r.AuthMiddlewareWithBlacklist(), r.UpdateIPTVConfig)
+		api.DELETE("/config/:nodeId/iptv/:userId", r.AuthMiddlewareWithBlacklist(), r.DeleteIPTVConfig)
 		api.POST("/pppoe/dial", r.AuthMiddlewareWithBlacklist(), r.DialPPPoE)
 		api.POST("/pppoe/hangup", r.AuthMiddlewareWithBlacklist(), r.HangupPPPoE)
+		api.POST("/wan/connect", r.AuthMiddlewareWithBlacklist(), r.ConnectWAN)
+		api.POST("/wan/disconnect", r.AuthMiddlewareWithBlacklist(), r.DisconnectWAN)
+
+		// Subscriber endpoints
+		api.GET("/subscribers/:nodeId", r.AuthMiddlewareWithBlacklist(), r.ListSubscribers)
+		api.GET("/subscribers/:nodeId/:userId", r.AuthMiddlewareWithBlacklist(), r.GetSubscriber)
+		api.DELETE("/subscribers/:nodeId/:userId", r.AuthMiddlewareWithBlacklist(), r.DeleteSubscriber)
+		api.POST("/subscribers/:nodeId/:userId/suspend", r.AuthMiddlewareWithBlacklist(), r.SuspendSubscriber)
+		api.POST("/subscribers/:nodeId/:userId/resume", r.AuthMiddlewareWithBlacklist(), r.ResumeSubscriber)
+		api.POST("/subscribers/:nodeId/:userId/move", r.AuthMiddlewareWithBlacklist(), r.MoveSubscriber)
+		api.GET("/subscribers/:nodeId/:userId/services/:service", r.AuthMiddlewareWithBlacklist(), r.GetSubscriberService)
+		api.PUT("/subscribers/:nodeId/:userId/services/:service", r.AuthMiddlewareWithBlacklist(), r.PutSubscriberService)
+		api.DELETE("/subscribers/:nodeId/:userId/services/:service", r.AuthMiddlewareWithBlacklist(), r.DeleteSubscriberService)
+		api.GET("/subscriber-moves", r.AuthMiddlewareWithBlacklist(), r.ListSubscriberMoves)
+		api.GET("/subscriber-moves/:id", r.AuthMiddlewareWithBlacklist(), r.GetSubscriberMove)
+
+		// Service profile endpoints
+		api.GET("/profiles", r.AuthMiddlewareWithBlacklist(), r.ListServiceProfiles)
+		api.POST("/profiles", r.AuthMiddlewareWithBlacklist(), r.CreateServiceProfile)
+		api.GET("/profiles/:name", r.AuthMiddlewareWithBlacklist(), r.GetServiceProfile)
+		api.PUT("/profiles/:name", r.AuthMiddlewareWithBlacklist(), r.UpdateServiceProfile)
+		api.DELETE("/profiles/:name", r.AuthMiddlewareWithBlacklist(), r.DeleteServiceProfile)
 
 		// Failed events endpoints
 		api.GET("/failed-events", r.AuthMiddlewareWithBlacklist(), r.GetAllFailedEvents)
 		api.GET("/failed-events/:nodeId", r.AuthMiddlewareWithBlacklist(), r.GetFailedEvents)
+
+		// Secret management endpoints
+		api.POST("/secrets/rotate", r.AuthMiddlewareWithBlacklist(), r.RotateSecrets)
+		api.GET("/secrets/audit", r.AuthMiddlewareWithBlacklist(), r.GetSecretAudit)
+
+		// Scheduled jobs endpoints
+		api.GET("/schedules", r.AuthMiddlewareWithBlacklist(), r.ListScheduledJobs)
+		api.POST("/schedules", r.AuthMiddlewareWithBlacklist(), r.CreateScheduledJob)
+		api.GET("/schedules/:id", r.AuthMiddlewareWithBlacklist(), r.GetScheduledJob)
+		api.PUT("/schedules/:id", r.AuthMiddlewareWithBlacklist(), r.UpdateScheduledJob)
+		api.DELETE("/schedules/:id", r.AuthMiddlewareWithBlacklist(), r.DeleteScheduledJob)
+		api.GET("/schedules/:id/history", r.AuthMiddlewareWithBlacklist(), r.GetScheduledJobHistory)
 	}
 
 	// ---- Swagger API documentation ----
@@ -0,0 +1,959 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"fastrg-controller/internal/storage"
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// SchedulerTickInterval defines how often the leader checks for due jobs (in seconds)
+	SchedulerTickInterval = 10
+	// ReplacementCheckInterval defines how often the leader checks for
+	// registered replacement nodes to dial (in seconds)
+	ReplacementCheckInterval = 10
+	// MoveRecoveryInterval defines how often the leader looks for subscriber
+	// moves left behind by a failed replica (in seconds)
+	MoveRecoveryInterval = 30
+	// SchedulerMaxRunningJobs bounds the jobs the leader runs at the same time
+	SchedulerMaxRunningJobs = 8
+	// SchedulerSessionTTL defines the leader election session TTL (in seconds)
+	SchedulerSessionTTL = 15
+	// ScheduleHistoryTTL defines how long execution history is kept (in seconds, 30 days)
+	ScheduleHistoryTTL = 2592000
+	// DefaultRedialDelay defines the wait between hangup and dial of a redial or reconnect action (in seconds)
+	DefaultRedialDelay = 5
+
+	scheduleJobsPrefix    = "schedules/jobs/"
+	scheduleHistoryPrefix = "schedules/history/"
+	scheduleLeaderKey     = "schedules/leader"
+	// scheduleRunningPrefix holds a key per running job, bound to the lease
+	// of the leader running it
+	scheduleRunningPrefix = "schedules/running/"
+)
+
+// Schedule types
+const (
+	ScheduleOnce = "once"
+	ScheduleCron = "cron"
+)
+
+// Scheduled action types
+const (
+	ActionPPPoEDial       = "pppoe_dial"
+	ActionPPPoEHangup     = "pppoe_hangup"
+	ActionPPPoERedial     = "pppoe_redial"
+	ActionWANConnect      = "wan_connect"
+	ActionWANDisconnect   = "wan_disconnect"
+	ActionWANReconnect    = "wan_reconnect"
+	ActionHSIConfigUpdate = "hsi_config_update"
+	ActionNodeMaintenance = "node_maintenance"
+)
+
+// ScheduleAction describes what a scheduled job does when it fires
+type ScheduleAction struct {
+	Type        string     `json:"type" example:"pppoe_redial"`
+	NodeID      string     `json:"node_id" example:"node001"`
+	UserIDs     []string   `json:"user_ids,omitempty" example:"1,2,3"`
+	HSIConfig   *HSIConfig `json:"hsi_config,omitempty"`
+	Maintenance *bool      `json:"maintenance,omitempty" example:"true"`
+	Reason      string     `json:"reason,omitempty" example:"OLT firmware upgrade"`
+	RedialDelay int        `json:"redial_delay_seconds,omitempty" example:"5"`
+}
+
+// ScheduledJob is a one-shot or recurring job stored in etcd
+type ScheduledJob struct {
+	ID         string         `json:"id" example:"9f86d081884c7d65"`
+	Name       string         `json:"name" example:"Nightly redial"`
+	Schedule   string         `json:"schedule" example:"cron"`
+	RunAt      string         `json:"run_at,omitempty" example:"2024-01-01T03:00:00Z"`
+	Cron       string         `json:"cron,omitempty" example:"0 3 * * *"`
+	Timezone   string         `json:"timezone,omitempty" example:"Asia/Taipei"`
+	Action     ScheduleAction `json:"action"`
+	Enabled    bool           `json:"enabled" example:"true"`
+	NextRunAt  string         `json:"next_run_at,omitempty" example:"2024-01-01T03:00:00Z"`
+	LastRunAt  string         `json:"last_run_at,omitempty" example:"2023-12-31T03:00:00Z"`
+	LastStatus string         `json:"last_status,omitempty" example:"succeeded"`
+	CreatedBy  string         `json:"created_by" example:"admin"`
+	CreatedAt  string         `json:"created_at" example:"2023-12-01T00:00:00Z"`
+	UpdatedBy  string         `json:"updated_by" example:"admin"`
+	UpdatedAt  string         `json:"updated_at" example:"2023-12-01T00:00:00Z"`
+}
+
+// UpdateScheduledJobRequest is the request to replace a scheduled job; an omitted enabled keeps the current state
+type UpdateScheduledJobRequest struct {
+	ScheduledJob
+	Enabled *bool `json:"enabled,omitempty" example:"false"`
+}
+
+// ScheduleTargetResult is the outcome of a job action for a single target
+type ScheduleTargetResult struct {
+	Target string `json:"target" example:"node001/2"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ScheduleExecution records a single run of a scheduled job
+type ScheduleExecution struct {
+	JobID      string                 `json:"job_id"`
+	StartedAt  string                 `json:"started_at"`
+	FinishedAt string                 `json:"finished_at"`
+	Status     string                 `json:"status" example:"succeeded"`
+	ExecutedBy string                 `json:"executed_by" example:"fastrg-controller-0"`
+	Results    []ScheduleTargetResult `json:"results"`
+}
+
+// NodeMaintenance represents the maintenance state of a node
+type NodeMaintenance struct {
+	Node      string `json:"node" example:"node001"`
+	Enabled   bool   `json:"enabled" example:"true"`
+	Reason    string `json:"reason,omitempty" example:"OLT firmware upgrade"`
+	UpdatedBy string `json:"updatedBy" example:"admin"`
+	UpdatedAt string `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// UpdateNodeMaintenance represents the request to change a node's maintenance state
+type UpdateNodeMaintenance struct {
+	Enabled bool   `json:"enabled" example:"true"`
+	Reason  string `json:"reason" example:"OLT firmware upgrade"`
+}
+
+// Scheduler runs due jobs on the replica currently holding scheduler leadership
+type Scheduler struct {
+	etcd *storage.EtcdClient
+	rest *RestServer
+	id   string
+	// slots holds a token per job being run
+	slots chan struct{}
+}
+
+func newResourceID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// StartScheduler starts the scheduler leader election loop in the background
+func (r *RestServer) StartScheduler() context.CancelFunc {
+	id, err := os.Hostname()
+	if err != nil || id == "" {
+		id = newResourceID()
+	}
+	s := &Scheduler{etcd: r.etcd, rest: r, id: id, slots: make(chan struct{}, SchedulerMaxRunningJobs)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.run(ctx)
+	logrus.Infof("Scheduler started on replica %s", id)
+
+	return cancel
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := s.campaignAndRun(ctx); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Warn("Scheduler lost leadership, retrying")
+			select {
+			case <-ctx.Done():
+			case <-time.After(SchedulerTickInterval * time.Second):
+			}
+		}
+	}
+	logrus.Info("Scheduler stopped")
+}
+
+// campaignAndRun blocks until this replica becomes leader, then runs due jobs
+// until the context is cancelled or the election session expires
+func (s *Scheduler) campaignAndRun(ctx context.Context) error {
+	session, err := concurrency.NewSession(s.etcd.Client(),
+		concurrency.WithTTL(SchedulerSessionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to create scheduler session")
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, scheduleLeaderKey)
+	if err := election.Campaign(ctx, s.id); err != nil {
+		return errors.Wrap(err, "scheduler campaign failed")
+	}
+	logrus.Infof("Replica %s is now the scheduler leader", s.id)
+	defer func() {
+		resignCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err := election.Resign(resignCtx); err != nil {
+			logrus.WithError(err).Warn("Failed to resign scheduler leadership")
+		}
+	}()
+
+	// Jobs and loops stop with the leadership and are waited for before the
+	// session, which their claims are bound to, is closed
+	leaderCtx, stop := context.WithCancel(ctx)
+	var running sync.WaitGroup
+	defer running.Wait()
+	defer stop()
+	loops := []struct {
+		interval time.Duration
+		run      func(context.Context)
+	}{
+		{SchedulerTickInterval * time.Second, func(ctx context.Context) { s.runDueJobs(ctx, session.Lease(), &running) }},
+		{ReplacementCheckInterval * time.Second, s.dialReplacementNodes},
+		{MoveRecoveryInterval * time.Second, s.recoverSubscriberMoves},
+	}
+	for _, loop := range loops {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			every(leaderCtx, loop.interval, loop.run)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-session.Done():
+		return errors.New("scheduler session expired")
+	}
+}
+
+// every runs fn right away and then on its own ticker until ctx is done
+func every(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fn(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func scheduleRunningKey(jobId string) string {
+	return scheduleRunningPrefix + jobId
+}
+
+// runDueJobs claims the due jobs and runs each in its own goroutine, at most
+// SchedulerMaxRunningJobs at a time. Jobs left running by a leader that died
+// are marked interrupted.
+func (s *Scheduler) runDueJobs(ctx context.Context, lease clientv3.LeaseID, running *sync.WaitGroup) {
+	resp, err := s.etcd.Client().Get(ctx, scheduleJobsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list scheduled jobs")
+		return
+	}
+	runningResp, err := s.etcd.Client().Get(ctx, scheduleRunningPrefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list running scheduled jobs")
+		return
+	}
+	claimed := make(map[string]bool, len(runningResp.Kvs))
+	for _, kv := range runningResp.Kvs {
+		claimed[strings.TrimPrefix(string(kv.Key), scheduleRunningPrefix)] = true
+	}
+
+	now := time.Now()
+	for _, kv := range resp.Kvs {
+		var job ScheduledJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse scheduled job %s", kv.Key)
+			continue
+		}
+		// The claim of a running job expires with the lease of its leader
+		if job.LastStatus == "running" && !claimed[job.ID] {
+			logrus.Warnf("Scheduled job %s was interrupted by a leader change", job.ID)
+			job.LastStatus = "interrupted"
+			s.updateJob(ctx, string(kv.Key), kv.ModRevision, &job, nil)
+			continue
+		}
+		if !job.Enabled || job.NextRunAt == "" || claimed[job.ID] {
+			continue
+		}
+		nextRun, err := time.Parse(time.RFC3339, job.NextRunAt)
+		if err != nil || nextRun.After(now) {
+			continue
+		}
+
+		// Claim the run by advancing the job before executing it, so a leader
+		// change never executes the same run twice
+		job.LastRunAt = now.UTC().Format(time.RFC3339)
+		if job.Schedule == ScheduleOnce {
+			job.Enabled = false
+			job.NextRunAt = ""
+		} else if job.NextRunAt, err = nextCronRun(&job, now); err != nil {
+			logrus.WithError(err).Errorf("Failed to compute next run of scheduled job %s", job.ID)
+			job.Enabled = false
+		}
+		job.LastStatus = "running"
+
+		// Jobs beyond the limit stay due until a slot is free
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return
+		}
+		claim := clientv3.OpPut(scheduleRunningKey(job.ID), s.id, clientv3.WithLease(lease))
+		modRevision, ok := s.updateJob(ctx, string(kv.Key), kv.ModRevision, &job, &claim)
+		if !ok {
+			<-s.slots
+			continue
+		}
+
+		running.Add(1)
+		go func(key string, job ScheduledJob) {
+			defer running.Done()
+			defer func() { <-s.slots }()
+			execution := s.execute(ctx, &job)
+			s.recordExecution(ctx, execution)
+
+			job.LastStatus = execution.Status
+			release := clientv3.OpDelete(scheduleRunningKey(job.ID))
+			if _, ok := s.updateJob(ctx, key, modRevision, &job, &release); !ok {
+				// The job was modified while running, keep it and only
+				// release the claim
+				if _, err := s.etcd.Client().Delete(ctx, scheduleRunningKey(job.ID)); err != nil {
+					logrus.WithError(err).Errorf("Failed to release scheduled job %s", job.ID)
+				}
+			}
+		}(string(kv.Key), job)
+	}
+}
+
+// updateJob writes the job only if it was not modified since modRevision,
+// together with an operation on its running claim if one is passed
+func (s *Scheduler) updateJob(ctx context.Context, key string, modRevision int64, job *ScheduledJob, claim *clientv3.Op) (int64, bool) {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to marshal scheduled job %s", job.ID)
+		return 0, false
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(key, string(jobJSON))}
+	if claim != nil {
+		ops = append(ops, *claim)
+	}
+	txnResp, err := s.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to update scheduled job %s", job.ID)
+		return 0, false
+	}
+	if !txnResp.Succeeded {
+		logrus.Infof("Scheduled job %s was modified concurrently, skipping", job.ID)
+		return 0, false
+	}
+	return txnResp.Header.Revision, true
+}
+
+func (s *Scheduler) execute(ctx context.Context, job *ScheduledJob) *ScheduleExecution {
+	execution := &ScheduleExecution{
+		JobID:      job.ID,
+		StartedAt:  time.Now().UTC().Format(time.RFC3339),
+		ExecutedBy: s.id,
+		Results:    []ScheduleTargetResult{},
+	}
+	logrus.Infof("Executing scheduled job %s (%s): %s on node %s", job.ID, job.Name, job.Action.Type, job.Action.NodeID)
+
+	action := job.Action
+	addResult := func(target string, err error) {
+		result := ScheduleTargetResult{Target: target}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		execution.Results = append(execution.Results, result)
+	}
+	sendCommands := func(send func(ctx context.Context, nodeId, userId, action string) *apiError, command string) {
+		for _, userId := range action.UserIDs {
+			target := fmt.Sprintf("%s/%s", action.NodeID, userId)
+			if apiErr := send(ctx, action.NodeID, userId, command); apiErr != nil {
+				addResult(target, apiErr)
+				continue
+			}
+			addResult(target, nil)
+		}
+	}
+	waitRedialDelay := func() {
+		delay := action.RedialDelay
+		if delay <= 0 {
+			delay = DefaultRedialDelay
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(delay) * time.Second):
+		}
+	}
+
+	// Only a job changing the maintenance state runs while the node is in maintenance
+	var held *apiError
+	if action.Type != ActionNodeMaintenance {
+		held = s.rest.checkNodeInService(ctx, action.NodeID)
+	}
+
+	switch {
+	case held != nil:
+		addResult(action.NodeID, held)
+	case action.Type == ActionPPPoEDial:
+		sendCommands(s.rest.sendPPPoECommand, "dial")
+	case action.Type == ActionPPPoEHangup:
+		sendCommands(s.rest.sendPPPoECommand, "hangup")
+	case action.Type == ActionPPPoERedial:
+		sendCommands(s.rest.sendPPPoECommand, "hangup")
+		waitRedialDelay()
+		sendCommands(s.rest.sendPPPoECommand, "dial")
+	case action.Type == ActionWANConnect:
+		sendCommands(s.rest.sendWANCommand, WANActionConnect)
+	case action.Type == ActionWANDisconnect:
+		sendCommands(s.rest.sendWANCommand, WANActionDisconnect)
+	case action.Type == ActionWANReconnect:
+		sendCommands(s.rest.sendWANCommand, WANActionDisconnect)
+		waitRedialDelay()
+		sendCommands(s.rest.sendWANCommand, WANActionConnect)
+	case action.Type == ActionHSIConfigUpdate:
+		target := fmt.Sprintf("%s/%s", action.NodeID, action.HSIConfig.UserID)
+		updatedBy := fmt.Sprintf("schedule/%s", job.ID)
+		config := *action.HSIConfig
+		if err := s.rest.openHSIConfig(&config); err != nil {
+			addResult(target, err)
+		} else if _, apiErr := s.rest.saveHSIConfig(ctx, action.NodeID, config, updatedBy, false, ""); apiErr != nil {
+			addResult(target, apiErr)
+		} else {
+			addResult(target, nil)
+		}
+	case action.Type == ActionNodeMaintenance:
+		updatedBy := fmt.Sprintf("schedule/%s", job.ID)
+		addResult(action.NodeID, s.rest.setNodeMaintenance(ctx, action.NodeID, *action.Maintenance, action.Reason, updatedBy))
+	default:
+		addResult(action.NodeID, fmt.Errorf("unknown action type %s", action.Type))
+	}
+
+	failed := 0
+	for _, result := range execution.Results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		execution.Status = "succeeded"
+	case failed == len(execution.Results):
+		execution.Status = "failed"
+	default:
+		execution.Status = "partially_failed"
+	}
+	execution.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+
+	logrus.Infof("Scheduled job %s finished with status %s", job.ID, execution.Status)
+	return execution
+}
+
+func (s *Scheduler) recordExecution(ctx context.Context, execution *ScheduleExecution) {
+	// Key format: schedules/history/{job_id}/{timestamp}
+	historyKey := fmt.Sprintf("%s%s/%d", scheduleHistoryPrefix, execution.JobID, time.Now().UnixNano())
+	executionJSON, err := json.Marshal(execution)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal schedule execution")
+		return
+	}
+
+	lease, err := s.etcd.Client().Grant(ctx, ScheduleHistoryTTL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create lease for schedule execution history")
+		return
+	}
+
+	if _, err := s.etcd.Client().Put(ctx, historyKey, string(executionJSON), clientv3.WithLease(lease.ID)); err != nil {
+		logrus.WithError(err).Error("Failed to store schedule execution history")
+	}
+}
+
+// nextCronRun returns the next activation of a cron job after t, formatted as RFC3339
+func nextCronRun(job *ScheduledJob, t time.Time) (string, error) {
+	schedule, err := utils.ParseCron(job.Cron)
+	if err != nil {
+		return "", err
+	}
+	location := time.UTC
+	if job.Timezone != "" {
+		if location, err = time.LoadLocation(job.Timezone); err != nil {
+			return "", errors.Wrapf(err, "invalid timezone %s", job.Timezone)
+		}
+	}
+	next := schedule.Next(t.In(location))
+	if next.IsZero() {
+		return "", fmt.Errorf("cron expression %q never fires", job.Cron)
+	}
+	return next.UTC().Format(time.RFC3339), nil
+}
+
+// prepareScheduledJob validates a job and computes its next run time
+func prepareScheduledJob(job *ScheduledJob) *apiError {
+	if job.Name == "" {
+		return newAPIError(http.StatusBadRequest, "Job name is required")
+	}
+
+	switch job.Schedule {
+	case ScheduleOnce:
+		runAt, err := time.Parse(time.RFC3339, job.RunAt)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "run_at must be an RFC3339 timestamp")
+		}
+		job.Cron = ""
+		job.NextRunAt = runAt.UTC().Format(time.RFC3339)
+	case ScheduleCron:
+		nextRun, err := nextCronRun(job, time.Now())
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, err.Error())
+		}
+		job.RunAt = ""
+		job.NextRunAt = nextRun
+	default:
+		return newAPIError(http.StatusBadRequest, "schedule must be either once or cron")
+	}
+
+	action := job.Action
+	if action.NodeID == "" {
+		return newAPIError(http.StatusBadRequest, "Action node ID is required")
+	}
+	switch action.Type {
+	case ActionPPPoEDial, ActionPPPoEHangup, ActionPPPoERedial, ActionWANConnect, ActionWANDisconnect, ActionWANReconnect:
+		if len(action.UserIDs) == 0 {
+			return newAPIError(http.StatusBadRequest, "Action user IDs are required")
+		}
+	case ActionHSIConfigUpdate:
+		if action.HSIConfig == nil {
+			return newAPIError(http.StatusBadRequest, "Action HSI config is required")
+		}
+		if apiErr := validateHSIConfig(*action.HSIConfig).apiError("HSI config"); apiErr != nil {
+			return apiErr
+		}
+	case ActionNodeMaintenance:
+		if action.Maintenance == nil {
+			return newAPIError(http.StatusBadRequest, "Action maintenance flag is required")
+		}
+	default:
+		return newAPIError(http.StatusBadRequest, fmt.Sprintf("Unknown action type: %s", action.Type))
+	}
+
+	return nil
+}
+
+// maskScheduledJob hides the secrets of a job before it is returned from the API
+func maskScheduledJob(job *ScheduledJob) {
+	if job.Action.HSIConfig != nil {
+		masked := *job.Action.HSIConfig
+		masked.Password = maskSecret(masked.Password)
+		job.Action.HSIConfig = &masked
+	}
+}
+
+func (r *RestServer) getScheduledJob(ctx context.Context, jobId string) (*ScheduledJob, *apiError) {
+	resp, err := r.etcd.Client().Get(ctx, scheduleJobsPrefix+jobId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get scheduled job")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, newAPIError(http.StatusNotFound, "Scheduled job not found")
+	}
+
+	var job ScheduledJob
+	if err := json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to parse scheduled job")
+	}
+	return &job, nil
+}
+
+// putScheduledJob stores a job with the secrets of its HSI config encrypted
+func (r *RestServer) putScheduledJob(ctx context.Context, job *ScheduledJob) *apiError {
+	stored := *job
+	if job.Action.HSIConfig != nil {
+		sealed, err := r.sealHSIConfig(*job.Action.HSIConfig)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "Failed to encrypt scheduled job secrets")
+		}
+		stored.Action.HSIConfig = &sealed
+	}
+
+	jobJSON, err := json.Marshal(stored)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to marshal scheduled job")
+	}
+	if _, err := r.etcd.Client().Put(ctx, scheduleJobsPrefix+job.ID, string(jobJSON)); err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to save scheduled job")
+	}
+	return nil
+}
+
+// ListScheduledJobs returns all scheduled jobs
+// @Summary      List scheduled jobs
+// @Description  Get a list of all one-shot and recurring scheduled jobs
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   ScheduledJob
+// @Failure      500  {object}  ErrorResponse
+// @Router       /schedules [get]
+func (r *RestServer) ListScheduledJobs(c *gin.Context) {
+	ctx := c.Request.Context()
+	resp, err := r.etcd.Client().Get(ctx, scheduleJobsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get scheduled jobs"})
+		return
+	}
+
+	jobs := []ScheduledJob{}
+	for _, kv := range resp.Kvs {
+		var job ScheduledJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse scheduled job %s", kv.Key)
+			continue
+		}
+		maskScheduledJob(&job)
+		jobs = append(jobs, job)
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetScheduledJob returns a scheduled job
+// @Summary      Get scheduled job
+// @Description  Get a scheduled job by its ID
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Job ID"
+// @Success      200  {object}  ScheduledJob
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /schedules/{id} [get]
+func (r *RestServer) GetScheduledJob(c *gin.Context) {
+	job, apiErr := r.getScheduledJob(c.Request.Context(), c.Param("id"))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	maskScheduledJob(job)
+	c.JSON(http.StatusOK, job)
+}
+
+// CreateScheduledJob creates a new scheduled job
+// @Summary      Create scheduled job
+// @Description  Create a one-shot (schedule=once, run_at) or recurring (schedule=cron, cron) job. Cron expressions are evaluated in the given timezone, UTC by default.
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      ScheduledJob  true  "Scheduled job"
+// @Success      200      {object}  ScheduledJob
+// @Failure      400      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /schedules [post]
+func (r *RestServer) CreateScheduledJob(c *gin.Context) {
+	var job ScheduledJob
+	if err := c.ShouldBindJSON(&job); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Get current username
+	authHeader := c.GetHeader("Authorization")
+	username, err := r.getUserFromToken(authHeader)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	if apiErr := prepareScheduledJob(&job); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	job.ID = newResourceID()
+	job.Enabled = true
+	job.LastRunAt = ""
+	job.LastStatus = ""
+	job.CreatedBy = username
+	job.CreatedAt = now
+	job.UpdatedBy = username
+	job.UpdatedAt = now
+
+	if apiErr := r.putScheduledJob(c.Request.Context(), &job); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	logrus.Infof("Scheduled job %s (%s) created by %s, next run: %s", job.ID, job.Name, username, job.NextRunAt)
+	maskScheduledJob(&job)
+	c.JSON(http.StatusOK, job)
+}
+
+// UpdateScheduledJob replaces an existing scheduled job
+// @Summary      Update scheduled job
+// @Description  Replace the schedule and action of an existing job. Set enabled=false to pause a job and enabled=true to resume it; omitting enabled keeps the current state.
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string                     true  "Job ID"
+// @Param        request  body      UpdateScheduledJobRequest  true  "Scheduled job"
+// @Success      200      {object}  ScheduledJob
+// @Failure      400      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /schedules/{id} [put]
+func (r *RestServer) UpdateScheduledJob(c *gin.Context) {
+	var req UpdateScheduledJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	job := req.ScheduledJob
+
+	// Get current username
+	authHeader := c.GetHeader("Authorization")
+	username, err := r.getUserFromToken(authHeader)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	existing, apiErr := r.getScheduledJob(ctx, c.Param("id"))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	if apiErr := prepareScheduledJob(&job); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	// A masked password, as returned by the API, keeps the stored one
+	if job.Action.HSIConfig != nil && job.Action.HSIConfig.Password == redactedValue &&
+		existing.Action.HSIConfig != nil && existing.Action.HSIConfig.UserID == job.Action.HSIConfig.UserID {
+		job.Action.HSIConfig.Password = existing.Action.HSIConfig.Password
+	}
+
+	job.ID = existing.ID
+	job.Enabled = existing.Enabled
+	if req.Enabled != nil {
+		job.Enabled = *req.Enabled
+	}
+	job.LastRunAt = existing.LastRunAt
+	job.LastStatus = existing.LastStatus
+	job.CreatedBy = existing.CreatedBy
+	job.CreatedAt = existing.CreatedAt
+	job.UpdatedBy = username
+	job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if apiErr := r.putScheduledJob(ctx, &job); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	logrus.Infof("Scheduled job %s (%s) updated by %s, next run: %s", job.ID, job.Name, username, job.NextRunAt)
+	maskScheduledJob(&job)
+	c.JSON(http.StatusOK, job)
+}
+
+// DeleteScheduledJob removes a scheduled job and its execution history
+// @Summary      Delete scheduled job
+// @Description  Delete a scheduled job together with its execution history
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Job ID"
+// @Success      200  {object}  MessageResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /schedules/{id} [delete]
+func (r *RestServer) DeleteScheduledJob(c *gin.Context) {
+	jobId := c.Param("id")
+	ctx := c.Request.Context()
+
+	resp, err := r.etcd.Client().Delete(ctx, scheduleJobsPrefix+jobId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete scheduled job"})
+		return
+	}
+	if resp.Deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled job not found"})
+		return
+	}
+
+	if _, err := r.etcd.Client().Delete(ctx, scheduleHistoryPrefix+jobId+"/", clientv3.WithPrefix()); err != nil {
+		logrus.WithError(err).Warnf("Failed to delete execution history of scheduled job %s", jobId)
+	}
+
+	logrus.Infof("Scheduled job %s deleted", jobId)
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled job deleted successfully"})
+}
+
+// GetScheduledJobHistory returns the execution history of a scheduled job
+// @Summary      Get scheduled job history
+// @Description  Get the execution history of a scheduled job, newest first
+// @Tags         Schedules
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Job ID"
+// @Success      200  {array}   ScheduleExecution
+// @Failure      500  {object}  ErrorResponse
+// @Router       /schedules/{id}/history [get]
+func (r *RestServer) GetScheduledJobHistory(c *gin.Context) {
+	prefix := scheduleHistoryPrefix + c.Param("id") + "/"
+	resp, err := r.etcd.Client().Get(c.Request.Context(), prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get scheduled job history"})
+		return
+	}
+
+	executions := []ScheduleExecution{}
+	for _, kv := range resp.Kvs {
+		var execution ScheduleExecution
+		if err := json.Unmarshal(kv.Value, &execution); err != nil {
+			logrus.WithError(err).Error("Failed to parse schedule execution")
+			continue
+		}
+		executions = append(executions, execution)
+	}
+	c.JSON(http.StatusOK, executions)
+}
+
+func nodeMaintenanceKey(nodeId string) string {
+	return storage.NodeMaintenanceKey(nodeId)
+}
+
+// loadNodeMaintenance reads the maintenance state of a node, which is out of
+// maintenance if none is stored
+func (r *RestServer) loadNodeMaintenance(ctx context.Context, nodeId string) (*NodeMaintenance, error) {
+	resp, err := r.etcd.Client().Get(ctx, nodeMaintenanceKey(nodeId))
+	if err != nil {
+		return nil, err
+	}
+	maintenance := &NodeMaintenance{Node: nodeId}
+	if len(resp.Kvs) > 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, maintenance); err != nil {
+			return nil, err
+		}
+	}
+	return maintenance, nil
+}
+
+// checkNodeInService refuses dialing subscribers and running scheduled jobs
+// on a node in maintenance
+func (r *RestServer) checkNodeInService(ctx context.Context, nodeId string) *apiError {
+	maintenance, err := r.loadNodeMaintenance(ctx, nodeId)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get node maintenance")
+	}
+	if !maintenance.Enabled {
+		return nil
+	}
+	message := fmt.Sprintf("Node %s is in maintenance", nodeId)
+	if maintenance.Reason != "" {
+		message = fmt.Sprintf("%s: %s", message, maintenance.Reason)
+	}
+	return newAPIError(http.StatusConflict, message)
+}
+
+// setNodeMaintenance stores the maintenance state of a node
+func (r *RestServer) setNodeMaintenance(ctx context.Context, nodeId string, enabled bool, reason, username string) error {
+	maintenance := NodeMaintenance{
+		Node:      nodeId,
+		Enabled:   enabled,
+		Reason:    reason,
+		UpdatedBy: username,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	maintenanceJSON, err := json.Marshal(maintenance)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal node maintenance")
+	}
+	if _, err := r.etcd.Client().Put(ctx, nodeMaintenanceKey(nodeId), string(maintenanceJSON)); err != nil {
+		return errors.Wrap(err, "failed to store node maintenance")
+	}
+	logrus.Infof("Node %s maintenance set to %t by %s", nodeId, enabled, username)
+	return nil
+}
+
+// GetNodeMaintenance gets the maintenance state of a node
+// @Summary      Get Node Maintenance
+// @Description  Get the maintenance state of a specific node
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeMaintenance
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/maintenance [get]
+func (r *RestServer) GetNodeMaintenance(c *gin.Context) {
+	maintenance, err := r.loadNodeMaintenance(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node maintenance"})
+		return
+	}
+	c.JSON(http.StatusOK, maintenance)
+}
+
+// UpdateNodeMaintenance puts a node into or out of maintenance
+// @Summary      Update Node Maintenance
+// @Description  Put a node into maintenance or bring it back into service. While a node is in maintenance its
+// @Description  subscribers cannot be dialed or connected, scheduled jobs other than maintenance changes fail and
+// @Description  failed events it reports are not recorded.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string                 true  "Node ID"
+// @Param        request  body      UpdateNodeMaintenance  true  "Maintenance request"
+// @Success      200      {object}  MessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/maintenance [put]
+func (r *RestServer) UpdateNodeMaintenance(c *gin.Context) {
+	var req UpdateNodeMaintenance
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Get current username
+	authHeader := c.GetHeader("Authorization")
+	username, err := r.getUserFromToken(authHeader)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	if err := r.setNodeMaintenance(c.Request.Context(), c.Param("nodeId"), req.Enabled, req.Reason, username); err != nil {
+		logrus.WithError(err).Error("Failed to update node maintenance")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node maintenance"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Node maintenance updated successfully"})
+}
@@ -0,0 +1,39 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestRunDueJobsMarksUnclaimedRunningJobsInterrupted(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	s := &Scheduler{etcd: r.etcd, rest: r, id: "replica1", slots: make(chan struct{}, SchedulerMaxRunningJobs)}
+
+	// The leader running job1 died, job2 is still run by a live leader
+	putTestJSON(t, r, scheduleJobsPrefix+"job1", `{"id":"job1","schedule":"cron","enabled":true,"next_run_at":"2999-01-01T00:00:00Z","last_status":"running"}`)
+	putTestJSON(t, r, scheduleJobsPrefix+"job2", `{"id":"job2","schedule":"cron","enabled":true,"next_run_at":"2999-01-01T00:00:00Z","last_status":"running"}`)
+	putTestJSON(t, r, scheduleRunningKey("job2"), "replica2")
+
+	var running sync.WaitGroup
+	s.runDueJobs(ctx, 0, &running)
+	running.Wait()
+
+	for id, want := range map[string]string{"job1": "interrupted", "job2": "running"} {
+		resp, err := r.etcd.Client().Get(ctx, scheduleJobsPrefix+id)
+		if err != nil || len(resp.Kvs) != 1 {
+			t.Fatalf("Get(%s) = %v, %v", id, resp, err)
+		}
+		var job ScheduledJob
+		if err := json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.LastStatus != want {
+			t.Errorf("%s status = %s, want %s", id, job.LastStatus, want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	secretAuditPrefix = "audit/secrets/"
+
+	SecretAuditReveal = "reveal"
+	SecretAuditRotate = "rotate"
+)
+
+// SecretAuditRecord records an access to subscriber secrets
+type SecretAuditRecord struct {
+	Username  string   `json:"username" example:"admin"`
+	Action    string   `json:"action" example:"reveal"`
+	Resource  string   `json:"resource" example:"configs/node-1/hsi/1"`
+	UserIDs   []string `json:"user_ids,omitempty"`
+	ClientIP  string   `json:"client_ip" example:"10.0.0.1"`
+	Timestamp string   `json:"timestamp" example:"2025-01-01T00:00:00Z"`
+}
+
+// SecretRotationResult summarizes a re-encryption of stored secrets
+type SecretRotationResult struct {
+	ActiveKeyID string `json:"active_key_id" example:"2025-01"`
+	Rewrapped   int    `json:"rewrapped" example:"10"`
+	Unchanged   int    `json:"unchanged" example:"0"`
+	Failed      int    `json:"failed" example:"0"`
+}
+
+// SetKeyProvider enables encryption of subscriber secrets at rest. Without a
+// key provider secrets are stored as given.
+func (r *RestServer) SetKeyProvider(keys utils.KeyProvider) {
+	r.keys = keys
+}
+
+// sealSecret encrypts a secret for storage. Empty and already encrypted values
+// are kept as is.
+func (r *RestServer) sealSecret(value string) (string, error) {
+	if r.keys == nil || value == "" || utils.IsEncryptedSecret(value) {
+		return value, nil
+	}
+	return utils.EncryptSecret(r.keys, value)
+}
+
+// openSecret decrypts a stored secret. Values stored before encryption was
+// enabled are returned as is.
+func (r *RestServer) openSecret(value string) (string, error) {
+	if !utils.IsEncryptedSecret(value) {
+		return value, nil
+	}
+	if r.keys == nil {
+		return "", fmt.Errorf("secret is encrypted but no key provider is configured")
+	}
+	return utils.DecryptSecret(r.keys, value)
+}
+
+// maskSecret hides a secret in API responses
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// sealHSIConfig returns a copy of config with its secrets encrypted for storage
+func (r *RestServer) sealHSIConfig(config HSIConfig) (HSIConfig, error) {
+	var err error
+	config.Password, err = r.sealSecret(config.Password)
+	return config, err
+}
+
+// openHSIConfig decrypts the secrets of a stored config in place
+func (r *RestServer) openHSIConfig(config *HSIConfig) error {
+	var err error
+	config.Password, err = r.openSecret(config.Password)
+	return err
+}
+
+// canRevealSecrets reports whether a user may see subscriber secrets in clear
+// text. Users are granted the permission through the comma separated
+// SECRET_REVEAL_USERS environment variable.
+func canRevealSecrets(username string) bool {
+	for _, allowed := range strings.Split(os.Getenv("SECRET_REVEAL_USERS"), ",") {
+		if strings.TrimSpace(allowed) == username && username != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeReveal checks whether the request asks to reveal secrets with
+// reveal=true and, if so, whether the user holds the permission. Every granted
+// reveal is recorded in the audit log.
+func (r *RestServer) authorizeReveal(c *gin.Context, resource string, userIds []string) (bool, *apiError) {
+	if c.Query("reveal") != "true" {
+		return false, nil
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		return false, newAPIError(http.StatusUnauthorized, "Failed to get user from token")
+	}
+	if !canRevealSecrets(username) {
+		logrus.Warnf("User %s was denied revealing secrets of %s", username, resource)
+		return false, newAPIError(http.StatusForbidden, "Permission to reveal secrets denied")
+	}
+
+	if err := r.recordSecretAudit(c.Request.Context(), SecretAuditRecord{
+		Username: username,
+		Action:   SecretAuditReveal,
+		Resource: resource,
+		UserIDs:  userIds,
+		ClientIP: c.ClientIP(),
+	}); err != nil {
+		// Secrets are never revealed without an audit record
+		return false, newAPIError(http.StatusInternalServerError, "Failed to record secret access")
+	}
+	return true, nil
+}
+
+func (r *RestServer) recordSecretAudit(ctx context.Context, record SecretAuditRecord) error {
+	now := time.Now().UTC()
+	record.Timestamp = now.Format(time.RFC3339)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s-%s", secretAuditPrefix, now.Format("20060102T150405.000000000Z"), newResourceID())
+	if _, err := r.etcd.Client().Put(ctx, key, string(data)); err != nil {
+		logrus.WithError(err).Error("Failed to record secret audit")
+		return err
+	}
+	logrus.Infof("Secret %s of %s by %s from %s", record.Action, record.Resource, record.Username, record.ClientIP)
+	return nil
+}
+
+// needsRewrap reports whether a stored secret is not yet encrypted with the active key
+func (r *RestServer) needsRewrap(value string) bool {
+	return value != "" && utils.SecretKeyID(value) != r.keys.ActiveKeyID()
+}
+
+// rewrapSecret re-encrypts a stored secret with the active key
+func (r *RestServer) rewrapSecret(value string) (string, error) {
+	plaintext, err := r.openSecret(value)
+	if err != nil {
+		return "", err
+	}
+	return utils.EncryptSecret(r.keys, plaintext)
+}
+
+// rewrapPrefix re-encrypts the secrets of every value under prefix. rewrap
+// returns the new value, or nil if the value needs no change. Each key is
+// written only if it was not modified in the meantime.
+func (r *RestServer) rewrapPrefix(ctx context.Context, prefix string, result *SecretRotationResult, rewrap func(value []byte) ([]byte, error)) error {
+	resp, err := r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		value, err := rewrap(kv.Value)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to re-encrypt secrets of %s", kv.Key)
+			result.Failed++
+			continue
+		}
+		if value == nil {
+			result.Unchanged++
+			continue
+		}
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(string(kv.Key), string(value))).
+			Commit()
+		if err != nil || !txnResp.Succeeded {
+			logrus.WithError(err).Warnf("Failed to store re-encrypted secrets of %s", kv.Key)
+			result.Failed++
+			continue
+		}
+		result.Rewrapped++
+	}
+	return nil
+}
+
+// rewrapHSIConfigPassword re-encrypts the password of an HSI config, reporting
+// whether it changed
+func (r *RestServer) rewrapHSIConfigPassword(config *HSIConfig) (bool, error) {
+	if config == nil || !r.needsRewrap(config.Password) {
+		return false, nil
+	}
+	password, err := r.rewrapSecret(config.Password)
+	if err != nil {
+		return false, err
+	}
+	config.Password = password
+	return true, nil
+}
+
+// RotateSecrets re-encrypts stored subscriber secrets with the active key
+// @Summary      Rotate secret encryption key
+// @Description  Re-encrypt every stored PPPoE password (HSI configs, their revisions and scheduled jobs) with the
+// @Description  active key, encrypting values stored before encryption was enabled. Add a new key to the key file
+// @Description  and restart the controller before calling this to rotate keys. Requires the reveal permission.
+// @Tags         Secrets
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  SecretRotationResult
+// @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /secrets/rotate [post]
+func (r *RestServer) RotateSecrets(c *gin.Context) {
+	if r.keys == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Secret encryption is not configured"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+	if !canRevealSecrets(username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission to rotate secrets denied"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := r.recordSecretAudit(ctx, SecretAuditRecord{
+		Username: username,
+		Action:   SecretAuditRotate,
+		Resource: "*",
+		ClientIP: c.ClientIP(),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record secret access"})
+		return
+	}
+
+	result := &SecretRotationResult{ActiveKeyID: r.keys.ActiveKeyID()}
+	rewrapConfig := func(value []byte) ([]byte, error) {
+		var configWithMetadata HSIConfigWithMetadata
+		if err := json.Unmarshal(value, &configWithMetadata); err != nil {
+			return nil, err
+		}
+		if changed, err := r.rewrapHSIConfigPassword(&configWithMetadata.Config); err != nil || !changed {
+			return nil, err
+		}
+		return json.Marshal(configWithMetadata)
+	}
+	rewrapRevision := func(value []byte) ([]byte, error) {
+		var revision HSIRevision
+		if err := json.Unmarshal(value, &revision); err != nil {
+			return nil, err
+		}
+		if changed, err := r.rewrapHSIConfigPassword(revision.Config); err != nil || !changed {
+			return nil, err
+		}
+		return json.Marshal(revision)
+	}
+	rewrapJob := func(value []byte) ([]byte, error) {
+		var job ScheduledJob
+		if err := json.Unmarshal(value, &job); err != nil {
+			return nil, err
+		}
+		if changed, err := r.rewrapHSIConfigPassword(job.Action.HSIConfig); err != nil || !changed {
+			return nil, err
+		}
+		return json.Marshal(job)
+	}
+
+	keysResp, err := r.etcd.Client().Get(ctx, "configs/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list HSI configs"})
+		return
+	}
+	nodes := make(map[string]bool)
+	for _, kv := range keysResp.Kvs {
+		// key format: configs/{nodeId}/hsi/{userId}
+		if parts := strings.Split(string(kv.Key), "/"); len(parts) == 4 && parts[2] == "hsi" {
+			nodes[parts[1]] = true
+		}
+	}
+	for nodeId := range nodes {
+		if err := r.rewrapPrefix(ctx, fmt.Sprintf("configs/%s/hsi/", nodeId), result, rewrapConfig); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to re-encrypt HSI configs"})
+			return
+		}
+	}
+	if err := r.rewrapPrefix(ctx, "history/hsi/", result, rewrapRevision); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to re-encrypt HSI config revisions"})
+		return
+	}
+	if err := r.rewrapPrefix(ctx, scheduleJobsPrefix, result, rewrapJob); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to re-encrypt scheduled jobs"})
+		return
+	}
+
+	logrus.Infof("Secrets re-encrypted with key %s by %s: %d rewrapped, %d unchanged, %d failed",
+		result.ActiveKeyID, username, result.Rewrapped, result.Unchanged, result.Failed)
+	c.JSON(http.StatusOK, result)
+}
+
+// GetSecretAudit returns the audit log of secret accesses
+// @Summary      Get secret audit log
+// @Description  List reveals of subscriber secrets and key rotations, newest first
+// @Tags         Secrets
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   SecretAuditRecord
+// @Failure      500  {object}  ErrorResponse
+// @Router       /secrets/audit [get]
+func (r *RestServer) GetSecretAudit(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), secretAuditPrefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get secret audit log"})
+		return
+	}
+
+	records := []SecretAuditRecord{}
+	for _, kv := range resp.Kvs {
+		var record SecretAuditRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	c.JSON(http.StatusOK, records)
+}
@@ -0,0 +1,108 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testKeys(t *testing.T, data string) utils.KeyProvider {
+	t.Helper()
+	keys, err := utils.ParseLocalKeys([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testKeyLine(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32))) + "\n"
+}
+
+// storedHSIPassword reads the password of an HSI config as stored in etcd
+func storedHSIPassword(t *testing.T, r *RestServer, nodeId, userId string) string {
+	t.Helper()
+	resp, err := r.etcd.Client().Get(context.Background(), hsiConfigKey(nodeId, userId))
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("Failed to get HSI config: %v", err)
+	}
+	var stored HSIConfigWithMetadata
+	if err := json.Unmarshal(resp.Kvs[0].Value, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored.Config.Password
+}
+
+func TestHSIConfigPasswordEncryptedAtRest(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	r.SetKeyProvider(testKeys(t, testKeyLine("k1", 'a')))
+
+	config := testHSIConfig("1", "100")
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", config, "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+	if password := storedHSIPassword(t, r, "node1", "1"); !utils.IsEncryptedSecret(password) || utils.SecretKeyID(password) != "k1" {
+		t.Errorf("stored password = %q, want encrypted with k1", password)
+	}
+
+	// Nodes receive the password in clear text in the dial command
+	if apiErr := r.sendWANCommand(ctx, "node1", "1", WANActionConnect); apiErr != nil {
+		t.Fatalf("sendWANCommand() error = %v", apiErr.Body)
+	}
+	resp, err := r.etcd.Client().Get(ctx, "commands/node1/pppoe_dial_1")
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("dial command not found: %v", err)
+	}
+	var command map[string]interface{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &command); err != nil {
+		t.Fatal(err)
+	}
+	if command["password"] != config.Password {
+		t.Errorf("dial command password = %v, want %s", command["password"], config.Password)
+	}
+}
+
+func TestRotateSecretsRewrapsHSIConfigs(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	r.SetKeyProvider(testKeys(t, testKeyLine("k1", 'a')))
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	r.SetKeyProvider(testKeys(t, testKeyLine("k1", 'a')+testKeyLine("k2", 'b')))
+	t.Setenv("SECRET_REVEAL_USERS", "admin")
+	token, err := r.generateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/secrets/rotate", nil)
+	c.Request.Header.Set("Authorization", token)
+	r.RotateSecrets(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("RotateSecrets() status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// The node-facing config stays encrypted, now with the active key
+	if password := storedHSIPassword(t, r, "node1", "1"); !utils.IsEncryptedSecret(password) || utils.SecretKeyID(password) != "k2" {
+		t.Errorf("stored password = %q, want encrypted with k2", password)
+	}
+	stored, _, err := r.loadHSIConfig(ctx, "node1", "1")
+	if err != nil || stored.Config.Password != testHSIConfig("1", "100").Password {
+		t.Errorf("loadHSIConfig() password = %v, %v", stored, err)
+	}
+}
@@ -0,0 +1,891 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// SNAT port-block allocation modes. Deterministic pools map user IDs to blocks
+// in order, so the block of a subscriber can be computed without a lookup.
+// Dynamic pools hand out the first free block.
+const (
+	SNATAllocationDeterministic = "deterministic"
+	SNATAllocationDynamic       = "dynamic"
+)
+
+const (
+	DefaultSNATPortStart = 1024
+	DefaultSNATPortEnd   = 65535
+	DefaultSNATBlockSize = 2048
+	MinSNATBlockSize     = 64
+	// MinSNATPrefixLength bounds the size of a pool to 65536 public addresses
+	MinSNATPrefixLength = 16
+)
+
+var snatPoolNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// SNATPool is a range of public IPv4 addresses and ports subscribers of a
+// node are translated to, divided into port blocks of BlockSize ports
+type SNATPool struct {
+	Name       string `json:"name" example:"cgnat-1"`
+	Prefix     string `json:"prefix" example:"203.0.113.0/28"`
+	PortStart  int    `json:"port_start" example:"1024"`
+	PortEnd    int    `json:"port_end" example:"65535"`
+	BlockSize  int    `json:"block_size" example:"2048"`
+	Allocation string `json:"allocation" example:"deterministic"`
+	// FirstUserID is the user ID mapped to the first block of a deterministic pool
+	FirstUserID int    `json:"first_user_id,omitempty" example:"1"`
+	UpdatedBy   string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt   string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// SNATPoolResponse reports a pool with its capacity and usage
+type SNATPoolResponse struct {
+	SNATPool
+	BlocksPerIP     int `json:"blocks_per_ip" example:"31"`
+	TotalBlocks     int `json:"total_blocks" example:"496"`
+	AllocatedBlocks int `json:"allocated_blocks" example:"120"`
+}
+
+// SNATAllocation is the public address and port block a subscriber is
+// translated to, read by the node
+type SNATAllocation struct {
+	NodeID      string `json:"node_id" example:"node001"`
+	UserID      string `json:"user_id" example:"2"`
+	Pool        string `json:"pool" example:"cgnat-1"`
+	PublicIP    string `json:"public_ip" example:"203.0.113.1"`
+	PortStart   int    `json:"port_start" example:"3072"`
+	PortEnd     int    `json:"port_end" example:"5119"`
+	AllocatedBy string `json:"allocatedBy" example:"admin"`
+	AllocatedAt string `json:"allocatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// SNATAllocationRecord keeps an allocation after it is released, so abuse
+// complaints can be traced back to a subscriber
+type SNATAllocationRecord struct {
+	SNATAllocation
+	ReleasedAt string `json:"releasedAt,omitempty" example:"2024-02-01T00:00:00Z"`
+}
+
+// SNATAllocationRequest represents the request to allocate a port block
+type SNATAllocationRequest struct {
+	// Pool is optional, the first pool by name with a free block is used otherwise
+	Pool string `json:"pool" example:"cgnat-1"`
+}
+
+// SNATLookupResponse lists the subscribers a public address and port belonged to
+type SNATLookupResponse struct {
+	PublicIP string                 `json:"public_ip" example:"203.0.113.1"`
+	Port     int                    `json:"port" example:"4000"`
+	Time     string                 `json:"time" example:"2024-01-15T10:00:00Z"`
+	Matches  []SNATAllocationRecord `json:"matches"`
+}
+
+// snatPoolRegistry lists the pools of all nodes, so public prefixes can be
+// kept apart across nodes with a single read and compare
+type snatPoolRegistry map[string]string
+
+func snatPoolPrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/snat/pools/", nodeId)
+}
+
+func snatPoolKey(nodeId, name string) string {
+	return snatPoolPrefix(nodeId) + name
+}
+
+func snatAllocationPrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/snat/allocations/", nodeId)
+}
+
+func snatAllocationKey(nodeId, userId string) string {
+	return snatAllocationPrefix(nodeId) + userId
+}
+
+// snatPoolRegistryKey maps "<node>/<pool>" to the prefix of every pool
+const snatPoolRegistryKey = "index/snat_pools"
+
+// snatBlockKey makes sure a port block is allocated to one subscriber only
+func snatBlockKey(publicIP string, portStart int) string {
+	return fmt.Sprintf("index/snat/%s/%05d", publicIP, portStart)
+}
+
+func snatHistoryPrefix(publicIP string) string {
+	return fmt.Sprintf("history/snat/%s/", publicIP)
+}
+
+// snatHistoryKey orders the records of an address by block and allocation time
+func snatHistoryKey(allocation SNATAllocation) string {
+	allocatedAt, _ := time.Parse(time.RFC3339, allocation.AllocatedAt)
+	return fmt.Sprintf("%s%05d/%020d/%s/%s", snatHistoryPrefix(allocation.PublicIP), allocation.PortStart,
+		allocatedAt.Unix(), allocation.NodeID, allocation.UserID)
+}
+
+// blocksPerIP returns the number of port blocks of each address of a valid pool
+func (p SNATPool) blocksPerIP() int {
+	return (p.PortEnd - p.PortStart + 1) / p.BlockSize
+}
+
+// addresses returns the first address and the number of addresses of a valid pool
+func (p SNATPool) addresses() (netip.Addr, int) {
+	prefix := netip.MustParsePrefix(p.Prefix)
+	return prefix.Addr(), 1 << (32 - prefix.Bits())
+}
+
+// block returns the address and first port of the n-th block of a valid pool
+func (p SNATPool) block(n int) (netip.Addr, int) {
+	first, _ := p.addresses()
+	base := first.As4()
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(base[:])+uint32(n/p.blocksPerIP()))
+	return netip.AddrFrom4(ip), p.PortStart + n%p.blocksPerIP()*p.BlockSize
+}
+
+// normalizeSNATPool fills in the defaults of a pool
+func normalizeSNATPool(pool SNATPool) SNATPool {
+	pool.Allocation = strings.ToLower(strings.TrimSpace(pool.Allocation))
+	if pool.Allocation == "" {
+		pool.Allocation = SNATAllocationDynamic
+	}
+	if pool.PortStart == 0 {
+		pool.PortStart = DefaultSNATPortStart
+	}
+	if pool.PortEnd == 0 {
+		pool.PortEnd = DefaultSNATPortEnd
+	}
+	if pool.BlockSize == 0 {
+		pool.BlockSize = DefaultSNATBlockSize
+	}
+	if pool.Allocation == SNATAllocationDeterministic && pool.FirstUserID == 0 {
+		pool.FirstUserID = 1
+	}
+	if prefix, err := netip.ParsePrefix(strings.TrimSpace(pool.Prefix)); err == nil {
+		pool.Prefix = prefix.Masked().String()
+	}
+	return pool
+}
+
+// validateSNATPool checks a normalized pool
+func validateSNATPool(pool SNATPool) fieldErrors {
+	var errs fieldErrors
+	if !snatPoolNamePattern.MatchString(pool.Name) {
+		errs.add("name", "Name must be 1-63 letters, digits, '.', '_' or '-'")
+	}
+	if prefix, err := netip.ParsePrefix(pool.Prefix); err != nil || !prefix.Addr().Is4() {
+		errs.add("prefix", "Prefix must be an IPv4 prefix, e.g. 203.0.113.0/28")
+	} else if prefix.Bits() < MinSNATPrefixLength {
+		errs.add("prefix", "Prefix length must be between /%d and /32", MinSNATPrefixLength)
+	}
+	if pool.PortStart < 1 || pool.PortEnd > 65535 || pool.PortStart > pool.PortEnd {
+		errs.add("port_end", "Port range must be between 1 and 65535 with port_start not above port_end")
+	} else if pool.BlockSize < MinSNATBlockSize || pool.BlockSize > pool.PortEnd-pool.PortStart+1 {
+		errs.add("block_size", "Block size must be between %d and the size of the port range", MinSNATBlockSize)
+	}
+	switch pool.Allocation {
+	case SNATAllocationDynamic:
+		if pool.FirstUserID != 0 {
+			errs.add("first_user_id", "First user ID only applies to %s pools", SNATAllocationDeterministic)
+		}
+	case SNATAllocationDeterministic:
+		if pool.FirstUserID < 1 {
+			errs.add("first_user_id", "First user ID must be positive")
+		}
+	default:
+		errs.add("allocation", "Allocation must be %s or %s", SNATAllocationDeterministic, SNATAllocationDynamic)
+	}
+	return errs
+}
+
+// getSNATPoolRegistry reads the pools of all nodes together with the etcd mod revision of the registry
+func (r *RestServer) getSNATPoolRegistry(ctx context.Context, opts ...clientv3.OpOption) (snatPoolRegistry, int64, error) {
+	registry := snatPoolRegistry{}
+	resp, err := r.etcd.Client().Get(ctx, snatPoolRegistryKey, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return registry, 0, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &registry); err != nil {
+		return nil, 0, err
+	}
+	return registry, resp.Kvs[0].ModRevision, nil
+}
+
+// loadSNATPool reads a pool together with its etcd mod revision. A nil pool means it does not exist.
+func (r *RestServer) loadSNATPool(ctx context.Context, nodeId, name string) (*SNATPool, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, snatPoolKey(nodeId, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var pool SNATPool
+	if err := json.Unmarshal(resp.Kvs[0].Value, &pool); err != nil {
+		return nil, 0, err
+	}
+	return &pool, resp.Kvs[0].ModRevision, nil
+}
+
+// listSNATPools returns the pools of a node ordered by name with their etcd mod revisions
+func (r *RestServer) listSNATPools(ctx context.Context, nodeId string) ([]SNATPool, map[string]int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, snatPoolPrefix(nodeId), clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, nil, err
+	}
+	pools := []SNATPool{}
+	revisions := make(map[string]int64, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var pool SNATPool
+		if err := json.Unmarshal(kv.Value, &pool); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse SNAT pool %s", kv.Key)
+			continue
+		}
+		pools = append(pools, pool)
+		revisions[pool.Name] = kv.ModRevision
+	}
+	return pools, revisions, nil
+}
+
+// listSNATAllocations returns the allocations of a node together with the
+// revision they were read at
+func (r *RestServer) listSNATAllocations(ctx context.Context, nodeId string) ([]SNATAllocation, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, snatAllocationPrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	allocations := []SNATAllocation{}
+	for _, kv := range resp.Kvs {
+		var allocation SNATAllocation
+		if err := json.Unmarshal(kv.Value, &allocation); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse SNAT allocation %s", kv.Key)
+			continue
+		}
+		allocations = append(allocations, allocation)
+	}
+	sort.Slice(allocations, func(i, j int) bool { return lessUserId(allocations[i].UserID, allocations[j].UserID) })
+	return allocations, resp.Header.Revision, nil
+}
+
+// loadSNATAllocation reads the allocation of a subscriber together with its
+// etcd mod revision. A nil allocation means the subscriber has none.
+func (r *RestServer) loadSNATAllocation(ctx context.Context, nodeId, userId string) (*SNATAllocation, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, snatAllocationKey(nodeId, userId))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var allocation SNATAllocation
+	if err := json.Unmarshal(resp.Kvs[0].Value, &allocation); err != nil {
+		return nil, 0, err
+	}
+	return &allocation, resp.Kvs[0].ModRevision, nil
+}
+
+// pickSNATBlock returns the block of a subscriber in a pool, or false if the
+// pool has none for it. used holds the blocks already allocated.
+func pickSNATBlock(pool SNATPool, userId string, used map[string]bool) (netip.Addr, int, bool) {
+	_, count := pool.addresses()
+	total := count * pool.blocksPerIP()
+	if pool.Allocation == SNATAllocationDeterministic {
+		id, err := strconv.Atoi(userId)
+		n := id - pool.FirstUserID
+		if err != nil || n < 0 || n >= total {
+			return netip.Addr{}, 0, false
+		}
+		ip, port := pool.block(n)
+		return ip, port, !used[snatBlockKey(ip.String(), port)]
+	}
+	for n := 0; n < total; n++ {
+		ip, port := pool.block(n)
+		if !used[snatBlockKey(ip.String(), port)] {
+			return ip, port, true
+		}
+	}
+	return netip.Addr{}, 0, false
+}
+
+// allocateSNATBlock allocates a port block to a subscriber, from the given
+// pool or the first pool with a block for it. An existing allocation is
+// returned as is.
+func (r *RestServer) allocateSNATBlock(ctx context.Context, nodeId, userId, poolName, username string) (*SNATAllocation, bool, *apiError) {
+	hsi, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, false, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if hsi == nil {
+		return nil, false, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+
+	for attempt := 0; attempt < hsiWriteRetries; attempt++ {
+		existing, _, err := r.loadSNATAllocation(ctx, nodeId, userId)
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to get SNAT allocation")
+		}
+		if existing != nil {
+			if poolName != "" && existing.Pool != poolName {
+				return nil, false, newAPIError(http.StatusConflict,
+					fmt.Sprintf("Subscriber already has a port block in pool %s", existing.Pool))
+			}
+			return existing, false, nil
+		}
+
+		pools, poolRevisions, err := r.listSNATPools(ctx, nodeId)
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to get SNAT pools")
+		}
+		allocations, _, err := r.listSNATAllocations(ctx, nodeId)
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to get SNAT allocations")
+		}
+		used := make(map[string]bool, len(allocations))
+		for _, allocation := range allocations {
+			used[snatBlockKey(allocation.PublicIP, allocation.PortStart)] = true
+		}
+
+		var allocation *SNATAllocation
+		found := false
+		for _, pool := range pools {
+			if poolName != "" && pool.Name != poolName {
+				continue
+			}
+			found = true
+			if ip, port, ok := pickSNATBlock(pool, userId, used); ok {
+				allocation = &SNATAllocation{
+					NodeID:      nodeId,
+					UserID:      userId,
+					Pool:        pool.Name,
+					PublicIP:    ip.String(),
+					PortStart:   port,
+					PortEnd:     port + pool.BlockSize - 1,
+					AllocatedBy: username,
+					AllocatedAt: time.Now().UTC().Format(time.RFC3339),
+				}
+				break
+			}
+		}
+		if !found {
+			if poolName != "" {
+				return nil, false, newAPIError(http.StatusNotFound, fmt.Sprintf("SNAT pool %s not found", poolName))
+			}
+			return nil, false, newAPIError(http.StatusConflict, fmt.Sprintf("Node %s has no SNAT pools", nodeId))
+		}
+		if allocation == nil {
+			return nil, false, newAPIError(http.StatusConflict, "No free port block for the subscriber")
+		}
+
+		allocationJSON, err := json.Marshal(allocation)
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to marshal SNAT allocation")
+		}
+		recordJSON, err := json.Marshal(SNATAllocationRecord{SNATAllocation: *allocation})
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to marshal SNAT allocation")
+		}
+		blockKey := snatBlockKey(allocation.PublicIP, allocation.PortStart)
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.ModRevision(snatPoolKey(nodeId, allocation.Pool)), "=", poolRevisions[allocation.Pool]),
+				clientv3.Compare(clientv3.CreateRevision(snatAllocationKey(nodeId, userId)), "=", 0),
+				clientv3.Compare(clientv3.CreateRevision(blockKey), "=", 0),
+			).
+			Then(
+				clientv3.OpPut(snatAllocationKey(nodeId, userId), string(allocationJSON)),
+				clientv3.OpPut(blockKey, nodeId+"/"+userId),
+				clientv3.OpPut(snatHistoryKey(*allocation), string(recordJSON)),
+			).
+			Commit()
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to save SNAT allocation")
+		}
+		if !txnResp.Succeeded {
+			logrus.Infof("SNAT pool or allocations of node %s changed while allocating user %s, retrying", nodeId, userId)
+			continue
+		}
+
+		logrus.Infof("SNAT block %s:%d-%d of pool %s allocated to node %s, user: %s, by: %s",
+			allocation.PublicIP, allocation.PortStart, allocation.PortEnd, allocation.Pool, nodeId, userId, username)
+		return allocation, true, nil
+	}
+	return nil, false, newAPIError(http.StatusConflict, "SNAT allocations have been modified by another request")
+}
+
+// snatReleaseOps returns the transaction releasing the port block of a
+// subscriber and closing its allocation record, which is empty if the
+// subscriber has no allocation
+func (r *RestServer) snatReleaseOps(ctx context.Context, nodeId, userId string) ([]clientv3.Cmp, []clientv3.Op, error) {
+	allocation, modRevision, err := r.loadSNATAllocation(ctx, nodeId, userId)
+	if err != nil || allocation == nil {
+		return nil, nil, err
+	}
+	record := SNATAllocationRecord{SNATAllocation: *allocation, ReleasedAt: time.Now().UTC().Format(time.RFC3339)}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(snatAllocationKey(nodeId, userId)), "=", modRevision)}
+	ops := []clientv3.Op{
+		clientv3.OpDelete(snatAllocationKey(nodeId, userId)),
+		clientv3.OpDelete(snatBlockKey(allocation.PublicIP, allocation.PortStart)),
+		clientv3.OpPut(snatHistoryKey(*allocation), string(recordJSON)),
+	}
+	return cmps, ops, nil
+}
+
+// lookupSNAT returns the allocations that covered a public address and port at a point in time
+func (r *RestServer) lookupSNAT(ctx context.Context, publicIP string, port int, at time.Time) ([]SNATAllocationRecord, error) {
+	resp, err := r.etcd.Client().Get(ctx, snatHistoryPrefix(publicIP), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	matches := []SNATAllocationRecord{}
+	for _, kv := range resp.Kvs {
+		var record SNATAllocationRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse SNAT allocation record %s", kv.Key)
+			continue
+		}
+		if port < record.PortStart || port > record.PortEnd {
+			continue
+		}
+		allocatedAt, err := time.Parse(time.RFC3339, record.AllocatedAt)
+		if err != nil || at.Before(allocatedAt) {
+			continue
+		}
+		if record.ReleasedAt != "" {
+			if releasedAt, err := time.Parse(time.RFC3339, record.ReleasedAt); err == nil && !at.Before(releasedAt) {
+				continue
+			}
+		}
+		matches = append(matches, record)
+	}
+	return matches, nil
+}
+
+// ListSNATPools returns the SNAT pools of a node
+// @Summary      List SNAT pools
+// @Description  Get the SNAT pools of a node with their capacity and number of allocated port blocks
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   SNATPoolResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/pools [get]
+func (r *RestServer) ListSNATPools(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	ctx := c.Request.Context()
+	pools, _, err := r.listSNATPools(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT pools"})
+		return
+	}
+	allocations, _, err := r.listSNATAllocations(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT allocations"})
+		return
+	}
+	allocated := make(map[string]int)
+	for _, allocation := range allocations {
+		allocated[allocation.Pool]++
+	}
+
+	response := make([]SNATPoolResponse, 0, len(pools))
+	for _, pool := range pools {
+		_, count := pool.addresses()
+		response = append(response, SNATPoolResponse{
+			SNATPool:        pool,
+			BlocksPerIP:     pool.blocksPerIP(),
+			TotalBlocks:     count * pool.blocksPerIP(),
+			AllocatedBlocks: allocated[pool.Name],
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetSNATPool returns a SNAT pool of a node
+// @Summary      Get SNAT pool
+// @Description  Get a SNAT pool of a node
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        name    path      string  true  "Pool name"
+// @Success      200     {object}  SNATPool
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/pools/{name} [get]
+func (r *RestServer) GetSNATPool(c *gin.Context) {
+	pool, _, err := r.loadSNATPool(c.Request.Context(), c.Param("nodeId"), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT pool"})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SNAT pool not found"})
+		return
+	}
+	c.JSON(http.StatusOK, pool)
+}
+
+// CreateSNATPool adds a SNAT pool to a node
+// @Summary      Create SNAT pool
+// @Description  Add a pool of public IPv4 addresses and ports to a node, divided into port blocks allocated to
+// @Description  subscribers deterministically by user ID or dynamically. Prefixes of all pools of all nodes must not
+// @Description  overlap. Pools cannot be changed once created.
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string    true  "Node ID"
+// @Param        request  body      SNATPool  true  "SNAT pool"
+// @Success      201      {object}  SNATPool
+// @Failure      400      {object}  ValidationErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/pools [post]
+func (r *RestServer) CreateSNATPool(c *gin.Context) {
+	var pool SNATPool
+	if err := c.ShouldBindJSON(&pool); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	pool = normalizeSNATPool(pool)
+	if apiErr := validateSNATPool(pool).apiError("SNAT pool"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+	pool.UpdatedBy = username
+	pool.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	ctx := c.Request.Context()
+	nodeId := c.Param("nodeId")
+	registry, registryRevision, err := r.getSNATPoolRegistry(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT pools"})
+		return
+	}
+	prefix := netip.MustParsePrefix(pool.Prefix)
+	for owner, other := range registry {
+		if otherPrefix, err := netip.ParsePrefix(other); err == nil && otherPrefix.Overlaps(prefix) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Prefix %s overlaps SNAT pool %s (%s)", pool.Prefix, owner, other)})
+			return
+		}
+	}
+	registry[nodeId+"/"+pool.Name] = pool.Prefix
+
+	poolJSON, err := json.Marshal(pool)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal SNAT pool"})
+		return
+	}
+	registryJSON, err := json.Marshal(registry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal SNAT pool registry"})
+		return
+	}
+	key := snatPoolKey(nodeId, pool.Name)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+			clientv3.Compare(clientv3.ModRevision(snatPoolRegistryKey), "=", registryRevision),
+		).
+		Then(
+			clientv3.OpPut(key, string(poolJSON)),
+			clientv3.OpPut(snatPoolRegistryKey, string(registryJSON)),
+		).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save SNAT pool"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "SNAT pool already exists or SNAT pools have been modified by another request"})
+		return
+	}
+
+	logrus.Infof("SNAT pool %s (%s, %s) created for node %s by %s", pool.Name, pool.Prefix, pool.Allocation, nodeId, username)
+	c.JSON(http.StatusCreated, pool)
+}
+
+// DeleteSNATPool removes a SNAT pool of a node
+// @Summary      Delete SNAT pool
+// @Description  Remove a SNAT pool of a node, which is only possible while none of its port blocks is allocated
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        name    path      string  true  "Pool name"
+// @Success      200     {object}  MessageResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      409     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/pools/{name} [delete]
+func (r *RestServer) DeleteSNATPool(c *gin.Context) {
+	nodeId, name := c.Param("nodeId"), c.Param("name")
+	ctx := c.Request.Context()
+	pool, poolRevision, err := r.loadSNATPool(ctx, nodeId, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT pool"})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SNAT pool not found"})
+		return
+	}
+
+	allocations, allocationsRevision, err := r.listSNATAllocations(ctx, nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT allocations"})
+		return
+	}
+	inUse := 0
+	for _, allocation := range allocations {
+		if allocation.Pool == name {
+			inUse++
+		}
+	}
+	if inUse > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("SNAT pool %s has %d allocated port blocks", name, inUse)})
+		return
+	}
+
+	registry, registryRevision, err := r.getSNATPoolRegistry(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT pools"})
+		return
+	}
+	delete(registry, nodeId+"/"+name)
+	registryJSON, err := json.Marshal(registry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal SNAT pool registry"})
+		return
+	}
+
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(snatPoolKey(nodeId, name)), "=", poolRevision),
+			clientv3.Compare(clientv3.ModRevision(snatPoolRegistryKey), "=", registryRevision),
+			clientv3.Compare(clientv3.ModRevision(snatAllocationPrefix(nodeId)), "<", allocationsRevision+1).WithPrefix(),
+		).
+		Then(
+			clientv3.OpDelete(snatPoolKey(nodeId, name)),
+			clientv3.OpPut(snatPoolRegistryKey, string(registryJSON)),
+		).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete SNAT pool"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "SNAT pool or allocations have been modified by another request"})
+		return
+	}
+
+	logrus.Infof("SNAT pool %s deleted from node %s", name, nodeId)
+	c.JSON(http.StatusOK, gin.H{"message": "SNAT pool deleted successfully"})
+}
+
+// ListSNATAllocations returns the SNAT allocations of a node
+// @Summary      List SNAT allocations
+// @Description  Get the public address and port block of every subscriber of a node with one
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   SNATAllocation
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/allocations [get]
+func (r *RestServer) ListSNATAllocations(c *gin.Context) {
+	allocations, _, err := r.listSNATAllocations(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT allocations"})
+		return
+	}
+	c.JSON(http.StatusOK, allocations)
+}
+
+// GetSNATAllocation returns the SNAT allocation of a subscriber
+// @Summary      Get SNAT allocation
+// @Description  Get the public address and port block of a subscriber
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  SNATAllocation
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/allocations/{userId} [get]
+func (r *RestServer) GetSNATAllocation(c *gin.Context) {
+	allocation, _, err := r.loadSNATAllocation(c.Request.Context(), c.Param("nodeId"), c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT allocation"})
+		return
+	}
+	if allocation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SNAT allocation not found"})
+		return
+	}
+	c.JSON(http.StatusOK, allocation)
+}
+
+// AllocateSNATBlock allocates a port block to a subscriber
+// @Summary      Allocate SNAT port block
+// @Description  Allocate a public address and port block to a subscriber, from the given pool or the first pool by
+// @Description  name with a block for it. Deterministic pools always give a subscriber the same block. A subscriber
+// @Description  with an allocation keeps it.
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string                 true   "Node ID"
+// @Param        userId   path      string                 true   "User ID"
+// @Param        request  body      SNATAllocationRequest  false  "Pool to allocate from"
+// @Success      200      {object}  SNATAllocation
+// @Success      201      {object}  SNATAllocation
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/allocations/{userId} [post]
+func (r *RestServer) AllocateSNATBlock(c *gin.Context) {
+	var req SNATAllocationRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	allocation, created, apiErr := r.allocateSNATBlock(c.Request.Context(), c.Param("nodeId"), c.Param("userId"), req.Pool, username)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	if created {
+		c.JSON(http.StatusCreated, allocation)
+		return
+	}
+	c.JSON(http.StatusOK, allocation)
+}
+
+// ReleaseSNATBlock releases the port block of a subscriber
+// @Summary      Release SNAT port block
+// @Description  Release the public address and port block of a subscriber. The allocation is kept in the SNAT history
+// @Description  for abuse lookups.
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  MessageResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      409     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/snat/allocations/{userId} [delete]
+func (r *RestServer) ReleaseSNATBlock(c *gin.Context) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	ctx := c.Request.Context()
+	cmps, ops, err := r.snatReleaseOps(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SNAT allocation"})
+		return
+	}
+	if len(ops) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SNAT allocation not found"})
+		return
+	}
+	txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release SNAT allocation"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "SNAT allocation has been modified by another request"})
+		return
+	}
+
+	logrus.Infof("SNAT block of node %s, user %s released", nodeId, userId)
+	c.JSON(http.StatusOK, gin.H{"message": "SNAT allocation released successfully"})
+}
+
+// LookupSNAT finds the subscriber a public address and port belonged to
+// @Summary      Look up SNAT allocation
+// @Description  Find which subscriber was translated to a public address and port at a point in time, e.g. to answer
+// @Description  an abuse complaint. Released allocations are included.
+// @Tags         SNAT
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        ip    query     string  true   "Public IPv4 address"
+// @Param        port  query     int     true   "Public port"
+// @Param        time  query     string  false  "RFC3339 time, defaults to now"
+// @Success      200   {object}  SNATLookupResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /snat/lookup [get]
+func (r *RestServer) LookupSNAT(c *gin.Context) {
+	ip, err := netip.ParseAddr(c.Query("ip"))
+	if err != nil || !ip.Is4() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip must be a valid IPv4 address"})
+		return
+	}
+	port, err := strconv.Atoi(c.Query("port"))
+	if err != nil || port < 1 || port > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "port must be between 1 and 65535"})
+		return
+	}
+	at := time.Now().UTC()
+	if value := c.Query("time"); value != "" {
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "time must be an RFC3339 time, e.g. 2024-01-15T10:00:00Z"})
+			return
+		}
+	}
+
+	matches, err := r.lookupSNAT(c.Request.Context(), ip.String(), port, at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up SNAT allocations"})
+		return
+	}
+	c.JSON(http.StatusOK, SNATLookupResponse{
+		PublicIP: ip.String(),
+		Port:     port,
+		Time:     at.UTC().Format(time.RFC3339),
+		Matches:  matches,
+	})
+}
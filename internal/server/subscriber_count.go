@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Ways of handling subscribers above a lowered subscriber count
+const (
+	SubscriberCountActionArchive = "archive"
+	SubscriberCountActionDelete  = "delete"
+)
+
+// NodeSubscriberCapacity is the number of subscribers the hardware of a node
+// supports, as reported by the node when it registers
+type NodeSubscriberCapacity struct {
+	Node           string `json:"node" example:"node001"`
+	MaxSubscribers int    `json:"max_subscribers" example:"2000"`
+	UpdatedAt      string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// AffectedSubscriber is a subscriber whose user ID is above a new subscriber count
+type AffectedSubscriber struct {
+	UserID       string   `json:"user_id" example:"120"`
+	HSIConfig    bool     `json:"hsi_config" example:"true"`
+	EnableStatus string   `json:"enable_status,omitempty" example:"enabled"`
+	Services     []string `json:"services"`
+	// ArchiveID is set once the subscriber has been archived
+	ArchiveID string `json:"archive_id,omitempty" example:"3f2a9c1e5b7d4e60"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SubscriberCountChangeResponse reports a subscriber count change and the
+// subscribers it affects
+type SubscriberCountChangeResponse struct {
+	Message         string               `json:"message" example:"Subscriber count updated successfully"`
+	NodeID          string               `json:"node_id" example:"node001"`
+	SubscriberCount int                  `json:"subscriber_count" example:"100"`
+	Capacity        int                  `json:"subscriber_capacity,omitempty" example:"2000"`
+	DryRun          bool                 `json:"dry_run" example:"false"`
+	Action          string               `json:"action,omitempty" example:"archive"`
+	Affected        []AffectedSubscriber `json:"affected"`
+}
+
+// SubscriberArchive keeps the etcd keys of a subscriber removed by a
+// subscriber count change
+type SubscriberArchive struct {
+	ID         string                     `json:"id" example:"3f2a9c1e5b7d4e60"`
+	NodeID     string                     `json:"node_id" example:"node001"`
+	UserID     string                     `json:"user_id" example:"120"`
+	Reason     string                     `json:"reason" example:"Subscriber count lowered to 100"`
+	ArchivedBy string                     `json:"archivedBy" example:"admin"`
+	ArchivedAt string                     `json:"archivedAt" example:"2024-01-01T00:00:00Z"`
+	Keys       map[string]json.RawMessage `json:"keys,omitempty" swaggertype:"object"`
+}
+
+func nodeSubscriberCapacityKey(nodeId string) string {
+	return fmt.Sprintf("subscriber_capacity/%s", nodeId)
+}
+
+func subscriberArchivePrefix(nodeId string) string {
+	return fmt.Sprintf("archive/subscribers/%s/", nodeId)
+}
+
+func subscriberArchiveKey(nodeId, id string) string {
+	return subscriberArchivePrefix(nodeId) + id
+}
+
+// getNodeSubscriberCapacity reads the subscriber capacity of a node together
+// with its etcd mod revision, nil if the node did not report one
+func (r *RestServer) getNodeSubscriberCapacity(ctx context.Context, nodeId string) (*NodeSubscriberCapacity, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, nodeSubscriberCapacityKey(nodeId))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, 0, err
+	}
+	var capacity NodeSubscriberCapacity
+	if err := json.Unmarshal(resp.Kvs[0].Value, &capacity); err != nil {
+		return nil, 0, err
+	}
+	return &capacity, resp.Kvs[0].ModRevision, nil
+}
+
+// subscribersAbove returns the subscribers of a node with a numeric user ID
+// above count, ordered by user ID, together with the revision they were read at
+func (r *RestServer) subscribersAbove(ctx context.Context, nodeId string, count int) ([]AffectedSubscriber, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, fmt.Sprintf("configs/%s/", nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	hsiPrefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	affected := make(map[string]*AffectedSubscriber)
+	get := func(userId string) *AffectedSubscriber {
+		if n, err := strconv.Atoi(userId); err != nil || n <= count {
+			return nil
+		}
+		if affected[userId] == nil {
+			affected[userId] = &AffectedSubscriber{UserID: userId, Services: []string{}}
+		}
+		return affected[userId]
+	}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		switch {
+		case strings.HasPrefix(key, hsiPrefix) && !strings.Contains(strings.TrimPrefix(key, hsiPrefix), "/"):
+			if subscriber := get(strings.TrimPrefix(key, hsiPrefix)); subscriber != nil {
+				var config HSIConfigWithMetadata
+				if err := json.Unmarshal(kv.Value, &config); err == nil {
+					subscriber.EnableStatus = config.Metadata.EnableStatus
+				}
+				subscriber.HSIConfig = true
+				subscriber.Services = append(subscriber.Services, ServiceInternet)
+			}
+		case strings.HasPrefix(key, subscriberPrefix(nodeId)):
+			get(strings.TrimPrefix(key, subscriberPrefix(nodeId)))
+		case strings.HasPrefix(key, servicePrefix(nodeId)):
+			userId, service, _ := strings.Cut(strings.TrimPrefix(key, servicePrefix(nodeId)), "/")
+			if subscriber := get(userId); subscriber != nil {
+				subscriber.Services = append(subscriber.Services, service)
+			}
+		case strings.HasPrefix(key, iptvConfigPrefix(nodeId)):
+			if subscriber := get(strings.TrimPrefix(key, iptvConfigPrefix(nodeId))); subscriber != nil {
+				subscriber.Services = append(subscriber.Services, ServiceIPTV)
+			}
+		}
+	}
+
+	result := make([]AffectedSubscriber, 0, len(affected))
+	for _, subscriber := range affected {
+		sort.Strings(subscriber.Services)
+		result = append(result, *subscriber)
+	}
+	sort.Slice(result, func(i, j int) bool { return lessUserId(result[i].UserID, result[j].UserID) })
+	return result, resp.Header.Revision, nil
+}
+
+// archiveSubscriber deletes a subscriber like deleteSubscriber and stores a
+// copy of its keys in the same transaction
+func (r *RestServer) archiveSubscriber(ctx context.Context, nodeId, userId, username, reason string) (string, *apiError) {
+	cmps, ops, apiErr := r.subscriberDeleteOps(ctx, nodeId, userId, username)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	archive := SubscriberArchive{
+		ID:         newResourceID(),
+		NodeID:     nodeId,
+		UserID:     userId,
+		Reason:     reason,
+		ArchivedBy: username,
+		ArchivedAt: time.Now().UTC().Format(time.RFC3339),
+		Keys:       make(map[string]json.RawMessage),
+	}
+	// Keys are copied as stored, so secrets stay encrypted
+	sources := []struct {
+		key    string
+		prefix bool
+	}{
+		{hsiConfigKey(nodeId, userId), false},
+		{natRulePrefix(nodeId, userId), true},
+		{iptvConfigKey(nodeId, userId), false},
+		{aclKey(nodeId, userId), false},
+		{snatAllocationKey(nodeId, userId), false},
+		{subscriberKey(nodeId, userId), false},
+		{subscriberServicePrefix(nodeId, userId), true},
+	}
+	for _, source := range sources {
+		var opts []clientv3.OpOption
+		if source.prefix {
+			opts = append(opts, clientv3.WithPrefix())
+		}
+		resp, err := r.etcd.Client().Get(ctx, source.key, opts...)
+		if err != nil {
+			return "", newAPIError(http.StatusInternalServerError, "Failed to read subscriber")
+		}
+		for _, kv := range resp.Kvs {
+			archive.Keys[string(kv.Key)] = json.RawMessage(kv.Value)
+		}
+		// The copy must match what is deleted
+		cmp := clientv3.Compare(clientv3.ModRevision(source.key), "<", resp.Header.Revision+1)
+		if source.prefix {
+			cmp = cmp.WithPrefix()
+		}
+		cmps = append(cmps, cmp)
+	}
+	archiveJSON, err := json.Marshal(archive)
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Failed to marshal subscriber archive")
+	}
+	ops = append(ops, clientv3.OpPut(subscriberArchiveKey(nodeId, archive.ID), string(archiveJSON)))
+
+	txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Failed to archive subscriber")
+	}
+	if !txnResp.Succeeded {
+		return "", newAPIError(http.StatusConflict, "Subscriber has been modified by another request")
+	}
+
+	logrus.Infof("Subscriber archived as %s for node %s, user: %s, by: %s", archive.ID, nodeId, userId, username)
+	return archive.ID, nil
+}
+
+// affectedUserIds formats the user IDs of affected subscribers for an error message
+func affectedUserIds(affected []AffectedSubscriber) string {
+	const shown = 10
+	ids := make([]string, 0, shown)
+	for i, subscriber := range affected {
+		if i == shown {
+			ids = append(ids, fmt.Sprintf("and %d more", len(affected)-shown))
+			break
+		}
+		ids = append(ids, subscriber.UserID)
+	}
+	return strings.Join(ids, ", ")
+}
+
+// ListSubscriberArchives returns the archived subscribers of a node
+// @Summary      List archived subscribers
+// @Description  Get the subscribers of a node archived by lowering its subscriber count, without their keys
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   SubscriberArchive
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/subscriber-archives [get]
+func (r *RestServer) ListSubscriberArchives(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	resp, err := r.etcd.Client().Get(c.Request.Context(), subscriberArchivePrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber archives"})
+		return
+	}
+	archives := []SubscriberArchive{}
+	for _, kv := range resp.Kvs {
+		var archive SubscriberArchive
+		if err := json.Unmarshal(kv.Value, &archive); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse subscriber archive %s", kv.Key)
+			continue
+		}
+		archive.Keys = nil
+		archives = append(archives, archive)
+	}
+	sort.SliceStable(archives, func(i, j int) bool { return archives[i].ArchivedAt > archives[j].ArchivedAt })
+	c.JSON(http.StatusOK, archives)
+}
+
+// GetSubscriberArchive returns an archived subscriber
+// @Summary      Get archived subscriber
+// @Description  Get an archived subscriber with the etcd keys it had, secrets stay encrypted
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId     path      string  true  "Node ID"
+// @Param        archiveId  path      string  true  "Archive ID"
+// @Success      200        {object}  SubscriberArchive
+// @Failure      404        {object}  ErrorResponse
+// @Failure      500        {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/subscriber-archives/{archiveId} [get]
+func (r *RestServer) GetSubscriberArchive(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), subscriberArchiveKey(c.Param("nodeId"), c.Param("archiveId")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber archive"})
+		return
+	}
+	if len(resp.Kvs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber archive not found"})
+		return
+	}
+	var archive SubscriberArchive
+	if err := json.Unmarshal(resp.Kvs[0].Value, &archive); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse subscriber archive"})
+		return
+	}
+	c.JSON(http.StatusOK, archive)
+}
+
+// GetNodeSubscriberCapacity returns the subscriber capacity of a node
+// @Summary      Get node subscriber capacity
+// @Description  Get the number of subscribers the hardware of a node supports, as reported by the node when it
+// @Description  registers. It bounds the subscriber count of the node.
+// @Tags         Nodes
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  NodeSubscriberCapacity
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /nodes/{nodeId}/subscriber-capacity [get]
+func (r *RestServer) GetNodeSubscriberCapacity(c *gin.Context) {
+	capacity, _, err := r.getNodeSubscriberCapacity(c.Request.Context(), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get node subscriber capacity"})
+		return
+	}
+	if capacity == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node has not reported a subscriber capacity"})
+		return
+	}
+	c.JSON(http.StatusOK, capacity)
+}
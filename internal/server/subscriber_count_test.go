@@ -0,0 +1,86 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// updateTestSubscriberCount sets the subscriber count of node1
+func updateTestSubscriberCount(t *testing.T, r *RestServer, count int) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := r.generateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPut, "/api/nodes/node1/subscriber-count",
+		strings.NewReader(fmt.Sprintf(`{"subscriber_count":%d}`, count)))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Header.Set("Authorization", token)
+	c.Params = gin.Params{{Key: "nodeId", Value: "node1"}}
+	r.UpdateNodeSubscriberCount(c)
+	return w
+}
+
+func TestNodeReportedSubscriberCapacity(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	s := &GrpcServer{etcd: r.etcd}
+
+	if err := s.storeNodeRegistration(ctx, "node1", `{"node_uuid":"node1"}`, 100); err != nil {
+		t.Fatalf("storeNodeRegistration() error = %v", err)
+	}
+	capacity, _, err := r.getNodeSubscriberCapacity(ctx, "node1")
+	if err != nil || capacity == nil || capacity.MaxSubscribers != 100 {
+		t.Fatalf("getNodeSubscriberCapacity() = %v, %v, want 100", capacity, err)
+	}
+	if w := updateTestSubscriberCount(t, r, 101); w.Code != http.StatusBadRequest {
+		t.Errorf("count above the capacity status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := updateTestSubscriberCount(t, r, 100); w.Code != http.StatusOK {
+		t.Errorf("count at the capacity status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// Hardware reporting no capacity removes the limit
+	if err := s.storeNodeRegistration(ctx, "node1", `{"node_uuid":"node1"}`, 0); err != nil {
+		t.Fatalf("storeNodeRegistration() error = %v", err)
+	}
+	if capacity, _, _ := r.getNodeSubscriberCapacity(ctx, "node1"); capacity != nil {
+		t.Errorf("capacity = %v after registering without one", capacity)
+	}
+	if w := updateTestSubscriberCount(t, r, 500); w.Code != http.StatusOK {
+		t.Errorf("count without a capacity status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateNodeSubscriberCountIncrementsResourceVersion(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	for i, want := range []string{"1", "2"} {
+		if w := updateTestSubscriberCount(t, r, 10+i); w.Code != http.StatusOK {
+			t.Fatalf("update status = %d, body = %s", w.Code, w.Body.String())
+		}
+		resp, err := r.etcd.Client().Get(ctx, "user_counts/node1/")
+		if err != nil || len(resp.Kvs) != 1 {
+			t.Fatalf("Get() = %v, %v", resp, err)
+		}
+		var count SubscriberCountData
+		if err := json.Unmarshal(resp.Kvs[0].Value, &count); err != nil {
+			t.Fatal(err)
+		}
+		if count.Metadata.ResourceVersion != want {
+			t.Errorf("resource version = %s, want %s", count.Metadata.ResourceVersion, want)
+		}
+	}
+}
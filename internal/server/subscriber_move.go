@@ -0,0 +1,768 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// SubscriberMoveLockTTL bounds how long a move holds its subscriber if the
+	// replica running it goes away before the scheduler recovers it (in seconds)
+	SubscriberMoveLockTTL = 15
+
+	subscriberMovePrefix     = "jobs/moves/"
+	subscriberMoveLockPrefix = "jobs/move_locks/"
+)
+
+var errMoveLockLost = errors.New("subscriber move lock lost")
+
+// Subscriber move statuses
+const (
+	MoveStatusRunning        = "running"
+	MoveStatusSucceeded      = "succeeded"
+	MoveStatusDialFailed     = "dial_failed"
+	MoveStatusRolledBack     = "rolled_back"
+	MoveStatusRollbackFailed = "rollback_failed"
+)
+
+// Subscriber move steps in the order they run. The source is only deleted
+// once the target exists, a failure before that rolls back the completed steps
+// in reverse, a failure after it leaves the subscriber on the target.
+const (
+	MoveStepValidate             = "validate"
+	MoveStepHangupSource         = "hangup_source"
+	MoveStepCopyConfig           = "copy_config"
+	MoveStepCreateTarget         = "create_target"
+	MoveStepDeleteSource         = "delete_source"
+	MoveStepDialTarget           = "dial_target"
+	MoveStepRollbackDeleteTarget = "rollback_delete_target"
+	MoveStepRollbackDialSource   = "rollback_dial_source"
+)
+
+// MoveSubscriberRequest represents the request to move a subscriber to another node
+type MoveSubscriberRequest struct {
+	TargetNodeID string `json:"target_node_id" example:"node002"`
+	// TargetUserID is optional, the lowest free user slot of the target node is used otherwise
+	TargetUserID string `json:"target_user_id" example:"7"`
+	// VlanID and OuterVlanID are optional, the subscriber keeps its VLANs otherwise
+	VlanID      string `json:"vlan_id" example:"120"`
+	OuterVlanID string `json:"outer_vlan_id" example:"200"`
+	RedialDelay int    `json:"redial_delay_seconds,omitempty" example:"5"`
+}
+
+// SubscriberMoveStep is the outcome of one step of a subscriber move
+type SubscriberMoveStep struct {
+	Name   string `json:"name" example:"hangup_source"`
+	Status string `json:"status" example:"succeeded"`
+	Error  string `json:"error,omitempty"`
+	At     string `json:"at" example:"2024-01-01T00:00:00Z"`
+}
+
+// SubscriberMoveJob tracks the move of a subscriber from one node to another
+type SubscriberMoveJob struct {
+	ID           string               `json:"id" example:"9f86d081884c7d65"`
+	SourceNodeID string               `json:"source_node_id" example:"node001"`
+	SourceUserID string               `json:"source_user_id" example:"2"`
+	TargetNodeID string               `json:"target_node_id" example:"node002"`
+	TargetUserID string               `json:"target_user_id,omitempty" example:"7"`
+	VlanID       string               `json:"vlan_id" example:"120"`
+	OuterVlanID  string               `json:"outer_vlan_id,omitempty" example:"200"`
+	Status       string               `json:"status" example:"succeeded"`
+	Error        string               `json:"error,omitempty"`
+	Steps        []SubscriberMoveStep `json:"steps"`
+	CreatedBy    string               `json:"created_by" example:"admin"`
+	CreatedAt    string               `json:"created_at" example:"2024-01-01T00:00:00Z"`
+	UpdatedAt    string               `json:"updated_at" example:"2024-01-01T00:00:00Z"`
+	FinishedAt   string               `json:"finished_at,omitempty" example:"2024-01-01T00:00:10Z"`
+}
+
+// subscriberRef identifies a subscriber on a node
+type subscriberRef struct {
+	nodeId string
+	userId string
+}
+
+// subscriberMove is a move in progress. The source stays in place until the
+// target exists, so nothing but the job has to survive the replica.
+type subscriberMove struct {
+	job         *SubscriberMoveJob
+	redialDelay int
+	// session keeps the lock of the move alive while this replica runs it
+	session *concurrency.Session
+	// source is the HSI config as validated, target the config to create
+	source *HSIConfigWithMetadata
+	target HSIConfig
+	acl    *ACL
+	snat   *SNATAllocation
+	// Mod revisions read by the copy, the source is only deleted if unchanged
+	hsiRevision int64
+	aclRevision int64
+}
+
+// stepSucceeded reports whether a step of the move completed
+func (job *SubscriberMoveJob) stepSucceeded(name string) bool {
+	for _, step := range job.Steps {
+		if step.Name == name && step.Status == "succeeded" {
+			return true
+		}
+	}
+	return false
+}
+
+func subscriberMoveKey(id string) string {
+	return subscriberMovePrefix + id
+}
+
+func subscriberMoveLockKey(nodeId, userId string) string {
+	return fmt.Sprintf("%s%s/%s", subscriberMoveLockPrefix, nodeId, userId)
+}
+
+// prepareSubscriberMove validates a move before anything is changed. The
+// subscriber must not have services the move does not carry over, the HSI
+// config and ACL are moved and a SNAT port block is allocated again on the
+// target. The target node must have the user slot, VLAN and capacity for it.
+func (r *RestServer) prepareSubscriberMove(ctx context.Context, nodeId, userId string, req MoveSubscriberRequest) (*subscriberMove, *apiError) {
+	if req.TargetNodeID == "" {
+		return nil, newAPIError(http.StatusBadRequest, "Target node ID is required")
+	}
+	if req.TargetNodeID == nodeId {
+		return nil, newAPIError(http.StatusBadRequest, "Target node must differ from the source node")
+	}
+	nodeResp, err := r.etcd.Client().Get(ctx, fmt.Sprintf("nodes/%s", req.TargetNodeID))
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check node existence")
+	}
+	if len(nodeResp.Kvs) == 0 {
+		return nil, newAPIError(http.StatusNotFound, "Target node not found")
+	}
+
+	source, _, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if source == nil {
+		return nil, newAPIError(http.StatusNotFound, "HSI config not found")
+	}
+	if apiErr := r.checkSubscriberActive(ctx, nodeId, userId); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// NAT rules, IPTV and the VLAN services depend on node-wide ports and
+	// VLANs, they are not moved
+	var left []string
+	natResp, err := r.etcd.Client().Get(ctx, natRulePrefix(nodeId, userId), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get NAT rules")
+	}
+	if natResp.Count > 0 {
+		left = append(left, "NAT rules")
+	}
+	iptv, _, err := r.loadIPTVConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get IPTV config")
+	}
+	if iptv != nil {
+		left = append(left, ServiceIPTV)
+	}
+	servicesResp, err := r.etcd.Client().Get(ctx, subscriberServicePrefix(nodeId, userId), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get subscriber services")
+	}
+	for _, kv := range servicesResp.Kvs {
+		left = append(left, strings.TrimPrefix(string(kv.Key), subscriberServicePrefix(nodeId, userId)))
+	}
+	if len(left) > 0 {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("Subscriber has services that are not moved, remove them first: %s", strings.Join(left, ", ")))
+	}
+
+	m := &subscriberMove{source: source, redialDelay: req.RedialDelay}
+	m.target = source.Config
+	if m.target.Profile != "" {
+		m.target = inheritProfileFields(m.target, source.Metadata.Overrides)
+	}
+	m.target.UserID = req.TargetUserID
+	if req.VlanID != "" {
+		m.target.VlanID = req.VlanID
+	}
+	if req.OuterVlanID != "" {
+		m.target.OuterVlanID = req.OuterVlanID
+	}
+
+	targetNode, targetUser := req.TargetNodeID, req.TargetUserID
+	if targetUser == "" {
+		slot, apiErr := r.freeUserSlot(ctx, targetNode)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		targetUser = slot
+	} else {
+		if apiErr := r.checkUserIdInRange(ctx, targetNode, targetUser); apiErr != nil {
+			return nil, apiErr
+		}
+		existing, _, err := r.loadHSIConfig(ctx, targetNode, targetUser)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get current HSI config")
+		}
+		_, subscriberRevision, err := r.loadSubscriber(ctx, targetNode, targetUser)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get subscriber")
+		}
+		if existing != nil || subscriberRevision != 0 {
+			return nil, newAPIError(http.StatusConflict, fmt.Sprintf("User ID %s is already used on node %s", targetUser, targetNode))
+		}
+	}
+
+	check := m.target
+	check.UserID = targetUser
+	config, _, _, apiErr := r.resolveHSIConfig(ctx, check)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr := validateHSIConfig(config).apiError("HSI config"); apiErr != nil {
+		return nil, apiErr
+	}
+	if _, apiErr := r.checkVlanMode(ctx, targetNode, config); apiErr != nil {
+		return nil, apiErr
+	}
+	if _, apiErr := r.checkQoSCapacity(ctx, targetNode, config); apiErr != nil {
+		return nil, apiErr
+	}
+	tag, _ := hsiVlanTag(config)
+	owner, _, err := r.getVlanOwner(ctx, targetNode, tag)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if owner != "" {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("VLAN %s is already used on node %s by user: %s", tag, targetNode, owner))
+	}
+	wireVid := tag.inner
+	if tag.outer != 0 {
+		wireVid = tag.outer
+	}
+	iptvUser, _, err := r.multicastVlanUser(ctx, targetNode, wireVid)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if iptvUser != "" {
+		return nil, newAPIError(http.StatusConflict,
+			fmt.Sprintf("VLAN is used as multicast VLAN on node %s by the IPTV service of user: %s", targetNode, iptvUser))
+	}
+	// The target takes the LAN subnet of the subscriber over from the source
+	ipam, err := r.loadIPAM(ctx)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocations")
+	}
+	ipam.release(nodeId, userId)
+	if _, _, apiErr := ipam.assignOps(targetNode, config); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if m.snat, _, err = r.loadSNATAllocation(ctx, nodeId, userId); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to get SNAT allocation")
+	}
+	if m.snat != nil {
+		pools, _, err := r.listSNATPools(ctx, targetNode)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Failed to get SNAT pools")
+		}
+		if len(pools) == 0 {
+			return nil, newAPIError(http.StatusConflict,
+				fmt.Sprintf("Subscriber has a SNAT port block but node %s has no SNAT pool", targetNode))
+		}
+	}
+
+	m.job = &SubscriberMoveJob{
+		ID:           newResourceID(),
+		SourceNodeID: nodeId,
+		SourceUserID: userId,
+		TargetNodeID: targetNode,
+		TargetUserID: req.TargetUserID,
+		VlanID:       config.VlanID,
+		OuterVlanID:  config.OuterVlanID,
+		Status:       MoveStatusRunning,
+		Steps:        []SubscriberMoveStep{},
+	}
+	return m, nil
+}
+
+// copyMoveSource reads the source again and fails if it changed since the
+// move was validated, so the copy written to the target is what was checked.
+// The target user ID is picked here and recorded in the job before anything
+// is created, so a recovered move knows which config is its own.
+func (r *RestServer) copyMoveSource(ctx context.Context, m *subscriberMove) *apiError {
+	job := m.job
+	current, hsiRevision, err := r.loadHSIConfig(ctx, job.SourceNodeID, job.SourceUserID)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if current == nil || current.Metadata.ResourceVersion != m.source.Metadata.ResourceVersion {
+		return newAPIError(http.StatusConflict, "HSI config has been modified since the move was requested")
+	}
+	acl, aclRevision, err := r.loadACL(ctx, aclKey(job.SourceNodeID, job.SourceUserID))
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get ACL")
+	}
+	m.acl, m.hsiRevision, m.aclRevision = acl, hsiRevision, aclRevision
+	if job.TargetUserID == "" {
+		slot, apiErr := r.freeUserSlot(ctx, job.TargetNodeID)
+		if apiErr != nil {
+			return apiErr
+		}
+		job.TargetUserID = slot
+	}
+	m.target.UserID = job.TargetUserID
+	return nil
+}
+
+// deleteMoveSource deletes the subscriber from the source node if neither its
+// HSI config nor its ACL changed since they were copied
+func (r *RestServer) deleteMoveSource(ctx context.Context, m *subscriberMove, username string) *apiError {
+	job := m.job
+	cmps, ops, apiErr := r.subscriberDeleteOps(ctx, job.SourceNodeID, job.SourceUserID, username)
+	if apiErr != nil {
+		return apiErr
+	}
+	cmps = append(cmps,
+		clientv3.Compare(clientv3.ModRevision(hsiConfigKey(job.SourceNodeID, job.SourceUserID)), "=", m.hsiRevision),
+		clientv3.Compare(clientv3.ModRevision(aclKey(job.SourceNodeID, job.SourceUserID)), "=", m.aclRevision),
+	)
+	txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to delete subscriber")
+	}
+	if !txnResp.Succeeded {
+		return newAPIError(http.StatusConflict, "Subscriber has been modified since it was copied")
+	}
+	return nil
+}
+
+// createMoveTarget creates the copied subscriber on the target node: the HSI
+// config, which takes the LAN subnet over from the source, then its ACL and
+// SNAT port block. created reports whether the HSI config was written, which
+// has to be undone even if a later part failed.
+func (r *RestServer) createMoveTarget(ctx context.Context, m *subscriberMove, username string) (created bool, apiErr *apiError) {
+	job := m.job
+	if _, apiErr := r.writeHSIConfig(ctx, hsiWrite{
+		nodeId:       job.TargetNodeID,
+		config:       m.target,
+		username:     username,
+		create:       true,
+		ipamTakeover: &subscriberRef{nodeId: job.SourceNodeID, userId: job.SourceUserID},
+	}); apiErr != nil {
+		return false, apiErr
+	}
+	if m.acl != nil {
+		if _, apiErr := r.saveACL(ctx, job.TargetNodeID, job.TargetUserID, m.acl.Rules, username, ""); apiErr != nil {
+			return true, apiErr
+		}
+	}
+	if m.snat != nil {
+		// The target has other pools, the pool name does not carry over
+		if _, _, apiErr := r.allocateSNATBlock(ctx, job.TargetNodeID, job.TargetUserID, "", username); apiErr != nil {
+			return true, apiErr
+		}
+	}
+	return true, nil
+}
+
+// removeMoveTarget deletes the subscriber a move created on the target and
+// gives the LAN subnet back to the source, which is still in place
+func (r *RestServer) removeMoveTarget(ctx context.Context, job *SubscriberMoveJob, username string) *apiError {
+	if apiErr := r.deleteSubscriber(ctx, job.TargetNodeID, job.TargetUserID, username); apiErr != nil {
+		return apiErr
+	}
+	source, _, err := r.loadHSIConfig(ctx, job.SourceNodeID, job.SourceUserID)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if source == nil {
+		return newAPIError(http.StatusNotFound, "HSI config of the source not found")
+	}
+	return r.reassignIPAMSubnet(ctx, job.SourceNodeID, source.Config)
+}
+
+// putSubscriberMove stores the current state of a move. It fails with
+// errMoveLockLost if the lease no longer holds the lock of the move, another
+// replica then recovers it.
+func (r *RestServer) putSubscriberMove(ctx context.Context, job *SubscriberMoveJob, lease clientv3.LeaseID, ops ...clientv3.Op) error {
+	job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, clientv3.OpPut(subscriberMoveKey(job.ID), string(jobJSON)))
+	lockKey := subscriberMoveLockKey(job.SourceNodeID, job.SourceUserID)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.LeaseValue(lockKey), "=", lease)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errMoveLockLost
+	}
+	return nil
+}
+
+// moveStep runs one step of a move and records its outcome in the job. A
+// move that lost its lock stops at the step, it is left to the recovery.
+func (r *RestServer) moveStep(ctx context.Context, job *SubscriberMoveJob, lease clientv3.LeaseID, name string, run func() *apiError) (ok, lockLost bool) {
+	step := SubscriberMoveStep{Name: name, Status: "succeeded"}
+	if apiErr := run(); apiErr != nil {
+		step.Status = "failed"
+		step.Error = apiErr.Error()
+		if job.Error == "" {
+			job.Error = fmt.Sprintf("%s: %s", name, apiErr.Error())
+		}
+		logrus.Warnf("Subscriber move %s failed at %s: %s", job.ID, name, apiErr.Error())
+	}
+	step.At = time.Now().UTC().Format(time.RFC3339)
+	job.Steps = append(job.Steps, step)
+	if err := r.putSubscriberMove(ctx, job, lease); err != nil {
+		logrus.WithError(err).Errorf("Failed to save subscriber move %s", job.ID)
+		if errors.Is(err, errMoveLockLost) {
+			return false, true
+		}
+	}
+	return step.Status == "succeeded", false
+}
+
+// finishSubscriberMove stores the final state of a move and releases its lock
+func (r *RestServer) finishSubscriberMove(ctx context.Context, job *SubscriberMoveJob, lease clientv3.LeaseID) {
+	job.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := r.putSubscriberMove(ctx, job, lease, clientv3.OpDelete(subscriberMoveLockKey(job.SourceNodeID, job.SourceUserID))); err != nil {
+		logrus.WithError(err).Errorf("Failed to save subscriber move %s", job.ID)
+		return
+	}
+	logrus.Infof("Subscriber move %s of node %s, user: %s to node %s, user: %s finished with status %s",
+		job.ID, job.SourceNodeID, job.SourceUserID, job.TargetNodeID, job.TargetUserID, job.Status)
+}
+
+// runSubscriberMove hangs up the subscriber on the source, copies it, creates
+// it on the target, deletes it on the source and dials it. A failed step
+// before the source is deleted undoes the completed ones in reverse order.
+func (r *RestServer) runSubscriberMove(ctx context.Context, m *subscriberMove) {
+	defer m.session.Close()
+	job := m.job
+	updatedBy := fmt.Sprintf("move/%s", job.ID)
+	var hungUp, targetCreated, lockLost bool
+	step := func(name string, run func() *apiError) bool {
+		if lockLost {
+			return false
+		}
+		ok, lost := r.moveStep(ctx, job, m.session.Lease(), name, run)
+		lockLost = lost
+		return ok
+	}
+
+	ok := step(MoveStepHangupSource, func() *apiError {
+		if apiErr := r.sendWANCommand(ctx, job.SourceNodeID, job.SourceUserID, WANActionDisconnect); apiErr != nil {
+			return apiErr
+		}
+		hungUp = true
+		delay := m.redialDelay
+		if delay <= 0 {
+			delay = DefaultRedialDelay
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(delay) * time.Second):
+		}
+		return nil
+	}) && step(MoveStepCopyConfig, func() *apiError {
+		return r.copyMoveSource(ctx, m)
+	}) && step(MoveStepCreateTarget, func() *apiError {
+		created, apiErr := r.createMoveTarget(ctx, m, updatedBy)
+		targetCreated = created
+		return apiErr
+	}) && step(MoveStepDeleteSource, func() *apiError {
+		return r.deleteMoveSource(ctx, m, updatedBy)
+	})
+
+	if ok {
+		// The subscriber lives on the target now, a failed dial is not undone
+		job.Status = MoveStatusSucceeded
+		if !step(MoveStepDialTarget, func() *apiError {
+			return r.sendWANCommand(ctx, job.TargetNodeID, job.TargetUserID, WANActionConnect)
+		}) {
+			job.Status = MoveStatusDialFailed
+		}
+	} else {
+		job.Status = MoveStatusRolledBack
+		rollback := func(name string, run func() *apiError) {
+			if !step(name, run) {
+				job.Status = MoveStatusRollbackFailed
+			}
+		}
+		if targetCreated {
+			rollback(MoveStepRollbackDeleteTarget, func() *apiError {
+				return r.removeMoveTarget(ctx, job, updatedBy)
+			})
+		}
+		if hungUp {
+			rollback(MoveStepRollbackDialSource, func() *apiError {
+				return r.sendWANCommand(ctx, job.SourceNodeID, job.SourceUserID, WANActionConnect)
+			})
+		}
+	}
+	if lockLost {
+		logrus.Warnf("Subscriber move %s lost its lock, leaving it to the recovery", job.ID)
+		return
+	}
+	r.finishSubscriberMove(ctx, job, m.session.Lease())
+}
+
+// recoverSubscriberMove finishes a move whose replica went away. The state is
+// read back from etcd, as the job may not have recorded the last step: a move
+// whose source is gone is completed on the target, any other is rolled back.
+func (r *RestServer) recoverSubscriberMove(ctx context.Context, job *SubscriberMoveJob, lease clientv3.LeaseID) {
+	updatedBy := fmt.Sprintf("move/%s", job.ID)
+	if job.Error == "" {
+		job.Error = "The replica running the move went away"
+	}
+	source, _, err := r.loadHSIConfig(ctx, job.SourceNodeID, job.SourceUserID)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get HSI config to recover subscriber move %s", job.ID)
+		return
+	}
+	// Only a config this move created counts as its target
+	targetCreated := false
+	if job.TargetUserID != "" {
+		target, _, err := r.loadHSIConfig(ctx, job.TargetNodeID, job.TargetUserID)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get HSI config to recover subscriber move %s", job.ID)
+			return
+		}
+		targetCreated = target != nil && target.Metadata.UpdatedBy == updatedBy
+	}
+
+	step := func(name string, run func() *apiError) bool {
+		ok, _ := r.moveStep(ctx, job, lease, name, run)
+		return ok
+	}
+	switch {
+	case source == nil && targetCreated:
+		job.Status = MoveStatusSucceeded
+		if !step(MoveStepDialTarget, func() *apiError {
+			return r.sendWANCommand(ctx, job.TargetNodeID, job.TargetUserID, WANActionConnect)
+		}) {
+			job.Status = MoveStatusDialFailed
+		}
+	case source != nil:
+		job.Status = MoveStatusRolledBack
+		if targetCreated && !step(MoveStepRollbackDeleteTarget, func() *apiError {
+			return r.removeMoveTarget(ctx, job, updatedBy)
+		}) {
+			job.Status = MoveStatusRollbackFailed
+		}
+		if job.stepSucceeded(MoveStepHangupSource) && !step(MoveStepRollbackDialSource, func() *apiError {
+			return r.sendWANCommand(ctx, job.SourceNodeID, job.SourceUserID, WANActionConnect)
+		}) {
+			job.Status = MoveStatusRollbackFailed
+		}
+	default:
+		job.Status = MoveStatusRollbackFailed
+		job.Error = "Subscriber found neither on the source nor on the target node"
+	}
+	r.finishSubscriberMove(ctx, job, lease)
+}
+
+// recoverSubscriberMoves takes over the running moves whose lock expired,
+// which happens when the replica running them stopped, and recovers them
+func (s *Scheduler) recoverSubscriberMoves(ctx context.Context) {
+	resp, err := s.etcd.Client().Get(ctx, subscriberMovePrefix, clientv3.WithPrefix())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list subscriber moves")
+		return
+	}
+	for _, kv := range resp.Kvs {
+		var job SubscriberMoveJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse subscriber move %s", kv.Key)
+			continue
+		}
+		if job.Status != MoveStatusRunning {
+			continue
+		}
+		lease, err := s.etcd.Client().Grant(ctx, SubscriberMoveLockTTL)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to create lease for subscriber move")
+			return
+		}
+		lockKey := subscriberMoveLockKey(job.SourceNodeID, job.SourceUserID)
+		txnResp, err := s.etcd.Client().Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0),
+				clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+			).
+			Then(clientv3.OpPut(lockKey, job.ID, clientv3.WithLease(lease.ID))).
+			Commit()
+		if err != nil || !txnResp.Succeeded {
+			s.etcd.Client().Revoke(ctx, lease.ID)
+			continue
+		}
+		logrus.Infof("Recovering subscriber move %s of node %s, user: %s", job.ID, job.SourceNodeID, job.SourceUserID)
+		s.rest.recoverSubscriberMove(ctx, &job, lease.ID)
+		s.etcd.Client().Revoke(ctx, lease.ID)
+	}
+}
+
+// MoveSubscriber moves a subscriber to another node
+// @Summary      Move subscriber
+// @Description  Move the HSI config and ACL of a subscriber to another node as a background job. The target node
+// @Description  is checked first: the user slot (the lowest free one if none is given), VLAN and NIC capacity. The job
+// @Description  then hangs up the subscriber, copies it, creates it on the target, deletes it on the source and dials
+// @Description  it. A failed step before the source is deleted rolls back the completed ones. A move whose replica
+// @Description  stops is recovered by the scheduler once its lock expires. Subscribers with NAT rules, IPTV, VoIP or
+// @Description  management services cannot be moved.
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string                 true  "Node ID"
+// @Param        userId   path      string                 true  "User ID"
+// @Param        request  body      MoveSubscriberRequest  true  "Target of the move"
+// @Success      202      {object}  SubscriberMoveJob
+// @Failure      400      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/move [post]
+func (r *RestServer) MoveSubscriber(c *gin.Context) {
+	var req MoveSubscriberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	m, apiErr := r.prepareSubscriberMove(ctx, nodeId, userId, req)
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	job := m.job
+	job.CreatedBy = username
+	job.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	job.UpdatedAt = job.CreatedAt
+	job.Steps = append(job.Steps, SubscriberMoveStep{Name: MoveStepValidate, Status: "succeeded", At: job.CreatedAt})
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal subscriber move"})
+		return
+	}
+
+	// The lock keeps a second move of the subscriber from starting. Its
+	// session is kept alive by the move, so the lock expires shortly after
+	// the replica goes away and the scheduler recovers the move.
+	session, err := concurrency.NewSession(r.etcd.Client(), concurrency.WithTTL(SubscriberMoveLockTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create lease for subscriber move"})
+		return
+	}
+	m.session = session
+	lockKey := subscriberMoveLockKey(nodeId, userId)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
+		Then(
+			clientv3.OpPut(lockKey, job.ID, clientv3.WithLease(session.Lease())),
+			clientv3.OpPut(subscriberMoveKey(job.ID), string(jobJSON)),
+		).
+		Commit()
+	if err != nil {
+		session.Close()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscriber move"})
+		return
+	}
+	if !txnResp.Succeeded {
+		session.Close()
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscriber is already being moved"})
+		return
+	}
+
+	logrus.Infof("Subscriber move %s of node %s, user: %s to node %s started by %s", job.ID, nodeId, userId, job.TargetNodeID, username)
+	// The move outlives the request
+	response := *job
+	response.Steps = append([]SubscriberMoveStep(nil), job.Steps...)
+	go r.runSubscriberMove(context.Background(), m)
+	c.JSON(http.StatusAccepted, response)
+}
+
+// ListSubscriberMoves returns all subscriber moves
+// @Summary      List subscriber moves
+// @Description  Get the subscriber move jobs, newest first
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   SubscriberMoveJob
+// @Failure      500  {object}  ErrorResponse
+// @Router       /subscriber-moves [get]
+func (r *RestServer) ListSubscriberMoves(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), subscriberMovePrefix, clientv3.WithPrefix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber moves"})
+		return
+	}
+	jobs := []SubscriberMoveJob{}
+	for _, kv := range resp.Kvs {
+		var job SubscriberMoveJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse subscriber move %s", kv.Key)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt > jobs[j].CreatedAt })
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetSubscriberMove returns a subscriber move
+// @Summary      Get subscriber move
+// @Description  Get a subscriber move job with the outcome of each step
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Move ID"
+// @Success      200  {object}  SubscriberMoveJob
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /subscriber-moves/{id} [get]
+func (r *RestServer) GetSubscriberMove(c *gin.Context) {
+	resp, err := r.etcd.Client().Get(c.Request.Context(), subscriberMoveKey(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber move"})
+		return
+	}
+	if len(resp.Kvs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber move not found"})
+		return
+	}
+	var job SubscriberMoveJob
+	if err := json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse subscriber move"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,199 @@
+//go:build etcd
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// prepareTestMove creates user 1 on node1 with VLAN 100 and prepares its move
+// to node2, holding the lock of the move like MoveSubscriber does
+func prepareTestMove(t *testing.T, r *RestServer) *subscriberMove {
+	t.Helper()
+	ctx := context.Background()
+	putTestJSON(t, r, "nodes/node2", `{}`)
+	if _, apiErr := r.saveHSIConfig(ctx, "node1", testHSIConfig("1", "100"), "admin", true, ""); apiErr != nil {
+		t.Fatalf("saveHSIConfig() error = %v", apiErr.Body)
+	}
+
+	m, apiErr := r.prepareSubscriberMove(ctx, "node1", "1", MoveSubscriberRequest{TargetNodeID: "node2", RedialDelay: 1})
+	if apiErr != nil {
+		t.Fatalf("prepareSubscriberMove() error = %v", apiErr.Body)
+	}
+	m.job.Steps = append(m.job.Steps, SubscriberMoveStep{Name: MoveStepValidate, Status: "succeeded"})
+	session, err := concurrency.NewSession(r.etcd.Client(), concurrency.WithTTL(SubscriberMoveLockTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.session = session
+	jobJSON, _ := json.Marshal(m.job)
+	if _, err := r.etcd.Client().Txn(ctx).Then(
+		clientv3.OpPut(subscriberMoveLockKey("node1", "1"), m.job.ID, clientv3.WithLease(session.Lease())),
+		clientv3.OpPut(subscriberMoveKey(m.job.ID), string(jobJSON)),
+	).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// loadTestMove reads a move job back from etcd
+func loadTestMove(t *testing.T, r *RestServer, id string) SubscriberMoveJob {
+	t.Helper()
+	resp, err := r.etcd.Client().Get(context.Background(), subscriberMoveKey(id))
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("Failed to get subscriber move %s: %v", id, err)
+	}
+	var job SubscriberMoveJob
+	if err := json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// checkMoveSteps compares the step names and outcomes of a move
+func checkMoveSteps(t *testing.T, job SubscriberMoveJob, want []string) {
+	t.Helper()
+	var got []string
+	for _, step := range job.Steps {
+		got = append(got, step.Name+":"+step.Status)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("steps = %v, want %v", got, want)
+	}
+}
+
+// checkMoveRolledBack verifies the subscriber is back on node1 only
+func checkMoveRolledBack(t *testing.T, r *RestServer, job SubscriberMoveJob) {
+	t.Helper()
+	ctx := context.Background()
+	if job.Status != MoveStatusRolledBack {
+		t.Errorf("status = %s, want %s (error: %s)", job.Status, MoveStatusRolledBack, job.Error)
+	}
+	if source, _, _ := r.loadHSIConfig(ctx, "node1", "1"); source == nil {
+		t.Error("source HSI config is gone")
+	}
+	if owner, _, _ := r.getVlanOwner(ctx, "node1", vlanTag{inner: 100}); owner != "1" {
+		t.Errorf("source VLAN owner = %q, want 1", owner)
+	}
+	if target, _, _ := r.loadHSIConfig(ctx, "node2", job.TargetUserID); target != nil {
+		t.Error("target HSI config still exists")
+	}
+	if owner, _, _ := r.getVlanOwner(ctx, "node2", vlanTag{inner: 100}); owner != "" && owner != "99" {
+		t.Errorf("target VLAN owner = %q, want released", owner)
+	}
+	resp, err := r.etcd.Client().Get(ctx, "commands/node1/pppoe_dial_1")
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Error("source was not dialed again")
+	}
+	lock, _ := r.etcd.Client().Get(ctx, subscriberMoveLockKey("node1", "1"))
+	if len(lock.Kvs) != 0 {
+		t.Error("move lock was not released")
+	}
+}
+
+func TestRunSubscriberMoveRollsBackFailedCreate(t *testing.T) {
+	r := newTestRestServer(t)
+	m := prepareTestMove(t, r)
+	// The VLAN is taken on the target after the move was validated
+	putTestJSON(t, r, vlanIndexKey("node2", vlanTag{inner: 100}), "99")
+
+	r.runSubscriberMove(context.Background(), m)
+
+	job := loadTestMove(t, r, m.job.ID)
+	checkMoveSteps(t, job, []string{
+		MoveStepValidate + ":succeeded",
+		MoveStepHangupSource + ":succeeded",
+		MoveStepCopyConfig + ":succeeded",
+		MoveStepCreateTarget + ":failed",
+		MoveStepRollbackDialSource + ":succeeded",
+	})
+	checkMoveRolledBack(t, r, job)
+}
+
+func TestRecoverSubscriberMoveRollsBackCreatedTarget(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	m := prepareTestMove(t, r)
+	job := m.job
+	updatedBy := "move/" + job.ID
+
+	// The replica stops right after creating the target, before recording it
+	lease := m.session.Lease()
+	if ok, _ := r.moveStep(ctx, job, lease, MoveStepHangupSource, func() *apiError { return nil }); !ok {
+		t.Fatal("hangup step failed")
+	}
+	if ok, _ := r.moveStep(ctx, job, lease, MoveStepCopyConfig, func() *apiError { return r.copyMoveSource(ctx, m) }); !ok {
+		t.Fatal("copy step failed")
+	}
+	if _, apiErr := r.createMoveTarget(ctx, m, updatedBy); apiErr != nil {
+		t.Fatalf("createMoveTarget() error = %v", apiErr.Body)
+	}
+	m.session.Orphan()
+	if _, err := r.etcd.Client().Revoke(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{etcd: r.etcd, rest: r, id: "test"}
+	s.recoverSubscriberMoves(ctx)
+
+	recovered := loadTestMove(t, r, job.ID)
+	checkMoveSteps(t, recovered, []string{
+		MoveStepValidate + ":succeeded",
+		MoveStepHangupSource + ":succeeded",
+		MoveStepCopyConfig + ":succeeded",
+		MoveStepRollbackDeleteTarget + ":succeeded",
+		MoveStepRollbackDialSource + ":succeeded",
+	})
+	checkMoveRolledBack(t, r, recovered)
+}
+
+func TestRecoverSubscriberMoveCompletesDeletedSource(t *testing.T) {
+	r := newTestRestServer(t)
+	ctx := context.Background()
+	m := prepareTestMove(t, r)
+	job := m.job
+	updatedBy := "move/" + job.ID
+
+	// The replica stops right after deleting the source
+	lease := m.session.Lease()
+	if apiErr := r.copyMoveSource(ctx, m); apiErr != nil {
+		t.Fatalf("copyMoveSource() error = %v", apiErr.Body)
+	}
+	if ok, _ := r.moveStep(ctx, job, lease, MoveStepCopyConfig, func() *apiError { return nil }); !ok {
+		t.Fatal("copy step failed")
+	}
+	if _, apiErr := r.createMoveTarget(ctx, m, updatedBy); apiErr != nil {
+		t.Fatalf("createMoveTarget() error = %v", apiErr.Body)
+	}
+	if apiErr := r.deleteMoveSource(ctx, m, updatedBy); apiErr != nil {
+		t.Fatalf("deleteMoveSource() error = %v", apiErr.Body)
+	}
+	m.session.Orphan()
+	if _, err := r.etcd.Client().Revoke(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{etcd: r.etcd, rest: r, id: "test"}
+	s.recoverSubscriberMoves(ctx)
+
+	recovered := loadTestMove(t, r, job.ID)
+	if recovered.Status != MoveStatusSucceeded {
+		t.Errorf("status = %s, want %s (error: %s)", recovered.Status, MoveStatusSucceeded, recovered.Error)
+	}
+	if target, _, _ := r.loadHSIConfig(ctx, "node2", job.TargetUserID); target == nil {
+		t.Error("target HSI config is gone")
+	}
+	if source, _, _ := r.loadHSIConfig(ctx, "node1", "1"); source != nil {
+		t.Error("source HSI config still exists")
+	}
+	resp, err := r.etcd.Client().Get(ctx, fmt.Sprintf("commands/node2/pppoe_dial_%s", job.TargetUserID))
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Error("target was not dialed")
+	}
+}
@@ -0,0 +1,942 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Services a subscriber can own. The internet service is the HSI config and
+// IPTV the IPTV config, VoIP and management are stored as subscriber services.
+const (
+	ServiceInternet   = "internet"
+	ServiceIPTV       = "iptv"
+	ServiceVoIP       = "voip"
+	ServiceManagement = "management"
+)
+
+// Administrative states of a subscriber
+const (
+	SubscriberActive    = "active"
+	SubscriberSuspended = "suspended"
+)
+
+// Status of a single service and aggregate status of a subscriber. A
+// subscriber is up when all of its services are up, down when none is and
+// degraded otherwise.
+const (
+	ServiceStatusUp         = "up"
+	ServiceStatusPending    = "pending"
+	ServiceStatusDown       = "down"
+	ServiceStatusSuspended  = "suspended"
+	SubscriberStatusUp      = "up"
+	SubscriberStatusDown    = "down"
+	SubscriberStatusPartial = "degraded"
+	SubscriberStatusEmpty   = "no_services"
+)
+
+// Addressing of a VoIP or management service
+const (
+	ServiceAddressDHCP   = "dhcp"
+	ServiceAddressStatic = "static"
+)
+
+const MaxServicePriority = 7
+
+// Subscriber is the parent object of the services of a user. Subscribers
+// without a stored record are active.
+type Subscriber struct {
+	NodeID          string `json:"node_id" example:"node001"`
+	UserID          string `json:"user_id" example:"2"`
+	State           string `json:"state" example:"active"`
+	SuspendReason   string `json:"suspend_reason,omitempty" example:"Unpaid invoice"`
+	ResourceVersion string `json:"resourceVersion,omitempty" example:"1"`
+	UpdatedBy       string `json:"updatedBy,omitempty" example:"admin"`
+	UpdatedAt       string `json:"updatedAt,omitempty" example:"2024-01-01T00:00:00Z"`
+}
+
+// SubscriberServiceConfig is a VoIP or management service of a subscriber,
+// carried on its own VLAN
+type SubscriberServiceConfig struct {
+	Enabled     bool   `json:"enabled" example:"true"`
+	VlanID      string `json:"vlan_id" example:"300"`
+	OuterVlanID string `json:"outer_vlan_id,omitempty" example:"200"`
+	Priority    int    `json:"priority" example:"5"`
+	AddressMode string `json:"address_mode" example:"dhcp"`
+	IPAddress   string `json:"ip_address,omitempty" example:"10.20.0.2/24"`
+	Gateway     string `json:"gateway,omitempty" example:"10.20.0.1"`
+	Description string `json:"description,omitempty" example:"SIP phone"`
+}
+
+// SubscriberServiceMetadata represents the metadata of a subscriber service
+type SubscriberServiceMetadata struct {
+	Node            string `json:"node" example:"node001"`
+	UserID          string `json:"user_id" example:"2"`
+	Type            string `json:"type" example:"voip"`
+	ResourceVersion string `json:"resourceVersion" example:"1"`
+	UpdatedBy       string `json:"updatedBy" example:"admin"`
+	UpdatedAt       string `json:"updatedAt" example:"2024-01-01T00:00:00Z"`
+}
+
+// SubscriberServiceWithMetadata is the etcd representation of a subscriber service
+type SubscriberServiceWithMetadata struct {
+	Config   SubscriberServiceConfig   `json:"config"`
+	Metadata SubscriberServiceMetadata `json:"metadata"`
+}
+
+// SubscriberServiceStatus summarizes one service of a subscriber
+type SubscriberServiceStatus struct {
+	Type        string `json:"type" example:"internet"`
+	VlanID      string `json:"vlan_id" example:"100"`
+	OuterVlanID string `json:"outer_vlan_id,omitempty" example:"200"`
+	Status      string `json:"status" example:"up"`
+}
+
+// SubscriberResponse represents a subscriber with the status of its services
+type SubscriberResponse struct {
+	Subscriber
+	Status   string                    `json:"status" example:"up"`
+	Services []SubscriberServiceStatus `json:"services"`
+}
+
+// SubscriberStateResponse is returned when a subscriber is suspended or resumed
+type SubscriberStateResponse struct {
+	SubscriberResponse
+	WANError string `json:"wan_error,omitempty" example:"HSI config not found"`
+}
+
+// SuspendSubscriberRequest represents the request to suspend a subscriber
+type SuspendSubscriberRequest struct {
+	Reason string `json:"reason" example:"Unpaid invoice"`
+}
+
+// subscriberParts collects the stored records of one subscriber
+type subscriberParts struct {
+	parent   *Subscriber
+	hsi      *HSIConfigWithMetadata
+	iptv     *IPTVConfigWithMetadata
+	services []SubscriberServiceWithMetadata
+}
+
+// subscriberKey is read by the node, which blocks every service of a suspended subscriber
+func subscriberKey(nodeId, userId string) string {
+	return subscriberPrefix(nodeId) + userId
+}
+
+func subscriberPrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/subscribers/", nodeId)
+}
+
+func servicePrefix(nodeId string) string {
+	return fmt.Sprintf("configs/%s/services/", nodeId)
+}
+
+func subscriberServicePrefix(nodeId, userId string) string {
+	return servicePrefix(nodeId) + userId + "/"
+}
+
+func subscriberServiceKey(nodeId, userId, serviceType string) string {
+	return subscriberServicePrefix(nodeId, userId) + serviceType
+}
+
+// serviceVlanOwner is the VLAN index value of a subscriber service, which
+// keeps its VLAN apart from the HSI VLAN owned by the plain user ID
+func serviceVlanOwner(userId, serviceType string) string {
+	return userId + "/" + serviceType
+}
+
+// serviceVlanTag returns the VLAN tag of a subscriber service
+func serviceVlanTag(config SubscriberServiceConfig) (vlanTag, error) {
+	return hsiVlanTag(HSIConfig{VlanID: config.VlanID, OuterVlanID: config.OuterVlanID})
+}
+
+// isSubscriberService reports whether a service type is stored as a subscriber service
+func isSubscriberService(serviceType string) bool {
+	return serviceType == ServiceVoIP || serviceType == ServiceManagement
+}
+
+// validateSubscriberService checks a VoIP or management service
+func validateSubscriberService(config SubscriberServiceConfig) fieldErrors {
+	var errs fieldErrors
+	if config.VlanID == "" {
+		errs.add("vlan_id", "VLAN ID is required")
+	} else {
+		validateVlanID(&errs, "vlan_id", config.VlanID)
+	}
+	validateOuterVlan(&errs, HSIConfig{OuterVlanID: config.OuterVlanID})
+	if config.Priority < 0 || config.Priority > MaxServicePriority {
+		errs.add("priority", "Priority must be an 802.1p class between 0 and %d", MaxServicePriority)
+	}
+
+	switch config.AddressMode {
+	case ServiceAddressDHCP:
+	case ServiceAddressStatic:
+		ip, subnet, err := net.ParseCIDR(strings.TrimSpace(config.IPAddress))
+		if err != nil || ip.To4() == nil {
+			errs.add("ip_address", "IP address must be an IPv4 address with prefix length, e.g. 10.20.0.2/24")
+		}
+		gateway := net.ParseIP(strings.TrimSpace(config.Gateway)).To4()
+		switch {
+		case gateway == nil:
+			errs.add("gateway", "Gateway must be a valid IPv4 address")
+		case subnet != nil && !subnet.Contains(gateway):
+			errs.add("gateway", "Gateway must be inside %s", subnet.String())
+		case ip != nil && gateway.Equal(ip):
+			errs.add("gateway", "Gateway must not be the service IP address")
+		}
+	default:
+		errs.add("address_mode", "Address mode must be %s or %s", ServiceAddressDHCP, ServiceAddressStatic)
+	}
+	validatePrintableASCII(&errs, "description", "Description", config.Description, 128)
+	return errs
+}
+
+// hsiServiceStatus maps the enable status reported by the node to a service status
+func hsiServiceStatus(enableStatus string) string {
+	switch enableStatus {
+	case "enabled":
+		return ServiceStatusUp
+	case "enabling", "disabling":
+		return ServiceStatusPending
+	default:
+		return ServiceStatusDown
+	}
+}
+
+// enabledServiceStatus returns the status of a service the node does not report on
+func enabledServiceStatus(enabled bool) string {
+	if enabled {
+		return ServiceStatusUp
+	}
+	return ServiceStatusDown
+}
+
+// view builds the API representation of a subscriber
+func (p *subscriberParts) view(nodeId, userId string) SubscriberResponse {
+	response := SubscriberResponse{
+		Subscriber: Subscriber{NodeID: nodeId, UserID: userId, State: SubscriberActive},
+		Services:   []SubscriberServiceStatus{},
+	}
+	if p.parent != nil {
+		response.Subscriber = *p.parent
+	}
+
+	if p.hsi != nil {
+		response.Services = append(response.Services, SubscriberServiceStatus{
+			Type:        ServiceInternet,
+			VlanID:      p.hsi.Config.VlanID,
+			OuterVlanID: p.hsi.Config.OuterVlanID,
+			Status:      hsiServiceStatus(p.hsi.Metadata.EnableStatus),
+		})
+	}
+	if p.iptv != nil {
+		response.Services = append(response.Services, SubscriberServiceStatus{
+			Type:   ServiceIPTV,
+			VlanID: p.iptv.Config.MulticastVlanID,
+			Status: enabledServiceStatus(p.iptv.Config.Enabled),
+		})
+	}
+	for _, service := range p.services {
+		response.Services = append(response.Services, SubscriberServiceStatus{
+			Type:        service.Metadata.Type,
+			VlanID:      service.Config.VlanID,
+			OuterVlanID: service.Config.OuterVlanID,
+			Status:      enabledServiceStatus(service.Config.Enabled),
+		})
+	}
+
+	up := 0
+	for i := range response.Services {
+		if response.State == SubscriberSuspended {
+			response.Services[i].Status = ServiceStatusSuspended
+		} else if response.Services[i].Status == ServiceStatusUp {
+			up++
+		}
+	}
+	switch {
+	case response.State == SubscriberSuspended:
+		response.Status = SubscriberSuspended
+	case len(response.Services) == 0:
+		response.Status = SubscriberStatusEmpty
+	case up == len(response.Services):
+		response.Status = SubscriberStatusUp
+	case up == 0:
+		response.Status = SubscriberStatusDown
+	default:
+		response.Status = SubscriberStatusPartial
+	}
+	return response
+}
+
+// collectSubscribers reads the records of the subscribers of a node, or of a
+// single subscriber if userId is set
+func (r *RestServer) collectSubscribers(ctx context.Context, nodeId, userId string) (map[string]*subscriberParts, error) {
+	get := func(prefix string) (*clientv3.GetResponse, error) {
+		if userId == "" {
+			return r.etcd.Client().Get(ctx, prefix, clientv3.WithPrefix())
+		}
+		return r.etcd.Client().Get(ctx, prefix+userId)
+	}
+
+	subscribers := make(map[string]*subscriberParts)
+	parts := func(userId string) *subscriberParts {
+		if subscribers[userId] == nil {
+			subscribers[userId] = &subscriberParts{}
+		}
+		return subscribers[userId]
+	}
+
+	hsiPrefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	resp, err := get(hsiPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		hsiUser := strings.TrimPrefix(string(kv.Key), hsiPrefix)
+		if strings.Contains(hsiUser, "/") {
+			continue
+		}
+		var config HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse HSI config %s", kv.Key)
+			continue
+		}
+		parts(hsiUser).hsi = &config
+	}
+
+	if resp, err = get(iptvConfigPrefix(nodeId)); err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		var config IPTVConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &config); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse IPTV config %s", kv.Key)
+			continue
+		}
+		parts(strings.TrimPrefix(string(kv.Key), iptvConfigPrefix(nodeId))).iptv = &config
+	}
+
+	if resp, err = get(subscriberPrefix(nodeId)); err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		var subscriber Subscriber
+		if err := json.Unmarshal(kv.Value, &subscriber); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse subscriber %s", kv.Key)
+			continue
+		}
+		parts(strings.TrimPrefix(string(kv.Key), subscriberPrefix(nodeId))).parent = &subscriber
+	}
+
+	servicesPrefix := servicePrefix(nodeId)
+	if userId != "" {
+		servicesPrefix = subscriberServicePrefix(nodeId, userId)
+	}
+	if resp, err = r.etcd.Client().Get(ctx, servicesPrefix, clientv3.WithPrefix()); err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		var service SubscriberServiceWithMetadata
+		if err := json.Unmarshal(kv.Value, &service); err != nil {
+			logrus.WithError(err).Errorf("Failed to parse subscriber service %s", kv.Key)
+			continue
+		}
+		p := parts(service.Metadata.UserID)
+		p.services = append(p.services, service)
+	}
+	return subscribers, nil
+}
+
+// loadSubscriber reads the subscriber record of a user together with its etcd
+// mod revision. A nil subscriber means it has never been suspended.
+func (r *RestServer) loadSubscriber(ctx context.Context, nodeId, userId string) (*Subscriber, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, subscriberKey(nodeId, userId))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var subscriber Subscriber
+	if err := json.Unmarshal(resp.Kvs[0].Value, &subscriber); err != nil {
+		return nil, 0, err
+	}
+	return &subscriber, resp.Kvs[0].ModRevision, nil
+}
+
+// checkSubscriberActive refuses to bring up the WAN of a suspended subscriber
+func (r *RestServer) checkSubscriberActive(ctx context.Context, nodeId, userId string) *apiError {
+	subscriber, _, err := r.loadSubscriber(ctx, nodeId, userId)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to get subscriber")
+	}
+	if subscriber != nil && subscriber.State == SubscriberSuspended {
+		return newAPIError(http.StatusConflict, "Subscriber is suspended")
+	}
+	return nil
+}
+
+// loadSubscriberService reads a subscriber service together with its etcd mod revision
+func (r *RestServer) loadSubscriberService(ctx context.Context, nodeId, userId, serviceType string) (*SubscriberServiceWithMetadata, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, subscriberServiceKey(nodeId, userId, serviceType))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var service SubscriberServiceWithMetadata
+	if err := json.Unmarshal(resp.Kvs[0].Value, &service); err != nil {
+		return nil, 0, err
+	}
+	return &service, resp.Kvs[0].ModRevision, nil
+}
+
+// saveSubscriberService validates and stores a VoIP or management service and
+// reserves its VLAN in the same transaction. It returns whether the service
+// was created.
+func (r *RestServer) saveSubscriberService(ctx context.Context, nodeId, userId, serviceType string, config SubscriberServiceConfig, username, ifMatch string) (*SubscriberServiceWithMetadata, bool, *apiError) {
+	if !isSubscriberService(serviceType) {
+		return nil, false, newAPIError(http.StatusBadRequest, fmt.Sprintf(
+			"Service must be %s or %s, internet and IPTV are managed with their own configs", ServiceVoIP, ServiceManagement))
+	}
+	if apiErr := r.checkUserIdInRange(ctx, nodeId, userId); apiErr != nil {
+		return nil, false, apiErr
+	}
+	if apiErr := validateSubscriberService(config).apiError("Subscriber service"); apiErr != nil {
+		return nil, false, apiErr
+	}
+	vlanModeRevision, apiErr := r.checkVlanMode(ctx, nodeId, HSIConfig{OuterVlanID: config.OuterVlanID})
+	if apiErr != nil {
+		return nil, false, apiErr
+	}
+
+	owner := serviceVlanOwner(userId, serviceType)
+	tag, _ := serviceVlanTag(config)
+	current, indexRevision, err := r.getVlanOwner(ctx, nodeId, tag)
+	if err != nil {
+		return nil, false, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+	}
+	if current != "" && current != owner {
+		return nil, false, newAPIError(http.StatusConflict, fmt.Sprintf("Input VLAN has been already used by: %s", current))
+	}
+	var multicastCmps []clientv3.Cmp
+	if tag.outer == 0 {
+		iptvUser, iptvCmp, err := r.multicastVlanUser(ctx, nodeId, tag.inner)
+		if err != nil {
+			return nil, false, newAPIError(http.StatusInternalServerError, "Failed to check VLAN availability")
+		}
+		if iptvUser != "" {
+			return nil, false, newAPIError(http.StatusConflict,
+				fmt.Sprintf("Input VLAN is used as multicast VLAN by the IPTV service of user: %s", iptvUser))
+		}
+		multicastCmps = append(multicastCmps, iptvCmp)
+	}
+
+	existing, modRevision, err := r.loadSubscriberService(ctx, nodeId, userId, serviceType)
+	if err != nil {
+		return nil, false, newAPIError(http.StatusInternalServerError, "Failed to get current subscriber service")
+	}
+	resourceVersion := "1"
+	if existing != nil {
+		if ifMatch != "" && ifMatch != "*" && ifMatch != existing.Metadata.ResourceVersion {
+			return nil, false, &apiError{Status: http.StatusConflict, Body: gin.H{
+				"error": "Subscriber service has been modified by another request", "current": existing}}
+		}
+		resourceVersion = incrementResourceVersion(existing.Metadata.ResourceVersion)
+	} else if ifMatch != "" && ifMatch != "*" {
+		return nil, false, newAPIError(http.StatusNotFound, "Subscriber service not found")
+	}
+
+	saved := SubscriberServiceWithMetadata{
+		Config: config,
+		Metadata: SubscriberServiceMetadata{
+			Node:            nodeId,
+			UserID:          userId,
+			Type:            serviceType,
+			ResourceVersion: resourceVersion,
+			UpdatedBy:       username,
+			UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	savedJSON, err := json.Marshal(saved)
+	if err != nil {
+		return nil, false, newAPIError(http.StatusInternalServerError, "Failed to marshal subscriber service")
+	}
+
+	etcdKey := subscriberServiceKey(nodeId, userId, serviceType)
+	ops := []clientv3.Op{
+		clientv3.OpPut(etcdKey, string(savedJSON)),
+		clientv3.OpPut(vlanIndexKey(nodeId, tag), owner),
+	}
+	if existing != nil {
+		if oldTag, err := serviceVlanTag(existing.Config); err == nil && oldTag != tag {
+			ops = append(ops, releaseVlanOp(nodeId, oldTag, owner))
+		}
+	}
+	cmps := append([]clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision),
+		clientv3.Compare(clientv3.ModRevision(vlanIndexKey(nodeId, tag)), "=", indexRevision),
+		clientv3.Compare(clientv3.ModRevision(nodeVlanModeKey(nodeId)), "=", vlanModeRevision),
+	}, multicastCmps...)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(cmps...).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, false, newAPIError(http.StatusInternalServerError, "Failed to save subscriber service")
+	}
+	if !txnResp.Succeeded {
+		return nil, false, newAPIError(http.StatusConflict, "Subscriber service, VLAN index or IPTV services have been modified by another request")
+	}
+
+	logrus.Infof("Subscriber service %s saved for node %s, user: %s, version: %s, by: %s",
+		serviceType, nodeId, userId, resourceVersion, username)
+	return &saved, existing == nil, nil
+}
+
+// deleteSubscriber removes a subscriber with all of its services in one
+// transaction: the HSI config with its NAT rules, IPTV service, SNAT port
+// block and IPAM subnet, the VoIP and management services with their VLANs
+// and the subscriber record
+func (r *RestServer) deleteSubscriber(ctx context.Context, nodeId, userId, username string) *apiError {
+	cmps, ops, apiErr := r.subscriberDeleteOps(ctx, nodeId, userId, username)
+	if apiErr != nil {
+		return apiErr
+	}
+	txnResp, err := r.etcd.Client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to delete subscriber")
+	}
+	if !txnResp.Succeeded {
+		return newAPIError(http.StatusConflict, "Subscriber has been modified by another request")
+	}
+
+	logrus.Infof("Subscriber deleted for node %s, user: %s, by: %s", nodeId, userId, username)
+	return nil
+}
+
+// subscriberDeleteOps returns the transaction of deleteSubscriber
+func (r *RestServer) subscriberDeleteOps(ctx context.Context, nodeId, userId, username string) ([]clientv3.Cmp, []clientv3.Op, *apiError) {
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	found := false
+
+	hsi, hsiRevision, err := r.loadHSIConfig(ctx, nodeId, userId)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get HSI config")
+	}
+	if hsi != nil {
+		found = true
+		cmps, ops, err = hsiDeleteOps(nodeId, userId, hsi, hsiRevision, username)
+		if err != nil {
+			return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to marshal config revision")
+		}
+		snatCmps, snatOps, err := r.snatReleaseOps(ctx, nodeId, userId)
+		if err != nil {
+			return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get SNAT allocation")
+		}
+		cmps, ops = append(cmps, snatCmps...), append(ops, snatOps...)
+		ipamCmps, ipamOps, err := r.ipamReleaseOps(ctx, nodeId, hsi.Config)
+		if err != nil {
+			return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get IPAM allocation")
+		}
+		cmps, ops = append(cmps, ipamCmps...), append(ops, ipamOps...)
+	} else {
+		// Without an HSI config only an orphaned IPTV service can be left
+		iptv, iptvRevision, err := r.loadIPTVConfig(ctx, nodeId, userId)
+		if err != nil {
+			return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get IPTV config")
+		}
+		if iptv != nil {
+			found = true
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(iptvConfigKey(nodeId, userId)), "=", iptvRevision))
+			ops = append(ops, clientv3.OpDelete(iptvConfigKey(nodeId, userId)))
+		}
+	}
+
+	resp, err := r.etcd.Client().Get(ctx, subscriberServicePrefix(nodeId, userId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get subscriber services")
+	}
+	for _, kv := range resp.Kvs {
+		found = true
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision))
+		ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		var service SubscriberServiceWithMetadata
+		if err := json.Unmarshal(kv.Value, &service); err != nil {
+			continue
+		}
+		if tag, err := serviceVlanTag(service.Config); err == nil {
+			ops = append(ops, releaseVlanOp(nodeId, tag, serviceVlanOwner(userId, service.Metadata.Type)))
+		}
+	}
+
+	_, parentRevision, err := r.loadSubscriber(ctx, nodeId, userId)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusInternalServerError, "Failed to get subscriber")
+	}
+	if parentRevision != 0 {
+		found = true
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(subscriberKey(nodeId, userId)), "=", parentRevision))
+		ops = append(ops, clientv3.OpDelete(subscriberKey(nodeId, userId)))
+	}
+	if !found {
+		return nil, nil, newAPIError(http.StatusNotFound, "Subscriber not found")
+	}
+	return cmps, ops, nil
+}
+
+// setSubscriberState suspends or resumes a subscriber and takes its WAN down
+// or up. The state is stored first so the node blocks the other services even
+// if the WAN command cannot be sent.
+func (r *RestServer) setSubscriberState(c *gin.Context, state, reason string) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	subscribers, err := r.collectSubscribers(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber"})
+		return
+	}
+	parts := subscribers[userId]
+	if parts == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber not found"})
+		return
+	}
+
+	_, modRevision, err := r.loadSubscriber(ctx, nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber"})
+		return
+	}
+	subscriber := Subscriber{NodeID: nodeId, UserID: userId, State: SubscriberActive, ResourceVersion: "1"}
+	if parts.parent != nil {
+		subscriber = *parts.parent
+		subscriber.ResourceVersion = incrementResourceVersion(subscriber.ResourceVersion)
+	}
+	subscriber.State = state
+	subscriber.SuspendReason = reason
+	subscriber.UpdatedBy = username
+	subscriber.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(subscriber)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal subscriber"})
+		return
+	}
+
+	key := subscriberKey(nodeId, userId)
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscriber"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscriber has been modified by another request"})
+		return
+	}
+	parts.parent = &subscriber
+	logrus.Infof("Subscriber %s of node %s set to %s by %s", userId, nodeId, state, username)
+
+	response := SubscriberStateResponse{SubscriberResponse: parts.view(nodeId, userId)}
+	if parts.hsi != nil {
+		action := WANActionDisconnect
+		if state == SubscriberActive {
+			action = WANActionConnect
+		}
+		if apiErr := r.sendWANCommand(ctx, nodeId, userId, action); apiErr != nil {
+			logrus.Warnf("Failed to send WAN %s to node %s for user %s: %v", action, nodeId, userId, apiErr)
+			response.WANError = apiErr.Error()
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// subscriberServiceParams returns the node, user and service type of a subscriber service request
+func subscriberServiceParams(c *gin.Context) (string, string, string) {
+	return c.Param("nodeId"), c.Param("userId"), c.Param("service")
+}
+
+// ListSubscribers returns the subscribers of a node
+// @Summary      List subscribers
+// @Description  Get the subscribers of a node with the status of each of their services and an aggregate status
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {array}   SubscriberResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /subscribers/{nodeId} [get]
+func (r *RestServer) ListSubscribers(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	subscribers, err := r.collectSubscribers(c.Request.Context(), nodeId, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscribers"})
+		return
+	}
+
+	userIds := make([]string, 0, len(subscribers))
+	for userId := range subscribers {
+		userIds = append(userIds, userId)
+	}
+	sort.Slice(userIds, func(i, j int) bool {
+		a, errA := strconv.Atoi(userIds[i])
+		b, errB := strconv.Atoi(userIds[j])
+		if errA != nil || errB != nil {
+			return userIds[i] < userIds[j]
+		}
+		return a < b
+	})
+
+	response := make([]SubscriberResponse, 0, len(userIds))
+	for _, userId := range userIds {
+		response = append(response, subscribers[userId].view(nodeId, userId))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetSubscriber returns a subscriber with the status of its services
+// @Summary      Get subscriber
+// @Description  Get a subscriber with its internet, IPTV, VoIP and management services and an aggregate status
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  SubscriberResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId} [get]
+func (r *RestServer) GetSubscriber(c *gin.Context) {
+	nodeId, userId := c.Param("nodeId"), c.Param("userId")
+	subscribers, err := r.collectSubscribers(c.Request.Context(), nodeId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber"})
+		return
+	}
+	parts := subscribers[userId]
+	if parts == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber not found"})
+		return
+	}
+	c.JSON(http.StatusOK, parts.view(nodeId, userId))
+}
+
+// DeleteSubscriber removes a subscriber with all of its services
+// @Summary      Delete subscriber
+// @Description  Delete the HSI config, NAT rules, IPTV, VoIP and management services and the record of a subscriber
+// @Description  in one transaction
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  MessageResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      409     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId} [delete]
+func (r *RestServer) DeleteSubscriber(c *gin.Context) {
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+	if apiErr := r.deleteSubscriber(c.Request.Context(), c.Param("nodeId"), c.Param("userId"), username); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Subscriber deleted successfully"})
+}
+
+// SuspendSubscriber suspends all services of a subscriber
+// @Summary      Suspend subscriber
+// @Description  Mark a subscriber as suspended, which makes the node block all of its services, and disconnect
+// @Description  its WAN. WAN connect and PPPoE dial are refused until the subscriber is resumed.
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string                    true   "Node ID"
+// @Param        userId   path      string                    true   "User ID"
+// @Param        request  body      SuspendSubscriberRequest  false  "Suspension reason"
+// @Success      200      {object}  SubscriberStateResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/suspend [post]
+func (r *RestServer) SuspendSubscriber(c *gin.Context) {
+	var req SuspendSubscriberRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	r.setSubscriberState(c, SubscriberSuspended, req.Reason)
+}
+
+// ResumeSubscriber lifts the suspension of a subscriber
+// @Summary      Resume subscriber
+// @Description  Reactivate all services of a suspended subscriber and connect its WAN
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      200     {object}  SubscriberStateResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      409     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/resume [post]
+func (r *RestServer) ResumeSubscriber(c *gin.Context) {
+	r.setSubscriberState(c, SubscriberActive, "")
+}
+
+// GetSubscriberService returns a VoIP or management service of a subscriber
+// @Summary      Get subscriber service
+// @Description  Get the VoIP or management service of a subscriber
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string  true  "Node ID"
+// @Param        userId   path      string  true  "User ID"
+// @Param        service  path      string  true  "Service type (voip or management)"
+// @Success      200      {object}  SubscriberServiceWithMetadata
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/services/{service} [get]
+func (r *RestServer) GetSubscriberService(c *gin.Context) {
+	nodeId, userId, serviceType := subscriberServiceParams(c)
+	service, _, err := r.loadSubscriberService(c.Request.Context(), nodeId, userId, serviceType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber service"})
+		return
+	}
+	if service == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber service not found"})
+		return
+	}
+	c.Header("ETag", resourceVersionETag(service.Metadata.ResourceVersion))
+	c.JSON(http.StatusOK, service)
+}
+
+// PutSubscriberService creates or replaces a VoIP or management service of a subscriber
+// @Summary      Create or update subscriber service
+// @Description  Provision the VoIP or management service of a subscriber on its own VLAN, which is reserved in the
+// @Description  VLAN index next to the HSI VLANs. On QinQ nodes the outer VLAN is required.
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId    path      string                   true   "Node ID"
+// @Param        userId    path      string                   true   "User ID"
+// @Param        service   path      string                   true   "Service type (voip or management)"
+// @Param        request   body      SubscriberServiceConfig  true   "Service configuration"
+// @Param        If-Match  header    string                   false  "Expected current resource version"
+// @Success      200       {object}  SubscriberServiceWithMetadata
+// @Success      201       {object}  SubscriberServiceWithMetadata
+// @Failure      400       {object}  ValidationErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/services/{service} [put]
+func (r *RestServer) PutSubscriberService(c *gin.Context) {
+	nodeId, userId, serviceType := subscriberServiceParams(c)
+	var config SubscriberServiceConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, err := r.getUserFromToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get user from token"})
+		return
+	}
+
+	saved, created, apiErr := r.saveSubscriberService(c.Request.Context(), nodeId, userId, serviceType, config, username,
+		parseIfMatch(c.GetHeader("If-Match")))
+	if apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	c.Header("ETag", resourceVersionETag(saved.Metadata.ResourceVersion))
+	if created {
+		c.JSON(http.StatusCreated, saved)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// DeleteSubscriberService removes a VoIP or management service of a subscriber
+// @Summary      Delete subscriber service
+// @Description  Remove the VoIP or management service of a subscriber and release its VLAN
+// @Tags         Subscribers
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId   path      string  true  "Node ID"
+// @Param        userId   path      string  true  "User ID"
+// @Param        service  path      string  true  "Service type (voip or management)"
+// @Success      200      {object}  MessageResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /subscribers/{nodeId}/{userId}/services/{service} [delete]
+func (r *RestServer) DeleteSubscriberService(c *gin.Context) {
+	nodeId, userId, serviceType := subscriberServiceParams(c)
+	ctx := c.Request.Context()
+	service, modRevision, err := r.loadSubscriberService(ctx, nodeId, userId, serviceType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriber service"})
+		return
+	}
+	if service == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber service not found"})
+		return
+	}
+
+	etcdKey := subscriberServiceKey(nodeId, userId, serviceType)
+	ops := []clientv3.Op{clientv3.OpDelete(etcdKey)}
+	if tag, err := serviceVlanTag(service.Config); err == nil {
+		ops = append(ops, releaseVlanOp(nodeId, tag, serviceVlanOwner(userId, serviceType)))
+	}
+	txnResp, err := r.etcd.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscriber service"})
+		return
+	}
+	if !txnResp.Succeeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscriber service has been modified by another request"})
+		return
+	}
+
+	logrus.Infof("Subscriber service %s deleted for node %s, user: %s", serviceType, nodeId, userId)
+	c.JSON(http.StatusOK, gin.H{"message": "Subscriber service deleted successfully"})
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// vlanIndexMigrationKey records that the VLAN index has been built from the
+// existing HSI configs once
+const vlanIndexMigrationKey = "migrations/vlan_index"
+
+// VlanOwnerResponse represents the subscriber that owns a VLAN on a node
+type VlanOwnerResponse struct {
+	NodeID      string `json:"node_id" example:"node-1"`
+	OuterVlanID int    `json:"outer_vlan_id,omitempty" example:"200"`
+	VlanID      int    `json:"vlan_id" example:"100"`
+	UserID      string `json:"user_id" example:"1"`
+	Service     string `json:"service" example:"internet"`
+}
+
+// VlanConflict lists subscribers found sharing a VLAN while rebuilding the index
+type VlanConflict struct {
+	OuterVlanID int      `json:"outer_vlan_id,omitempty" example:"200"`
+	VlanID      int      `json:"vlan_id" example:"100"`
+	UserIDs     []string `json:"user_ids"`
+}
+
+// VlanIndexRebuildResult summarizes a VLAN index rebuild of a node
+type VlanIndexRebuildResult struct {
+	NodeID    string         `json:"node_id" example:"node-1"`
+	Indexed   int            `json:"indexed" example:"10"`
+	Removed   int            `json:"removed" example:"0"`
+	Skipped   int            `json:"skipped" example:"0"`
+	Conflicts []VlanConflict `json:"conflicts"`
+}
+
+type vlanIndexEntry struct {
+	owner       string
+	modRevision int64
+}
+
+func vlanIndexPrefix(nodeId string) string {
+	return fmt.Sprintf("index/%s/vlan/", nodeId)
+}
+
+// vlanTag identifies a subscriber on a node, outer is 0 for a single tag
+type vlanTag struct {
+	outer int
+	inner int
+}
+
+// String formats a tag as "<inner>", or "<outer>.<inner>" for a QinQ pair
+func (t vlanTag) String() string {
+	if t.outer == 0 {
+		return strconv.Itoa(t.inner)
+	}
+	return fmt.Sprintf("%d.%d", t.outer, t.inner)
+}
+
+// parseVlanTag parses a tag formatted by vlanTag.String
+func parseVlanTag(s string) (vlanTag, error) {
+	var tag vlanTag
+	outer, inner, qinq := strings.Cut(s, ".")
+	if !qinq {
+		inner = outer
+	} else if vid, err := strconv.Atoi(outer); err != nil {
+		return tag, err
+	} else {
+		tag.outer = vid
+	}
+	vid, err := strconv.Atoi(inner)
+	if err != nil {
+		return tag, err
+	}
+	tag.inner = vid
+	return tag, nil
+}
+
+// hsiVlanTag returns the VLAN tag of an HSI config
+func hsiVlanTag(config HSIConfig) (vlanTag, error) {
+	var tag vlanTag
+	vid, err := strconv.Atoi(config.VlanID)
+	if err != nil {
+		return tag, err
+	}
+	tag.inner = vid
+	if config.OuterVlanID != "" {
+		if tag.outer, err = strconv.Atoi(config.OuterVlanID); err != nil {
+			return tag, err
+		}
+	}
+	return tag, nil
+}
+
+// vlanIndexKey maps a VLAN tag of a node to the user ID owning it. VLANs are
+// stored as plain numbers so "100" and "0100" share the same entry.
+func vlanIndexKey(nodeId string, tag vlanTag) string {
+	return vlanIndexPrefix(nodeId) + tag.String()
+}
+
+// getVlanOwner returns the user ID owning a VLAN tag and the mod revision of
+// its index entry, which is 0 if the tag is free
+func (r *RestServer) getVlanOwner(ctx context.Context, nodeId string, tag vlanTag) (string, int64, error) {
+	resp, err := r.etcd.Client().Get(ctx, vlanIndexKey(nodeId, tag))
+	if err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0, nil
+	}
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
+// releaseVlanOp deletes a VLAN index entry, but only if it is still owned by userId
+func releaseVlanOp(nodeId string, tag vlanTag, userId string) clientv3.Op {
+	key := vlanIndexKey(nodeId, tag)
+	return clientv3.OpTxn(
+		[]clientv3.Cmp{clientv3.Compare(clientv3.Value(key), "=", userId)},
+		[]clientv3.Op{clientv3.OpDelete(key)},
+		nil,
+	)
+}
+
+// rebuildVlanIndex recreates the VLAN index of a node from its HSI configs
+// and subscriber services. Entries are written with a mod revision guard so
+// concurrent config writes win over the rebuild. When several subscribers already share a VLAN the
+// current index owner, or else the lowest user ID, keeps it and the clash is
+// reported as a conflict.
+func (r *RestServer) rebuildVlanIndex(ctx context.Context, nodeId string) (*VlanIndexRebuildResult, error) {
+	result := &VlanIndexRebuildResult{NodeID: nodeId, Conflicts: []VlanConflict{}}
+
+	configPrefix := fmt.Sprintf("configs/%s/hsi/", nodeId)
+	configResp, err := r.etcd.Client().Get(ctx, configPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[vlanTag][]string)
+	for _, kv := range configResp.Kvs {
+		userId := strings.TrimPrefix(string(kv.Key), configPrefix)
+		if userId == "" || strings.Contains(userId, "/") {
+			continue
+		}
+		var configWithMetadata HSIConfigWithMetadata
+		if err := json.Unmarshal(kv.Value, &configWithMetadata); err != nil {
+			logrus.WithError(err).Warnf("Skipping unparsable HSI config %s while rebuilding VLAN index", kv.Key)
+			continue
+		}
+		tag, err := hsiVlanTag(configWithMetadata.Config)
+		if err != nil {
+			logrus.Warnf("Skipping HSI config %s with invalid VLAN %q/%q while rebuilding VLAN index",
+				kv.Key, configWithMetadata.Config.OuterVlanID, configWithMetadata.Config.VlanID)
+			continue
+		}
+		owners[tag] = append(owners[tag], userId)
+	}
+
+	// VoIP and management services reserve their VLANs as "<user>/<service>"
+	serviceResp, err := r.etcd.Client().Get(ctx, servicePrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range serviceResp.Kvs {
+		var service SubscriberServiceWithMetadata
+		if err := json.Unmarshal(kv.Value, &service); err != nil {
+			logrus.WithError(err).Warnf("Skipping unparsable subscriber service %s while rebuilding VLAN index", kv.Key)
+			continue
+		}
+		tag, err := serviceVlanTag(service.Config)
+		if err != nil {
+			logrus.Warnf("Skipping subscriber service %s with invalid VLAN %q/%q while rebuilding VLAN index",
+				kv.Key, service.Config.OuterVlanID, service.Config.VlanID)
+			continue
+		}
+		owner := serviceVlanOwner(service.Metadata.UserID, service.Metadata.Type)
+		owners[tag] = append(owners[tag], owner)
+	}
+
+	indexResp, err := r.etcd.Client().Get(ctx, vlanIndexPrefix(nodeId), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	indexed := make(map[vlanTag]vlanIndexEntry)
+	for _, kv := range indexResp.Kvs {
+		tag, err := parseVlanTag(strings.TrimPrefix(string(kv.Key), vlanIndexPrefix(nodeId)))
+		if err != nil {
+			continue
+		}
+		indexed[tag] = vlanIndexEntry{owner: string(kv.Value), modRevision: kv.ModRevision}
+	}
+
+	tags := make([]vlanTag, 0, len(owners))
+	for tag := range owners {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].outer != tags[j].outer {
+			return tags[i].outer < tags[j].outer
+		}
+		return tags[i].inner < tags[j].inner
+	})
+
+	for _, tag := range tags {
+		userIds := owners[tag]
+		sort.Strings(userIds)
+		owner := userIds[0]
+		current, found := indexed[tag]
+		if len(userIds) > 1 {
+			result.Conflicts = append(result.Conflicts, VlanConflict{OuterVlanID: tag.outer, VlanID: tag.inner, UserIDs: userIds})
+			logrus.Warnf("VLAN %s on node %s is configured for multiple users: %v", tag, nodeId, userIds)
+			for _, userId := range userIds {
+				if found && userId == current.owner {
+					owner = userId
+				}
+			}
+		}
+
+		if found && current.owner == owner {
+			result.Indexed++
+			continue
+		}
+		key := vlanIndexKey(nodeId, tag)
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", current.modRevision)).
+			Then(clientv3.OpPut(key, owner)).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+		if txnResp.Succeeded {
+			result.Indexed++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	for tag, current := range indexed {
+		if _, ok := owners[tag]; ok {
+			continue
+		}
+		key := vlanIndexKey(nodeId, tag)
+		txnResp, err := r.etcd.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", current.modRevision)).
+			Then(clientv3.OpDelete(key)).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+		if txnResp.Succeeded {
+			result.Removed++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	logrus.Infof("VLAN index of node %s rebuilt: %d indexed, %d removed, %d skipped, %d conflicts",
+		nodeId, result.Indexed, result.Removed, result.Skipped, len(result.Conflicts))
+	return result, nil
+}
+
+// EnsureVlanIndex builds the VLAN index of every node from the existing HSI
+// configs unless this has been done before. It must complete before HSI
+// configs are written, otherwise VLANs of unindexed subscribers could be reused.
+func (r *RestServer) EnsureVlanIndex(ctx context.Context) error {
+	resp, err := r.etcd.Client().Get(ctx, vlanIndexMigrationKey)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) > 0 {
+		return nil
+	}
+
+	keysResp, err := r.etcd.Client().Get(ctx, "configs/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]bool)
+	for _, kv := range keysResp.Kvs {
+		// key format: configs/{nodeId}/hsi/{userId}
+		parts := strings.Split(string(kv.Key), "/")
+		if len(parts) == 4 && parts[2] == "hsi" {
+			nodes[parts[1]] = true
+		}
+	}
+
+	for nodeId := range nodes {
+		if _, err := r.rebuildVlanIndex(ctx, nodeId); err != nil {
+			return fmt.Errorf("failed to rebuild VLAN index of node %s: %w", nodeId, err)
+		}
+	}
+
+	_, err = r.etcd.Client().Put(ctx, vlanIndexMigrationKey, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("VLAN index built for %d nodes", len(nodes))
+	return nil
+}
+
+// GetVlanOwner returns the subscriber owning a VLAN on a node
+// @Summary      Get VLAN owner
+// @Description  Look up which subscriber owns a VLAN on a node using the VLAN index. On QinQ nodes the
+// @Description  outer VLAN is given as query parameter and the path VLAN is the inner one.
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Param        vlanId  path      string  true  "VLAN ID"
+// @Param        outer_vlan_id  query  string  false  "Outer VLAN ID of a QinQ pair"
+// @Success      200     {object}  VlanOwnerResponse
+// @Failure      400     {object}  ErrorResponse
+// @Failure      404     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/vlans/{vlanId} [get]
+func (r *RestServer) GetVlanOwner(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	var errs fieldErrors
+	config := HSIConfig{VlanID: c.Param("vlanId"), OuterVlanID: c.Query("outer_vlan_id")}
+	validateVlanID(&errs, "vlan_id", config.VlanID)
+	validateOuterVlan(&errs, config)
+	if apiErr := errs.apiError("VLAN ID"); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+	tag, _ := hsiVlanTag(config)
+
+	owner, _, err := r.getVlanOwner(c.Request.Context(), nodeId, tag)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get VLAN owner"})
+		return
+	}
+	if owner == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VLAN is not in use"})
+		return
+	}
+
+	response := VlanOwnerResponse{NodeID: nodeId, OuterVlanID: tag.outer, VlanID: tag.inner, UserID: owner, Service: ServiceInternet}
+	if userId, service, found := strings.Cut(owner, "/"); found {
+		response.UserID, response.Service = userId, service
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RebuildVlanIndex rebuilds the VLAN index of a node from its HSI configs
+// @Summary      Rebuild VLAN index
+// @Description  Rebuild the VLAN index of a node from its HSI configs and subscriber services and report VLANs shared by several subscribers
+// @Tags         HSI Configuration
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        nodeId  path      string  true  "Node ID"
+// @Success      200     {object}  VlanIndexRebuildResult
+// @Failure      500     {object}  ErrorResponse
+// @Router       /config/{nodeId}/vlans/rebuild [post]
+func (r *RestServer) RebuildVlanIndex(c *gin.Context) {
+	nodeId := c.Param("nodeId")
+	result, err := r.rebuildVlanIndex(c.Request.Context(), nodeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild VLAN index"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"fastrg-controller/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// WAN modes of a subscriber
+const (
+	WANModePPPoE    = "pppoe"
+	WANModeIPoEDHCP = "ipoe_dhcp"
+	WANModeStatic   = "static"
+)
+
+// WAN actions. PPPoE subscribers dial and hang up, IPoE subscribers acquire
+// and release a DHCP lease and static subscribers bring their address up or down.
+const (
+	WANActionConnect    = "connect"
+	WANActionDisconnect = "disconnect"
+)
+
+const (
+	MaxWANDHCPHostnameLength    = 63
+	MaxWANDHCPVendorClassLength = 64
+	MaxWANDNSServers            = 3
+)
+
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// pppoeWANActions maps the WAN actions to the PPPoE commands of the node
+var pppoeWANActions = map[string]string{
+	WANActionConnect:    "dial",
+	WANActionDisconnect: "hangup",
+}
+
+// wanMode returns the WAN mode of a config, configs without one use PPPoE
+func wanMode(config HSIConfig) string {
+	if config.WANMode == "" {
+		return WANModePPPoE
+	}
+	return config.WANMode
+}
+
+// validateWANSettings checks the fields required by the WAN mode of a config.
+// Fields of the other modes are kept for switching back, so they are only
+// checked when set.
+func validateWANSettings(errs *fieldErrors, config HSIConfig) {
+	mode := wanMode(config)
+	switch mode {
+	case WANModePPPoE:
+		if config.AccountName == "" {
+			errs.add("account_name", "Account Name is required")
+		}
+		if config.Password == "" {
+			errs.add("password", "Password is required")
+		}
+	case WANModeIPoEDHCP:
+	case WANModeStatic:
+		if config.WANIPAddress == "" {
+			errs.add("wan_ip_address", "WAN IP address is required in static mode")
+		}
+		if config.WANGateway == "" {
+			errs.add("wan_gateway", "WAN gateway is required in static mode")
+		}
+	default:
+		errs.add("wan_mode", "WAN mode must be one of %s, %s or %s", WANModePPPoE, WANModeIPoEDHCP, WANModeStatic)
+	}
+
+	if config.WANDHCPHostname != "" && !hostnamePattern.MatchString(config.WANDHCPHostname) {
+		errs.add("wan_dhcp_hostname", "WAN DHCP hostname must be a single DNS label of up to %d letters, digits or '-'",
+			MaxWANDHCPHostnameLength)
+	}
+	validatePrintableASCII(errs, "wan_dhcp_vendor_class", "WAN DHCP vendor class", config.WANDHCPVendorClass,
+		MaxWANDHCPVendorClassLength)
+	validateIPv4List(errs, "wan_dns", "WAN DNS servers", config.WANDNS, MaxWANDNSServers)
+	validateStaticWAN(errs, config)
+}
+
+// validateStaticWAN checks the static WAN address and gateway, which must
+// share a subnet that does not overlap the subscriber's LAN
+func validateStaticWAN(errs *fieldErrors, config HSIConfig) {
+	var address net.IP
+	var subnet *net.IPNet
+	if config.WANIPAddress != "" {
+		ip, ipNet, err := net.ParseCIDR(strings.TrimSpace(config.WANIPAddress))
+		if err != nil || ip.To4() == nil {
+			errs.add("wan_ip_address", "WAN IP address must be an IPv4 address with prefix length, e.g. 203.0.113.10/30")
+		} else if ones, _ := ipNet.Mask.Size(); ones < 8 || ones > 30 {
+			errs.add("wan_ip_address", "WAN IP address prefix length must be between /8 and /30")
+		} else {
+			address, subnet = ip.To4(), ipNet
+			broadcast := make(net.IP, len(subnet.IP))
+			for i := range subnet.IP {
+				broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+			}
+			if address.Equal(subnet.IP) || address.Equal(broadcast) {
+				errs.add("wan_ip_address", "WAN IP address must not be the network or broadcast address of %s", subnet.String())
+			}
+		}
+	}
+
+	if config.WANGateway != "" {
+		gateway := net.ParseIP(strings.TrimSpace(config.WANGateway)).To4()
+		switch {
+		case gateway == nil:
+			errs.add("wan_gateway", "WAN gateway must be a valid IPv4 address")
+		case subnet == nil:
+		case !subnet.Contains(gateway):
+			errs.add("wan_gateway", "WAN gateway must be inside %s", subnet.String())
+		case gateway.Equal(address):
+			errs.add("wan_gateway", "WAN gateway must not be the WAN IP address")
+		}
+	}
+
+	// The WAN subnet must not be routed to the LAN, errors of the LAN
+	// settings are reported by validateDHCPSettings
+	if subnet == nil {
+		return
+	}
+	mask, err := utils.ParseIPv4Netmask(config.DHCPSubnet)
+	lanGateway := net.ParseIP(strings.TrimSpace(config.DHCPGateway)).To4()
+	if err != nil || lanGateway == nil {
+		return
+	}
+	lan := &net.IPNet{IP: lanGateway.Mask(mask), Mask: mask}
+	if lan.Contains(subnet.IP) || subnet.Contains(lan.IP) {
+		errs.add("wan_ip_address", "WAN subnet %s must not overlap the LAN subnet %s", subnet.String(), lan.String())
+	}
+}
+
+// sendWANCommand stores a WAN connect or disconnect command in etcd for the
+// node to execute. PPPoE subscribers get the PPPoE dial and hangup commands.
+// Suspended subscribers cannot be connected.
+func (r *RestServer) sendWANCommand(ctx context.Context, nodeId, userId, action string) *apiError {
+	hsiConfig, apiErr := r.commandHSIConfig(ctx, nodeId, userId)
+	if apiErr != nil {
+		return apiErr
+	}
+	if action == WANActionConnect {
+		if apiErr := r.checkNodeInService(ctx, nodeId); apiErr != nil {
+			return apiErr
+		}
+		if apiErr := r.checkSubscriberActive(ctx, nodeId, userId); apiErr != nil {
+			return apiErr
+		}
+	}
+	mode := wanMode(*hsiConfig)
+	if mode == WANModePPPoE {
+		return r.putPPPoECommand(ctx, nodeId, userId, pppoeWANActions[action], hsiConfig)
+	}
+
+	commandKey := fmt.Sprintf("commands/%s/%s_%s_%s", nodeId, mode, action, userId)
+	commandData := map[string]interface{}{
+		"action":    action,
+		"user_id":   userId,
+		"wan_mode":  mode,
+		"timestamp": time.Now().Unix(),
+	}
+	addVlanTags(commandData, *hsiConfig)
+	switch mode {
+	case WANModeIPoEDHCP:
+		commandData["dhcp_hostname"] = hsiConfig.WANDHCPHostname
+		commandData["dhcp_vendor_class"] = hsiConfig.WANDHCPVendorClass
+	case WANModeStatic:
+		commandData["ip_address"] = hsiConfig.WANIPAddress
+		commandData["gateway"] = hsiConfig.WANGateway
+		commandData["dns"] = hsiConfig.WANDNS
+	}
+
+	commandJSON, err := json.Marshal(commandData)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to create command")
+	}
+	if _, err := r.etcd.Client().Put(ctx, commandKey, string(commandJSON)); err != nil {
+		return newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to send %s command", action))
+	}
+
+	logrus.Infof("WAN %s command (%s) sent to node %s for user %s", action, mode, nodeId, userId)
+	return nil
+}
+
+// handleWANAction implements ConnectWAN and DisconnectWAN
+func (r *RestServer) handleWANAction(c *gin.Context, action string) {
+	var req HSIActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if req.NodeID == "" || req.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Node ID and User ID are required"})
+		return
+	}
+
+	if apiErr := r.sendWANCommand(c.Request.Context(), req.NodeID, req.UserID, action); apiErr != nil {
+		abortWithAPIError(c, apiErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("WAN %s command sent successfully", action)})
+}
+
+// ConnectWAN sends a WAN connect command to a node
+// @Summary      Connect WAN
+// @Description  Bring up the WAN of a subscriber according to its WAN mode: dial PPPoE, acquire an IPoE DHCP lease
+// @Description  or configure the static address
+// @Tags         WAN
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      HSIActionRequest  true  "WAN connect request"
+// @Success      200      {object}  MessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /wan/connect [post]
+func (r *RestServer) ConnectWAN(c *gin.Context) {
+	r.handleWANAction(c, WANActionConnect)
+}
+
+// DisconnectWAN sends a WAN disconnect command to a node
+// @Summary      Disconnect WAN
+// @Description  Take down the WAN of a subscriber according to its WAN mode: hang up PPPoE, release the IPoE DHCP
+// @Description  lease or remove the static address
+// @Tags         WAN
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      HSIActionRequest  true  "WAN disconnect request"
+// @Success      200      {object}  MessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /wan/disconnect [post]
+func (r *RestServer) DisconnectWAN(c *gin.Context) {
+	r.handleWANAction(c, WANActionDisconnect)
+}
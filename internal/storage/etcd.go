@@ -115,7 +115,40 @@ func (e *EtcdClient) WatchFailedEvents(ctx context.Context, handler FailedEventH
 	return nil
 }
 
+// NodeMaintenanceKey is the key holding the maintenance state of a node
+func NodeMaintenanceKey(nodeId string) string {
+	return fmt.Sprintf("maintenance/%s", nodeId)
+}
+
+// inMaintenance reports whether a node has been put into maintenance, where
+// failures are expected
+func (e *EtcdClient) inMaintenance(ctx context.Context, nodeId string) bool {
+	resp, err := e.client.Get(ctx, NodeMaintenanceKey(nodeId))
+	if err != nil || len(resp.Kvs) == 0 {
+		return false
+	}
+	var maintenance struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &maintenance); err != nil {
+		return false
+	}
+	return maintenance.Enabled
+}
+
 func (e *EtcdClient) processFailedEvent(event *FailedEvent, key string, eventType string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Nodes in maintenance raise no alerts
+	if e.inMaintenance(ctx, event.NodeID) {
+		logrus.WithFields(logrus.Fields{
+			"node_id": event.NodeID,
+			"key":     key,
+		}).Debug("Ignoring failed event of node in maintenance")
+		return
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"event_type":   event.EventType,
 		"node_id":      event.NodeID,
@@ -135,9 +168,6 @@ func (e *EtcdClient) processFailedEvent(event *FailedEvent, key string, eventTyp
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// Store with 7 days TTL (604800 seconds)
 	lease, err := e.client.Grant(ctx, 604800)
 	if err != nil {
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "every minute", expr: "* * * * *", wantErr: false},
+		{name: "maintenance window", expr: "0 3 * * 1-5", wantErr: false},
+		{name: "lists and steps", expr: "*/15 0,12 1-10/2 * *", wantErr: false},
+		{name: "sunday as 7", expr: "30 2 * * 7", wantErr: false},
+		{name: "daily shortcut", expr: "@daily", wantErr: false},
+		{name: "too few fields", expr: "0 3 * *", wantErr: true},
+		{name: "minute out of range", expr: "60 * * * *", wantErr: true},
+		{name: "reversed range", expr: "0 5-1 * * *", wantErr: true},
+		{name: "zero step", expr: "*/0 * * * *", wantErr: true},
+		{name: "non numeric", expr: "a * * * *", wantErr: true},
+		{name: "empty string", expr: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-01-01 is a Monday
+	base := time.Date(2024, 1, 1, 10, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{
+			name: "every minute",
+			expr: "* * * * *",
+			from: base,
+			want: time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC),
+		},
+		{
+			name: "3am daily rolls to next day",
+			expr: "0 3 * * *",
+			from: base,
+			want: time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "every 15 minutes",
+			expr: "*/15 * * * *",
+			from: base,
+			want: time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC),
+		},
+		{
+			name: "weekend only",
+			expr: "0 0 * * 6,0",
+			from: base,
+			want: time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "sunday as 7",
+			expr: "0 0 * * 7",
+			from: base,
+			want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 0 15 * 5",
+			from: base,
+			want: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: base,
+			want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "exact match is not returned",
+			expr: "30 10 * * *",
+			from: time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "never fires",
+			expr: "0 0 30 2 *",
+			from: base,
+			want: time.Time{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
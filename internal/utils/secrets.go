@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretPrefix marks a value produced by EncryptSecret
+const secretPrefix = "enc:v1:"
+
+// KeyProvider wraps and unwraps data encryption keys with key encryption keys.
+// Implementations may hold the keys locally or delegate to a KMS.
+type KeyProvider interface {
+	// ActiveKeyID returns the ID of the key new secrets are encrypted with
+	ActiveKeyID() string
+	// WrapKey encrypts a data key with the active key
+	WrapKey(dek []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped with the given key
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyProvider keeps AES-256 key encryption keys in memory
+type LocalKeyProvider struct {
+	keys   map[string][]byte
+	active string
+}
+
+// LoadLocalKeyProvider reads keys from a file with one "<key id>:<base64 32 byte key>"
+// per line. Empty lines and lines starting with "#" are ignored. The last key is
+// the active one, so a key is rotated by appending a new line; older keys stay
+// available to decrypt existing secrets.
+func LoadLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLocalKeys(data)
+}
+
+// ParseLocalKeys parses the key file format of LoadLocalKeyProvider
+func ParseLocalKeys(data []byte) (*LocalKeyProvider, error) {
+	p := &LocalKeyProvider{keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected <key id>:<base64 key>", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid base64 key: %w", line, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("line %d: key must be 32 bytes, got %d", line, len(key))
+		}
+		if _, ok := p.keys[parts[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key id %q", line, parts[0])
+		}
+		p.keys[parts[0]] = key
+		p.active = parts[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.active == "" {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) ActiveKeyID() string {
+	return p.active
+}
+
+func (p *LocalKeyProvider) WrapKey(dek []byte) (string, []byte, error) {
+	wrapped, err := sealAESGCM(p.keys[p.active], dek)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.active, wrapped, nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", keyID)
+	}
+	return openAESGCM(key, wrapped)
+}
+
+// IsEncryptedSecret reports whether a value was produced by EncryptSecret
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// SecretKeyID returns the ID of the key an encrypted secret is wrapped with,
+// or "" if the value is not encrypted
+func SecretKeyID(value string) string {
+	if !IsEncryptedSecret(value) {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, secretPrefix), ":", 2)
+	return parts[0]
+}
+
+// EncryptSecret encrypts a value with a fresh data key, which is wrapped by the
+// provider's active key and stored alongside the ciphertext as
+// "enc:v1:<key id>:<wrapped data key>:<ciphertext>"
+func EncryptSecret(p KeyProvider, plaintext string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAESGCM(dek, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	keyID, wrapped, err := p.WrapKey(dek)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + keyID + ":" +
+		base64.StdEncoding.EncodeToString(wrapped) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptSecret reverses EncryptSecret
+func DecryptSecret(p KeyProvider, value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return "", fmt.Errorf("value is not an encrypted secret")
+	}
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext: %w", err)
+	}
+	dek, err := p.UnwrapKey(parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openAESGCM(dek, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealAESGCM encrypts with AES-GCM and prepends the random nonce
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestParseLocalKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantActive string
+		wantErr    bool
+	}{
+		{name: "single key", data: "k1:" + testKey('a'), wantActive: "k1", wantErr: false},
+		{name: "last key is active", data: "# keys\nk1:" + testKey('a') + "\n\nk2:" + testKey('b') + "\n", wantActive: "k2", wantErr: false},
+		{name: "no keys", data: "# nothing here\n", wantErr: true},
+		{name: "missing id", data: ":" + testKey('a'), wantErr: true},
+		{name: "invalid base64", data: "k1:not-base64!", wantErr: true},
+		{name: "short key", data: "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "duplicate id", data: "k1:" + testKey('a') + "\nk1:" + testKey('b'), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLocalKeys([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLocalKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.ActiveKeyID() != tt.wantActive {
+				t.Errorf("ParseLocalKeys() active = %v, want %v", p.ActiveKeyID(), tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	oldKeys, err := ParseLocalKeys([]byte("k1:" + testKey('a')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeys, err := ParseLocalKeys([]byte("k1:" + testKey('a') + "\nk2:" + testKey('b')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := ParseLocalKeys([]byte("k1:" + testKey('c')))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := EncryptSecret(oldKeys, "pppoe-password")
+	if err != nil {
+		t.Fatalf("EncryptSecret() error = %v", err)
+	}
+	if !IsEncryptedSecret(secret) || strings.Contains(secret, "pppoe-password") {
+		t.Fatalf("EncryptSecret() = %v, want an encrypted value", secret)
+	}
+	if got := SecretKeyID(secret); got != "k1" {
+		t.Errorf("SecretKeyID() = %v, want k1", got)
+	}
+
+	// Secrets encrypted before a rotation stay readable
+	got, err := DecryptSecret(rotatedKeys, secret)
+	if err != nil || got != "pppoe-password" {
+		t.Errorf("DecryptSecret() after rotation = %v, %v, want pppoe-password", got, err)
+	}
+	rotated, err := EncryptSecret(rotatedKeys, "pppoe-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SecretKeyID(rotated); got != "k2" {
+		t.Errorf("SecretKeyID() after rotation = %v, want k2", got)
+	}
+
+	if _, err := DecryptSecret(otherKeys, secret); err == nil {
+		t.Error("DecryptSecret() with a different key succeeded, want error")
+	}
+	if _, err := DecryptSecret(oldKeys, rotated); err == nil {
+		t.Error("DecryptSecret() with an unknown key id succeeded, want error")
+	}
+	if _, err := DecryptSecret(oldKeys, "plaintext"); err == nil {
+		t.Error("DecryptSecret() of plaintext succeeded, want error")
+	}
+	if _, err := DecryptSecret(oldKeys, secret[:len(secret)-4]); err == nil {
+		t.Error("DecryptSecret() of truncated secret succeeded, want error")
+	}
+}
@@ -1,29 +1,190 @@
 package utils
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"net/netip"
+	"strconv"
 	"strings"
 )
 
-func ParseIPRange(ipRange string) (net.IP, net.IP, error) {
+// ParseAddrRange parses an inclusive address range such as
+// "192.168.1.10-192.168.1.200". Both "start-end" and "start~end" are accepted.
+// IPv4-mapped IPv6 addresses are returned as IPv4 addresses.
+func ParseAddrRange(addrRange string) (netip.Addr, netip.Addr, error) {
 	// 去除空白
-	ipRange = strings.TrimSpace(ipRange)
-	parts := strings.Split(ipRange, "-")
+	addrRange = strings.TrimSpace(addrRange)
+	parts := strings.FieldsFunc(addrRange, func(r rune) bool { return r == '-' || r == '~' })
 	if len(parts) != 2 {
-		return nil, nil, fmt.Errorf("invalid IP range format: %s", ipRange)
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid IP range format: %s", addrRange)
 	}
-	startIP := strings.TrimSpace(parts[0])
-	endIP := strings.TrimSpace(parts[1])
-	return net.ParseIP(startIP), net.ParseIP(endIP), nil
+	start, err := netip.ParseAddr(strings.TrimSpace(parts[0]))
+	if err != nil || start.Zone() != "" {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid start IP in range: %s", addrRange)
+	}
+	end, err := netip.ParseAddr(strings.TrimSpace(parts[1]))
+	if err != nil || end.Zone() != "" {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid end IP in range: %s", addrRange)
+	}
+	return start.Unmap(), end.Unmap(), nil
+}
+
+// AddrRangeSize returns the number of addresses from start to end inclusive.
+// Both addresses must be of the same family, IPv4 or IPv6, and start must not
+// be greater than end.
+func AddrRangeSize(start, end netip.Addr) (*big.Int, error) {
+	if !start.IsValid() || !end.IsValid() {
+		return nil, errors.New("not a valid IP address")
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() {
+		return nil, errors.New("IP range mixes IPv4 and IPv6 addresses")
+	}
+	if start.Compare(end) > 0 {
+		return nil, errors.New("start IP is greater than end IP")
+	}
+	size := new(big.Int).Sub(new(big.Int).SetBytes(end.AsSlice()), new(big.Int).SetBytes(start.AsSlice()))
+	return size.Add(size, big.NewInt(1)), nil
+}
+
+// AddrInRange reports whether addr lies between start and end inclusive.
+// Addresses of different families are never in range.
+func AddrInRange(addr, start, end netip.Addr) bool {
+	addr, start, end = addr.Unmap(), start.Unmap(), end.Unmap()
+	if !addr.IsValid() || addr.Is4() != start.Is4() || addr.Is4() != end.Is4() {
+		return false
+	}
+	return start.Compare(addr) <= 0 && addr.Compare(end) <= 0
+}
+
+// PrefixLastAddr returns the last address of a prefix, the broadcast address
+// of an IPv4 subnet
+func PrefixLastAddr(prefix netip.Prefix) netip.Addr {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
 }
 
-func IPv4toInt(ip net.IP) (uint32, error) {
-	ipv4Bytes := ip.To4()
-	if ipv4Bytes == nil {
-		return 0, errors.New("not a valid IPv4 address")
+// NextFreePrefix returns the first prefix of the given length inside supernet
+// that overlaps none of the used prefixes
+func NextFreePrefix(supernet netip.Prefix, bits int, used []netip.Prefix) (netip.Prefix, bool) {
+	supernet = supernet.Masked()
+	if bits < supernet.Bits() || bits > supernet.Addr().BitLen() {
+		return netip.Prefix{}, false
+	}
+	last := PrefixLastAddr(supernet)
+	addr := supernet.Addr()
+	for addr.IsValid() && addr.Compare(last) <= 0 {
+		candidate := netip.PrefixFrom(addr, bits)
+		var blocking *netip.Prefix
+		for i := range used {
+			if used[i].Overlaps(candidate) {
+				blocking = &used[i]
+				break
+			}
+		}
+		if blocking == nil {
+			return candidate, true
+		}
+		// Continue at the first aligned prefix after the blocking one
+		next := PrefixLastAddr(*blocking).Next()
+		if end := PrefixLastAddr(candidate); next.Compare(end) <= 0 {
+			next = end.Next()
+		} else if aligned := netip.PrefixFrom(next, bits).Masked(); aligned.Addr() != next {
+			next = PrefixLastAddr(aligned).Next()
+		}
+		addr = next
+	}
+	return netip.Prefix{}, false
+}
+
+// ParseIPv4Netmask parses a dotted-decimal netmask such as 255.255.255.0 and
+// rejects masks whose one bits are not contiguous
+func ParseIPv4Netmask(mask string) (net.IPMask, error) {
+	ip := net.ParseIP(strings.TrimSpace(mask))
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid netmask: %s", mask)
+	}
+	ipMask := net.IPMask(ip.To4())
+	if ones, bits := ipMask.Size(); ones == 0 && bits == 0 {
+		return nil, fmt.Errorf("netmask is not contiguous: %s", mask)
+	}
+	return ipMask, nil
+}
+
+// ParsePortRange parses a single port such as "8080" or an inclusive port
+// range such as "8000-8010"
+func ParsePortRange(portRange string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(portRange), "-")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("invalid port range format: %s", portRange)
+	}
+	ports := make([]int, len(parts))
+	for i, part := range parts {
+		port, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || port < 1 || port > 65535 {
+			return 0, 0, fmt.Errorf("invalid port in range: %s", portRange)
+		}
+		ports[i] = port
+	}
+	first, last := ports[0], ports[len(ports)-1]
+	if first > last {
+		return 0, 0, fmt.Errorf("start port is greater than end port: %s", portRange)
+	}
+	return first, last, nil
+}
+
+// ReplaceJSONField replaces the string value old with new in every object
+// field named one of fields, at any depth of a JSON document. Numbers keep
+// their precision. The document is returned as is if nothing was replaced.
+func ReplaceJSONField(data []byte, fields []string, old, new string) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return data, false, err
+	}
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		names[field] = true
+	}
+
+	var replace func(value interface{}) bool
+	replace = func(value interface{}) bool {
+		replaced := false
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for name, child := range value {
+				if s, ok := child.(string); ok && names[name] && s == old {
+					value[name] = new
+					replaced = true
+				} else if replace(child) {
+					replaced = true
+				}
+			}
+		case []interface{}:
+			for _, child := range value {
+				if replace(child) {
+					replaced = true
+				}
+			}
+		}
+		return replaced
+	}
+	if !replace(doc) {
+		return data, false, nil
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return data, false, err
 	}
-	return binary.BigEndian.Uint32(ipv4Bytes), nil
+	return out, true, nil
 }
@@ -1,11 +1,11 @@
 package utils
 
 import (
-	"net"
+	"net/netip"
 	"testing"
 )
 
-func TestParseIPRange(t *testing.T) {
+func TestParseAddrRange(t *testing.T) {
 	tests := []struct {
 		name        string
 		ipRange     string
@@ -34,6 +34,13 @@ func TestParseIPRange(t *testing.T) {
 			wantEndIP:   "10.0.0.100",
 			wantErr:     false,
 		},
+		{
+			name:        "valid IP range with tilde",
+			ipRange:     "192.168.1.10~192.168.1.200",
+			wantStartIP: "192.168.1.10",
+			wantEndIP:   "192.168.1.200",
+			wantErr:     false,
+		},
 		{
 			name:        "invalid format - no dash",
 			ipRange:     "192.168.1.1 192.168.1.10",
@@ -55,80 +62,492 @@ func TestParseIPRange(t *testing.T) {
 			wantEndIP:   "",
 			wantErr:     true,
 		},
+		{
+			name:        "invalid start IP",
+			ipRange:     "192.168.1.abc-192.168.1.10",
+			wantStartIP: "",
+			wantEndIP:   "",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid end IP",
+			ipRange:     "192.168.1.1-garbage",
+			wantStartIP: "",
+			wantEndIP:   "",
+			wantErr:     true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			startIP, endIP, err := ParseIPRange(tt.ipRange)
+			startIP, endIP, err := ParseAddrRange(tt.ipRange)
 
 			if (err != nil) != tt.wantErr {
-				t.Errorf("ParseIPRange() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("ParseAddrRange() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
 			if !tt.wantErr {
 				if startIP.String() != tt.wantStartIP {
-					t.Errorf("ParseIPRange() startIP = %v, want %v", startIP.String(), tt.wantStartIP)
+					t.Errorf("ParseAddrRange() startIP = %v, want %v", startIP.String(), tt.wantStartIP)
 				}
 				if endIP.String() != tt.wantEndIP {
-					t.Errorf("ParseIPRange() endIP = %v, want %v", endIP.String(), tt.wantEndIP)
+					t.Errorf("ParseAddrRange() endIP = %v, want %v", endIP.String(), tt.wantEndIP)
 				}
 			}
 		})
 	}
 }
 
-func TestIPv4toInt(t *testing.T) {
+func TestAddrRangeSize(t *testing.T) {
 	tests := []struct {
 		name    string
-		ip      string
-		want    uint32
+		start   string
+		end     string
+		want    string
 		wantErr bool
 	}{
 		{
-			name:    "valid IPv4 - 192.168.1.1",
-			ip:      "192.168.1.1",
-			want:    3232235777, // 192*256^3 + 168*256^2 + 1*256 + 1
+			name:    "IPv4 range",
+			start:   "192.168.1.100",
+			end:     "192.168.1.200",
+			want:    "101",
 			wantErr: false,
 		},
 		{
-			name:    "valid IPv4 - 10.0.0.1",
-			ip:      "10.0.0.1",
-			want:    167772161, // 10*256^3 + 0*256^2 + 0*256 + 1
+			name:    "single IPv4 address",
+			start:   "10.0.0.1",
+			end:     "10.0.0.1",
+			want:    "1",
 			wantErr: false,
 		},
 		{
-			name:    "valid IPv4 - 0.0.0.0",
-			ip:      "0.0.0.0",
-			want:    0,
+			name:    "IPv6 range",
+			start:   "2001:db8::1000",
+			end:     "2001:db8::1fff",
+			want:    "4096",
 			wantErr: false,
 		},
 		{
-			name:    "valid IPv4 - 255.255.255.255",
-			ip:      "255.255.255.255",
-			want:    4294967295,
+			name:    "whole IPv6 /64",
+			start:   "2001:db8::",
+			end:     "2001:db8::ffff:ffff:ffff:ffff",
+			want:    "18446744073709551616",
 			wantErr: false,
 		},
 		{
-			name:    "IPv6 address",
-			ip:      "2001:db8::1",
-			want:    0,
+			name:    "start greater than end",
+			start:   "192.168.1.200",
+			end:     "192.168.1.100",
+			wantErr: true,
+		},
+		{
+			name:    "mixed families",
+			start:   "192.168.1.1",
+			end:     "2001:db8::1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddrRangeSize(netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end))
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AddrRangeSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("AddrRangeSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddrInRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		ip    string
+		start string
+		end   string
+		want  bool
+	}{
+		{
+			name:  "IPv4 inside range",
+			ip:    "192.168.1.150",
+			start: "192.168.1.100",
+			end:   "192.168.1.200",
+			want:  true,
+		},
+		{
+			name:  "IPv4 range bounds",
+			ip:    "192.168.1.200",
+			start: "192.168.1.100",
+			end:   "192.168.1.200",
+			want:  true,
+		},
+		{
+			name:  "IPv4 outside range",
+			ip:    "192.168.1.10",
+			start: "192.168.1.100",
+			end:   "192.168.1.200",
+			want:  false,
+		},
+		{
+			name:  "IPv6 inside range",
+			ip:    "2001:db8::1800",
+			start: "2001:db8::1000",
+			end:   "2001:db8::1fff",
+			want:  true,
+		},
+		{
+			name:  "mixed families",
+			ip:    "192.168.1.150",
+			start: "2001:db8::1000",
+			end:   "2001:db8::1fff",
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AddrInRange(netip.MustParseAddr(tt.ip), netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end))
+			if got != tt.want {
+				t.Errorf("AddrInRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixLastAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{
+			name:   "IPv4 /24",
+			prefix: "192.168.1.0/24",
+			want:   "192.168.1.255",
+		},
+		{
+			name:   "IPv4 /30 with host bits set",
+			prefix: "10.0.0.5/30",
+			want:   "10.0.0.7",
+		},
+		{
+			name:   "IPv4 /32",
+			prefix: "10.0.0.1/32",
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "IPv6 /64",
+			prefix: "2001:db8::/64",
+			want:   "2001:db8::ffff:ffff:ffff:ffff",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PrefixLastAddr(netip.MustParsePrefix(tt.prefix))
+			if got.String() != tt.want {
+				t.Errorf("PrefixLastAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextFreePrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		supernet string
+		bits     int
+		used     []string
+		want     string
+		wantOk   bool
+	}{
+		{
+			name:     "empty supernet",
+			supernet: "10.0.0.0/16",
+			bits:     24,
+			want:     "10.0.0.0/24",
+			wantOk:   true,
+		},
+		{
+			name:     "skips used prefixes",
+			supernet: "10.0.0.0/16",
+			bits:     24,
+			used:     []string{"10.0.0.0/24", "10.0.1.0/24"},
+			want:     "10.0.2.0/24",
+			wantOk:   true,
+		},
+		{
+			name:     "fills a gap",
+			supernet: "10.0.0.0/16",
+			bits:     24,
+			used:     []string{"10.0.0.0/24", "10.0.2.0/24"},
+			want:     "10.0.1.0/24",
+			wantOk:   true,
+		},
+		{
+			name:     "smaller used prefix blocks a candidate",
+			supernet: "10.0.0.0/16",
+			bits:     24,
+			used:     []string{"10.0.0.128/25"},
+			want:     "10.0.1.0/24",
+			wantOk:   true,
+		},
+		{
+			name:     "larger used prefix is skipped at once",
+			supernet: "10.0.0.0/16",
+			bits:     28,
+			used:     []string{"10.0.0.0/20"},
+			want:     "10.0.16.0/28",
+			wantOk:   true,
+		},
+		{
+			name:     "unaligned end of used prefix",
+			supernet: "10.0.0.0/16",
+			bits:     24,
+			used:     []string{"10.0.0.0/24", "10.0.1.0/26"},
+			want:     "10.0.2.0/24",
+			wantOk:   true,
+		},
+		{
+			name:     "supernet exhausted",
+			supernet: "10.0.0.0/23",
+			bits:     24,
+			used:     []string{"10.0.0.0/24", "10.0.1.0/24"},
+			wantOk:   false,
+		},
+		{
+			name:     "prefix length shorter than supernet",
+			supernet: "10.0.0.0/24",
+			bits:     16,
+			wantOk:   false,
+		},
+		{
+			name:     "end of the address space",
+			supernet: "255.255.255.0/24",
+			bits:     25,
+			used:     []string{"255.255.255.0/25", "255.255.255.128/25"},
+			wantOk:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := make([]netip.Prefix, len(tt.used))
+			for i, prefix := range tt.used {
+				used[i] = netip.MustParsePrefix(prefix)
+			}
+			got, ok := NextFreePrefix(netip.MustParsePrefix(tt.supernet), tt.bits, used)
+			if ok != tt.wantOk {
+				t.Errorf("NextFreePrefix() ok = %v, want %v", ok, tt.wantOk)
+				return
+			}
+			if ok && got.String() != tt.want {
+				t.Errorf("NextFreePrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPv4Netmask(t *testing.T) {
+	tests := []struct {
+		name     string
+		mask     string
+		wantOnes int
+		wantErr  bool
+	}{
+		{
+			name:     "class C netmask",
+			mask:     "255.255.255.0",
+			wantOnes: 24,
+			wantErr:  false,
+		},
+		{
+			name:     "/30 netmask",
+			mask:     "255.255.255.252",
+			wantOnes: 30,
+			wantErr:  false,
+		},
+		{
+			name:     "all zero netmask",
+			mask:     "0.0.0.0",
+			wantOnes: 0,
+			wantErr:  false,
+		},
+		{
+			name:    "non contiguous netmask",
+			mask:    "255.0.255.0",
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 netmask",
+			mask:    "ffff:ffff::",
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			mask:    "abc",
 			wantErr: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ip := net.ParseIP(tt.ip)
-			got, err := IPv4toInt(ip)
+			got, err := ParseIPv4Netmask(tt.mask)
 
 			if (err != nil) != tt.wantErr {
-				t.Errorf("IPv4toInt() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("ParseIPv4Netmask() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
-			if !tt.wantErr && got != tt.want {
-				t.Errorf("IPv4toInt() = %v, want %v", got, tt.want)
+			if !tt.wantErr {
+				if ones, _ := got.Size(); ones != tt.wantOnes {
+					t.Errorf("ParseIPv4Netmask() ones = %v, want %v", ones, tt.wantOnes)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		portRange string
+		wantFirst int
+		wantLast  int
+		wantErr   bool
+	}{
+		{
+			name:      "single port",
+			portRange: "8080",
+			wantFirst: 8080,
+			wantLast:  8080,
+			wantErr:   false,
+		},
+		{
+			name:      "port range with spaces",
+			portRange: " 8000 - 8010 ",
+			wantFirst: 8000,
+			wantLast:  8010,
+			wantErr:   false,
+		},
+		{
+			name:      "full range",
+			portRange: "1-65535",
+			wantFirst: 1,
+			wantLast:  65535,
+			wantErr:   false,
+		},
+		{
+			name:      "port zero",
+			portRange: "0",
+			wantErr:   true,
+		},
+		{
+			name:      "port above 65535",
+			portRange: "65536",
+			wantErr:   true,
+		},
+		{
+			name:      "reversed range",
+			portRange: "8010-8000",
+			wantErr:   true,
+		},
+		{
+			name:      "too many dashes",
+			portRange: "1-2-3",
+			wantErr:   true,
+		},
+		{
+			name:      "empty string",
+			portRange: "",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, err := ParsePortRange(tt.portRange)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePortRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr && (first != tt.wantFirst || last != tt.wantLast) {
+				t.Errorf("ParsePortRange() = %v-%v, want %v-%v", first, last, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestReplaceJSONField(t *testing.T) {
+	fields := []string{"node", "node_id"}
+	tests := []struct {
+		name         string
+		data         string
+		want         string
+		wantReplaced bool
+		wantErr      bool
+	}{
+		{
+			name:         "top-level field",
+			data:         `{"node_id":"old","user_id":"2"}`,
+			want:         `{"node_id":"new","user_id":"2"}`,
+			wantReplaced: true,
+		},
+		{
+			name:         "nested object and array",
+			data:         `{"action":{"node_id":"old"},"items":[{"node":"old"},{"node":"other"}]}`,
+			want:         `{"action":{"node_id":"new"},"items":[{"node":"new"},{"node":"other"}]}`,
+			wantReplaced: true,
+		},
+		{
+			name:         "other fields with the old value are kept",
+			data:         `{"name":"old","node":"old"}`,
+			want:         `{"name":"old","node":"new"}`,
+			wantReplaced: true,
+		},
+		{
+			name:         "large numbers keep their precision",
+			data:         `{"node":"old","revision":9007199254740993}`,
+			want:         `{"node":"new","revision":9007199254740993}`,
+			wantReplaced: true,
+		},
+		{
+			name: "nothing to replace returns the document as is",
+			data: `{ "node" : "other" }`,
+			want: `{ "node" : "other" }`,
+		},
+		{
+			name: "scalar document",
+			data: `2`,
+			want: `2`,
+		},
+		{
+			name:    "not JSON",
+			data:    `old/2`,
+			want:    `old/2`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, replaced, err := ReplaceJSONField([]byte(tt.data), fields, "old", "new")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReplaceJSONField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if replaced != tt.wantReplaced {
+				t.Errorf("ReplaceJSONField() replaced = %v, want %v", replaced, tt.wantReplaced)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReplaceJSONField() = %s, want %s", got, tt.want)
 			}
 		})
 	}
@@ -16,6 +16,7 @@ import (
 
 	"fastrg-controller/internal/server"
 	"fastrg-controller/internal/storage"
+	"fastrg-controller/internal/utils"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -128,6 +129,26 @@ func main() {
 
 	// start REST API (HTTPS)
 	rest := server.NewRestServer(etcd)
+
+	// Encrypt PPPoE passwords at rest when a key file is configured
+	if keyFile := os.Getenv("SECRET_KEY_FILE"); keyFile != "" {
+		keys, err := utils.LoadLocalKeyProvider(keyFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to load secret key file")
+		}
+		rest.SetKeyProvider(keys)
+		logrus.Infof("Secret encryption enabled with key %s", keys.ActiveKeyID())
+	}
+
+	// Build the VLAN index from existing HSI configs before accepting writes
+	if err := rest.EnsureVlanIndex(ctx); err != nil {
+		logrus.WithError(err).Fatal("failed to build VLAN index")
+	}
+
+	// Start scheduler, jobs only run on the replica elected as leader
+	cancelScheduler := rest.StartScheduler()
+	defer cancelScheduler()
+
 	logrus.Infof("Starting HTTPS server on :%s", httpsPort)
 	if err := rest.StartRestServer(":" + httpsPort); err != nil {
 		logrus.WithError(err).Fatal("failed to start HTTPS server")
@@ -31,6 +31,8 @@ func main() {
 		NodeUuid: "test-node-001",
 		Ip:       "192.168.1.100",
 		Version:  "1.0.0",
+		// 節點硬體支援的用戶數
+		MaxSubscribers: 2000,
 	}
 
 	logrus.Infof("Registering node: %+v", registerReq)
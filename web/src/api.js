@@ -140,9 +140,11 @@ export async function createHSIConfig(nodeId, config){
   return resp.data
 }
 
-export async function updateHSIConfig(nodeId, userId, config){
+export async function updateHSIConfig(nodeId, userId, config, resourceVersion){
   const token = localStorage.getItem('token')
   const headers = token ? { Authorization: token } : {}
+  // Reject the update if someone else changed the config since it was loaded
+  if (resourceVersion) headers['If-Match'] = `"${resourceVersion}"`
   const resp = await axios.put(`/api/config/${nodeId}/hsi/${userId}`, config, { headers })
   if(resp.status !== 200) throw new Error('failed to update HSI config')
   return resp.data
@@ -172,6 +174,22 @@ export async function hangupPPPoE(nodeId, userId){
   return resp.data
 }
 
+export async function connectWAN(nodeId, userId){
+  const token = localStorage.getItem('token')
+  const headers = token ? { Authorization: token } : {}
+  const resp = await axios.post(`/api/wan/connect`, { node_id: nodeId, user_id: userId }, { headers })
+  if(resp.status !== 200) throw new Error('failed to connect WAN')
+  return resp.data
+}
+
+export async function disconnectWAN(nodeId, userId){
+  const token = localStorage.getItem('token')
+  const headers = token ? { Authorization: token } : {}
+  const resp = await axios.post(`/api/wan/disconnect`, { node_id: nodeId, user_id: userId }, { headers })
+  if(resp.status !== 200) throw new Error('failed to disconnect WAN')
+  return resp.data
+}
+
 // Failed Events API
 export async function getFailedEvents(nodeId){
   const token = localStorage.getItem('token')
@@ -115,6 +115,35 @@ export const translations = {
     'hsi.dhcpAddrPoolLabel': 'DHCP Address Pool',
     'hsi.subnetLabel': 'Subnet Mask',
     'hsi.gatewayLabel': 'Gateway',
+    'hsi.pppoeOptions': 'PPPoE 進階選項',
+    'hsi.pppoeServiceName': 'Service-Name',
+    'hsi.pppoeAcName': 'AC-Name',
+    'hsi.pppoeMru': 'MRU',
+    'hsi.pppoeAuthProtocol': '認證協定',
+    'hsi.pppoeLcpEchoInterval': 'LCP Echo 間隔 (秒)',
+    'hsi.pppoeLcpEchoFailure': 'LCP Echo 失敗次數',
+    'hsi.pppoeDefault': '預設',
+    'hsi.wanSettings': 'WAN 設定',
+    'hsi.wanMode': 'WAN 模式',
+    'hsi.wanModePppoe': 'PPPoE',
+    'hsi.wanMode.ipoe_dhcp': 'IPoE (DHCP 用戶端)',
+    'hsi.wanMode.static': '固定 IP',
+    'hsi.wanDhcpHostname': 'DHCP 主機名稱',
+    'hsi.wanDhcpVendorClass': 'DHCP Vendor Class',
+    'hsi.wanIpAddress': 'WAN IP 位址 (CIDR)',
+    'hsi.wanGateway': 'WAN 閘道',
+    'hsi.wanDns': 'WAN DNS 伺服器',
+    'hsi.outerVlanLabel': '外層 S-VLAN (QinQ)',
+    'hsi.outerTpid': '外層 TPID',
+    'hsi.qosSettings': 'QoS 頻寬設定',
+    'hsi.qosUpstreamRate': '上行速率 (Mbit/s)',
+    'hsi.qosDownstreamRate': '下行速率 (Mbit/s)',
+    'hsi.qosUpstreamBurst': '上行突發量 (KB)',
+    'hsi.qosDownstreamBurst': '下行突發量 (KB)',
+    'hsi.qosPriorityClass': '優先等級',
+    'hsi.qosClass.best_effort': '盡力而為 (Best effort)',
+    'hsi.qosClass.assured': '保證轉送 (Assured)',
+    'hsi.qosClass.expedited': '加速轉送 (Expedited)',
     'hsi.userId': 'User ID',
     'hsi.chooseAction': '請選擇要進行的操作：',
     'hsi.createPppoe': '新增 PPPoE 設定',
@@ -309,6 +338,35 @@ export const translations = {
     'hsi.dhcpAddrPoolLabel': 'DHCP Address Pool',
     'hsi.subnetLabel': 'Subnet Mask',
     'hsi.gatewayLabel': 'Gateway',
+    'hsi.pppoeOptions': 'Advanced PPPoE Options',
+    'hsi.pppoeServiceName': 'Service-Name',
+    'hsi.pppoeAcName': 'AC-Name',
+    'hsi.pppoeMru': 'MRU',
+    'hsi.pppoeAuthProtocol': 'Authentication Protocol',
+    'hsi.pppoeLcpEchoInterval': 'LCP Echo Interval (seconds)',
+    'hsi.pppoeLcpEchoFailure': 'LCP Echo Failure Count',
+    'hsi.pppoeDefault': 'Default',
+    'hsi.wanSettings': 'WAN Settings',
+    'hsi.wanMode': 'WAN Mode',
+    'hsi.wanModePppoe': 'PPPoE',
+    'hsi.wanMode.ipoe_dhcp': 'IPoE (DHCP client)',
+    'hsi.wanMode.static': 'Static IP',
+    'hsi.wanDhcpHostname': 'DHCP Hostname',
+    'hsi.wanDhcpVendorClass': 'DHCP Vendor Class',
+    'hsi.wanIpAddress': 'WAN IP Address (CIDR)',
+    'hsi.wanGateway': 'WAN Gateway',
+    'hsi.wanDns': 'WAN DNS Servers',
+    'hsi.outerVlanLabel': 'Outer S-VLAN (QinQ)',
+    'hsi.outerTpid': 'Outer TPID',
+    'hsi.qosSettings': 'QoS Settings',
+    'hsi.qosUpstreamRate': 'Upstream Rate (Mbit/s)',
+    'hsi.qosDownstreamRate': 'Downstream Rate (Mbit/s)',
+    'hsi.qosUpstreamBurst': 'Upstream Burst (KB)',
+    'hsi.qosDownstreamBurst': 'Downstream Burst (KB)',
+    'hsi.qosPriorityClass': 'Priority Class',
+    'hsi.qosClass.best_effort': 'Best effort',
+    'hsi.qosClass.assured': 'Assured',
+    'hsi.qosClass.expedited': 'Expedited',
     'hsi.userId': 'User ID',
     'hsi.chooseAction': 'Please choose an action:',
     'hsi.createPppoe': 'Add PPPoE Configuration',
@@ -6,12 +6,66 @@ import {
   createHSIConfig, 
   updateHSIConfig, 
   deleteHSIConfig,
-  dialPPPoE,
-  hangupPPPoE
+  connectWAN,
+  disconnectWAN
 } from '../api'
 import { useI18n } from '../i18n/I18nContext'
 import useToast from '../components/ToastBridge'
 
+// Optional PPPoE client options, left empty they use the controller defaults
+const PPPOE_OPTION_FIELDS = [
+  { field: 'pppoe_service_name', label: 'hsi.pppoeServiceName', placeholder: '' },
+  { field: 'pppoe_ac_name', label: 'hsi.pppoeAcName', placeholder: '' },
+  { field: 'pppoe_mru', label: 'hsi.pppoeMru', placeholder: '1492' },
+  { field: 'pppoe_auth_protocol', label: 'hsi.pppoeAuthProtocol', options: ['auto', 'pap', 'chap'] },
+  { field: 'pppoe_lcp_echo_interval', label: 'hsi.pppoeLcpEchoInterval', placeholder: '10' },
+  { field: 'pppoe_lcp_echo_failure', label: 'hsi.pppoeLcpEchoFailure', placeholder: '3' }
+]
+const EMPTY_PPPOE_OPTIONS = Object.fromEntries(PPPOE_OPTION_FIELDS.map(({ field }) => [field, '']))
+const pppoeOptionsFrom = (configData) =>
+  Object.fromEntries(PPPOE_OPTION_FIELDS.map(({ field }) => [field, configData[field] || '']))
+
+// WAN mode and the settings of the IPoE DHCP and static modes, empty wan_mode means PPPoE
+const WAN_MODES = ['pppoe', 'ipoe_dhcp', 'static']
+const WAN_FIELDS = [
+  { field: 'wan_mode', label: 'hsi.wanMode', modes: WAN_MODES },
+  { field: 'wan_dhcp_hostname', label: 'hsi.wanDhcpHostname', placeholder: '', modes: ['ipoe_dhcp'] },
+  { field: 'wan_dhcp_vendor_class', label: 'hsi.wanDhcpVendorClass', placeholder: '', modes: ['ipoe_dhcp'] },
+  { field: 'wan_ip_address', label: 'hsi.wanIpAddress', placeholder: '203.0.113.10/30', modes: ['static'] },
+  { field: 'wan_gateway', label: 'hsi.wanGateway', placeholder: '203.0.113.9', modes: ['static'] },
+  { field: 'wan_dns', label: 'hsi.wanDns', placeholder: '8.8.8.8,1.1.1.1', modes: ['static'] }
+]
+const EMPTY_WAN_FIELDS = Object.fromEntries(WAN_FIELDS.map(({ field }) => [field, '']))
+const wanFieldsFrom = (configData) =>
+  Object.fromEntries(WAN_FIELDS.map(({ field }) => [field, configData[field] || '']))
+const isPPPoEMode = (config) => !config.wan_mode || config.wan_mode === 'pppoe'
+
+// Outer S-VLAN tag, required on QinQ nodes and rejected on single-tagged ones
+const QINQ_FIELDS = [
+  { field: 'outer_vlan_id', label: 'hsi.outerVlanLabel', placeholder: '' },
+  { field: 'outer_tpid', label: 'hsi.outerTpid', options: ['0x88a8', '0x8100', '0x9100', '0x9200'] }
+]
+const EMPTY_QINQ_FIELDS = Object.fromEntries(QINQ_FIELDS.map(({ field }) => [field, '']))
+const qinqFieldsFrom = (configData) =>
+  Object.fromEntries(QINQ_FIELDS.map(({ field }) => [field, configData[field] || '']))
+
+// Optional shaping rates in Mbit/s, bursts in KB and priority class, left empty the subscriber is not shaped
+const QOS_FIELDS = [
+  { field: 'qos_upstream_rate', label: 'hsi.qosUpstreamRate', placeholder: '300' },
+  { field: 'qos_downstream_rate', label: 'hsi.qosDownstreamRate', placeholder: '300' },
+  { field: 'qos_upstream_burst', label: 'hsi.qosUpstreamBurst', placeholder: '' },
+  { field: 'qos_downstream_burst', label: 'hsi.qosDownstreamBurst', placeholder: '' },
+  { field: 'qos_priority_class', label: 'hsi.qosPriorityClass', options: ['best_effort', 'assured', 'expedited'] }
+]
+const EMPTY_QOS_FIELDS = Object.fromEntries(QOS_FIELDS.map(({ field }) => [field, '']))
+const qosFieldsFrom = (configData) =>
+  Object.fromEntries(QOS_FIELDS.map(({ field }) => [field, configData[field] || '']))
+
+// HSI config fields edited on this page, any other field is kept as loaded
+const EDITED_FIELDS = ['user_id', 'vlan_id', 'account_name', 'password', 'dhcp_addr_pool', 'dhcp_subnet', 'dhcp_gateway',
+  ...PPPOE_OPTION_FIELDS.map(({ field }) => field), ...WAN_FIELDS.map(({ field }) => field),
+  ...QINQ_FIELDS.map(({ field }) => field), ...QOS_FIELDS.map(({ field }) => field)]
+
 export default function HSIConfig() {
   const { nodeId } = useParams()
   const navigate = useNavigate()
@@ -28,6 +82,10 @@ export default function HSIConfig() {
     vlan_id: '',
     account_name: '',
     password: '',
+    ...EMPTY_PPPOE_OPTIONS,
+    ...EMPTY_WAN_FIELDS,
+    ...EMPTY_QINQ_FIELDS,
+    ...EMPTY_QOS_FIELDS,
     // enableStatus is returned from backend metadata as a string: "enabled", "enabling", "disabling", "disabled"
     enableStatus: ''
   })
@@ -47,6 +105,10 @@ export default function HSIConfig() {
   const [fieldErrors, setFieldErrors] = useState({})
   const [autoFillTimeout, setAutoFillTimeout] = useState(null)
   const [isCheckingConfig, setIsCheckingConfig] = useState(false)
+  // Resource version of the config loaded into the form, sent as If-Match on update
+  const [loadedVersion, setLoadedVersion] = useState({ userId: '', resourceVersion: '' })
+  // Config fields this page does not edit (profile, IPv6, ...), sent back unchanged on update
+  const [loadedExtraFields, setLoadedExtraFields] = useState({})
   const { showToast } = useToast()
 
   // Map backend enableStatus string to display label and color
@@ -116,9 +178,17 @@ export default function HSIConfig() {
         vlan_id: configData.vlan_id || '',
         account_name: configData.account_name || '',
         password: configData.password || '',
+        ...pppoeOptionsFrom(configData),
+        ...wanFieldsFrom(configData),
+        ...qinqFieldsFrom(configData),
+        ...qosFieldsFrom(configData),
         // store backend string state (enabled/enabling/disabling/disabled)
         enableStatus: metadata.enableStatus || ''
       })
+      setLoadedVersion({ userId: configData.user_id || '', resourceVersion: metadata.resourceVersion || '' })
+      setLoadedExtraFields(Object.fromEntries(
+        Object.entries(configData).filter(([field]) => !EDITED_FIELDS.includes(field))
+      ))
       setDhcpConfig({
         dhcp_addr_pool: configData.dhcp_addr_pool || '',
         dhcp_subnet: configData.dhcp_subnet || '',
@@ -141,7 +211,11 @@ export default function HSIConfig() {
       user_id: '',
       vlan_id: '',
       account_name: '',
-      password: ''
+      password: '',
+      ...EMPTY_PPPOE_OPTIONS,
+      ...EMPTY_WAN_FIELDS,
+      ...EMPTY_QINQ_FIELDS,
+      ...EMPTY_QOS_FIELDS
     })
     setDhcpConfig({
       dhcp_addr_pool: '',
@@ -234,7 +308,11 @@ export default function HSIConfig() {
           ...prev,
           vlan_id: configData.vlan_id || '',
           account_name: configData.account_name || '',
-          password: configData.password || ''
+          password: configData.password || '',
+          ...pppoeOptionsFrom(configData),
+          ...wanFieldsFrom(configData),
+          ...qinqFieldsFrom(configData),
+          ...qosFieldsFrom(configData)
         }))
 
         // Auto-fill DHCP settings
@@ -296,8 +374,10 @@ export default function HSIConfig() {
 
     if (!user_id) return t('hsi.error.missingUserId')
     if (!vlan_id) return t('hsi.error.missingVlan')
-    if (!account_name) return t('hsi.error.missingAccountName')
-    if (!password) return t('hsi.error.missingPassword')
+    if (isPPPoEMode(pppoeConfig)) {
+      if (!account_name) return t('hsi.error.missingAccountName')
+      if (!password) return t('hsi.error.missingPassword')
+    }
 
     // Validate user_id range (1-2000)
     const userIdNum = parseInt(user_id)
@@ -443,18 +523,25 @@ export default function HSIConfig() {
       }
 
       // Build payload only with HSIConfig fields (do not send UI-only fields like enableStatus)
+      const extraFields = loadedVersion.userId === pppoeConfig.user_id ? loadedExtraFields : {}
       const fullConfig = {
+        ...extraFields,
         user_id: pppoeConfig.user_id,
         vlan_id: pppoeConfig.vlan_id,
         account_name: pppoeConfig.account_name,
         password: pppoeConfig.password,
+        ...pppoeOptionsFrom(pppoeConfig),
+        ...wanFieldsFrom(pppoeConfig),
+        ...qinqFieldsFrom(pppoeConfig),
+        ...qosFieldsFrom(pppoeConfig),
         dhcp_addr_pool: dhcpConfig.dhcp_addr_pool,
         dhcp_subnet: dhcpConfig.dhcp_subnet,
         dhcp_gateway: dhcpConfig.dhcp_gateway
       }
 
       if (exists) {
-        await updateHSIConfig(nodeId, pppoeConfig.user_id, fullConfig)
+        const resourceVersion = loadedVersion.userId === pppoeConfig.user_id ? loadedVersion.resourceVersion : ''
+        await updateHSIConfig(nodeId, pppoeConfig.user_id, fullConfig, resourceVersion)
         alert(t('hsi.saveSuccess'))
       } else {
         await createHSIConfig(nodeId, fullConfig)
@@ -467,7 +554,11 @@ export default function HSIConfig() {
         user_id: '',
         vlan_id: '',
         account_name: '',
-        password: ''
+        password: '',
+        ...EMPTY_PPPOE_OPTIONS,
+        ...EMPTY_WAN_FIELDS,
+        ...EMPTY_QINQ_FIELDS,
+        ...EMPTY_QOS_FIELDS
       })
       setDhcpConfig({
         dhcp_addr_pool: '',
@@ -478,6 +569,17 @@ export default function HSIConfig() {
   const msg = extractApiError(err) || t('hsi.saveFailed')
   if (msg === 'User ID exceeds subscriber count') showToast(t('hsi.error.userIdExceeds') || msg, 3500, 'error')
   else setError(msg)
+      // Highlight the fields rejected by server-side validation
+      const serverFieldErrors = err && err.response && err.response.data && err.response.data.field_errors
+      if (Array.isArray(serverFieldErrors) && serverFieldErrors.length > 0) {
+        const errs = {}
+        serverFieldErrors.forEach(fe => { errs[fe.field] = true })
+        setFieldErrors(errs)
+        const pppoeFields = ['user_id', 'vlan_id', 'account_name', 'password',
+          ...PPPOE_OPTION_FIELDS.map(({ field }) => field), ...WAN_FIELDS.map(({ field }) => field),
+          ...QINQ_FIELDS.map(({ field }) => field), ...QOS_FIELDS.map(({ field }) => field)]
+        if (serverFieldErrors.some(fe => pppoeFields.includes(fe.field))) setCurrentStep(1)
+      }
     } finally {
       setLoading(false)
     }
@@ -520,7 +622,7 @@ export default function HSIConfig() {
     setLoading(true)
     setError(null)
     try {
-      await dialPPPoE(nodeId, selectedUserId)
+      await connectWAN(nodeId, selectedUserId)
       alert(t('hsi.dialSuccess'))
     } catch (err) {
       const msg = extractApiError(err) || t('hsi.dialFailed')
@@ -543,7 +645,7 @@ export default function HSIConfig() {
     setLoading(true)
     setError(null)
     try {
-      await hangupPPPoE(nodeId, selectedUserId)
+      await disconnectWAN(nodeId, selectedUserId)
       alert(t('hsi.hangupSuccess'))
     } catch (err) {
       const msg = extractApiError(err) || t('hsi.hangupFailed')
@@ -683,6 +785,41 @@ export default function HSIConfig() {
                     }}
                   />
                 </div>
+                {QINQ_FIELDS.map(({ field, label, placeholder, options }) => (
+                  <div key={field} style={{ marginBottom: '15px' }}>
+                    <label style={{ display: 'block', marginBottom: '5px' }}>{t(label)}:</label>
+                    {options ? (
+                      <select
+                        value={pppoeConfig[field]}
+                        onChange={(e) => handleInputChange(field, e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      >
+                        <option value="">{t('hsi.pppoeDefault')}</option>
+                        {options.map(option => (
+                          <option key={option} value={option}>{option}</option>
+                        ))}
+                      </select>
+                    ) : (
+                      <input
+                        type="text"
+                        placeholder={placeholder}
+                        value={pppoeConfig[field]}
+                        onChange={(e) => handleInputChange(field, e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      />
+                    )}
+                  </div>
+                ))}
                 <div style={{ marginBottom: '15px' }}>
                   <label style={{ display: 'block', marginBottom: '5px' }}>{t('hsi.accountNameLabel')}:</label>
                   {hasFieldError('account_name') && (
@@ -733,6 +870,118 @@ export default function HSIConfig() {
                     }}
                   />
                 </div>
+                <h4>{t('hsi.wanSettings')}</h4>
+                {WAN_FIELDS.filter(({ field, modes }) => field === 'wan_mode' || modes.includes(pppoeConfig.wan_mode)).map(({ field, label, placeholder, modes }) => (
+                  <div key={field} style={{ marginBottom: '15px' }}>
+                    <label style={{ display: 'block', marginBottom: '5px' }}>{t(label)}:</label>
+                    {field === 'wan_mode' ? (
+                      <select
+                        value={pppoeConfig.wan_mode}
+                        onChange={(e) => handleInputChange('wan_mode', e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError('wan_mode') ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      >
+                        <option value="">{t('hsi.wanModePppoe')}</option>
+                        {modes.filter(mode => mode !== 'pppoe').map(mode => (
+                          <option key={mode} value={mode}>{t(`hsi.wanMode.${mode}`)}</option>
+                        ))}
+                      </select>
+                    ) : (
+                      <input
+                        type="text"
+                        placeholder={placeholder}
+                        value={pppoeConfig[field]}
+                        onChange={(e) => handleInputChange(field, e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      />
+                    )}
+                  </div>
+                ))}
+                {isPPPoEMode(pppoeConfig) && (
+                  <>
+                    <h4>{t('hsi.pppoeOptions')}</h4>
+                    {PPPOE_OPTION_FIELDS.map(({ field, label, placeholder, options }) => (
+                      <div key={field} style={{ marginBottom: '15px' }}>
+                        <label style={{ display: 'block', marginBottom: '5px' }}>{t(label)}:</label>
+                        {options ? (
+                          <select
+                            value={pppoeConfig[field]}
+                            onChange={(e) => handleInputChange(field, e.target.value)}
+                            style={{
+                              width: '100%',
+                              padding: '8px',
+                              border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                              borderRadius: '4px'
+                            }}
+                          >
+                            <option value="">{t('hsi.pppoeDefault')}</option>
+                            {options.map(option => (
+                              <option key={option} value={option}>{option}</option>
+                            ))}
+                          </select>
+                        ) : (
+                          <input
+                            type="text"
+                            placeholder={placeholder}
+                            value={pppoeConfig[field]}
+                            onChange={(e) => handleInputChange(field, e.target.value)}
+                            style={{
+                              width: '100%',
+                              padding: '8px',
+                              border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                              borderRadius: '4px'
+                            }}
+                          />
+                        )}
+                      </div>
+                    ))}
+                  </>
+                )}
+                <h4>{t('hsi.qosSettings')}</h4>
+                {QOS_FIELDS.map(({ field, label, placeholder, options }) => (
+                  <div key={field} style={{ marginBottom: '15px' }}>
+                    <label style={{ display: 'block', marginBottom: '5px' }}>{t(label)}:</label>
+                    {options ? (
+                      <select
+                        value={pppoeConfig[field]}
+                        onChange={(e) => handleInputChange(field, e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      >
+                        <option value="">{t('hsi.pppoeDefault')}</option>
+                        {options.map(option => (
+                          <option key={option} value={option}>{t(`hsi.qosClass.${option}`)}</option>
+                        ))}
+                      </select>
+                    ) : (
+                      <input
+                        type="text"
+                        placeholder={placeholder}
+                        value={pppoeConfig[field]}
+                        onChange={(e) => handleInputChange(field, e.target.value)}
+                        style={{
+                          width: '100%',
+                          padding: '8px',
+                          border: hasFieldError(field) ? '2px solid #dc3545' : '1px solid #ccc',
+                          borderRadius: '4px'
+                        }}
+                      />
+                    )}
+                  </div>
+                ))}
                 <button
                   onClick={handleCreateOrUpdate}
                   disabled={loading}
@@ -907,6 +1156,7 @@ export default function HSIConfig() {
               </div>
               <div style={{ marginBottom: '10px' }}>
                 <strong>{t('hsi.vlanLabel')}:</strong> {pppoeConfig.vlan_id}
+                {pppoeConfig.outer_vlan_id && ` (${t('hsi.outerVlanLabel')}: ${pppoeConfig.outer_vlan_id}, ${pppoeConfig.outer_tpid || '0x88a8'})`}
               </div>
               <div style={{ marginBottom: '10px' }}>
                 <strong>{t('hsi.accountNameLabel')}:</strong> {pppoeConfig.account_name}
@@ -914,6 +1164,26 @@ export default function HSIConfig() {
               <div style={{ marginBottom: '10px' }}>
                 <strong>{t('hsi.password')}:</strong> {'*'.repeat(pppoeConfig.password.length)}
               </div>
+              <div style={{ marginBottom: '10px' }}>
+                <strong>{t('hsi.wanMode')}:</strong>{' '}
+                {isPPPoEMode(pppoeConfig) ? t('hsi.wanModePppoe') : t(`hsi.wanMode.${pppoeConfig.wan_mode}`)}
+              </div>
+              {isPPPoEMode(pppoeConfig) && PPPOE_OPTION_FIELDS.map(({ field, label, placeholder }) => (
+                <div key={field} style={{ marginBottom: '10px' }}>
+                  <strong>{t(label)}:</strong>{' '}
+                  {pppoeConfig[field] || `${t('hsi.pppoeDefault')}${placeholder ? ` (${placeholder})` : ''}`}
+                </div>
+              ))}
+              {WAN_FIELDS.filter(({ field, modes }) => field !== 'wan_mode' && modes.includes(pppoeConfig.wan_mode)).map(({ field, label }) => (
+                <div key={field} style={{ marginBottom: '10px' }}>
+                  <strong>{t(label)}:</strong> {pppoeConfig[field] || t('common.notSet')}
+                </div>
+              ))}
+              {QOS_FIELDS.filter(({ field }) => pppoeConfig[field]).map(({ field, label, options }) => (
+                <div key={field} style={{ marginBottom: '10px' }}>
+                  <strong>{t(label)}:</strong> {options ? t(`hsi.qosClass.${pppoeConfig[field]}`) : pppoeConfig[field]}
+                </div>
+              ))}
               <div style={{ marginBottom: '20px' }}>
                 <strong>{t('hsi.status')}:</strong>{' '}
                 {(() => {